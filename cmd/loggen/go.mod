@@ -0,0 +1,3 @@
+module loggen
+
+go 1.24
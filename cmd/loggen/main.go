@@ -0,0 +1,282 @@
+// Command loggen writes made up structured logs at a configurable volume,
+// to stdout or straight to Loki's push API, without any of the
+// playground's services running. It is a quick way to fill Loki with
+// enough logs, from enough services, to try out queries, label choices
+// and retention on.
+//
+// Lines are JSON in the shape the services log in (time, level, msg and
+// fields), from each of -services in turn, with levels drawn from -levels.
+// Extra high-cardinality fields and periodic bursts can be added to see
+// how queries and ingestion cope with them.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tick is how often lines are written, in batches of however many are due.
+const tick = 100 * time.Millisecond
+
+func main() {
+	lokiURL := flag.String("loki", "", "Loki base address to push to, e.g. http://localhost:3100 (default stdout)")
+	services := flag.String("services", "loggen-web,loggen-worker", "comma separated service names, each a service_name stream")
+	labels := flag.String("labels", "", "extra stream labels for every service, e.g. env=dev,team=a")
+	rate := flag.Float64("rate", 50, "lines per second across all services")
+	duration := flag.Duration("duration", time.Minute, "how long to write for, 0 for until interrupted")
+	levels := flag.String("levels", "debug=10,info=70,warn=15,error=5", "relative weight of each level")
+	fields := flag.Int("fields", 0, "extra attr_<n> fields on each line")
+	cardinality := flag.Int("cardinality", 100, "distinct values each extra field takes")
+	burstEvery := flag.Duration("burst-every", 0, "start a burst this often, 0 for none")
+	burstFor := flag.Duration("burst-for", 5*time.Second, "how long each burst lasts")
+	burstFactor := flag.Float64("burst-factor", 10, "how many times -rate lines are written at during a burst")
+	batch := flag.Int("batch", 500, "lines per push to Loki, at most")
+	seed := flag.Uint64("seed", 0, "random seed, for repeatable logs (0 picks one)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: loggen [flags]\n\nWrites made up structured logs, to stdout or to Loki.\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	g, err := newGenerator(strings.Split(*services, ","), *levels, *fields, *cardinality, *seed)
+	if err == nil {
+		err = validate(*rate, *duration, *burstEvery, *burstFor, *burstFactor, *batch)
+	}
+	var out sink = stdoutSink{}
+	if err == nil && *lokiURL != "" {
+		out, err = newLokiSink(*lokiURL, *labels, *batch)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "loggen: %v\n", err)
+		os.Exit(2)
+	}
+
+	// Stop cleanly on Ctrl-C, pushing what is buffered
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	burst := burstPattern{every: *burstEvery, length: *burstFor, factor: *burstFactor}
+	start := time.Now()
+	if err := run(ctx, g, out, *rate, burst); err != nil {
+		fmt.Fprintf(os.Stderr, "loggen: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d lines (%d bytes) in %s, seed %d: %s\n",
+		g.lines, g.bytes, time.Since(start).Round(time.Millisecond), g.seed, g.levelCounts())
+}
+
+func validate(rate float64, duration, burstEvery, burstFor time.Duration, burstFactor float64, batch int) error {
+	switch {
+	case rate <= 0:
+		return errors.New("-rate must be positive")
+	case duration < 0:
+		return errors.New("-duration must not be negative")
+	case burstEvery < 0 || (burstEvery > 0 && (burstFor <= 0 || burstFor > burstEvery)):
+		return errors.New("-burst-for must be positive and no longer than -burst-every")
+	case burstFactor < 1:
+		return errors.New("-burst-factor must be at least 1")
+	case batch < 1:
+		return errors.New("-batch must be at least 1")
+	}
+	return nil
+}
+
+// run writes lines at rate, faster during bursts, until ctx is done.
+func run(ctx context.Context, g *generator, out sink, rate float64, burst burstPattern) error {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	start, last := time.Now(), time.Now()
+	due := 0.0
+	for {
+		select {
+		case <-ctx.Done():
+			return out.Flush()
+		case now := <-ticker.C:
+			due += rate * burst.multiplier(now.Sub(start)) * now.Sub(last).Seconds()
+			last = now
+			for ; due >= 1; due-- {
+				service, line := g.Line(now)
+				if err := out.Write(service, now, line); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// burstPattern multiplies the rate for length out of every period.
+type burstPattern struct {
+	every  time.Duration
+	length time.Duration
+	factor float64
+}
+
+// multiplier is the rate multiplier at elapsed into the run. Bursts come at
+// the end of each period, so a run starts at the steady rate.
+func (b burstPattern) multiplier(elapsed time.Duration) float64 {
+	if b.every <= 0 || elapsed%b.every < b.every-b.length {
+		return 1
+	}
+	return b.factor
+}
+
+// level is a log level and its relative weight.
+type level struct {
+	name   string
+	weight float64
+}
+
+// messages are what each level's lines say.
+var messages = map[string][]string{
+	"debug": {"Cache lookup", "Loaded configuration value", "Query plan chosen", "Retrying connection"},
+	"info":  {"Request handled successfully", "Order created", "Job completed", "User signed in"},
+	"warn":  {"Slow request", "Retrying after timeout", "Cache miss rate high", "Deprecated API called"},
+	"error": {"Request failed", "Database query failed", "Payment declined", "Upstream unavailable"},
+}
+
+// paths are the routes lines mention, for something realistic to filter on.
+var paths = []string{"/products", "/products/{id}", "/orders", "/cart", "/checkout", "/search"}
+
+// record is a log line, its fields in the order the services' slog JSON
+// handler writes them.
+type record struct {
+	Time       string `json:"time"`
+	Level      string `json:"level"`
+	Msg        string `json:"msg"`
+	Service    string `json:"service"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	StatusCode int    `json:"status_code"`
+	DurationMS int    `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+	TraceID    string `json:"trace_id"`
+}
+
+// generator makes log lines.
+type generator struct {
+	services    []string
+	levels      []level
+	total       float64
+	fields      int
+	cardinality int
+	seed        uint64
+	rng         *rand.Rand
+	next        int
+	lines       int
+	bytes       int
+	counts      map[string]int
+}
+
+func newGenerator(services []string, levels string, fields, cardinality int, seed uint64) (*generator, error) {
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	g := &generator{fields: fields, cardinality: cardinality, seed: seed, rng: rand.New(rand.NewPCG(seed, seed)), counts: map[string]int{}}
+	for _, service := range services {
+		if service = strings.TrimSpace(service); service == "" {
+			return nil, errors.New("-services must not have empty names")
+		}
+		g.services = append(g.services, service)
+	}
+	for _, entry := range strings.Split(levels, ",") {
+		name, weight, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		w, err := strconv.ParseFloat(weight, 64)
+		if _, known := messages[name]; !ok || !known || err != nil || w < 0 {
+			return nil, fmt.Errorf("expected level=weight with a level of debug, info, warn or error, got %q", entry)
+		}
+		g.levels = append(g.levels, level{name, w})
+		g.total += w
+	}
+	if g.total <= 0 {
+		return nil, errors.New("-levels must give some level a weight")
+	}
+	if fields < 0 || cardinality < 1 {
+		return nil, errors.New("-fields must not be negative and -cardinality must be at least 1")
+	}
+	return g, nil
+}
+
+// Line returns the next service to log and a line for it, written at now.
+func (g *generator) Line(now time.Time) (string, []byte) {
+	service := g.services[g.next%len(g.services)]
+	g.next++
+
+	// Pick a level by weight, the last weighted one covering rounding
+	var lvl string
+	pick := g.rng.Float64() * g.total
+	for _, l := range g.levels {
+		if l.weight > 0 {
+			lvl = l.name
+		}
+		if pick < l.weight {
+			break
+		}
+		pick -= l.weight
+	}
+
+	rec := record{
+		Time:       now.Format(time.RFC3339Nano),
+		Level:      strings.ToUpper(lvl),
+		Msg:        messages[lvl][g.rng.IntN(len(messages[lvl]))],
+		Service:    service,
+		Method:     "GET",
+		Path:       paths[g.rng.IntN(len(paths))],
+		StatusCode: 200,
+		DurationMS: g.rng.IntN(500),
+		TraceID:    fmt.Sprintf("%016x%016x", g.rng.Uint64(), g.rng.Uint64()),
+	}
+	switch lvl {
+	case "error":
+		rec.StatusCode = []int{500, 502, 503, 504}[g.rng.IntN(4)]
+		rec.Error = "context deadline exceeded"
+	case "warn":
+		rec.StatusCode = []int{200, 429}[g.rng.IntN(2)]
+	}
+	line, _ := json.Marshal(rec)
+	// Extra fields go last, as attributes added with slog.With would
+	if g.fields > 0 {
+		line = line[:len(line)-1]
+		for i := range g.fields {
+			line = fmt.Appendf(line, `,"attr_%d":"v%d"`, i+1, g.rng.IntN(g.cardinality))
+		}
+		line = append(line, '}')
+	}
+
+	g.lines++
+	g.bytes += len(line)
+	g.counts[lvl]++
+	return service, line
+}
+
+// levelCounts summarises the lines written at each level.
+func (g *generator) levelCounts() string {
+	names := make([]string, 0, len(g.counts))
+	for name := range g.counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return levelOrder(names[i]) < levelOrder(names[j]) })
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%d", name, g.counts[name]))
+	}
+	return strings.Join(parts, " ")
+}
+
+func levelOrder(name string) int {
+	return map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}[name]
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sink is where lines go.
+type sink interface {
+	Write(service string, at time.Time, line []byte) error
+	Flush() error
+}
+
+// stdoutSink writes lines to stdout, for a log collector to pick up or to
+// pipe elsewhere.
+type stdoutSink struct{}
+
+func (stdoutSink) Write(_ string, _ time.Time, line []byte) error {
+	_, err := os.Stdout.Write(append(line, '\n'))
+	return err
+}
+
+func (stdoutSink) Flush() error { return nil }
+
+// lokiFlushInterval is the longest lines wait to be pushed, at low rates.
+const lokiFlushInterval = time.Second
+
+// labelName is what Loki accepts as a label name.
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// lokiSink pushes lines to Loki's push API in batches, a stream per
+// service labelled with service_name, as the services' logs are.
+type lokiSink struct {
+	url       string
+	labels    map[string]string
+	batch     int
+	client    *http.Client
+	streams   map[string][][2]string
+	buffered  int
+	lastFlush time.Time
+}
+
+func newLokiSink(base, labels string, batch int) (*lokiSink, error) {
+	s := &lokiSink{
+		url:       strings.TrimSuffix(base, "/") + "/loki/api/v1/push",
+		labels:    map[string]string{},
+		batch:     batch,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		streams:   map[string][][2]string{},
+		lastFlush: time.Now(),
+	}
+	for _, pair := range strings.Split(labels, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !labelName.MatchString(name) || name == "service_name" {
+			return nil, fmt.Errorf("expected label=value with a valid label name other than service_name, got %q", pair)
+		}
+		s.labels[name] = strings.TrimSpace(value)
+	}
+	return s, nil
+}
+
+func (s *lokiSink) Write(service string, at time.Time, line []byte) error {
+	s.streams[service] = append(s.streams[service], [2]string{strconv.FormatInt(at.UnixNano(), 10), string(line)})
+	s.buffered++
+	if s.buffered >= s.batch || time.Since(s.lastFlush) >= lokiFlushInterval {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Flush pushes the buffered lines.
+func (s *lokiSink) Flush() error {
+	s.lastFlush = time.Now()
+	if s.buffered == 0 {
+		return nil
+	}
+
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	var push struct {
+		Streams []stream `json:"streams"`
+	}
+	for service, values := range s.streams {
+		labels := map[string]string{"service_name": service}
+		for name, value := range s.labels {
+			labels[name] = value
+		}
+		push.Streams = append(push.Streams, stream{Stream: labels, Values: values})
+	}
+	body, err := json.Marshal(push)
+	if err != nil {
+		return err
+	}
+	clear(s.streams)
+	s.buffered = 0
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to push to Loki: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Loki rejected push: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchScenario is a profiling setup the benchmark measures the workload
+// under. The rates are the runtime's: bytes per memory sample, 1 in how
+// many contention events, and nanoseconds blocked per block event, 0 being
+// off.
+type benchScenario struct {
+	name          string
+	cpu           bool
+	memRate       int
+	mutexFraction int
+	blockRate     int
+}
+
+// benchScenarios are the setups bench knows, the first the baseline the
+// rest are compared with. "services" is what store-api runs with by
+// default.
+var benchScenarios = []benchScenario{
+	{name: "off"},
+	{name: "cpu", cpu: true},
+	{name: "mem", memRate: 512 * 1024},
+	{name: "mem-fine", memRate: 4096},
+	{name: "mutex", mutexFraction: 5},
+	{name: "mutex-all", mutexFraction: 1},
+	{name: "block", blockRate: 10000},
+	{name: "block-all", blockRate: 1},
+	{name: "services", cpu: true, memRate: 512 * 1024, mutexFraction: 5},
+	{name: "all", cpu: true, memRate: 4096, mutexFraction: 1, blockRate: 1},
+}
+
+// benchResult is what one scenario measured, over all its rounds.
+type benchResult struct {
+	scenario  benchScenario
+	ops       int
+	elapsed   time.Duration
+	latencies []time.Duration
+}
+
+func (r benchResult) throughput() float64 {
+	return float64(r.ops) / r.elapsed.Seconds()
+}
+
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	duration := fs.Duration("d", 5*time.Second, "how long each scenario runs for, per round")
+	rounds := fs.Int("rounds", 3, "times to run every scenario, interleaved so drift affects them all alike")
+	concurrency := fs.Int("c", runtime.GOMAXPROCS(0), "goroutines running the workload")
+	names := fs.String("scenarios", "", "comma separated scenarios to run (default all); off always runs, as the baseline")
+	push := fs.String("push", "", "push the results as metrics to this Prometheus text import URL, e.g. http://localhost:8480/insert/0/prometheus/api/v1/import/prometheus")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: o11yctl bench [flags]\n\nRuns a fixed workload with profiling off and under each scenario, then\nprints how much throughput and latency each one costs.\n\nScenarios:\n")
+		for _, s := range benchScenarios {
+			fmt.Fprintf(os.Stderr, "  %-10s %s\n", s.name, s.describe())
+		}
+		fmt.Fprintf(os.Stderr, "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *duration <= 0 || *rounds <= 0 || *concurrency <= 0 {
+		return errors.New("d, rounds and c must be positive")
+	}
+	scenarios, err := selectScenarios(*names)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// Leave the runtime as it was found
+	memRate := runtime.MemProfileRate
+	mutexFraction := runtime.SetMutexProfileFraction(-1)
+	defer func() {
+		runtime.MemProfileRate = memRate
+		runtime.SetMutexProfileFraction(mutexFraction)
+		runtime.SetBlockProfileRate(0)
+	}()
+
+	fmt.Printf("Running %d scenario(s) for %s each, %d round(s), %d goroutine(s), ctrl-c to stop early\n",
+		len(scenarios), *duration, *rounds, *concurrency)
+	results := make([]benchResult, len(scenarios))
+	for round := range *rounds {
+		for i, s := range scenarios {
+			if ctx.Err() != nil {
+				break
+			}
+			fmt.Printf("  round %d/%d: %s\n", round+1, *rounds, s.name)
+			ops, elapsed, latencies, err := runScenario(ctx, s, *duration, *concurrency)
+			if err != nil {
+				return fmt.Errorf("scenario %s: %w", s.name, err)
+			}
+			results[i].scenario = s
+			results[i].ops += ops
+			results[i].elapsed += elapsed
+			results[i].latencies = append(results[i].latencies, latencies...)
+		}
+	}
+	if results[0].ops == 0 {
+		return errors.New("stopped before the baseline finished")
+	}
+	for _, r := range results {
+		sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	}
+
+	printBenchSummary(results)
+	if *push != "" {
+		if err := pushBenchMetrics(*push, results); err != nil {
+			return err
+		}
+		fmt.Printf("\nPushed results to %s\n", *push)
+	}
+	return nil
+}
+
+// describe says what a scenario turns on.
+func (s benchScenario) describe() string {
+	var parts []string
+	if s.cpu {
+		parts = append(parts, "CPU profile at 100 Hz")
+	}
+	if s.memRate > 0 {
+		parts = append(parts, fmt.Sprintf("memory sample every %d bytes", s.memRate))
+	}
+	if s.mutexFraction > 0 {
+		parts = append(parts, fmt.Sprintf("1 in %d contention events", s.mutexFraction))
+	}
+	if s.blockRate > 0 {
+		parts = append(parts, fmt.Sprintf("block sample every %dns", s.blockRate))
+	}
+	if len(parts) == 0 {
+		return "no profiling, the baseline"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// selectScenarios returns the named scenarios, with the baseline first.
+func selectScenarios(names string) ([]benchScenario, error) {
+	if names == "" {
+		return benchScenarios, nil
+	}
+	selected := []benchScenario{benchScenarios[0]}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, s := range benchScenarios[1:] {
+			if s.name == name {
+				selected = append(selected, s)
+				found = true
+			}
+		}
+		if !found && name != benchScenarios[0].name {
+			return nil, fmt.Errorf("unknown scenario %q, see o11yctl bench -h", name)
+		}
+	}
+	return selected, nil
+}
+
+// runScenario profiles as s says and runs the workload on concurrency
+// goroutines for duration, returning the operations completed, the time
+// taken and each operation's latency. Changing MemProfileRate mid-run is
+// something real programs shouldn't do, but it only changes how often
+// later allocations are sampled, which is what is being measured.
+func runScenario(ctx context.Context, s benchScenario, duration time.Duration, concurrency int) (int, time.Duration, []time.Duration, error) {
+	runtime.MemProfileRate = s.memRate
+	runtime.SetMutexProfileFraction(s.mutexFraction)
+	runtime.SetBlockProfileRate(s.blockRate)
+	// Start from a clean heap, so garbage from the last scenario isn't
+	// collected on this one's time
+	runtime.GC()
+	if s.cpu {
+		// Encoding the profile is part of the cost, so it is written, if
+		// only to nowhere
+		if err := pprof.StartCPUProfile(io.Discard); err != nil {
+			return 0, 0, nil, err
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	w := newBenchWorkload()
+	defer w.Close()
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		ops       int
+		latencies []time.Duration
+	)
+	start := time.Now()
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var local []time.Duration
+			for ctx.Err() == nil {
+				opStart := time.Now()
+				w.Op()
+				local = append(local, time.Since(opStart))
+			}
+			mu.Lock()
+			ops += len(local)
+			latencies = append(latencies, local...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return ops, time.Since(start), latencies, nil
+}
+
+// benchItem is what the workload encodes, shaped like a product.
+type benchItem struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Price       float64  `json:"price"`
+	Tags        []string `json:"tags"`
+}
+
+// benchWorkload is a fixed unit of work, like handling a catalog request:
+// JSON encoding and decoding, sorting and hashing for CPU and allocations,
+// a shared lock for contention, and a hand-off to another goroutine that
+// blocks, so every kind of profile has something to sample.
+type benchWorkload struct {
+	items  []benchItem
+	mu     sync.Mutex
+	counts map[int]int
+	queue  chan int
+	done   chan struct{}
+}
+
+func newBenchWorkload() *benchWorkload {
+	w := &benchWorkload{counts: map[int]int{}, queue: make(chan int), done: make(chan struct{})}
+	for i := range 100 {
+		w.items = append(w.items, benchItem{
+			ID:          i,
+			Name:        fmt.Sprintf("Product %d", i),
+			Description: strings.Repeat("A kitchen essential. ", 5),
+			Price:       float64((i*7919)%10000) / 100,
+			Tags:        []string{"kitchen", fmt.Sprintf("tag-%d", i%10)},
+		})
+	}
+	// The consumer takes one item at a time, so senders queue up
+	go func() {
+		for {
+			select {
+			case <-w.queue:
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// Op runs one unit of work.
+func (w *benchWorkload) Op() {
+	body, _ := json.Marshal(w.items)
+	var decoded []benchItem
+	json.Unmarshal(body, &decoded)
+	sort.Slice(decoded, func(i, j int) bool { return decoded[i].Price < decoded[j].Price })
+	sum := sha256.Sum256(body)
+
+	w.mu.Lock()
+	w.counts[int(sum[0])]++
+	w.mu.Unlock()
+	w.queue <- decoded[0].ID
+}
+
+func (w *benchWorkload) Close() {
+	close(w.done)
+}
+
+// latencyQuantile returns the q-th quantile of sorted latencies, unrounded
+// as the workload's are microseconds.
+func latencyQuantile(sorted []time.Duration, q float64) time.Duration {
+	return sorted[int(float64(len(sorted)-1)*q)]
+}
+
+// printBenchSummary prints each scenario's throughput and latency, and how
+// they compare with the baseline.
+func printBenchSummary(results []benchResult) {
+	base := results[0]
+	baseP99 := latencyQuantile(base.latencies, 0.99)
+
+	fmt.Printf("\n%-10s %12s %10s %10s %10s %10s\n", "SCENARIO", "OPS/S", "Δ OPS/S", "P50", "P99", "Δ P99")
+	for _, r := range results {
+		if r.ops == 0 {
+			continue
+		}
+		p99 := latencyQuantile(r.latencies, 0.99)
+		fmt.Printf("%-10s %12.0f %9.1f%% %10s %10s %9.1f%%\n",
+			r.scenario.name,
+			r.throughput(),
+			100*(r.throughput()/base.throughput()-1),
+			latencyQuantile(r.latencies, 0.5).Round(time.Microsecond),
+			p99.Round(time.Microsecond),
+			100*(float64(p99)/float64(baseP99)-1),
+		)
+	}
+}
+
+// pushBenchMetrics sends the results in the Prometheus text format, which
+// VictoriaMetrics (and the Pushgateway, at its own path) accept, so runs
+// can be graphed next to the services' own overhead.
+func pushBenchMetrics(url string, results []benchResult) error {
+	var buf bytes.Buffer
+	base := results[0]
+	for _, r := range results {
+		if r.ops == 0 {
+			continue
+		}
+		labels := fmt.Sprintf(`scenario=%q`, r.scenario.name)
+		fmt.Fprintf(&buf, "o11yctl_bench_throughput_ops_per_second{%s} %g\n", labels, r.throughput())
+		fmt.Fprintf(&buf, "o11yctl_bench_throughput_change_ratio{%s} %g\n", labels, r.throughput()/base.throughput()-1)
+		for _, q := range []float64{0.5, 0.9, 0.99} {
+			fmt.Fprintf(&buf, "o11yctl_bench_latency_seconds{%s,quantile=\"%g\"} %g\n", labels, q, latencyQuantile(r.latencies, q).Seconds())
+		}
+		fmt.Fprintf(&buf, "o11yctl_bench_latency_p99_change_ratio{%s} %g\n", labels,
+			float64(latencyQuantile(r.latencies, 0.99))/float64(latencyQuantile(base.latencies, 0.99))-1)
+	}
+
+	resp, err := client.Post(url, "text/plain; version=0.0.4", &buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("push failed: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
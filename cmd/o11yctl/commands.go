@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// client is used for every call to the services. The timeout is generous
+// because some admin calls (heap dumps, say) take a moment.
+var client = &http.Client{Timeout: 30 * time.Second}
+
+// compose runs docker compose with args, wired to our terminal.
+func compose(args ...string) error {
+	cmd := exec.Command("docker", append([]string{"compose"}, args...)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+func runUp(args []string) error {
+	return compose(append([]string{"up", "-d", "--wait", "--build"}, args...)...)
+}
+
+func runDown(args []string) error {
+	return compose("down")
+}
+
+func runLogs(args []string) error {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	since := fs.String("since", "10m", "show logs since this long ago")
+	fs.Parse(args)
+	return compose(append([]string{"logs", "--follow", "--since", *since}, fs.Args()...)...)
+}
+
+// call makes a request to path on the named service, sending the admin
+// token if there is one, and returns the status code and body.
+func call(method, service, path string) (int, string, error) {
+	base, err := serviceURL(service)
+	if err != nil {
+		return 0, "", err
+	}
+	req, err := http.NewRequest(method, base+path, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("X-Caller", "o11yctl")
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, strings.TrimSpace(string(body)), err
+}
+
+// callAndPrint makes a request and prints the response, failing on an
+// error status.
+func callAndPrint(method, service, path string) error {
+	code, body, err := call(method, service, path)
+	if err != nil {
+		return err
+	}
+	fmt.Println(body)
+	if code >= 400 {
+		return fmt.Errorf("%s %s returned %d", method, path, code)
+	}
+	return nil
+}
+
+func runGet(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: o11yctl get <service> <path>")
+	}
+	return callAndPrint(http.MethodGet, args[0], args[1])
+}
+
+func runLogLevel(args []string) error {
+	fs := flag.NewFlagSet("loglevel", flag.ExitOnError)
+	reset := fs.Bool("reset", false, "remove the route's override, or without route every override, and restore LOG_LEVEL")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: o11yctl loglevel [-reset] <service> [level=<debug|info|warn|error>] [route=<pattern>] [ttl=<duration>]\n\nShows the log level and route overrides, or sets them. With route, the level\napplies to that route's records only, until ttl (default 10m) has passed.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("a service is required")
+	}
+	query, err := keyValues(fs.Args()[1:])
+	if err != nil {
+		return err
+	}
+
+	method := http.MethodGet
+	switch {
+	case *reset:
+		method = http.MethodDelete
+	case len(query) > 0:
+		method = http.MethodPost
+	}
+	return callAndPrint(method, fs.Arg(0), "/admin/loglevel?"+query.Encode())
+}
+
+func runHealth(args []string) error {
+	unhealthy := false
+	for _, name := range serviceNames(args) {
+		code, body, err := call(http.MethodGet, name, "/readyz")
+		switch {
+		case err != nil:
+			fmt.Printf("%-14s down      %v\n", name, err)
+			unhealthy = true
+			continue
+		case code == http.StatusNotFound:
+			fmt.Printf("%-14s up        (no readiness endpoint)\n", name)
+		case code != http.StatusOK:
+			fmt.Printf("%-14s not ready %s\n", name, body)
+			unhealthy = true
+		default:
+			fmt.Printf("%-14s ready\n", name)
+		}
+
+		if code, body, err := call(http.MethodGet, name, "/healthz/dependencies"); err == nil && code != http.StatusNotFound {
+			fmt.Printf("%-14s deps      %s\n", "", body)
+		}
+	}
+	if unhealthy {
+		return errors.New("some services are unhealthy")
+	}
+	return nil
+}
+
+// chaosMode is where a chaos mode is controlled.
+type chaosMode struct {
+	service string
+	path    string
+	help    string
+}
+
+var chaosModes = map[string]chaosMode{
+	"leak":      {"store-api", "/admin/chaos/leak", "kind=file|conn rate=<per second>"},
+	"oom":       {"store-api", "/admin/chaos/oom", "rate_mb=<per second>"},
+	"network":   {"store-client", "/admin/chaos/network", "mode=dns|tls|reset probability=<0-1>"},
+	"dns":       {"store-client", "/admin/chaos/dns", "ttl_ms=<ms, 0 to stop caching>"},
+	"discovery": {"store-client", "/admin/chaos/discovery", "latency_ms=<ms> error_rate=<0-1> empty=true"},
+	"zone":      {"store-api", "/admin/chaos/zone", "zone=<zone> latency_ms=<ms> error_rate=<0-1> status_code=<code>"},
+	"skew":      {"store-api", "/admin/chaos/clockskew", "offset_ms=<ms, negative to run behind>"},
+	"starve":    {"store-api", "/admin/chaos/parallelism", "gomaxprocs=<n> workers=<n>"},
+	"exit":      {"store-api", "/admin/chaos/exit", "code=<exit code> delay_ms=<ms>"},
+	"faults":    {"store-api", "/admin/chaos/faults", "key=<baggage key> value=<value> latency_ms=<ms> error_rate=<0-1> status_code=<code>"},
+	"deadlock":  {"store-api", "/admin/deadlock", ""},
+	"heapdump":  {"store-api", "/admin/heapdump", "reason=<why>"},
+	"pricing":   {"flaky-dep", "/admin/profile", "name=<profile> latency_ms=<ms> jitter_ms=<ms> error_rate=<0-1> corrupt_rate=<0-1>"},
+	"fx":        {"fx-api", "/admin/profile", "name=<profile> latency_ms=<ms> jitter_ms=<ms> error_rate=<0-1>"},
+	"payments":  {"payments", "/admin/profile", "decline_rate=<0-1> timeout_rate=<0-1> timeout_ms=<ms> latency_ms=<ms>"},
+	"webhooks":  {"webhook-receiver", "/admin/profile", "error_rate=<0-1> status_code=<code> latency_ms=<ms> jitter_ms=<ms>"},
+	"notify":    {"store-api", "/admin/chaos/notifications", "provider=<mailhop|postbox|textwave|smsline> error_rate=<0-1> latency_ms=<ms> jitter_ms=<ms>"},
+	"sampling":  {"store-client", "/admin/sampling", "ratio=<0-1>, -stop restores the configured ratio"},
+	"schema":    {"store-api", "/admin/schema", "version=1|2, -stop restores the configured version"},
+}
+
+func runChaos(args []string) error {
+	fs := flag.NewFlagSet("chaos", flag.ExitOnError)
+	stop := fs.Bool("stop", false, "stop the mode instead of starting it")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: o11yctl chaos [-stop] <mode> [key=value...]\n\nModes:\n")
+		names := make([]string, 0, len(chaosModes))
+		for name := range chaosModes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %-9s %s\n", name, chaosModes[name].help)
+		}
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("a mode is required")
+	}
+
+	mode, ok := chaosModes[fs.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unknown chaos mode %q", fs.Arg(0))
+	}
+	query, err := keyValues(fs.Args()[1:])
+	if err != nil {
+		return err
+	}
+
+	method := http.MethodPost
+	if *stop {
+		method = http.MethodDelete
+	}
+	return callAndPrint(method, mode.service, mode.path+"?"+query.Encode())
+}
+
+func runFlags(args []string) error {
+	if len(args) == 0 {
+		return callAndPrint(http.MethodGet, "store-client", "/admin/flags")
+	}
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		enabled, err := strconv.ParseBool(value)
+		if !ok || err != nil {
+			return fmt.Errorf("expected name=true|false, got %q", arg)
+		}
+		query := url.Values{"name": {name}, "enabled": {strconv.FormatBool(enabled)}}
+		if err := callAndPrint(http.MethodPost, "store-client", "/admin/flags?"+query.Encode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyValues turns key=value arguments into query parameters.
+func keyValues(args []string) (url.Values, error) {
+	query := url.Values{}
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected key=value, got %q", arg)
+		}
+		query.Add(key, value)
+	}
+	return query, nil
+}
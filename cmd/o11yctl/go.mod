@@ -0,0 +1,3 @@
+module o11yctl
+
+go 1.24
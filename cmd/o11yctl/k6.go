@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"text/template"
+	"time"
+)
+
+// k6Script mirrors what o11yctl load does: a constant-arrival-rate executor
+// sends rate requests per second, up to vus at a time, cycling through the
+// targets. k6 also drops iterations when every VU is busy, so the two
+// generators report a slow service the same way.
+var k6Script = template.Must(template.New("k6").Parse(`// Generated by o11yctl load -k6. Run with: k6 run <this file>
+import http from 'k6/http';
+
+const targets = {{.Targets}};
+
+export const options = {
+  scenarios: {
+    load: {
+      executor: 'constant-arrival-rate',
+      rate: {{.RPS}},
+      timeUnit: '1s',
+      duration: '{{.Duration}}',
+      preAllocatedVUs: {{.VUs}},
+      maxVUs: {{.VUs}},
+    },
+  },
+};
+
+export default function () {
+  const t = targets[__ITER % targets.length];
+  http.request(t.method, t.url, null, { headers: t.headers });
+}
+`))
+
+// writeK6Script writes a k6 script equivalent to running the load generator
+// with the same targets and options.
+func writeK6Script(w io.Writer, targets []loadTarget, rps int, duration time.Duration, concurrency int) error {
+	type k6Target struct {
+		Method  string            `json:"method"`
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+	}
+	list := make([]k6Target, len(targets))
+	for i, t := range targets {
+		headers := map[string]string{"X-Caller": "o11yctl-k6"}
+		for name := range t.Header {
+			headers[name] = t.Header.Get(name)
+		}
+		list[i] = k6Target{Method: t.Method, URL: t.URL, Headers: headers}
+	}
+	encoded, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return k6Script.Execute(w, map[string]any{
+		"Targets":  string(encoded),
+		"RPS":      rps,
+		"Duration": duration.String(),
+		"VUs":      concurrency,
+	})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadTarget is one request the load generator sends.
+type loadTarget struct {
+	Method string
+	URL    string
+	Header http.Header
+}
+
+// loadResult is the outcome of one request.
+type loadResult struct {
+	status  int
+	latency time.Duration
+	err     error
+}
+
+func runLoad(args []string) error {
+	fs := flag.NewFlagSet("load", flag.ExitOnError)
+	rps := fs.Int("rps", 10, "requests per second, across all workers")
+	duration := fs.Duration("d", 30*time.Second, "how long to run for")
+	concurrency := fs.Int("c", 10, "maximum requests in flight")
+	method := fs.String("m", http.MethodGet, "request method")
+	var headers headerFlag
+	fs.Var(&headers, "H", "request header as 'Name: value', repeatable")
+	k6 := fs.String("k6", "", "write the scenario as a k6 script to this file (- for stdout) instead of running it")
+	topologyFile := fs.String("topology", "", "send load to every entrypoint in this file from o11yctl topology, as well as to any urls")
+	// The k6 spellings, so a k6 command line works here too
+	fs.DurationVar(duration, "duration", *duration, "same as -d")
+	fs.IntVar(concurrency, "vus", *concurrency, "same as -c")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: o11yctl load [flags] <url> [url...]\n       o11yctl load [flags] -topology <file> [url...]\n\nSends requests to the urls in turn at a steady rate, then prints a summary.\nWith -k6 it writes an equivalent k6 script instead.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 && *topologyFile == "" {
+		fs.Usage()
+		return errors.New("at least one url is required")
+	}
+	if *rps <= 0 || *concurrency <= 0 {
+		return errors.New("rps and c must be positive")
+	}
+
+	targets := make([]loadTarget, fs.NArg())
+	for i, u := range fs.Args() {
+		targets[i] = loadTarget{Method: *method, URL: u, Header: http.Header(headers)}
+	}
+	if *topologyFile != "" {
+		entrypoints, err := readTopologyTargets(*topologyFile, *method, http.Header(headers))
+		if err != nil {
+			return err
+		}
+		targets = append(targets, entrypoints...)
+	}
+
+	if *k6 != "" {
+		if *k6 == "-" {
+			return writeK6Script(os.Stdout, targets, *rps, *duration, *concurrency)
+		}
+		f, err := os.Create(*k6)
+		if err != nil {
+			return err
+		}
+		if err := writeK6Script(f, targets, *rps, *duration, *concurrency); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+
+	fmt.Printf("Sending %d rps to %d target(s) for %s, ctrl-c to stop early\n", *rps, len(targets), *duration)
+	i := 0
+	results := generateLoad(ctx, *concurrency, time.Second/time.Duration(*rps), func() loadTarget {
+		t := targets[i%len(targets)]
+		i++
+		return t
+	})
+	printSummary(results)
+	return nil
+}
+
+// generateLoad calls next for a target every interval and sends it, with at
+// most concurrency requests in flight, until ctx is done. When every worker
+// is busy the tick is dropped rather than queued, so a slow service sees the
+// rate it can handle and the summary shows the shortfall.
+func generateLoad(ctx context.Context, concurrency int, interval time.Duration, next func() loadTarget) []loadResult {
+	var (
+		mu      sync.Mutex
+		results []loadResult
+		wg      sync.WaitGroup
+	)
+	slots := make(chan struct{}, concurrency)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	dropped := 0
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			if dropped > 0 {
+				fmt.Printf("Dropped %d requests with every worker busy\n", dropped)
+			}
+			return results
+		case <-ticker.C:
+		}
+
+		target := next()
+		select {
+		case slots <- struct{}{}:
+		default:
+			dropped++
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			result := send(target)
+			mu.Lock()
+			results = append(results, result)
+			mu.Unlock()
+		}()
+	}
+}
+
+// send makes one request and times it.
+func send(target loadTarget) loadResult {
+	req, err := http.NewRequest(target.Method, target.URL, nil)
+	if err != nil {
+		return loadResult{err: err}
+	}
+	for name, values := range target.Header {
+		req.Header[name] = values
+	}
+	if req.Header.Get("X-Caller") == "" {
+		req.Header.Set("X-Caller", "o11yctl")
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return loadResult{latency: time.Since(start), err: err}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return loadResult{status: resp.StatusCode, latency: time.Since(start)}
+}
+
+// printSummary prints the count of each status and latency percentiles.
+func printSummary(results []loadResult) {
+	if len(results) == 0 {
+		fmt.Println("No requests completed")
+		return
+	}
+
+	statuses := map[string]int{}
+	latencies := make([]time.Duration, 0, len(results))
+	for _, r := range results {
+		if r.err != nil {
+			statuses["error"]++
+			continue
+		}
+		statuses[fmt.Sprint(r.status)]++
+		latencies = append(latencies, r.latency)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	fmt.Printf("\nRequests: %d\n", len(results))
+	keys := make([]string, 0, len(statuses))
+	for k := range statuses {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("  %-6s %d\n", k, statuses[k])
+	}
+	if len(latencies) > 0 {
+		fmt.Printf("Latency: p50 %s  p90 %s  p99 %s  max %s\n",
+			percentile(latencies, 0.5), percentile(latencies, 0.9), percentile(latencies, 0.99), latencies[len(latencies)-1].Round(time.Millisecond))
+	}
+}
+
+// percentile returns the p-th percentile of sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	return sorted[int(float64(len(sorted)-1)*p)].Round(time.Millisecond)
+}
+
+// headerFlag collects repeated -H flags.
+type headerFlag http.Header
+
+func (h *headerFlag) String() string {
+	return fmt.Sprint(map[string][]string(*h))
+}
+
+func (h *headerFlag) Set(value string) error {
+	name, v, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("expected 'Name: value', got %q", value)
+	}
+	if *h == nil {
+		*h = headerFlag{}
+	}
+	http.Header(*h).Add(strings.TrimSpace(name), strings.TrimSpace(v))
+	return nil
+}
@@ -0,0 +1,106 @@
+// Command o11yctl drives the playground from the terminal: it starts the
+// stack, generates load, flips chaos modes and feature flags on the running
+// services, checks their health and tails their logs. It wraps the curl and
+// docker compose commands the workshop otherwise has you copy and paste.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// services maps each service name to its address, overridable with an
+// O11YCTL_<NAME>_URL env var (e.g. O11YCTL_STORE_API_URL).
+var services = map[string]string{
+	"store-api":        "http://localhost:8080",
+	"store-client":     "http://localhost:8081",
+	"flaky-dep":        "http://localhost:8082",
+	"pricing":          "http://localhost:8083",
+	"fx-api":           "http://localhost:8084",
+	"payments":         "http://localhost:8085",
+	"webhook-receiver": "http://localhost:8086",
+}
+
+// command is one o11yctl subcommand.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"bench":       {"bench [flags]                    measure profiling overhead, see o11yctl bench -h", runBench},
+	"up":          {"up [service...]                  build and start the stack (or some of it)", runUp},
+	"down":        {"down                             stop the stack", runDown},
+	"logs":        {"logs [-since 10m] [service...]   tail service logs", runLogs},
+	"load":        {"load [flags] <url>               generate load, see o11yctl load -h", runLoad},
+	"replay":      {"replay [flags] <recording>       replay recorded traffic, see o11yctl replay -h", runReplay},
+	"health":      {"health [service...]              show readiness and dependency health", runHealth},
+	"chaos":       {"chaos <mode> [key=value...]      start a chaos mode, see o11yctl chaos -h", runChaos},
+	"flags":       {"flags [name=true|false...]       list or set store-client feature flags", runFlags},
+	"get":         {"get <service> <path>             GET any path on a service", runGet},
+	"loglevel":    {"loglevel <service> [key=value]   show or set log levels, see o11yctl loglevel -h", runLogLevel},
+	"topology":    {"topology [-o file] [service...]  collect each service's /topology into one file", runTopology},
+	"new-service": {"new-service [flags] <name>       scaffold an instrumented service, see o11yctl new-service -h", runNewService},
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "o11yctl: unknown command %q\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "o11yctl %s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: o11yctl <command> [arguments]\n\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nService addresses can be overridden with O11YCTL_<SERVICE>_URL, and\nADMIN_TOKEN is sent to admin endpoints when set.\n")
+}
+
+// serviceURL returns the base address of the named service.
+func serviceURL(name string) (string, error) {
+	addr, ok := services[name]
+	if !ok {
+		return "", fmt.Errorf("unknown service %q", name)
+	}
+	env := "O11YCTL_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_URL"
+	if v := os.Getenv(env); v != "" {
+		addr = v
+	}
+	return strings.TrimSuffix(addr, "/"), nil
+}
+
+// serviceNames returns names if any are given, otherwise every service.
+func serviceNames(names []string) []string {
+	if len(names) > 0 {
+		return names
+	}
+	all := make([]string, 0, len(services))
+	for name := range services {
+		all = append(all, name)
+	}
+	sort.Strings(all)
+	return all
+}
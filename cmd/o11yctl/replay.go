@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"time"
+)
+
+// recordedRequest is one line of a recording made by a service with
+// RECORD_TRAFFIC_FILE set.
+type recordedRequest struct {
+	Time    time.Time           `json:"time"`
+	Service string              `json:"service"`
+	Method  string              `json:"method"`
+	Path    string              `json:"path"`
+	Headers map[string][]string `json:"headers"`
+}
+
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "playback speed, 2 replays twice as fast")
+	target := fs.String("target", "", "send everything here instead of to each request's own service")
+	concurrency := fs.Int("c", 100, "maximum requests in flight")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: o11yctl replay [flags] <recording>\n\nReplays a traffic recording with its original pacing, then prints a summary.\nServices record traffic when RECORD_TRAFFIC_FILE is set.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("a recording is required")
+	}
+	if *speed <= 0 || *concurrency <= 0 {
+		return errors.New("speed and c must be positive")
+	}
+
+	recording, err := readRecording(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if len(recording) == 0 {
+		return errors.New("recording is empty")
+	}
+
+	targets := make([]loadTarget, len(recording))
+	for i, r := range recording {
+		base := *target
+		if base == "" {
+			if base, err = serviceURL(r.Service); err != nil {
+				return fmt.Errorf("request %d: %w", i+1, err)
+			}
+		}
+		header := http.Header(r.Headers).Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set("X-Replay", "true")
+		targets[i] = loadTarget{Method: r.Method, URL: base + r.Path, Header: header}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	span := recording[len(recording)-1].Time.Sub(recording[0].Time)
+	fmt.Printf("Replaying %d requests spanning %s at %gx, ctrl-c to stop early\n", len(recording), span.Round(time.Millisecond), *speed)
+	printSummary(replay(ctx, recording, targets, *speed, *concurrency))
+	return nil
+}
+
+// readRecording reads a recording, ordered by when each request arrived.
+func readRecording(path string) ([]recordedRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recording []recordedRequest
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var r recordedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		recording = append(recording, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Requests served concurrently can be written slightly out of order
+	sort.SliceStable(recording, func(i, j int) bool { return recording[i].Time.Before(recording[j].Time) })
+	return recording, nil
+}
+
+// replay sends each target at the same offset from the start as its
+// recorded request had, scaled by speed. Like generateLoad it drops a
+// request rather than delay it when concurrency requests are in flight, so
+// the shape of the traffic is kept.
+func replay(ctx context.Context, recording []recordedRequest, targets []loadTarget, speed float64, concurrency int) []loadResult {
+	var (
+		mu      sync.Mutex
+		results []loadResult
+		wg      sync.WaitGroup
+	)
+	slots := make(chan struct{}, concurrency)
+	start, first := time.Now(), recording[0].Time
+
+	dropped := 0
+	for i, target := range targets {
+		due := start.Add(time.Duration(float64(recording[i].Time.Sub(first)) / speed))
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(due)):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		select {
+		case slots <- struct{}{}:
+		default:
+			dropped++
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			result := send(target)
+			mu.Lock()
+			results = append(results, result)
+			mu.Unlock()
+		}()
+	}
+
+	wg.Wait()
+	if dropped > 0 {
+		fmt.Printf("Dropped %d requests with every worker busy\n", dropped)
+	}
+	return results
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"go/format"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// serviceTemplates are the files of a new service that differ from one to
+// the next. go.mod and go.sum are copied from an existing service, so the
+// new one starts on the same dependency versions as the others, and on the
+// shared logfields module they all point at.
+//
+//go:embed templates/service
+var serviceTemplates embed.FS
+
+// serviceName is what a service can be called: a docker compose service
+// name that also works as a Go module path.
+var serviceName = regexp.MustCompile(`^[a-z][a-z0-9-]*[a-z0-9]$`)
+
+// scaffold is what the service templates are filled in with.
+type scaffold struct {
+	Name string
+	Port int
+	// MetricPrefix and EnvPrefix are the name as metric names and env vars
+	// want it
+	MetricPrefix string
+	EnvPrefix    string
+}
+
+func runNewService(args []string) error {
+	fs := flag.NewFlagSet("new-service", flag.ExitOnError)
+	port := fs.Int("port", nextPort(), "port the service listens on")
+	from := fs.String("from", "webhook-receiver", "existing service to copy go.mod and go.sum from")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: o11yctl new-service [flags] <name>\n\nCreates <name>/ in the repository root with a service that has tracing,\nmetrics, JSON logs, an admin API and a Dockerfile set up like the others.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("a service name is required")
+	}
+	name := fs.Arg(0)
+	if !serviceName.MatchString(name) {
+		return fmt.Errorf("%q isn't a valid service name: use lowercase letters, digits and dashes", name)
+	}
+	if _, ok := services[name]; ok {
+		return fmt.Errorf("there is already a service called %q", name)
+	}
+	if _, err := os.Stat("docker-compose.yml"); err != nil {
+		return errors.New("run this from the root of the repository")
+	}
+	if _, err := os.Stat(name); err == nil {
+		return fmt.Errorf("%s already exists", name)
+	}
+
+	s := scaffold{
+		Name:         name,
+		Port:         *port,
+		MetricPrefix: strings.ReplaceAll(name, "-", "_"),
+		EnvPrefix:    strings.ToUpper(strings.ReplaceAll(name, "-", "_")),
+	}
+	if err := writeService(s, *from); err != nil {
+		os.RemoveAll(name)
+		return err
+	}
+	printNextSteps(s)
+	return nil
+}
+
+// writeService creates the service's directory from the templates and the
+// files copied from the from service.
+func writeService(s scaffold, from string) error {
+	if err := os.MkdirAll(s.Name, 0o755); err != nil {
+		return err
+	}
+
+	templates, err := template.ParseFS(serviceTemplates, "templates/service/*.tmpl")
+	if err != nil {
+		return err
+	}
+	for _, t := range templates.Templates() {
+		name := strings.TrimSuffix(t.Name(), ".tmpl")
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, s); err != nil {
+			return fmt.Errorf("writing %s: %w", name, err)
+		}
+		data := buf.Bytes()
+		if strings.HasSuffix(name, ".go") {
+			// Filling in the templates can leave the code unformatted
+			if data, err = format.Source(data); err != nil {
+				return fmt.Errorf("formatting %s: %w", name, err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(s.Name, name), data, 0o644); err != nil {
+			return err
+		}
+	}
+
+	mod, err := os.ReadFile(filepath.Join(from, "go.mod"))
+	if err != nil {
+		return err
+	}
+	mod = regexp.MustCompile(`(?m)^module .*$`).ReplaceAll(mod, []byte("module "+s.Name))
+	if err := os.WriteFile(filepath.Join(s.Name, "go.mod"), mod, 0o644); err != nil {
+		return err
+	}
+	sum, err := os.ReadFile(filepath.Join(from, "go.sum"))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.Name, "go.sum"), sum, 0o644)
+}
+
+// nextPort is the port after the highest any service listens on.
+func nextPort() int {
+	highest := 8080
+	for _, addr := range services {
+		u, err := url.Parse(addr)
+		if err != nil {
+			continue
+		}
+		if port, err := strconv.Atoi(u.Port()); err == nil {
+			highest = max(highest, port)
+		}
+	}
+	return highest + 1
+}
+
+// printNextSteps says what's left to wire the new service into the stack.
+// Alloy finds containers through docker, so its metrics and logs are
+// collected once it runs, and its traces go to alloy like everyone else's.
+func printNextSteps(s scaffold) {
+	fmt.Printf(`Created %[1]s/. To add it to the stack:
+
+1. Add it to docker-compose.yml:
+
+  %[1]s:
+    build:
+      context: .
+      dockerfile: %[1]s/Dockerfile
+    container_name: %[1]s
+    ports:
+      - "%[2]d:%[2]d"
+    environment:
+      - OTEL_SERVICE_NAME=%[1]s
+      - OTEL_EXPORTER_OTLP_TRACES_ENDPOINT=alloy:4317
+    depends_on:
+      - alloy
+
+2. Let docker build it from the repository root, by adding it to .dockerignore:
+
+  !%[1]s/
+
+3. Add it to the services map in cmd/o11yctl/main.go, so o11yctl can reach it:
+
+	%[3]q: "http://localhost:%[2]d",
+
+4. Start it and say hello:
+
+  o11yctl up %[1]s
+  curl localhost:%[2]d/hello?name=you
+
+Its metrics and logs are collected as soon as it runs, and its traces go
+to alloy with everyone else's. %[4]s_LATENCY_MS, %[4]s_JITTER_MS and
+%[4]s_ERROR_RATE set how it misbehaves, as does /admin/profile.
+`, s.Name, s.Port, s.Name, s.EnvPrefix)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// serviceTopology is what a service reports on /topology, plus where
+// o11yctl reached it.
+type serviceTopology struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	URL     string `json:"url"`
+	Listen  []struct {
+		Name string `json:"name"`
+		Addr string `json:"addr"`
+	} `json:"listen"`
+	Dependencies []struct {
+		Name    string `json:"name"`
+		Address string `json:"address"`
+	} `json:"dependencies"`
+	Entrypoints []string `json:"entrypoints"`
+	// Error is why the service couldn't be asked, if it couldn't
+	Error string `json:"error,omitempty"`
+}
+
+// topology is the file o11yctl topology writes. Nodes and edges hold the
+// services and the calls between them again, with the field names Grafana's
+// node graph panel reads.
+type topology struct {
+	GeneratedAt time.Time         `json:"generated_at"`
+	Services    []serviceTopology `json:"services"`
+	Nodes       []topologyNode    `json:"nodes"`
+	Edges       []topologyEdge    `json:"edges"`
+}
+
+type topologyNode struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	SubTitle string `json:"subTitle,omitempty"`
+}
+
+type topologyEdge struct {
+	ID     string `json:"id"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+func runTopology(args []string) error {
+	fs := flag.NewFlagSet("topology", flag.ExitOnError)
+	out := fs.String("o", "topology.json", "file to write the topology to, - for stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: o11yctl topology [-o file] [service...]\n\nAsks each service what it is, where it listens, what it calls and where\nload can be sent, and writes it all to one file. o11yctl load -topology\nsends load to every entrypoint in it.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	t := topology{GeneratedAt: time.Now().UTC()}
+	reached := 0
+	for _, name := range serviceNames(fs.Args()) {
+		s, err := fetchTopology(name)
+		if err != nil {
+			s.Error = err.Error()
+			fmt.Printf("%-16s %v\n", name, err)
+		} else {
+			reached++
+			deps := make([]string, len(s.Dependencies))
+			for i, d := range s.Dependencies {
+				deps[i] = d.Name
+			}
+			fmt.Printf("%-16s %-10s calls %s\n", s.Name, s.Version, strings.Join(deps, ", "))
+		}
+		t.Services = append(t.Services, s)
+	}
+	if reached == 0 {
+		return errors.New("no service could be reached")
+	}
+	t.Nodes, t.Edges = topologyGraph(t.Services)
+
+	// Entrypoint queries keep their & rather than \u0026
+	var data bytes.Buffer
+	enc := json.NewEncoder(&data)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(t); err != nil {
+		return err
+	}
+	if *out == "-" {
+		_, err := os.Stdout.Write(data.Bytes())
+		return err
+	}
+	if err := os.WriteFile(*out, data.Bytes(), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d services and %d calls to %s\n", len(t.Nodes), len(t.Edges), *out)
+	return nil
+}
+
+// fetchTopology asks the named service for its topology. It is named as
+// o11yctl knows it when it can't be asked.
+func fetchTopology(name string) (serviceTopology, error) {
+	s := serviceTopology{Name: name}
+	base, err := serviceURL(name)
+	if err != nil {
+		return s, err
+	}
+	s.URL = base
+	code, body, err := call(http.MethodGet, name, "/topology")
+	if err != nil {
+		return s, err
+	}
+	if code != http.StatusOK {
+		return s, fmt.Errorf("/topology returned %d", code)
+	}
+	if err := json.Unmarshal([]byte(body), &s); err != nil {
+		return s, fmt.Errorf("decoding /topology: %w", err)
+	}
+	if s.Name == "" {
+		s.Name = name
+	}
+	s.URL = base
+	return s, nil
+}
+
+// topologyGraph returns the services as nodes, and the calls between them
+// as edges. Dependencies that weren't asked for their own topology are
+// nodes too.
+func topologyGraph(services []serviceTopology) ([]topologyNode, []topologyEdge) {
+	nodes := map[string]topologyNode{}
+	var edges []topologyEdge
+	for _, s := range services {
+		nodes[s.Name] = topologyNode{ID: s.Name, Title: s.Name, SubTitle: s.Version}
+	}
+	for _, s := range services {
+		for _, d := range s.Dependencies {
+			if _, ok := nodes[d.Name]; !ok {
+				nodes[d.Name] = topologyNode{ID: d.Name, Title: d.Name}
+			}
+			edges = append(edges, topologyEdge{ID: s.Name + "->" + d.Name, Source: s.Name, Target: d.Name})
+		}
+	}
+
+	sorted := make([]topologyNode, 0, len(nodes))
+	for _, n := range nodes {
+		sorted = append(sorted, n)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	return sorted, edges
+}
+
+// readTopologyTargets reads a topology file into a load target for each
+// entrypoint of each service in it.
+func readTopologyTargets(path, method string, header http.Header) ([]loadTarget, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t topology
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+
+	var targets []loadTarget
+	for _, s := range t.Services {
+		for _, entrypoint := range s.Entrypoints {
+			targets = append(targets, loadTarget{Method: method, URL: s.URL + entrypoint, Header: header})
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("%s has no entrypoints", path)
+	}
+	return targets, nil
+}
@@ -0,0 +1,321 @@
+// Command tracegen fabricates traces of a configurable shape and sends them
+// over OTLP, without any of the playground's services running. It is a
+// quick way to check that Tempo, the service graph and Grafana's trace
+// panels are wired up, and to see how they cope with traces that are
+// deeper, wider or fail more often than the store ever produces.
+//
+// Each trace is a tree of services: the root service calls -width services
+// at the next level, each of those calls -width more, and so on -depth
+// levels down. Every call is a client span in the caller and a server span
+// in the callee, so the service graph sees real edges. Timestamps are made
+// up rather than waited for, so a thousand deep traces take no longer to
+// send than a thousand shallow ones.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxSpansPerTrace stops a typo in -depth or -width from building traces
+// nothing downstream will accept.
+const maxSpansPerTrace = 10000
+
+// config is the shape of the traces to generate.
+type config struct {
+	depth     int
+	width     int
+	services  []string
+	errorRate float64
+	duration  time.Duration
+	jitter    float64
+	parallel  bool
+}
+
+func main() {
+	endpoint := flag.String("endpoint", envString("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "localhost:4317"), "OTLP gRPC endpoint to send traces to")
+	traces := flag.Int("traces", 100, "number of traces to send")
+	rate := flag.Float64("rate", 10, "traces per second, 0 to send them as fast as possible")
+	depth := flag.Int("depth", 3, "levels of services in each trace, the root included")
+	width := flag.Int("width", 2, "services each non-leaf service calls")
+	services := flag.String("services", "tracegen-gateway,tracegen-orders,tracegen-stock,tracegen-db", "comma separated service names, one per level, reused from the top when there are more levels")
+	errorRate := flag.Float64("error-rate", 0.05, "chance each service fails a request itself; failures propagate to its callers")
+	duration := flag.Duration("duration", 20*time.Millisecond, "typical time each service spends on its own work")
+	jitter := flag.Float64("jitter", 0.5, "how much durations vary either way, as a fraction of -duration")
+	parallel := flag.Bool("parallel", false, "make each service's calls in parallel rather than one after another")
+	seed := flag.Uint64("seed", 0, "random seed, for repeatable traces (0 picks one)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: tracegen [flags]\n\nSends made up traces of the given shape over OTLP gRPC.\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cfg := config{
+		depth:     *depth,
+		width:     *width,
+		services:  strings.Split(*services, ","),
+		errorRate: *errorRate,
+		duration:  *duration,
+		jitter:    *jitter,
+		parallel:  *parallel,
+	}
+	if err := run(*endpoint, *traces, *rate, *seed, cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "tracegen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(endpoint string, traces int, rate float64, seed uint64, cfg config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if traces < 1 || rate < 0 {
+		return errors.New("-traces must be at least 1 and -rate at least 0")
+	}
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+
+	// Export failures are otherwise only logged by the SDK's batcher
+	var mu sync.Mutex
+	var exportErr error
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if exportErr == nil {
+			exportErr = err
+		}
+	}))
+
+	ctx := context.Background()
+	g := &generator{cfg: cfg, services: cfg.levelServices(), rng: rand.New(rand.NewPCG(seed, seed)), tracers: map[string]trace.Tracer{}}
+	var providers []*sdktrace.TracerProvider
+	for _, name := range g.services {
+		if _, ok := g.tracers[name]; ok {
+			continue
+		}
+		exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+		if err != nil {
+			return fmt.Errorf("failed to create exporter: %w", err)
+		}
+		// One provider per service, since the service is the resource
+		tp := sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exporter),
+			sdktrace.WithResource(resource.NewWithAttributes(
+				semconv.SchemaURL,
+				semconv.ServiceName(name),
+				attribute.String("application", name),
+			)),
+		)
+		providers = append(providers, tp)
+		g.tracers[name] = tp.Tracer("tracegen")
+	}
+
+	start := time.Now()
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for i := range traces {
+		if tick != nil && i > 0 {
+			<-tick
+		}
+		g.Trace(ctx)
+	}
+
+	// Shutting down flushes what is still batched
+	for _, tp := range providers {
+		if err := tp.Shutdown(ctx); err != nil {
+			otel.Handle(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if exportErr != nil {
+		return fmt.Errorf("failed to export traces to %s: %w", endpoint, exportErr)
+	}
+	fmt.Printf("Sent %d traces, %d spans (%d with errors) to %s in %s, seed %d\n",
+		traces, g.spans, g.failed, endpoint, time.Since(start).Round(time.Millisecond), seed)
+	return nil
+}
+
+func (c config) validate() error {
+	switch {
+	case c.depth < 1:
+		return errors.New("-depth must be at least 1")
+	case c.width < 1:
+		return errors.New("-width must be at least 1")
+	case c.errorRate < 0 || c.errorRate > 1:
+		return errors.New("-error-rate must be between 0 and 1")
+	case c.duration <= 0:
+		return errors.New("-duration must be positive")
+	case c.jitter < 0 || c.jitter >= 1:
+		return errors.New("-jitter must be at least 0 and less than 1")
+	}
+	for _, name := range c.services {
+		if strings.TrimSpace(name) == "" {
+			return errors.New("-services must not have empty names")
+		}
+	}
+	// A server span per service called, and a client span per call
+	servers, level := 0, 1
+	for range c.depth {
+		servers += level
+		if servers*2 > maxSpansPerTrace {
+			return fmt.Errorf("-depth %d and -width %d make traces of over %d spans", c.depth, c.width, maxSpansPerTrace)
+		}
+		level *= c.width
+	}
+	return nil
+}
+
+// levelServices returns the service at each level.
+func (c config) levelServices() []string {
+	services := make([]string, c.depth)
+	for i := range services {
+		services[i] = strings.TrimSpace(c.services[i%len(c.services)])
+	}
+	return services
+}
+
+// call is a request to a service in a planned trace: what it does itself,
+// the calls it makes, and how it ends.
+type call struct {
+	service   string
+	route     string
+	self      time.Duration
+	hop       time.Duration
+	failed    bool
+	propagate bool
+	calls     []*call
+	duration  time.Duration
+}
+
+// generator plans traces and emits their spans.
+type generator struct {
+	cfg      config
+	services []string
+	rng      *rand.Rand
+	tracers  map[string]trace.Tracer
+	spans    int
+	failed   int
+}
+
+// Trace plans a trace and emits it, timed to end now.
+func (g *generator) Trace(ctx context.Context) {
+	root := g.plan(0, "/")
+	g.emit(ctx, root, time.Now().Add(-root.duration))
+}
+
+// jittered returns d varied by up to the configured jitter either way.
+func (g *generator) jittered(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * (1 + g.cfg.jitter*(2*g.rng.Float64()-1)))
+}
+
+// plan lays out the call to the service at level, and everything it calls,
+// working out durations from the leaves up.
+func (g *generator) plan(level int, route string) *call {
+	c := &call{
+		service: g.services[level],
+		route:   route,
+		self:    g.jittered(g.cfg.duration),
+		// The network, a small share of the work
+		hop:    g.jittered(g.cfg.duration / 20),
+		failed: g.rng.Float64() < g.cfg.errorRate,
+	}
+	c.duration = c.self
+	if level+1 < g.cfg.depth {
+		var longest time.Duration
+		for i := range g.cfg.width {
+			child := g.plan(level+1, fmt.Sprintf("/op%d", i))
+			c.calls = append(c.calls, child)
+			c.propagate = c.propagate || child.failed || child.propagate
+			if g.cfg.parallel {
+				longest = max(longest, child.duration+child.hop)
+			} else {
+				c.duration += child.duration + child.hop
+			}
+		}
+		c.duration += longest
+	}
+	return c
+}
+
+// emit records the server span for c starting at start, with a client span
+// and the callee's spans for each call it makes. Half the service's own
+// work comes before its calls and half after.
+func (g *generator) emit(ctx context.Context, c *call, start time.Time) {
+	ctx, span := g.tracers[c.service].Start(ctx, "GET "+c.route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(start),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodGet,
+			semconv.HTTPRoute(c.route),
+		),
+	)
+	g.spans++
+
+	at := start.Add(c.self / 2)
+	for _, callee := range c.calls {
+		callCtx, client := g.tracers[c.service].Start(ctx, "GET",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithTimestamp(at),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodGet,
+				semconv.ServerAddress(callee.service),
+				semconv.PeerService(callee.service),
+			),
+		)
+		g.spans++
+		g.emit(callCtx, callee, at.Add(callee.hop/2))
+		end := at.Add(callee.duration + callee.hop)
+		g.finish(client, callee.failed || callee.propagate, "downstream call failed", end)
+		if !g.cfg.parallel {
+			at = end
+		}
+	}
+
+	reason := "downstream call failed"
+	if c.failed {
+		reason = "injected failure"
+	}
+	g.finish(span, c.failed || c.propagate, reason, start.Add(c.duration))
+}
+
+// finish ends span at end, with a status code and, if it failed, an error
+// status saying why.
+func (g *generator) finish(span trace.Span, failed bool, reason string, end time.Time) {
+	status := 200
+	if failed {
+		status = 500
+		span.SetStatus(codes.Error, reason)
+		g.failed++
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	span.End(trace.WithTimestamp(end))
+}
+
+func envString(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Create a new counter vector for total requests.
+	requestCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_http_requests_total",
+			Help: "Total number of HTTP requests.",
+		},
+		[]string{"path", "method", "status_code"},
+	)
+
+	// Create a new histogram for request latencies.
+	requestLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_http_request_duration_seconds",
+			Help:    "HTTP request latency in seconds.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"path"},
+	)
+
+	// Gauges describing the currently active failure profile.
+	profileLatency = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "flaky_dep_profile_latency_seconds",
+			Help: "Base latency of the active profile in seconds.",
+		},
+	)
+	profileJitter = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "flaky_dep_profile_jitter_seconds",
+			Help: "Maximum extra random latency of the active profile in seconds.",
+		},
+	)
+	profileErrorRate = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "flaky_dep_profile_error_rate",
+			Help: "Fraction of requests the active profile fails.",
+		},
+	)
+	profileCorruptRate = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "flaky_dep_profile_corrupt_rate",
+			Help: "Fraction of prices the active profile corrupts into negative ones.",
+		},
+	)
+)
+
+type Config struct {
+	serviceName string
+	tempoServer string
+	profile     Profile
+}
+
+// Profile describes how badly the dependency behaves.
+type Profile struct {
+	Name      string  `json:"name"`
+	LatencyMS int     `json:"latency_ms"`
+	JitterMS  int     `json:"jitter_ms"`
+	ErrorRate float64 `json:"error_rate"`
+	// CorruptRate is the fraction of prices returned negative, a data
+	// bug that comes back with a 200
+	CorruptRate float64 `json:"corrupt_rate"`
+}
+
+// Named profiles that can be switched to with /admin/profile?name=<name>.
+var profiles = map[string]Profile{
+	"healthy": {Name: "healthy", LatencyMS: 20, JitterMS: 10, ErrorRate: 0},
+	"slow":    {Name: "slow", LatencyMS: 800, JitterMS: 400, ErrorRate: 0},
+	"flaky":   {Name: "flaky", LatencyMS: 50, JitterMS: 200, ErrorRate: 0.2},
+	"down":    {Name: "down", LatencyMS: 2000, JitterMS: 0, ErrorRate: 1},
+}
+
+var (
+	mu     sync.RWMutex
+	active Profile
+)
+
+func init() {
+	// Register the metrics with Prometheus's default registry.
+	prometheus.MustRegister(requestCount, requestLatency, profileLatency, profileJitter, profileErrorRate, profileCorruptRate)
+}
+
+func main() {
+
+	config := Config{
+		serviceName: os.Getenv("OTEL_SERVICE_NAME"),
+		tempoServer: os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"),
+		profile: Profile{
+			Name:        "custom",
+			LatencyMS:   envInt("FLAKY_LATENCY_MS", 20),
+			JitterMS:    envInt("FLAKY_JITTER_MS", 10),
+			ErrorRate:   envFloat("FLAKY_ERROR_RATE", 0),
+			CorruptRate: envFloat("FLAKY_CORRUPT_RATE", 0),
+		},
+	}
+
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	})))
+
+	// Setup OpenTelemetry for tracing
+	shutdown := setupTracer(config)
+	defer shutdown()
+
+	setProfile(config.profile)
+	slog.Info("Starting flaky dependency ...")
+
+	// Prices for the requested product IDs, served according to the profile
+	http.Handle("/prices", otelhttp.NewHandler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "prices-handler")
+			defer span.End()
+			start := time.Now()
+			if misbehave(ctx, w, r, start) {
+				return
+			}
+
+			prices := map[string]int{}
+			corrupt, corrupted := currentProfile().CorruptRate, 0
+			for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+				if n, err := strconv.Atoi(id); err == nil {
+					prices[id] = price(n)
+					if rand.Float64() < corrupt {
+						prices[id], corrupted = -prices[id], corrupted+1
+					}
+				}
+			}
+			span.SetAttributes(attribute.Int("flaky.corrupted_prices", corrupted))
+
+			slog.InfoContext(ctx, "Request handled successfully", logfields.Duration(time.Since(start)))
+			requestCount.WithLabelValues(r.URL.Path, r.Method, strconv.Itoa(http.StatusOK)).Inc()
+			requestLatency.WithLabelValues(r.URL.Path).Observe(time.Since(start).Seconds())
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(prices)
+		}),
+		"prices-handler-span",
+	))
+
+	// Exchange rates from USD, for when this runs as the external FX API,
+	// served according to the profile like prices are
+	http.Handle("/rates", otelhttp.NewHandler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "rates-handler")
+			defer span.End()
+			start := time.Now()
+			if misbehave(ctx, w, r, start) {
+				return
+			}
+
+			slog.InfoContext(ctx, "Request handled successfully", logfields.Duration(time.Since(start)))
+			requestCount.WithLabelValues(r.URL.Path, r.Method, strconv.Itoa(http.StatusOK)).Inc()
+			requestLatency.WithLabelValues(r.URL.Path).Observe(time.Since(start).Seconds())
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"base": "USD", "rates": rates()})
+		}),
+		"rates-handler-span",
+	))
+
+	// Inspect or change the active profile, either by name or by setting
+	// latency_ms, jitter_ms, error_rate and corrupt_rate directly.
+	http.Handle("/admin/profile", otelhttp.NewHandler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPut || r.Method == http.MethodPost {
+				q := r.URL.Query()
+				profile := currentProfile()
+				if name := q.Get("name"); name != "" {
+					p, ok := profiles[name]
+					if !ok {
+						http.Error(w, "unknown profile "+name, http.StatusBadRequest)
+						return
+					}
+					profile = p
+				}
+				if v, err := strconv.Atoi(q.Get("latency_ms")); err == nil {
+					profile.Name, profile.LatencyMS = "custom", v
+				}
+				if v, err := strconv.Atoi(q.Get("jitter_ms")); err == nil {
+					profile.Name, profile.JitterMS = "custom", v
+				}
+				if v, err := strconv.ParseFloat(q.Get("error_rate"), 64); err == nil {
+					profile.Name, profile.ErrorRate = "custom", v
+				}
+				if v, err := strconv.ParseFloat(q.Get("corrupt_rate"), 64); err == nil {
+					profile.Name, profile.CorruptRate = "custom", v
+				}
+				setProfile(profile)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(currentProfile())
+		}),
+		"admin-profile-handler-span",
+	))
+
+	// What the service is, where it listens and what it calls, for
+	// o11yctl topology
+	http.Handle("/topology", otelhttp.NewHandler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{
+				"name":         config.serviceName,
+				"version":      os.Getenv("SERVICE_VERSION"),
+				"listen":       []map[string]string{{"name": "app", "addr": ":8082"}},
+				"dependencies": []map[string]string{},
+				"entrypoints":  []string{"/prices?ids=1,2,3", "/rates"},
+			})
+		}),
+		"topology-handler-span",
+	))
+
+	// Endpoint to get metrics
+	http.Handle("/metrics", promhttp.Handler())
+
+	slog.Info("Application is listening on port 8082...")
+	// Accept h2c as well as HTTP/1.1, so callers can pick either
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Addr: ":8082", Protocols: &protocols}
+	server.ListenAndServe()
+}
+
+func currentProfile() Profile {
+	mu.RLock()
+	defer mu.RUnlock()
+	return active
+}
+
+func setProfile(p Profile) {
+	mu.Lock()
+	active = p
+	mu.Unlock()
+
+	profileLatency.Set(float64(p.LatencyMS) / 1000)
+	profileJitter.Set(float64(p.JitterMS) / 1000)
+	profileErrorRate.Set(p.ErrorRate)
+	profileCorruptRate.Set(p.CorruptRate)
+	slog.Info("Active profile changed", "profile", p.Name, "latency_ms", p.LatencyMS, "jitter_ms", p.JitterMS, "error_rate", p.ErrorRate, "corrupt_rate", p.CorruptRate)
+}
+
+// misbehave delays the request according to the active profile, then fails
+// it with a 503 at the profile's error rate, reporting whether it did.
+func misbehave(ctx context.Context, w http.ResponseWriter, r *http.Request, start time.Time) bool {
+	span := trace.SpanFromContext(ctx)
+	profile := currentProfile()
+	delay := time.Duration(profile.LatencyMS) * time.Millisecond
+	if profile.JitterMS > 0 {
+		delay += time.Duration(rand.Intn(profile.JitterMS)) * time.Millisecond
+	}
+	span.SetAttributes(
+		attribute.String("flaky.profile", profile.Name),
+		attribute.Int64("flaky.delay_ms", delay.Milliseconds()),
+	)
+	time.Sleep(delay)
+
+	if rand.Float64() >= profile.ErrorRate {
+		return false
+	}
+	span.RecordError(errors.New("simulated dependency failure"))
+	slog.ErrorContext(ctx, "Simulated dependency failure", logfields.Path(r.URL.Path), "profile", profile.Name)
+	requestCount.WithLabelValues(r.URL.Path, r.Method, strconv.Itoa(http.StatusServiceUnavailable)).Inc()
+	requestLatency.WithLabelValues(r.URL.Path).Observe(time.Since(start).Seconds())
+	http.Error(w, "simulated dependency failure", http.StatusServiceUnavailable)
+	return true
+}
+
+// baseRates are the exchange rates from USD that rates drifts around.
+var baseRates = map[string]float64{"USD": 1, "EUR": 0.92, "GBP": 0.79, "JPY": 151.3, "CAD": 1.37, "AUD": 1.52}
+
+// rates returns the exchange rates from USD, each drifted by up to half a
+// percent either way, like a live feed.
+func rates() map[string]float64 {
+	drifted := make(map[string]float64, len(baseRates))
+	for currency, rate := range baseRates {
+		if currency != "USD" {
+			rate *= 1 + (rand.Float64()-0.5)/100
+		}
+		drifted[currency] = rate
+	}
+	return drifted
+}
+
+// price derives a stable price in cents for a product ID.
+func price(id int) int {
+	return 499 + (id*7919)%1500
+}
+
+func setupTracer(config Config) func() {
+	ctx := context.Background()
+	slog.Info("Setting up traces with config", "config", config.tempoServer)
+	// Tempo gRPC endpoint from docker-compose.yml
+	conn, err := grpc.DialContext(ctx, config.tempoServer,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+	)
+	if err != nil {
+		slog.Error("Failed to create gRPC connection to Tempo:", logfields.Error(err))
+		return func() {}
+	}
+
+	// Create a new OTLP gRPC exporter
+	traceExporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(conn))
+	if err != nil {
+		slog.Error("Failed to create a new OTLP exporter:", logfields.Error(err))
+		return func() {}
+	}
+
+	// Create a new tracer provider with the exporter
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(traceExporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(config.serviceName),
+			attribute.String("application", config.serviceName),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return func() {
+		ctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			slog.Error("Failed to shutdown tracer provider:", logfields.Error(err))
+		}
+	}
+}
+
+// envInt returns the integer value of an env var, or def if it is unset or
+// not a number.
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// envFloat returns the float value of an env var, or def if it is unset or
+// not a number.
+func envFloat(key string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Create a new counter vector for total requests.
+	requestCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_http_requests_total",
+			Help: "Total number of HTTP requests.",
+		},
+		[]string{"path", "method", "status_code"},
+	)
+
+	// Create a new histogram for request latencies.
+	requestLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_http_request_duration_seconds",
+			Help:    "HTTP request latency in seconds.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"path"},
+	)
+
+	// Count payments, by outcome.
+	transactions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "payments_transactions_total",
+			Help: "Total number of payments processed, by outcome (approved, declined or timeout).",
+		},
+		[]string{"outcome"},
+	)
+
+	// Count declined payments, by reason.
+	declines = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "payments_declines_total",
+			Help: "Total number of declined payments, by decline reason.",
+		},
+		[]string{"reason"},
+	)
+
+	// Gauges describing the active behaviour.
+	declineRateGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "payments_profile_decline_rate",
+			Help: "Fraction of payments the active profile declines.",
+		},
+	)
+	timeoutRateGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "payments_profile_timeout_rate",
+			Help: "Fraction of payments the active profile hangs on.",
+		},
+	)
+)
+
+type Config struct {
+	serviceName string
+	tempoServer string
+	profile     Profile
+}
+
+// Profile describes how the simulated card processor behaves.
+type Profile struct {
+	LatencyMS   int     `json:"latency_ms"`
+	JitterMS    int     `json:"jitter_ms"`
+	DeclineRate float64 `json:"decline_rate"`
+	TimeoutRate float64 `json:"timeout_rate"`
+	// TimeoutMS is how long a payment that times out hangs for before
+	// giving up with a 504
+	TimeoutMS int `json:"timeout_ms"`
+}
+
+// declineReasons are the reasons payments get declined for, weighted by
+// how often each comes up.
+var declineReasons = []struct {
+	reason string
+	weight int
+}{
+	{"insufficient_funds", 50},
+	{"do_not_honor", 20},
+	{"card_expired", 15},
+	{"incorrect_cvc", 10},
+	{"fraud_suspected", 5},
+}
+
+var (
+	mu     sync.RWMutex
+	active Profile
+	nextID atomic.Int64
+)
+
+func init() {
+	// Register the metrics with Prometheus's default registry.
+	prometheus.MustRegister(requestCount, requestLatency, transactions, declines, declineRateGauge, timeoutRateGauge)
+}
+
+func main() {
+
+	config := Config{
+		serviceName: os.Getenv("OTEL_SERVICE_NAME"),
+		tempoServer: os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"),
+		profile: Profile{
+			LatencyMS:   envInt("PAYMENTS_LATENCY_MS", 100),
+			JitterMS:    envInt("PAYMENTS_JITTER_MS", 100),
+			DeclineRate: envFloat("PAYMENTS_DECLINE_RATE", 0.1),
+			TimeoutRate: envFloat("PAYMENTS_TIMEOUT_RATE", 0.02),
+			TimeoutMS:   envInt("PAYMENTS_TIMEOUT_MS", 10000),
+		},
+	}
+
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	})))
+
+	// Setup OpenTelemetry for tracing
+	shutdown := setupTracer(config)
+	defer shutdown()
+
+	setProfile(config.profile)
+	slog.Info("Starting payments simulator ...")
+
+	// Charge a payment, which is approved, declined or hangs
+	http.Handle("/payments", otelhttp.NewHandler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "payments-handler")
+			defer span.End()
+			start := time.Now()
+
+			respond := func(status int, body any) {
+				requestCount.WithLabelValues(r.URL.Path, r.Method, strconv.Itoa(status)).Inc()
+				requestLatency.WithLabelValues(r.URL.Path).Observe(time.Since(start).Seconds())
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(status)
+				json.NewEncoder(w).Encode(body)
+			}
+
+			if r.Method != http.MethodPost {
+				respond(http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+				return
+			}
+			var payment struct {
+				Amount   int    `json:"amount"`
+				Currency string `json:"currency"`
+				OrderRef string `json:"order_ref"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payment); err != nil || payment.Amount <= 0 {
+				respond(http.StatusBadRequest, map[string]string{"error": "payment needs a positive amount"})
+				return
+			}
+
+			id := "pay_" + strconv.FormatInt(nextID.Add(1), 10)
+			span.SetAttributes(
+				attribute.String("payment.id", id),
+				attribute.Int("payment.amount", payment.Amount),
+				attribute.String("payment.currency", payment.Currency),
+			)
+
+			profile := currentProfile()
+			delay := time.Duration(profile.LatencyMS) * time.Millisecond
+			if profile.JitterMS > 0 {
+				delay += time.Duration(rand.Intn(profile.JitterMS)) * time.Millisecond
+			}
+
+			switch roll := rand.Float64(); {
+			case roll < profile.TimeoutRate:
+				// The processor never answers; callers with a shorter
+				// timeout give up first
+				select {
+				case <-time.After(time.Duration(profile.TimeoutMS) * time.Millisecond):
+				case <-ctx.Done():
+				}
+				transactions.WithLabelValues("timeout").Inc()
+				span.SetStatus(codes.Error, "processor timeout")
+				slog.WarnContext(ctx, "Payment timed out", "payment_id", id)
+				respond(http.StatusGatewayTimeout, map[string]string{"id": id, "status": "timeout"})
+
+			case roll < profile.TimeoutRate+profile.DeclineRate:
+				time.Sleep(delay)
+				reason := declineReason()
+				transactions.WithLabelValues("declined").Inc()
+				declines.WithLabelValues(reason).Inc()
+				// A decline is the processor working as intended, so the
+				// span isn't an error
+				span.SetAttributes(attribute.String("payment.decline_reason", reason))
+				slog.InfoContext(ctx, "Payment declined", "payment_id", id, "reason", reason, logfields.Duration(time.Since(start)))
+				respond(http.StatusPaymentRequired, map[string]string{"id": id, "status": "declined", "reason": reason})
+
+			default:
+				time.Sleep(delay)
+				transactions.WithLabelValues("approved").Inc()
+				slog.InfoContext(ctx, "Payment approved", "payment_id", id, logfields.Duration(time.Since(start)))
+				respond(http.StatusOK, map[string]string{"id": id, "status": "approved"})
+			}
+		}),
+		"payments-handler-span",
+	))
+
+	// Inspect or change the active profile by setting any of latency_ms,
+	// jitter_ms, decline_rate, timeout_rate and timeout_ms.
+	http.Handle("/admin/profile", otelhttp.NewHandler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPut || r.Method == http.MethodPost {
+				q := r.URL.Query()
+				profile := currentProfile()
+				if v, err := strconv.Atoi(q.Get("latency_ms")); err == nil {
+					profile.LatencyMS = v
+				}
+				if v, err := strconv.Atoi(q.Get("jitter_ms")); err == nil {
+					profile.JitterMS = v
+				}
+				if v, err := strconv.ParseFloat(q.Get("decline_rate"), 64); err == nil {
+					profile.DeclineRate = v
+				}
+				if v, err := strconv.ParseFloat(q.Get("timeout_rate"), 64); err == nil {
+					profile.TimeoutRate = v
+				}
+				if v, err := strconv.Atoi(q.Get("timeout_ms")); err == nil {
+					profile.TimeoutMS = v
+				}
+				setProfile(profile)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(currentProfile())
+		}),
+		"admin-profile-handler-span",
+	))
+
+	// What the service is, where it listens and what it calls, for
+	// o11yctl topology
+	http.Handle("/topology", otelhttp.NewHandler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{
+				"name":         config.serviceName,
+				"version":      os.Getenv("SERVICE_VERSION"),
+				"listen":       []map[string]string{{"name": "app", "addr": ":8085"}},
+				"dependencies": []map[string]string{},
+				"entrypoints":  []string{},
+			})
+		}),
+		"topology-handler-span",
+	))
+
+	// Endpoint to get metrics
+	http.Handle("/metrics", promhttp.Handler())
+
+	slog.Info("Application is listening on port 8085...")
+	// Accept h2c as well as HTTP/1.1, so callers can pick either
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Addr: ":8085", Protocols: &protocols}
+	server.ListenAndServe()
+}
+
+func currentProfile() Profile {
+	mu.RLock()
+	defer mu.RUnlock()
+	return active
+}
+
+func setProfile(p Profile) {
+	mu.Lock()
+	active = p
+	mu.Unlock()
+
+	declineRateGauge.Set(p.DeclineRate)
+	timeoutRateGauge.Set(p.TimeoutRate)
+	slog.Info("Active profile changed", "latency_ms", p.LatencyMS, "jitter_ms", p.JitterMS, "decline_rate", p.DeclineRate, "timeout_rate", p.TimeoutRate, "timeout_ms", p.TimeoutMS)
+}
+
+// declineReason picks a weighted random decline reason.
+func declineReason() string {
+	total := 0
+	for _, d := range declineReasons {
+		total += d.weight
+	}
+	n := rand.Intn(total)
+	for _, d := range declineReasons {
+		if n < d.weight {
+			return d.reason
+		}
+		n -= d.weight
+	}
+	return declineReasons[0].reason
+}
+
+func setupTracer(config Config) func() {
+	ctx := context.Background()
+	slog.Info("Setting up traces with config", "config", config.tempoServer)
+	// Tempo gRPC endpoint from docker-compose.yml
+	conn, err := grpc.DialContext(ctx, config.tempoServer,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+	)
+	if err != nil {
+		slog.Error("Failed to create gRPC connection to Tempo:", logfields.Error(err))
+		return func() {}
+	}
+
+	// Create a new OTLP gRPC exporter
+	traceExporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(conn))
+	if err != nil {
+		slog.Error("Failed to create a new OTLP exporter:", logfields.Error(err))
+		return func() {}
+	}
+
+	// Create a new tracer provider with the exporter
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(traceExporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(config.serviceName),
+			attribute.String("application", config.serviceName),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return func() {
+		ctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			slog.Error("Failed to shutdown tracer provider:", logfields.Error(err))
+		}
+	}
+}
+
+// envInt returns the integer value of an env var, or def if it is unset or
+// not a number.
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// envFloat returns the float value of an env var, or def if it is unset or
+// not a number.
+func envFloat(key string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,109 @@
+// Package cgroup exports a container's CPU and memory accounting from its
+// cgroup v2 files.
+package cgroup
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// collector exports the container's CPU and memory accounting from the
+// cgroup v2 files at scrape time, so CPU throttling can be lined up with the
+// request latency it causes. It is scrape-safe: a file that is missing
+// (cgroup v1, no limit set, not in a container) or unreadable just means its
+// metrics are left out, never a failed scrape.
+type collector struct {
+	root string
+
+	periods, throttledPeriods, throttledSeconds, usageSeconds *prometheus.Desc
+	quotaCores, memoryUsage, memoryLimit                      *prometheus.Desc
+}
+
+// NewCollector returns a collector reading the cgroup files under root,
+// usually /sys/fs/cgroup.
+func NewCollector(root string) prometheus.Collector {
+	return collector{
+		root:             root,
+		periods:          prometheus.NewDesc("go_app_cgroup_cpu_periods_total", "Number of CPU enforcement periods elapsed.", nil, nil),
+		throttledPeriods: prometheus.NewDesc("go_app_cgroup_cpu_throttled_periods_total", "Number of CPU enforcement periods in which the container was throttled.", nil, nil),
+		throttledSeconds: prometheus.NewDesc("go_app_cgroup_cpu_throttled_seconds_total", "Total time the container was throttled for in seconds.", nil, nil),
+		usageSeconds:     prometheus.NewDesc("go_app_cgroup_cpu_usage_seconds_total", "Total CPU time used by the container in seconds.", nil, nil),
+		quotaCores:       prometheus.NewDesc("go_app_cgroup_cpu_quota_cores", "CPU quota in cores, absent when there is none.", nil, nil),
+		memoryUsage:      prometheus.NewDesc("go_app_cgroup_memory_usage_bytes", "Memory used by the container in bytes.", nil, nil),
+		memoryLimit:      prometheus.NewDesc("go_app_cgroup_memory_limit_bytes", "Container memory limit in bytes, absent when there is none.", nil, nil),
+	}
+}
+
+func (c collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.periods
+	ch <- c.throttledPeriods
+	ch <- c.throttledSeconds
+	ch <- c.usageSeconds
+	ch <- c.quotaCores
+	ch <- c.memoryUsage
+	ch <- c.memoryLimit
+}
+
+func (c collector) Collect(ch chan<- prometheus.Metric) {
+	// cpu.stat is "key value" lines, times in microseconds
+	stat := c.readKeyValues("cpu.stat")
+	for key, desc := range map[string]*prometheus.Desc{"nr_periods": c.periods, "nr_throttled": c.throttledPeriods} {
+		if v, ok := stat[key]; ok {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, v)
+		}
+	}
+	for key, desc := range map[string]*prometheus.Desc{"throttled_usec": c.throttledSeconds, "usage_usec": c.usageSeconds} {
+		if v, ok := stat[key]; ok {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, v/1e6)
+		}
+	}
+
+	// cpu.max is "<quota> <period>", quota being "max" when unlimited
+	if fields := strings.Fields(c.read("cpu.max")); len(fields) == 2 {
+		quota, err1 := strconv.ParseFloat(fields[0], 64)
+		period, err2 := strconv.ParseFloat(fields[1], 64)
+		if err1 == nil && err2 == nil && period > 0 {
+			ch <- prometheus.MustNewConstMetric(c.quotaCores, prometheus.GaugeValue, quota/period)
+		}
+	}
+
+	if v, err := strconv.ParseFloat(c.read("memory.current"), 64); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.memoryUsage, prometheus.GaugeValue, v)
+	}
+	// "max" when unlimited, which fails to parse and is left out
+	if v, err := strconv.ParseFloat(c.read("memory.max"), 64); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.memoryLimit, prometheus.GaugeValue, v)
+	}
+}
+
+// read returns the trimmed contents of a cgroup file, or "" if it can't be
+// read.
+func (c collector) read(name string) string {
+	raw, err := os.ReadFile(filepath.Join(c.root, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(raw))
+}
+
+// readKeyValues parses a flat keyed cgroup file, skipping lines it can't
+// make sense of.
+func (c collector) readKeyValues(name string) map[string]float64 {
+	values := map[string]float64{}
+	scanner := bufio.NewScanner(strings.NewReader(c.read(name)))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			values[key] = v
+		}
+	}
+	return values
+}
@@ -0,0 +1,151 @@
+// Package clientpool tunes the connection pools of a service's outbound
+// transports, and exports statistics on the connections in them.
+package clientpool
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Count connections handed to outbound requests, by whether they were
+	// reused from the pool.
+	clientConnsAcquired = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_client_connections_acquired_total",
+			Help: "Total number of connections outbound requests got, by client and whether it was reused from the pool.",
+		},
+		[]string{"client", "reused"},
+	)
+
+	// Gauge of open outbound connections.
+	clientConnsOpen = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_client_connections_open",
+			Help: "Number of open outbound connections, by client.",
+		},
+		[]string{"client"},
+	)
+
+	// Gauge of outbound connections idle in the pool.
+	clientConnsIdle = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_client_connections_idle",
+			Help: "Number of outbound HTTP/1.1 connections idle in the pool, by client.",
+		},
+		[]string{"client"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(clientConnsAcquired, clientConnsOpen, clientConnsIdle)
+}
+
+// Tuning is the connection pool configuration every outbound transport
+// gets, to show what too small a pool, too short an idle timeout, or no
+// keep-alives at all cost in connection churn and latency.
+type Tuning struct {
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	DisableKeepAlives   bool
+}
+
+// tuning is what Apply gives transports.
+var tuning = Tuning{
+	MaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+// Configure sets the tuning Apply gives transports. It must be called
+// before any clients are created.
+func Configure(t Tuning) {
+	tuning = t
+}
+
+// Apply gives transport the configured pool tuning.
+func Apply(transport *http.Transport) {
+	transport.MaxIdleConnsPerHost = tuning.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = tuning.IdleConnTimeout
+	transport.DisableKeepAlives = tuning.DisableKeepAlives
+}
+
+// poolTracker exports pool statistics for a transport's connections.
+type poolTracker struct {
+	client    string
+	transport *http.Transport
+}
+
+// Track returns transport exporting pool statistics for its connections,
+// labelled client. It must wrap the transport directly, below anything that
+// rewrites the request context.
+func Track(client string, transport *http.Transport) http.RoundTripper {
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		clientConnsOpen.WithLabelValues(client).Inc()
+		return &pooledConn{Conn: conn, client: client}, nil
+	}
+	return poolTracker{client: client, transport: transport}
+}
+
+func (p poolTracker) RoundTrip(r *http.Request) (*http.Response, error) {
+	var conn atomic.Pointer[pooledConn]
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			clientConnsAcquired.WithLabelValues(p.client, strconv.FormatBool(info.Reused)).Inc()
+			if c, ok := info.Conn.(*pooledConn); ok {
+				conn.Store(c)
+				c.setIdle(false)
+			}
+		},
+		// Only HTTP/1.1 connections go back to the idle pool; HTTP/2 ones
+		// are shared between requests instead
+		PutIdleConn: func(err error) {
+			if c := conn.Load(); c != nil && err == nil {
+				c.setIdle(true)
+			}
+		},
+	}
+	return p.transport.RoundTrip(r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
+}
+
+// pooledConn is an outbound connection that keeps the pool gauges up to date.
+type pooledConn struct {
+	net.Conn
+	client string
+	idle   atomic.Bool
+	closed sync.Once
+}
+
+func (c *pooledConn) setIdle(idle bool) {
+	if c.idle.Swap(idle) == idle {
+		return
+	}
+	if idle {
+		clientConnsIdle.WithLabelValues(c.client).Inc()
+	} else {
+		clientConnsIdle.WithLabelValues(c.client).Dec()
+	}
+}
+
+func (c *pooledConn) Close() error {
+	c.closed.Do(func() {
+		c.setIdle(false)
+		clientConnsOpen.WithLabelValues(c.client).Dec()
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,100 @@
+// Package conns measures a server's connections: how many are open in each
+// state, how often they change state and how long they stay open.
+package conns
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Count connection state changes, by listener and the state entered.
+	connectionTransitions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_connection_state_changes_total",
+			Help: "Total number of server connections entering a state (new, active, idle, hijacked or closed), by listener.",
+		},
+		[]string{"listener", "state"},
+	)
+
+	// Gauge of open connections, by listener and state.
+	connectionsOpen = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_connections_open",
+			Help: "Number of open server connections, by listener and state (new, active or idle).",
+		},
+		[]string{"listener", "state"},
+	)
+
+	// Histogram of how long connections stayed open.
+	connectionLifetime = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_connection_duration_seconds",
+			Help:    "Time server connections stayed open, until closed or hijacked, in seconds.",
+			Buckets: []float64{.01, .1, .5, 1, 5, 15, 30, 60, 120, 300, 600},
+		},
+		[]string{"listener"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(connectionTransitions, connectionsOpen, connectionLifetime)
+}
+
+// Tracker follows a listener's connections through http.Server's
+// ConnState hook, so connection churn and a pool of idle keep-alives (or of
+// active connections with no room for more) show up independently of the
+// requests on them.
+type Tracker struct {
+	listener string
+	mu       sync.Mutex
+	conns    map[net.Conn]trackedConn
+}
+
+type trackedConn struct {
+	state  http.ConnState
+	opened time.Time
+}
+
+// NewTracker returns a tracker for the connections to listener, which names
+// it in the metrics.
+func NewTracker(listener string) *Tracker {
+	for _, state := range []http.ConnState{http.StateNew, http.StateActive, http.StateIdle} {
+		connectionsOpen.WithLabelValues(listener, state.String()).Set(0)
+	}
+	return &Tracker{listener: listener, conns: map[net.Conn]trackedConn{}}
+}
+
+// ConnState is an http.Server ConnState hook.
+func (t *Tracker) ConnState(conn net.Conn, state http.ConnState) {
+	connectionTransitions.WithLabelValues(t.listener, state.String()).Inc()
+
+	t.mu.Lock()
+	c, known := t.conns[conn]
+	switch state {
+	case http.StateNew:
+		t.conns[conn] = trackedConn{state: state, opened: time.Now()}
+	case http.StateActive, http.StateIdle:
+		t.conns[conn] = trackedConn{state: state, opened: c.opened}
+	default:
+		// Hijacked and closed are final
+		delete(t.conns, conn)
+	}
+	t.mu.Unlock()
+
+	if known {
+		connectionsOpen.WithLabelValues(t.listener, c.state.String()).Dec()
+	}
+	switch state {
+	case http.StateNew, http.StateActive, http.StateIdle:
+		connectionsOpen.WithLabelValues(t.listener, state.String()).Inc()
+	default:
+		if known {
+			connectionLifetime.WithLabelValues(t.listener).Observe(time.Since(c.opened).Seconds())
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Package errreport sends errors and panics to an exception tracker, either a
+// Sentry project (via its DSN) or a local error-aggregator endpoint that
+// accepts JSON events. Events are fingerprinted so repeats of the same error
+// group together, and rate limited per fingerprint so an error storm does not
+// turn into a reporting storm.
+package errreport
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// Count reports by outcome: sent, failed or rate_limited.
+	reportsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "error_reports_total",
+			Help: "Total number of error reports, by outcome.",
+		},
+		[]string{"kind", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(reportsTotal)
+}
+
+// Event is a single error occurrence as sent to the aggregator.
+type Event struct {
+	Fingerprint string            `json:"fingerprint"`
+	Kind        string            `json:"kind"`
+	Type        string            `json:"type"`
+	Message     string            `json:"message"`
+	Stack       string            `json:"stack,omitempty"`
+	Service     string            `json:"service"`
+	TraceID     string            `json:"trace_id,omitempty"`
+	SpanID      string            `json:"span_id,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Timestamp   time.Time         `json:"timestamp"`
+}
+
+// Transport delivers events to an aggregator.
+type Transport interface {
+	Send(ctx context.Context, event Event) error
+}
+
+// NewTransport picks a transport based on which destination is configured.
+// A Sentry DSN takes precedence over a plain aggregator URL. When neither is
+// set a nil transport is returned and reports are only logged.
+func NewTransport(sentryDSN, aggregatorURL string) (Transport, error) {
+	switch {
+	case sentryDSN != "":
+		return newSentryTransport(sentryDSN)
+	case aggregatorURL != "":
+		return &httpTransport{url: aggregatorURL}, nil
+	}
+	return nil, nil
+}
+
+// Reporter fingerprints, rate limits and forwards errors to a Transport.
+// A nil *Reporter is valid and drops everything.
+type Reporter struct {
+	service   string
+	transport Transport
+	limit     int
+	window    time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	start time.Time
+	count int
+}
+
+// New returns a Reporter that forwards at most limit events per fingerprint
+// within each window.
+func New(service string, transport Transport, limit int, window time.Duration) *Reporter {
+	return &Reporter{
+		service:   service,
+		transport: transport,
+		limit:     limit,
+		window:    window,
+		buckets:   make(map[string]*bucket),
+	}
+}
+
+// Report sends err to the aggregator. It never blocks the caller.
+func (r *Reporter) Report(ctx context.Context, err error, tags map[string]string) {
+	if r == nil || err == nil {
+		return
+	}
+	r.report(ctx, "error", fmt.Sprintf("%T", err), err.Error(), "", tags)
+}
+
+// ReportPanic sends a recovered panic value and its stack to the aggregator.
+func (r *Reporter) ReportPanic(ctx context.Context, recovered any, stack []byte, tags map[string]string) {
+	if r == nil {
+		return
+	}
+	r.report(ctx, "panic", fmt.Sprintf("%T", recovered), fmt.Sprint(recovered), string(stack), tags)
+}
+
+func (r *Reporter) report(ctx context.Context, kind, typ, message, stack string, tags map[string]string) {
+	event := Event{
+		Fingerprint: Fingerprint(typ, message, stack),
+		Kind:        kind,
+		Type:        typ,
+		Message:     message,
+		Stack:       stack,
+		Service:     r.service,
+		Tags:        tags,
+		Timestamp:   time.Now(),
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		event.TraceID = sc.TraceID().String()
+		event.SpanID = sc.SpanID().String()
+	}
+
+	if !r.allow(event.Fingerprint, event.Timestamp) {
+		reportsTotal.WithLabelValues(kind, "rate_limited").Inc()
+		return
+	}
+	if r.transport == nil {
+		slog.DebugContext(ctx, "No error aggregator configured, dropping report", "fingerprint", event.Fingerprint)
+		return
+	}
+
+	// Send in the background so reporting never adds to request latency.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		if err := r.transport.Send(ctx, event); err != nil {
+			reportsTotal.WithLabelValues(kind, "failed").Inc()
+			slog.WarnContext(ctx, "Failed to send error report", "fingerprint", event.Fingerprint, logfields.Error(err))
+			return
+		}
+		reportsTotal.WithLabelValues(kind, "sent").Inc()
+	}()
+}
+
+// allow reports whether another event with this fingerprint may be sent in
+// the current window.
+func (r *Reporter) allow(fingerprint string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Once a window, forget the fingerprints whose window is over, so ones
+	// that never come back don't stay in the map for good
+	if now.Sub(r.lastSweep) >= r.window {
+		for fp, b := range r.buckets {
+			if now.Sub(b.start) >= r.window {
+				delete(r.buckets, fp)
+			}
+		}
+		r.lastSweep = now
+	}
+
+	b, ok := r.buckets[fingerprint]
+	if !ok || now.Sub(b.start) >= r.window {
+		r.buckets[fingerprint] = &bucket{start: now, count: 1}
+		return true
+	}
+	if b.count >= r.limit {
+		return false
+	}
+	b.count++
+	return true
+}
+
+var (
+	numbers = regexp.MustCompile(`\d+`)
+	hexIDs  = regexp.MustCompile(`0x[0-9a-fA-F]+`)
+)
+
+// Fingerprint groups errors that only differ in variable parts such as IDs,
+// counts or addresses. For panics the first frame of application code is
+// included so that the same message from two call sites stays separate.
+func Fingerprint(typ, message, stack string) string {
+	normalized := numbers.ReplaceAllString(hexIDs.ReplaceAllString(message, "?"), "?")
+
+	h := sha1.New()
+	h.Write([]byte(typ))
+	h.Write([]byte(normalized))
+	h.Write([]byte(topFrame(stack)))
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// topFrame returns the first function in stack that is not part of the
+// runtime or the panic recovery machinery.
+func topFrame(stack string) string {
+	for _, line := range strings.Split(stack, "\n") {
+		if line == "" || strings.HasPrefix(line, "\t") || strings.HasPrefix(line, "goroutine ") {
+			continue
+		}
+		if strings.HasPrefix(line, "runtime") || strings.HasPrefix(line, "panic(") || strings.Contains(line, "errreport") {
+			continue
+		}
+		if i := strings.LastIndex(line, "("); i > 0 {
+			line = line[:i]
+		}
+		return line
+	}
+	return ""
+}
@@ -0,0 +1,110 @@
+package errreport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// httpTransport posts events as JSON to a local error-aggregator endpoint.
+type httpTransport struct {
+	url string
+}
+
+func (t *httpTransport) Send(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return post(ctx, t.url, body, nil)
+}
+
+// sentryTransport sends events to Sentry's store endpoint, derived from the
+// project DSN (https://<key>@<host>/<project>).
+type sentryTransport struct {
+	storeURL string
+	auth     string
+}
+
+func newSentryTransport(dsn string) (*sentryTransport, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sentry DSN: %w", err)
+	}
+	project := strings.Trim(u.Path, "/")
+	if u.User == nil || project == "" {
+		return nil, fmt.Errorf("invalid sentry DSN: missing key or project")
+	}
+
+	return &sentryTransport{
+		storeURL: fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, project),
+		auth:     fmt.Sprintf("Sentry sentry_version=7, sentry_client=o11y-playground/1.0, sentry_key=%s", u.User.Username()),
+	}, nil
+}
+
+func (t *sentryTransport) Send(ctx context.Context, event Event) error {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	payload := map[string]any{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   event.Timestamp.UTC().Format("2006-01-02T15:04:05.000Z"),
+		"level":       "error",
+		"platform":    "go",
+		"server_name": event.Service,
+		"fingerprint": []string{event.Fingerprint},
+		"tags":        event.Tags,
+		"exception": map[string]any{
+			"values": []map[string]any{{
+				"type":  event.Type,
+				"value": event.Message,
+				"mechanism": map[string]any{
+					"type":    event.Kind,
+					"handled": event.Kind != "panic",
+				},
+			}},
+		},
+	}
+	if event.Stack != "" {
+		payload["extra"] = map[string]string{"stack": event.Stack}
+	}
+	if event.TraceID != "" {
+		payload["contexts"] = map[string]any{
+			"trace": map[string]string{"trace_id": event.TraceID, "span_id": event.SpanID},
+		}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return post(ctx, t.storeURL, body, map[string]string{"X-Sentry-Auth": t.auth})
+}
+
+func post(ctx context.Context, url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+	return nil
+}
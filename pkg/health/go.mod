@@ -0,0 +1,22 @@
+module github.com/j6nca/o11y-playground/pkg/health
+
+go 1.24
+
+require (
+	github.com/j6nca/o11y-playground/pkg/logfields v0.0.0
+	github.com/prometheus/client_golang v1.23.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.2 // indirect
+	github.com/prometheus/common v0.65.0 // indirect
+	github.com/prometheus/procfs v0.17.0 // indirect
+	github.com/stretchr/testify v1.11.1 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	google.golang.org/protobuf v1.36.8 // indirect
+)
+
+replace github.com/j6nca/o11y-playground/pkg/logfields => ../logfields
@@ -0,0 +1,179 @@
+// Package health is a small registry of dependency health checks. Components
+// register a check function for each thing they depend on (a database, a
+// cache, a downstream API, a telemetry exporter) and the registry runs them
+// all on an interval, exporting each dependency's status as metrics and
+// logging whenever one changes state.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Gauge of each dependency's status, 1 when its last check passed.
+	dependencyUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dependency_up",
+			Help: "Whether the last health check of a dependency passed (1) or not (0).",
+		},
+		[]string{"dependency"},
+	)
+
+	// Gauge of how many checks in a row each dependency has failed.
+	dependencyFailures = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dependency_check_consecutive_failures",
+			Help: "Number of consecutive failed health checks of a dependency.",
+		},
+		[]string{"dependency"},
+	)
+
+	// Histogram of health check latencies, by dependency.
+	checkDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "dependency_check_duration_seconds",
+			Help:    "Dependency health check latency in seconds.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"dependency"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(dependencyUp, dependencyFailures, checkDuration)
+}
+
+// CheckFunc reports whether a dependency is healthy by returning nil.
+type CheckFunc func(ctx context.Context) error
+
+// Status is the latest result of a dependency's checks.
+type Status struct {
+	Healthy             bool      `json:"healthy"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastChecked         time.Time `json:"last_checked"`
+}
+
+var (
+	mu       sync.RWMutex
+	checks   = map[string]CheckFunc{}
+	statuses = map[string]Status{}
+)
+
+// Register adds a check for the named dependency. It is unchecked (and so
+// reported unhealthy) until the first round of checks runs.
+func Register(name string, check CheckFunc) {
+	mu.Lock()
+	defer mu.Unlock()
+	checks[name] = check
+	statuses[name] = Status{}
+	dependencyUp.WithLabelValues(name).Set(0)
+	dependencyFailures.WithLabelValues(name).Set(0)
+}
+
+// Start runs every registered check now and then every interval, giving
+// each one timeout to finish.
+func Start(interval, timeout time.Duration) {
+	go func() {
+		for {
+			checkAll(timeout)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// checkAll runs every registered check concurrently and waits for them.
+func checkAll(timeout time.Duration) {
+	mu.RLock()
+	current := make(map[string]CheckFunc, len(checks))
+	for name, check := range checks {
+		current[name] = check
+	}
+	mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for name, check := range current {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(ctx)
+			checkDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+			record(name, err)
+		}()
+	}
+	wg.Wait()
+}
+
+// record stores the result of a check, logging if it changed the
+// dependency's state.
+func record(name string, err error) {
+	mu.Lock()
+	previous := statuses[name]
+	status := Status{Healthy: err == nil, LastChecked: time.Now()}
+	if err != nil {
+		status.ConsecutiveFailures = previous.ConsecutiveFailures + 1
+		status.LastError = err.Error()
+	}
+	statuses[name] = status
+	mu.Unlock()
+
+	if status.Healthy {
+		dependencyUp.WithLabelValues(name).Set(1)
+	} else {
+		dependencyUp.WithLabelValues(name).Set(0)
+	}
+	dependencyFailures.WithLabelValues(name).Set(float64(status.ConsecutiveFailures))
+
+	// A dependency that has never been checked is only logged if it
+	// starts out unhealthy
+	switch {
+	case status.Healthy && !previous.Healthy && !previous.LastChecked.IsZero():
+		slog.Info("Dependency recovered", "dependency", name, "failures", previous.ConsecutiveFailures)
+	case !status.Healthy && (previous.Healthy || previous.LastChecked.IsZero()):
+		slog.Warn("Dependency unhealthy", "dependency", name, logfields.Error(err))
+	}
+}
+
+// Snapshot returns a copy of every dependency's current status.
+func Snapshot() map[string]Status {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	snapshot := make(map[string]Status, len(statuses))
+	for name, status := range statuses {
+		snapshot[name] = status
+	}
+	return snapshot
+}
+
+// Handler reports every dependency's status as JSON, with a 503 if any of
+// them are unhealthy.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snapshot := Snapshot()
+
+		code := http.StatusOK
+		for _, status := range snapshot {
+			if !status.Healthy {
+				code = http.StatusServiceUnavailable
+				break
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(snapshot)
+	})
+}
@@ -0,0 +1,63 @@
+// Package highres measures request latency in fine buckets, for heatmaps
+// that show the shape of the latency between the default buckets.
+package highres
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Histogram of request latency in fine exponential buckets, by route,
+	// for heatmaps.
+	requestLatencyHighRes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "go_app_http_request_duration_highres_seconds",
+			Help: "HTTP request latency in seconds, in exponential buckets about 26% apart from 0.5ms to 30s, by route.",
+			// Classic buckets for backends that only scrape those
+			Buckets: prometheus.ExponentialBucketsRange(0.0005, 30, 48),
+			// And a native histogram, for those that scrape them
+			NativeHistogramBucketFactor:     1.1,
+			NativeHistogramMaxBucketNumber:  160,
+			NativeHistogramMinResetDuration: time.Hour,
+		},
+		[]string{"route"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(requestLatencyHighRes)
+}
+
+// enabled turns on the high resolution latency histogram.
+var enabled bool
+
+// Enable turns on the high resolution latency histogram. Its 48 buckets per
+// route cost more series than go_app_http_request_duration_seconds does, so
+// it is off unless there is latency structure worth seeing.
+func Enable() {
+	enabled = true
+}
+
+// Middleware observes each request's latency in the high
+// resolution histogram, when it is on. Where DefBuckets jump from 100ms to
+// 250ms, these show a heatmap the shape of the latency in between: a
+// second mode from a slow dependency, or the step an injected delay adds.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		requestLatencyHighRes.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,3 @@
+module github.com/j6nca/o11y-playground/pkg/listen
+
+go 1.24
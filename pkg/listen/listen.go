@@ -0,0 +1,97 @@
+// Package listen opens the listeners a service accepts connections on: its
+// app listener, and optionally an admin listener and a Unix socket.
+package listen
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// adminPrefixes are the paths served on the admin listener, when there is
+// one, instead of the app listener.
+var adminPrefixes = []string{"/admin/", "/debug/", "/metrics"}
+
+// Listener is somewhere the service accepts connections, and what it serves
+// there.
+type Listener struct {
+	net.Listener
+	Name    string
+	Handler http.Handler
+}
+
+// Open opens the app listener on appAddr, plus an admin listener on
+// adminAddr and a Unix socket at socketPath if they are set, all serving
+// mux. With a separate admin listener the admin endpoints, pprof and
+// metrics move to it, so it can be bound to an internal interface; the Unix
+// socket serves everything, for sidecars and agents on the same host.
+func Open(appAddr, adminAddr, socketPath string, mux http.Handler) ([]Listener, error) {
+	app, err := net.Listen("tcp", appAddr)
+	if err != nil {
+		return nil, err
+	}
+	listeners := []Listener{{Listener: app, Name: "app", Handler: mux}}
+
+	if adminAddr != "" {
+		admin, err := net.Listen("tcp", adminAddr)
+		if err != nil {
+			Close(listeners)
+			return nil, err
+		}
+		listeners[0].Handler = serveAdmin(false, mux)
+		listeners = append(listeners, Listener{Listener: admin, Name: "admin", Handler: serveAdmin(true, mux)})
+	}
+
+	if socketPath != "" {
+		// A socket left behind by an earlier run would fail the listen
+		if err := os.Remove(socketPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			Close(listeners)
+			return nil, err
+		}
+		unix, err := net.Listen("unix", socketPath)
+		if err != nil {
+			Close(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, Listener{Listener: unix, Name: "unix", Handler: mux})
+	}
+
+	for _, l := range listeners {
+		slog.Info("Listening", "listener", l.Name, "addr", l.Addr().String())
+	}
+	return listeners, nil
+}
+
+// Close closes listeners.
+func Close(listeners []Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// serveAdmin passes on only the admin paths when admin is set, and only the
+// rest when it isn't; anything else is not found.
+func serveAdmin(admin bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if IsAdminPath(r.URL.Path) != admin {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// IsAdminPath reports whether path is served on the admin listener, when
+// there is one.
+func IsAdminPath(path string) bool {
+	for _, prefix := range adminPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+// Package logfields holds the structured logging field names shared by the
+// services, along with typed helpers for building them. Using these instead of
+// ad-hoc keys keeps field names consistent across services, which in turn
+// keeps Loki queries and derived fields working everywhere.
+package logfields
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Field names used across the services.
+const (
+	KeyMethod      = "method"
+	KeyPath        = "path"
+	KeyStatusCode  = "status_code"
+	KeyDurationMS  = "duration_ms"
+	KeyError       = "error"
+	KeyPeerService = "peer_service"
+	KeyProductID   = "product_id"
+)
+
+// Method returns the HTTP request method field.
+func Method(method string) slog.Attr {
+	return slog.String(KeyMethod, method)
+}
+
+// Path returns the HTTP request path field.
+func Path(path string) slog.Attr {
+	return slog.String(KeyPath, path)
+}
+
+// StatusCode returns the HTTP response status code field.
+func StatusCode(code int) slog.Attr {
+	return slog.Int(KeyStatusCode, code)
+}
+
+// Duration returns the duration field, always expressed in milliseconds.
+func Duration(d time.Duration) slog.Attr {
+	return slog.Int64(KeyDurationMS, d.Milliseconds())
+}
+
+// Error returns the error field. A nil error is logged as an empty string.
+func Error(err error) slog.Attr {
+	if err == nil {
+		return slog.String(KeyError, "")
+	}
+	return slog.String(KeyError, err.Error())
+}
+
+// PeerService returns the name of the remote service involved in a call.
+func PeerService(name string) slog.Attr {
+	return slog.String(KeyPeerService, name)
+}
+
+// ProductID returns the ID of the product a record is about.
+func ProductID(id int) slog.Attr {
+	return slog.Int(KeyProductID, id)
+}
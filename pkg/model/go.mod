@@ -0,0 +1,7 @@
+module github.com/j6nca/o11y-playground/pkg/model
+
+go 1.24
+
+require google.golang.org/protobuf v1.36.8
+
+require github.com/google/go-cmp v0.7.0 // indirect
@@ -0,0 +1,42 @@
+// Package model holds the domain types the services exchange, so a product
+// or order decodes the same way on every side of a call. The JSON encoding
+// is defined by the struct tags here, the protobuf one by model.proto, which
+// mirrors these types field for field; keep the two in step.
+package model
+
+import "time"
+
+//go:generate protoc --go_out=. --go_opt=module=github.com/j6nca/o11y-playground/pkg/model model.proto
+
+// Product is an item in the catalog.
+type Product struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Price int    `json:"price"`
+}
+
+// ProductDetail is a product along with the details that take an extra
+// lookup to find.
+type ProductDetail struct {
+	Product
+	Description string `json:"description"`
+	Stock       int    `json:"stock"`
+}
+
+// Employee is a member of staff.
+type Employee struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Position string `json:"position"`
+	// ManagerID is 0 for the top of the org chart
+	ManagerID int `json:"manager_id,omitempty"`
+}
+
+// Order is a customer order for a single product.
+type Order struct {
+	ID        int       `json:"id"`
+	ProductID int       `json:"product_id"`
+	Quantity  int       `json:"quantity"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,166 @@
+// Package overhead measures what a service's own instrumentation costs it:
+// the time each request spends in the telemetry middleware and writing log
+// records, rather than in its handler.
+package overhead
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Histogram of the time each request spends in instrumentation.
+	overheadDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_instrumentation_overhead_seconds",
+			Help:    "Time each request spent in the telemetry middleware and writing log records, rather than in the handler.",
+			Buckets: prometheus.ExponentialBucketsRange(1e-6, 0.01, 14),
+		},
+		[]string{"route"},
+	)
+
+	// Count time spent in instrumentation, by component.
+	overheadComponentSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_instrumentation_overhead_component_seconds_total",
+			Help: "Total time requests spent in instrumentation, by component: otelhttp (server spans and HTTP metrics), tracing, metrics, logging, recording or profiling.",
+		},
+		[]string{"component"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(overheadDuration, overheadComponentSeconds)
+}
+
+// enabled turns on measuring the instrumentation's own cost.
+var enabled bool
+
+// Enable turns on measuring the instrumentation's own cost. It must be
+// called before any handler is instrumented, since Accounted only wraps
+// middleware when it is on.
+func Enable() {
+	enabled = true
+}
+
+// accountKey is the context key for a request's account.
+type accountKey struct{}
+
+// account is a stopwatch for one request that charges time to
+// whichever component is running: the innermost accounted middleware, or a
+// log record being written. Time in the handler and in other middleware
+// isn't charged.
+type account struct {
+	mu    sync.Mutex
+	last  time.Time
+	stack []string
+	spent map[string]time.Duration
+	done  bool
+}
+
+// enter charges the time so far and starts charging component.
+func (a *account) enter(component string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.chargeLocked()
+	a.stack = append(a.stack, component)
+}
+
+// leave charges the time so far and goes back to charging whatever was
+// running before the last enter.
+func (a *account) leave() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.chargeLocked()
+	if len(a.stack) > 0 {
+		a.stack = a.stack[:len(a.stack)-1]
+	}
+}
+
+func (a *account) chargeLocked() {
+	now := time.Now()
+	// A handler a timeout gave up on may still be running; the request
+	// has already been accounted for
+	if !a.done && len(a.stack) > 0 {
+		if top := a.stack[len(a.stack)-1]; top != "" {
+			a.spent[top] += now.Sub(a.last)
+		}
+	}
+	a.last = now
+}
+
+// Account starts an account for each request, and records what it was
+// charged once the request is done. It goes outside everything it accounts
+// for.
+func Account(next http.Handler) http.Handler {
+	if !enabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := &account{last: time.Now(), spent: map[string]time.Duration{}}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), accountKey{}, a)))
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.chargeLocked()
+		a.done = true
+		var total time.Duration
+		for component, spent := range a.spent {
+			overheadComponentSeconds.WithLabelValues(component).Add(spent.Seconds())
+			total += spent
+		}
+		overheadDuration.WithLabelValues(r.Pattern).Observe(total.Seconds())
+	})
+}
+
+// Accounted charges the time a middleware spends before and after calling
+// the next handler to component. The next handler's own time is not
+// charged to it.
+func Accounted(component string, mw func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	if !enabled {
+		return mw
+	}
+	return func(next http.Handler) http.Handler {
+		inner := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if a, ok := r.Context().Value(accountKey{}).(*account); ok {
+				a.enter("")
+				defer a.leave()
+			}
+			next.ServeHTTP(w, r)
+		}))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if a, ok := r.Context().Value(accountKey{}).(*account); ok {
+				a.enter(component)
+				defer a.leave()
+			}
+			inner.ServeHTTP(w, r)
+		})
+	}
+}
+
+// LogHandler charges the time spent writing log records during a
+// request to logging.
+type LogHandler struct {
+	slog.Handler
+}
+
+func (h LogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if a, ok := ctx.Value(accountKey{}).(*account); ok {
+		a.enter("logging")
+		defer a.leave()
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return LogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h LogHandler) WithGroup(name string) slog.Handler {
+	return LogHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,289 @@
+// Package priority admits requests by priority: past a concurrency limit,
+// the rest are queued highest priority first, and the least important are
+// shed under load. A request's priority comes from its X-Priority
+// header, the hint a caller passed on in tracestate, or its route.
+package priority
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/j6nca/o11y-playground/pkg/tracehints"
+)
+
+var (
+	// Histogram of request latency, including time queued, by priority.
+	priorityLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_priority_request_duration_seconds",
+			Help:    "Request latency including admission queueing in seconds, by priority.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"priority"},
+	)
+
+	// Histogram of time spent waiting for admission, by priority.
+	priorityQueueWait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_priority_queue_wait_seconds",
+			Help:    "Time requests spent queued for admission in seconds, by priority.",
+			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		},
+		[]string{"priority"},
+	)
+
+	// Gauge of requests queued for admission, by priority.
+	priorityQueued = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_priority_queued_requests",
+			Help: "Number of requests waiting for admission, by priority.",
+		},
+		[]string{"priority"},
+	)
+
+	// Count requests shed under load, by priority.
+	priorityShed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_priority_shed_total",
+			Help: "Total number of requests shed because the admission queue was full, by priority.",
+		},
+		[]string{"priority"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(priorityLatency, priorityQueueWait, priorityQueued, priorityShed)
+}
+
+// Priority is a request class; lower values are more important.
+type Priority int
+
+const (
+	High Priority = iota
+	Normal
+	Low
+	numPriorities
+)
+
+var names = [numPriorities]string{"high", "normal", "low"}
+
+func (p Priority) String() string {
+	return names[p]
+}
+
+func parse(name string) (Priority, bool) {
+	for p, n := range names {
+		if n == name {
+			return Priority(p), true
+		}
+	}
+	return 0, false
+}
+
+// routes maps mux patterns to their default priority. Requests can ask for
+// another with the X-Priority header.
+var routes = map[string]Priority{}
+
+// Set gives the routes in r their default priorities, replacing any set
+// before. It must be called before requests are served.
+func Set(r map[string]Priority) {
+	routes = r
+}
+
+// Parse parses a ROUTE_PRIORITIES value: comma separated pattern=priority
+// pairs, e.g. "/products/all=low,/orders=high".
+func Parse(spec string) (map[string]Priority, error) {
+	parsed := map[string]Priority{}
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("expected pattern=priority, got %q", entry)
+		}
+		p, ok := parse(strings.TrimSpace(entry[i+1:]))
+		if !ok {
+			return nil, fmt.Errorf("unknown priority in %q, want high, normal or low", entry)
+		}
+		parsed[strings.TrimSpace(entry[:i])] = p
+	}
+	return parsed, nil
+}
+
+// requestPriority is the priority asked for in X-Priority, or else the one
+// the caller passed on in tracestate, or else the route's, or else normal.
+func requestPriority(r *http.Request) Priority {
+	if p, ok := parse(r.Header.Get("X-Priority")); ok {
+		return p
+	}
+	if hint, ok := tracehints.Get(r.Context(), "priority"); ok {
+		if p, ok := parse(hint); ok {
+			return p
+		}
+	}
+	if p, ok := routes[r.Pattern]; ok {
+		return p
+	}
+	return Normal
+}
+
+var errShed = errors.New("shed under load")
+
+// admissionQueue lets limit requests run at once and queues the rest by
+// priority, serving the queue highest priority first. When the queue is
+// full, a newcomer displaces the most recently queued request of a lower
+// priority, or is shed itself if there is none, so under load it is always
+// the least important work that gets turned away.
+type admissionQueue struct {
+	mu        sync.Mutex
+	limit     int
+	queueSize int
+	active    int
+	queued    int
+	waiting   [numPriorities][]chan bool
+}
+
+// admissions is nil (admitting everything) unless a limit is configured.
+var admissions *admissionQueue
+
+// SetLimit lets limit requests run at once, queueing up to queueSize more by
+// priority. It must be called before requests are served.
+func SetLimit(limit, queueSize int) {
+	admissions = &admissionQueue{limit: limit, queueSize: queueSize}
+}
+
+// Acquire waits for a slot for a request of priority p. It returns errShed
+// if the request was shed, or ctx's error if the caller gave up first.
+func (q *admissionQueue) Acquire(ctx context.Context, p Priority) error {
+	q.mu.Lock()
+	if q.active < q.limit {
+		q.active++
+		q.mu.Unlock()
+		return nil
+	}
+	if q.queued >= q.queueSize && !q.displace(p) {
+		q.mu.Unlock()
+		return errShed
+	}
+	// Admitted or shed is sent on the channel, buffered so the sender never
+	// waits on a request that is giving up
+	ready := make(chan bool, 1)
+	q.waiting[p] = append(q.waiting[p], ready)
+	q.queued++
+	priorityQueued.WithLabelValues(p.String()).Inc()
+	q.mu.Unlock()
+
+	select {
+	case admitted := <-ready:
+		if !admitted {
+			return errShed
+		}
+		return nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		removed := q.remove(p, ready)
+		q.mu.Unlock()
+		if !removed && <-ready {
+			// Admitted just as we gave up, so hand the slot on
+			q.Release()
+		}
+		return ctx.Err()
+	}
+}
+
+// displace sheds the newest waiter of the lowest priority below p, to make
+// room for a request of priority p. The caller must hold mu.
+func (q *admissionQueue) displace(p Priority) bool {
+	for lower := numPriorities - 1; lower > p; lower-- {
+		if n := len(q.waiting[lower]); n > 0 {
+			victim := q.waiting[lower][n-1]
+			q.waiting[lower] = q.waiting[lower][:n-1]
+			q.queued--
+			priorityQueued.WithLabelValues(lower.String()).Dec()
+			victim <- false
+			return true
+		}
+	}
+	return false
+}
+
+// remove takes ready out of the queue, reporting false if it had already
+// been admitted or shed. The caller must hold mu.
+func (q *admissionQueue) remove(p Priority, ready chan bool) bool {
+	for i, w := range q.waiting[p] {
+		if w == ready {
+			q.waiting[p] = append(q.waiting[p][:i], q.waiting[p][i+1:]...)
+			q.queued--
+			priorityQueued.WithLabelValues(p.String()).Dec()
+			return true
+		}
+	}
+	return false
+}
+
+// Release frees a slot, handing it to the longest waiting request of the
+// highest priority, if any.
+func (q *admissionQueue) Release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for p := High; p < numPriorities; p++ {
+		if len(q.waiting[p]) > 0 {
+			next := q.waiting[p][0]
+			q.waiting[p] = q.waiting[p][1:]
+			q.queued--
+			priorityQueued.WithLabelValues(p.String()).Dec()
+			next <- true
+			return
+		}
+	}
+	q.active--
+}
+
+// Middleware admits requests through the admission queue, failing the ones
+// it sheds with a 503 through fail, and records latency by priority.
+func Middleware(fail func(w http.ResponseWriter, r *http.Request, err error, code int)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Pass the priority on, so the services this calls queue it the same
+			p := requestPriority(r)
+			r = r.WithContext(tracehints.With(r.Context(), "priority", p.String()))
+			if admissions == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			start := time.Now()
+			span := trace.SpanFromContext(r.Context())
+			span.SetAttributes(attribute.String("request.priority", p.String()))
+
+			err := admissions.Acquire(r.Context(), p)
+			wait := time.Since(start)
+			priorityQueueWait.WithLabelValues(p.String()).Observe(wait.Seconds())
+			span.SetAttributes(attribute.Int64("request.queue_wait_ms", wait.Milliseconds()))
+			if errors.Is(err, errShed) {
+				priorityShed.WithLabelValues(p.String()).Inc()
+				w.Header().Set("Retry-After", "1")
+				fail(w, r, fmt.Errorf("%s priority request %w", p, err), http.StatusServiceUnavailable)
+				return
+			}
+			if err != nil {
+				// The caller gave up while queued
+				return
+			}
+			defer admissions.Release()
+
+			next.ServeHTTP(w, r)
+			priorityLatency.WithLabelValues(p.String()).Observe(time.Since(start).Seconds())
+		})
+	}
+}
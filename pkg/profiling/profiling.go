@@ -0,0 +1,173 @@
+// Package profiling configures continuous profiling: which profile types
+// are collected, at what sample rates, and who may pull them from
+// /debug/pprof/.
+package profiling
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+
+	"github.com/grafana/pyroscope-go"
+	// Delta heap, mutex and block profiles at /debug/pprof/delta_*, what
+	// Alloy's godeltaprof scrapes expect, so pulled profiles match pushed
+	// ones
+	_ "github.com/grafana/pyroscope-go/godeltaprof/http/pprof"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Profiling modes: push uploads profiles to Pyroscope with its SDK, pull
+// leaves them at /debug/pprof/ for Alloy or Pyroscope to scrape.
+const (
+	Push = "push"
+	Pull = "pull"
+)
+
+var (
+	// Gauge of the profiling mode in use.
+	profilingMode = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_profiling_mode",
+			Help: "The profiling mode in use (1): push to Pyroscope, or pull from /debug/pprof/.",
+		},
+		[]string{"mode"},
+	)
+
+	// Gauge of the profile types collected.
+	profileTypeEnabled = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_profiling_type_enabled",
+			Help: "Whether each profile type is collected (1) or not (0).",
+		},
+		[]string{"type"},
+	)
+
+	// Gauge of the runtime's profile sample rates.
+	profileSampleRate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_profiling_sample_rate",
+			Help: "Profile sample rates: bytes allocated per memory sample, 1 in how many mutex contention events, and nanoseconds blocked per block event. 0 is off.",
+		},
+		[]string{"type"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(profilingMode, profileTypeEnabled, profileSampleRate)
+}
+
+// profileTypes are the profile types PROFILE_TYPES can turn on, and what
+// Pyroscope collects for each.
+var profileTypes = []struct {
+	name  string
+	types []pyroscope.ProfileType
+}{
+	{"cpu", []pyroscope.ProfileType{pyroscope.ProfileCPU}},
+	{"alloc", []pyroscope.ProfileType{pyroscope.ProfileAllocObjects, pyroscope.ProfileAllocSpace}},
+	{"inuse", []pyroscope.ProfileType{pyroscope.ProfileInuseObjects, pyroscope.ProfileInuseSpace}},
+	{"goroutines", []pyroscope.ProfileType{pyroscope.ProfileGoroutines}},
+	{"mutex", []pyroscope.ProfileType{pyroscope.ProfileMutexCount, pyroscope.ProfileMutexDuration}},
+	{"block", []pyroscope.ProfileType{pyroscope.ProfileBlockCount, pyroscope.ProfileBlockDuration}},
+}
+
+// ParseTypes parses a PROFILE_TYPES value, a comma separated list of
+// profile types such as "cpu,alloc,inuse", into the set it turns on.
+func ParseTypes(spec string) (map[string]bool, error) {
+	enabled := map[string]bool{}
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, t := range profileTypes {
+			known = known || t.name == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown profile type %q, expected cpu, alloc, inuse, goroutines, mutex or block", name)
+		}
+		enabled[name] = true
+	}
+	return enabled, nil
+}
+
+// Rates are how often the runtime samples the profiles that are sampled as
+// they happen, rather than over an interval as CPU is.
+type Rates struct {
+	MemBytes      int
+	MutexFraction int
+	BlockNanos    int
+}
+
+// Apply sets the runtime's sample rates for the enabled profile types,
+// turning off mutex and block sampling when they aren't, since their cost
+// is paid while sampling whether or not anything collects them. It returns
+// the Pyroscope profile types to push.
+func Apply(enabled map[string]bool, rates Rates) []pyroscope.ProfileType {
+	var types []pyroscope.ProfileType
+	for _, t := range profileTypes {
+		if enabled[t.name] {
+			profileTypeEnabled.WithLabelValues(t.name).Set(1)
+			types = append(types, t.types...)
+		} else {
+			profileTypeEnabled.WithLabelValues(t.name).Set(0)
+		}
+	}
+
+	// Memory sampling is always on in the runtime, so the rate is set
+	// whatever is collected
+	if rates.MemBytes > 0 {
+		runtime.MemProfileRate = rates.MemBytes
+	}
+	profileSampleRate.WithLabelValues("memory").Set(float64(runtime.MemProfileRate))
+	mutex, block := 0, 0
+	if enabled["mutex"] {
+		mutex = rates.MutexFraction
+	}
+	if enabled["block"] {
+		block = rates.BlockNanos
+	}
+	runtime.SetMutexProfileFraction(mutex)
+	runtime.SetBlockProfileRate(block)
+	profileSampleRate.WithLabelValues("mutex").Set(float64(mutex))
+	profileSampleRate.WithLabelValues("block").Set(float64(block))
+	return types
+}
+
+// ParseMode checks a PROFILING_MODE value.
+func ParseMode(mode string) (string, error) {
+	switch mode {
+	case Push, Pull:
+		return mode, nil
+	}
+	return "", fmt.Errorf("expected %s or %s, got %q", Push, Pull, mode)
+}
+
+// SetMode records mode as the profiling mode in use.
+func SetMode(mode string) {
+	profilingMode.WithLabelValues(mode).Set(1)
+}
+
+// RequireToken only lets requests for /debug/pprof/ through if they carry
+// token as a bearer token, which is what a scraper is configured with,
+// failing the rest through fail. When token is empty the profiles are open
+// to anyone who can reach the service, as the admin endpoints are without
+// an admin token. net/http/pprof registers its handlers on the default mux
+// itself, so this wraps the mux rather than them.
+func RequireToken(token string, fail func(w http.ResponseWriter, r *http.Request, err error, code int)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token != "" && strings.HasPrefix(r.URL.Path, "/debug/pprof/") {
+				given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+				if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+					fail(w, r, errors.New("pprof token required"), http.StatusUnauthorized)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
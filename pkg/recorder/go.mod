@@ -0,0 +1,7 @@
+module github.com/j6nca/o11y-playground/pkg/recorder
+
+go 1.24
+
+require github.com/j6nca/o11y-playground/pkg/logfields v0.0.0
+
+replace github.com/j6nca/o11y-playground/pkg/logfields => ../logfields
@@ -0,0 +1,88 @@
+// Package recorder records the requests a service receives, as JSON lines
+// that o11yctl replay can send again.
+package recorder
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+// Request is one line of a traffic recording. o11yctl replay reads the
+// same format back.
+type Request struct {
+	Time    time.Time           `json:"time"`
+	Service string              `json:"service"`
+	Method  string              `json:"method"`
+	Path    string              `json:"path"`
+	Headers map[string][]string `json:"headers,omitempty"`
+}
+
+// unrecordedHeaders are left out of recordings: credentials have no business
+// in a file that gets passed around, and replayed requests should start
+// traces of their own.
+var unrecordedHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+	"Traceparent":   true,
+	"Tracestate":    true,
+}
+
+// trafficRecorder appends every request it sees to a file as JSON lines.
+type trafficRecorder struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	service string
+}
+
+// recorder is nil (and recording off) until Start is called.
+var recorder *trafficRecorder
+
+// Start records the requests service receives from now on to path,
+// appending to it and creating it if needed. It must be called before
+// requests are served.
+func Start(path, service string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	recorder = &trafficRecorder{enc: json.NewEncoder(f), service: service}
+	return nil
+}
+
+// Middleware records each request on its way in, when recording is on.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if recorder != nil {
+			recorder.record(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (t *trafficRecorder) record(r *http.Request) {
+	headers := map[string][]string{}
+	for name, values := range r.Header {
+		if !unrecordedHeaders[name] {
+			headers[name] = values
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err := t.enc.Encode(Request{
+		Time:    time.Now(),
+		Service: t.service,
+		Method:  r.Method,
+		Path:    r.URL.RequestURI(),
+		Headers: headers,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to record request", logfields.Path(r.URL.Path), logfields.Error(err))
+	}
+}
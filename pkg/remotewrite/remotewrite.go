@@ -0,0 +1,449 @@
+// Package remotewrite pushes a service's metrics to a Prometheus remote
+// write endpoint, such as Mimir, Grafana Cloud or vminsert, rather than
+// waiting for them to be scraped.
+package remotewrite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+	"github.com/klauspost/compress/s2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	// Count remote write requests, by status code.
+	remoteWriteRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_remote_write_requests_total",
+			Help: "Total number of remote write requests, by status code (error when no response came back).",
+		},
+		[]string{"status_code"},
+	)
+
+	// Histogram of remote write request latency.
+	remoteWriteDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "go_app_remote_write_request_duration_seconds",
+			Help:    "Remote write request latency in seconds.",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
+	// Count samples written.
+	remoteWriteSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "go_app_remote_write_samples_sent_total",
+			Help: "Total number of samples the remote write endpoint accepted.",
+		},
+	)
+
+	// Count samples given up on, by reason.
+	remoteWriteDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_remote_write_samples_dropped_total",
+			Help: "Total number of samples given up on, by reason: rejected by the endpoint with a 4xx, or wal_full when the WAL outgrew its limit before they could be sent.",
+		},
+		[]string{"reason"},
+	)
+
+	// Gauges of the WAL's size.
+	remoteWriteWALBatches = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_remote_write_wal_batches",
+			Help: "Number of batches in the remote write WAL waiting to be sent.",
+		},
+	)
+	remoteWriteWALBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_remote_write_wal_bytes",
+			Help: "Bytes of batches in the remote write WAL waiting to be sent.",
+		},
+	)
+
+	// Gauge of how far behind remote write is.
+	remoteWriteLag = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_remote_write_lag_seconds",
+			Help: "Age of the oldest batch in the remote write WAL, 0 when it is empty.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(remoteWriteRequests, remoteWriteDuration, remoteWriteSamples, remoteWriteDropped,
+		remoteWriteWALBatches, remoteWriteWALBytes, remoteWriteLag)
+}
+
+// maxBackoff caps the wait between retries of a failing batch.
+const maxBackoff = 30 * time.Second
+
+// Writer pushes the default registry's metrics to a remote write endpoint.
+// Each interval the registry is gathered into a batch and appended to a WAL
+// on disk. A sender works through the WAL oldest first, retrying 5xx and
+// 429 responses with backoff, so an outage or a restart delays samples
+// rather than losing them, up to the WAL's size limit.
+type Writer struct {
+	// Client sends the write requests. Its Transport can be wrapped, to
+	// count what is sent, before Run is called.
+	Client *http.Client
+
+	url      string
+	username string
+	password string
+	labels   [][2]string
+	interval time.Duration
+	wal      *writeAheadLog
+}
+
+// New returns a Writer that sends to url every interval, adding labels to
+// every series. Batches wait in walDir until they are sent, picking up any
+// a previous run left there, and the oldest are dropped once the WAL holds
+// more than walMaxBytes.
+func New(url, username, password string, labels map[string]string, interval time.Duration, walDir string, walMaxBytes int64) (*Writer, error) {
+	wal, err := openWAL(walDir, walMaxBytes)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{
+		Client:   &http.Client{Timeout: 30 * time.Second},
+		url:      url,
+		username: username,
+		password: password,
+		interval: interval,
+		wal:      wal,
+	}
+	for name, value := range labels {
+		w.labels = append(w.labels, [2]string{name, value})
+	}
+	return w, nil
+}
+
+// Run gathers and sends metrics until the process exits.
+func (w *Writer) Run() {
+	go w.send()
+	for range time.Tick(w.interval) {
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			slog.Warn("Failed to gather metrics for remote write:", logfields.Error(err))
+		}
+		body, samples := encodeWriteRequest(families, w.labels, time.Now())
+		if err := w.wal.Append(s2.EncodeSnappy(nil, body), samples); err != nil {
+			slog.Error("Failed to write remote write WAL:", logfields.Error(err))
+		}
+	}
+}
+
+// send works through the WAL, oldest batch first.
+func (w *Writer) send() {
+	backoff := time.Second
+	for {
+		batch, ok := w.wal.Oldest()
+		if !ok {
+			w.wal.Wait()
+			continue
+		}
+		body, err := os.ReadFile(batch.path)
+		if err != nil {
+			slog.Error("Dropping unreadable remote write batch:", logfields.Error(err))
+			w.wal.Remove(batch)
+			continue
+		}
+
+		retry, err := w.post(body)
+		switch {
+		case err == nil:
+			remoteWriteSamples.Add(float64(batch.samples))
+			w.wal.Remove(batch)
+			backoff = time.Second
+		case retry:
+			slog.Warn("Remote write failed, retrying:", logfields.Error(err), "retry_in", backoff.String())
+			time.Sleep(backoff)
+			backoff = min(backoff*2, maxBackoff)
+		default:
+			slog.Error("Remote write rejected, dropping batch:", logfields.Error(err), "samples", batch.samples)
+			remoteWriteDropped.WithLabelValues("rejected").Add(float64(batch.samples))
+			w.wal.Remove(batch)
+		}
+	}
+}
+
+// post sends one batch, reporting whether a failure is worth retrying: the
+// remote write spec has senders retry 5xx and 429, and drop other 4xx.
+func (w *Writer) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.username != "" {
+		req.SetBasicAuth(w.username, w.password)
+	}
+
+	start := time.Now()
+	resp, err := w.Client.Do(req)
+	remoteWriteDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		remoteWriteRequests.WithLabelValues("error").Inc()
+		return true, err
+	}
+	defer resp.Body.Close()
+	remoteWriteRequests.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("remote write returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// walBatch is a batch in the WAL. Its file is named
+// <sequence>-<unix ms>-<samples>, so the WAL can be rebuilt from a listing.
+type walBatch struct {
+	path    string
+	seq     uint64
+	written time.Time
+	samples int
+	size    int64
+}
+
+// writeAheadLog keeps batches on disk until they are sent, a file each,
+// dropping the oldest when it grows past maxBytes.
+type writeAheadLog struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	batches []walBatch
+	bytes   int64
+	nextSeq uint64
+	ready   chan struct{}
+}
+
+// openWAL opens the WAL in dir, picking up any batches a
+// previous run left unsent.
+func openWAL(dir string, maxBytes int64) (*writeAheadLog, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create remote write WAL: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read remote write WAL: %w", err)
+	}
+	wal := &writeAheadLog{dir: dir, maxBytes: maxBytes, ready: make(chan struct{}, 1)}
+	for _, entry := range entries {
+		var seq uint64
+		var ms int64
+		var samples int
+		if _, err := fmt.Sscanf(entry.Name(), "%d-%d-%d", &seq, &ms, &samples); err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		wal.batches = append(wal.batches, walBatch{
+			path: filepath.Join(dir, entry.Name()), seq: seq, written: time.UnixMilli(ms), samples: samples, size: info.Size(),
+		})
+		wal.bytes += info.Size()
+		wal.nextSeq = max(wal.nextSeq, seq+1)
+	}
+	sort.Slice(wal.batches, func(i, j int) bool { return wal.batches[i].seq < wal.batches[j].seq })
+	if len(wal.batches) > 0 {
+		slog.Info("Resuming remote write WAL", "batches", len(wal.batches), "bytes", wal.bytes)
+	}
+	wal.updateMetricsLocked()
+	return wal, nil
+}
+
+// Append adds a batch to the WAL, then drops the oldest batches while the
+// WAL is over its limit.
+func (w *writeAheadLog) Append(body []byte, samples int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	batch := walBatch{seq: w.nextSeq, written: now, samples: samples, size: int64(len(body))}
+	batch.path = filepath.Join(w.dir, fmt.Sprintf("%020d-%d-%d", batch.seq, now.UnixMilli(), samples))
+	if err := os.WriteFile(batch.path, body, 0o644); err != nil {
+		return err
+	}
+	w.nextSeq++
+	w.batches = append(w.batches, batch)
+	w.bytes += batch.size
+
+	for w.bytes > w.maxBytes && len(w.batches) > 1 {
+		oldest := w.batches[0]
+		remoteWriteDropped.WithLabelValues("wal_full").Add(float64(oldest.samples))
+		w.removeLocked(oldest)
+	}
+	w.updateMetricsLocked()
+
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Oldest returns the oldest batch, if there is one.
+func (w *writeAheadLog) Oldest() (walBatch, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.updateMetricsLocked()
+	if len(w.batches) == 0 {
+		return walBatch{}, false
+	}
+	return w.batches[0], true
+}
+
+// Wait blocks until a batch is appended.
+func (w *writeAheadLog) Wait() {
+	<-w.ready
+}
+
+// Remove removes a batch, if it is still there: the WAL may have dropped
+// it for space while it was being sent.
+func (w *writeAheadLog) Remove(batch walBatch) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.removeLocked(batch)
+	w.updateMetricsLocked()
+}
+
+func (w *writeAheadLog) removeLocked(batch walBatch) {
+	for i, b := range w.batches {
+		if b.seq == batch.seq {
+			w.batches = append(w.batches[:i], w.batches[i+1:]...)
+			w.bytes -= b.size
+			if err := os.Remove(b.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				slog.Warn("Failed to remove remote write batch:", logfields.Error(err))
+			}
+			return
+		}
+	}
+}
+
+func (w *writeAheadLog) updateMetricsLocked() {
+	remoteWriteWALBatches.Set(float64(len(w.batches)))
+	remoteWriteWALBytes.Set(float64(w.bytes))
+	if len(w.batches) == 0 {
+		remoteWriteLag.Set(0)
+	} else {
+		remoteWriteLag.Set(time.Since(w.batches[0].written).Seconds())
+	}
+}
+
+// encodeWriteRequest encodes metric families as a remote write
+// WriteRequest, returning it and the number of samples in it. Every
+// series gets the extra labels, and the timestamp at.
+//
+// The protobuf is written by hand with protowire, which takes three small
+// messages rather than pulling in prompb and the Prometheus server module:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(families []*dto.MetricFamily, extra [][2]string, at time.Time) ([]byte, int) {
+	ts := at.UnixMilli()
+	var req []byte
+	samples := 0
+	add := func(name string, pairs []*dto.LabelPair, value float64, more ...[2]string) {
+		labels := make([][2]string, 0, len(pairs)+len(extra)+len(more)+1)
+		labels = append(labels, [2]string{"__name__", name})
+		for _, pair := range pairs {
+			labels = append(labels, [2]string{pair.GetName(), pair.GetValue()})
+		}
+		labels = append(labels, extra...)
+		labels = append(labels, more...)
+		// Receivers require labels sorted by name
+		sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+
+		var series []byte
+		for _, label := range labels {
+			var l []byte
+			l = protowire.AppendTag(l, 1, protowire.BytesType)
+			l = protowire.AppendString(l, label[0])
+			l = protowire.AppendTag(l, 2, protowire.BytesType)
+			l = protowire.AppendString(l, label[1])
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, l)
+		}
+		var s []byte
+		s = protowire.AppendTag(s, 1, protowire.Fixed64Type)
+		s = protowire.AppendFixed64(s, math.Float64bits(value))
+		s = protowire.AppendTag(s, 2, protowire.VarintType)
+		s = protowire.AppendVarint(s, uint64(ts))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, s)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, series)
+		samples++
+	}
+
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.GetMetric() {
+			labels := m.GetLabel()
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, labels, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, labels, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, labels, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add(name+"_bucket", labels, float64(b.GetCumulativeCount()), [2]string{"le", strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64)})
+				}
+				add(name+"_bucket", labels, float64(h.GetSampleCount()), [2]string{"le", "+Inf"})
+				add(name+"_sum", labels, h.GetSampleSum())
+				add(name+"_count", labels, float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(name, labels, q.GetValue(), [2]string{"quantile", strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64)})
+				}
+				add(name+"_sum", labels, s.GetSampleSum())
+				add(name+"_count", labels, float64(s.GetSampleCount()))
+			}
+		}
+	}
+	return req, samples
+}
+
+// ParseLabels parses a REMOTE_WRITE_LABELS value: comma separated
+// name=value pairs, e.g. "source=remote_write,env=dev".
+func ParseLabels(spec string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("expected name=value, got %q", entry)
+		}
+		labels[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return labels, nil
+}
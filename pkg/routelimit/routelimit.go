@@ -0,0 +1,120 @@
+// Package routelimit caps how many requests to a route run at once, so a
+// burst on one expensive endpoint queues up on that endpoint instead of
+// taking the CPU (or connections, or memory) every other endpoint needs.
+package routelimit
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// Gauge of the fraction of a route's concurrency cap in use.
+	routeSaturation = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_route_concurrency_saturation",
+			Help: "Fraction of a route's concurrency cap in use, 1 when every slot is taken.",
+		},
+		[]string{"route"},
+	)
+
+	// Gauge of requests waiting for one of a route's slots.
+	routeWaiting = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_route_concurrency_waiting",
+			Help: "Number of requests waiting for a free slot on their route.",
+		},
+		[]string{"route"},
+	)
+
+	// Histogram of how long requests waited for a slot on their route.
+	routeSlotWait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_route_concurrency_wait_seconds",
+			Help:    "Time requests waited for a free slot on their route in seconds.",
+			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"route"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(routeSaturation, routeWaiting, routeSlotWait)
+}
+
+// routeSlots holds a semaphore for each route with a concurrency cap.
+var routeSlots = map[string]chan struct{}{}
+
+// Set caps the routes in limits at their number of concurrent requests,
+// replacing any caps set before. It must be called before requests are
+// served.
+func Set(limits map[string]int) {
+	routeSlots = map[string]chan struct{}{}
+	for route, limit := range limits {
+		routeSlots[route] = make(chan struct{}, limit)
+		routeSaturation.WithLabelValues(route).Set(0)
+	}
+}
+
+// Parse parses a ROUTE_CONCURRENCY value: comma separated pattern=limit
+// pairs, e.g. "/products=2,/search=4".
+func Parse(spec string) (map[string]int, error) {
+	parsed := map[string]int{}
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("expected pattern=limit, got %q", entry)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(entry[i+1:]))
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid limit in %q", entry)
+		}
+		parsed[strings.TrimSpace(entry[:i])] = limit
+	}
+	return parsed, nil
+}
+
+// Middleware runs requests to a capped route in one of its slots. Requests
+// wait for a slot for as long as their context allows.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slots, ok := routeSlots[r.Pattern]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		route := r.Pattern
+		start := time.Now()
+		routeWaiting.WithLabelValues(route).Inc()
+		select {
+		case slots <- struct{}{}:
+			routeWaiting.WithLabelValues(route).Dec()
+		case <-r.Context().Done():
+			// Gave up waiting, or ran out of route timeout doing so
+			routeWaiting.WithLabelValues(route).Dec()
+			routeSlotWait.WithLabelValues(route).Observe(time.Since(start).Seconds())
+			return
+		}
+		wait := time.Since(start)
+		routeSlotWait.WithLabelValues(route).Observe(wait.Seconds())
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.Int64("route.slot_wait_ms", wait.Milliseconds()))
+
+		routeSaturation.WithLabelValues(route).Set(float64(len(slots)) / float64(cap(slots)))
+		defer func() {
+			<-slots
+			routeSaturation.WithLabelValues(route).Set(float64(len(slots)) / float64(cap(slots)))
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
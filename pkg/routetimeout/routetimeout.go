@@ -0,0 +1,245 @@
+// Package routetimeout gives each route a timeout of its own, like
+// http.TimeoutHandler, but without holding streamed responses back. Routes
+// are mux patterns, and a request over its route's timeout gets a 503 naming
+// the route, or has its connection aborted if part of the response has
+// already gone out.
+package routetimeout
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Count requests cut off by their route's timeout, by route and by
+	// whether the caller got a clean 503 or a truncated response.
+	routeTimeouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_http_route_timeouts_total",
+			Help: "Total number of requests that exceeded their route's timeout, by route and response (503 or partial).",
+		},
+		[]string{"route", "response"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(routeTimeouts)
+}
+
+// timeouts maps mux patterns to how long their handlers may run. Routes
+// without an entry have no timeout.
+var timeouts = map[string]time.Duration{}
+
+// Set gives the routes in t their timeouts, replacing any set before. It
+// must be called before requests are served.
+func Set(t map[string]time.Duration) {
+	timeouts = t
+}
+
+// Parse parses a ROUTE_TIMEOUTS value: comma separated pattern=duration
+// pairs, e.g. "/products=2s,GET /catalog/{id}=500ms".
+func Parse(spec string) (map[string]time.Duration, error) {
+	parsed := map[string]time.Duration{}
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("expected pattern=duration, got %q", entry)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(entry[i+1:]))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid timeout in %q", entry)
+		}
+		parsed[strings.TrimSpace(entry[:i])] = d
+	}
+	return parsed, nil
+}
+
+// Panic is a panic in a handler running under a timeout, passed on to the
+// goroutine serving the request with the stack it was raised on, since the
+// stack there would only show the middleware.
+type Panic struct {
+	Value any
+	Stack []byte
+}
+
+func (p *Panic) Error() string {
+	return fmt.Sprint(p.Value)
+}
+
+// Middleware gives each handler its route's timeout, like
+// http.TimeoutHandler: the handler runs with a deadline on its context, and
+// if it hasn't finished by then the caller gets a 503 naming the route
+// instead, counted with count. Unlike http.TimeoutHandler it doesn't hold
+// streamed responses back: the response is buffered only until the handler
+// first flushes, and a timeout after that can no longer become a 503, so the
+// connection is aborted and the response counted as partial. A panic in the
+// handler is raised again as a *Panic, except http.ErrAbortHandler, which is
+// raised as it is.
+func Middleware(count func(r *http.Request, code int)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeout, ok := timeouts[r.Pattern]
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+
+			tw := &timeoutWriter{w: w, h: http.Header{}, code: http.StatusOK}
+			done := make(chan struct{})
+			panicked := make(chan any, 1)
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						if p == http.ErrAbortHandler {
+							panicked <- p
+							return
+						}
+						panicked <- &Panic{Value: p, Stack: debug.Stack()}
+					}
+				}()
+				next.ServeHTTP(tw, r)
+				close(done)
+			}()
+
+			select {
+			case p := <-panicked:
+				// Raised again here so whatever recovers panics sees it
+				panic(p)
+			case <-done:
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.commit()
+			case <-ctx.Done():
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.timedOut = true
+				if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					// The caller went away, there is nobody to answer
+					return
+				}
+				timedOut(w, r, tw.committed, timeout, count)
+			}
+		})
+	}
+}
+
+// timedOut records a timeout and answers it, with a 503 if nothing has been
+// sent yet or by aborting the connection if part of the response has.
+func timedOut(w http.ResponseWriter, r *http.Request, committed bool, timeout time.Duration, count func(r *http.Request, code int)) {
+	ctx := r.Context()
+	response := "503"
+	if committed {
+		response = "partial"
+	}
+	routeTimeouts.WithLabelValues(r.Pattern, response).Inc()
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Int64("http.route_timeout_ms", timeout.Milliseconds()), attribute.String("http.timeout_response", response))
+	span.SetStatus(codes.Error, "DeadlineExceeded")
+	slog.WarnContext(ctx, "Request exceeded route timeout", logfields.Path(r.URL.Path), "route", r.Pattern, "timeout", timeout.String(), "response", response)
+
+	if committed {
+		// Too late for a status code, so make the truncation unmistakable
+		panic(http.ErrAbortHandler)
+	}
+	count(r, http.StatusServiceUnavailable)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error":      "request timed out",
+		"route":      r.Pattern,
+		"timeout_ms": timeout.Milliseconds(),
+	})
+}
+
+// timeoutWriter buffers a response until the handler finishes or flushes,
+// so that a timeout before then can still replace it with a 503. Once the
+// handler has timed out, its writes fail with http.ErrHandlerTimeout.
+type timeoutWriter struct {
+	mu          sync.Mutex
+	w           http.ResponseWriter
+	h           http.Header
+	buf         bytes.Buffer
+	code        int
+	wroteHeader bool
+	committed   bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.h
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader, tw.code = true, code
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.wroteHeader = true
+	if tw.committed {
+		return tw.w.Write(p)
+	}
+	return tw.buf.Write(p)
+}
+
+// Flush commits the response so far to the client; it can't be taken back
+// after this.
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.commit()
+	http.NewResponseController(tw.w).Flush()
+}
+
+// commit sends the status, headers and buffered body on, if they haven't
+// been already. The caller must hold mu.
+func (tw *timeoutWriter) commit() {
+	if !tw.committed {
+		for name, values := range tw.h {
+			tw.w.Header()[name] = values
+		}
+		tw.w.WriteHeader(tw.code)
+		tw.committed = true
+	}
+	if tw.buf.Len() > 0 {
+		tw.w.Write(tw.buf.Bytes())
+		tw.buf.Reset()
+	}
+}
@@ -0,0 +1,90 @@
+// Package servicegraph counts the calls between services from their client
+// spans, so a service graph panel can be built from Prometheus alone,
+// without Tempo's metrics-generator.
+package servicegraph
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// Count calls between services, one series per edge of the service
+	// graph.
+	serviceGraphCalls = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "client_server_calls_total",
+			Help: "Total number of calls made from client to server, taken from finished client spans, by status (ok or error).",
+		},
+		[]string{"client", "server", "status"},
+	)
+
+	// Histogram of call latency between services, as the client saw it.
+	serviceGraphLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "client_server_call_duration_seconds",
+			Help:    "Latency of calls from client to server in seconds, taken from finished client spans.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"client", "server"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(serviceGraphCalls, serviceGraphLatency)
+}
+
+// processor turns finished client spans into service graph edges.
+type processor struct {
+	client string
+}
+
+// NewProcessor returns a span processor recording the calls client makes.
+// Each service only reports the calls it makes, which between them cover
+// every edge.
+func NewProcessor(client string) sdktrace.SpanProcessor {
+	return processor{client: client}
+}
+
+func (p processor) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+
+func (p processor) OnEnd(s sdktrace.ReadOnlySpan) {
+	if s.SpanKind() != trace.SpanKindClient {
+		return
+	}
+	server := spanServer(s.Attributes())
+	if server == "" {
+		return
+	}
+
+	status := "ok"
+	if s.Status().Code == codes.Error {
+		status = "error"
+	}
+	serviceGraphCalls.WithLabelValues(p.client, server, status).Inc()
+	serviceGraphLatency.WithLabelValues(p.client, server).Observe(s.EndTime().Sub(s.StartTime()).Seconds())
+}
+
+func (p processor) Shutdown(context.Context) error   { return nil }
+func (p processor) ForceFlush(context.Context) error { return nil }
+
+// spanServer names the service a client span called, preferring an explicit
+// peer.service over the address it was sent to, which in docker-compose is
+// the service name anyway.
+func spanServer(attrs []attribute.KeyValue) string {
+	var address string
+	for _, kv := range attrs {
+		switch kv.Key {
+		case "peer.service":
+			return kv.Value.AsString()
+		case "server.address", "net.peer.name":
+			address = kv.Value.AsString()
+		}
+	}
+	return address
+}
@@ -0,0 +1,146 @@
+// Package spanaudit checks ended spans against the instrumentation
+// conventions worth learning early, counting and logging the ones that
+// break them.
+package spanaudit
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// Count spans that broke an instrumentation convention, by rule.
+	spanViolations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_span_convention_violations_total",
+			Help: "Total number of ended spans that broke an instrumentation convention, by rule.",
+		},
+		[]string{"rule"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(spanViolations)
+}
+
+// logInterval is how often each rule may log a violation. The
+// counter sees every one; the log only needs an example, plus how many
+// were skipped since the last.
+const logInterval = time.Minute
+
+// maxSpanNameLength and maxAttributeLength are where names and attribute
+// values stop being labels and start being payloads.
+const (
+	maxSpanNameLength  = 64
+	maxAttributeLength = 1024
+)
+
+// highCardinalityName matches what tends to leak into span names from
+// URLs and data: numeric IDs, UUIDs, long hex strings and query strings.
+var highCardinalityName = regexp.MustCompile(`[0-9]{3,}|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-|[0-9a-fA-F]{16,}|\?`)
+
+// processor checks ended spans against the instrumentation conventions
+// worth learning early: span names that stay low-cardinality, the
+// attributes each kind of span needs to be useful, and errors that say what
+// went wrong. It only reports; spans are exported the same either way.
+type processor struct {
+	mu      sync.Mutex
+	lastLog map[string]time.Time
+	skipped map[string]int
+}
+
+// NewProcessor returns a span processor that audits every span it sees.
+func NewProcessor() sdktrace.SpanProcessor {
+	return &processor{lastLog: map[string]time.Time{}, skipped: map[string]int{}}
+}
+
+func (p *processor) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+
+func (p *processor) OnEnd(s sdktrace.ReadOnlySpan) {
+	for _, rule := range check(s) {
+		spanViolations.WithLabelValues(rule).Inc()
+		p.report(rule, s)
+	}
+}
+
+func (p *processor) Shutdown(context.Context) error   { return nil }
+func (p *processor) ForceFlush(context.Context) error { return nil }
+
+// report logs a violation of rule by s, unless the rule has logged within
+// logInterval, in which case it is counted towards the next log.
+func (p *processor) report(rule string, s sdktrace.ReadOnlySpan) {
+	p.mu.Lock()
+	if time.Since(p.lastLog[rule]) < logInterval {
+		p.skipped[rule]++
+		p.mu.Unlock()
+		return
+	}
+	skipped := p.skipped[rule]
+	p.lastLog[rule], p.skipped[rule] = time.Now(), 0
+	p.mu.Unlock()
+
+	slog.Warn("Span breaks instrumentation convention", "rule", rule, "span_name", s.Name(),
+		"span_kind", s.SpanKind().String(), "trace_id", s.SpanContext().TraceID().String(),
+		"skipped", skipped)
+}
+
+// check returns the rules s breaks.
+func check(s sdktrace.ReadOnlySpan) []string {
+	var broken []string
+	name := s.Name()
+	if highCardinalityName.MatchString(name) {
+		broken = append(broken, "name-high-cardinality")
+	}
+	if len(name) > maxSpanNameLength {
+		broken = append(broken, "name-too-long")
+	}
+
+	attrs := map[attribute.Key]bool{}
+	oversized := false
+	for _, kv := range s.Attributes() {
+		attrs[kv.Key] = true
+		if kv.Value.Type() == attribute.STRING && len(kv.Value.AsString()) > maxAttributeLength {
+			oversized = true
+		}
+	}
+	if oversized {
+		broken = append(broken, "attribute-too-long")
+	}
+	has := func(keys ...attribute.Key) bool {
+		for _, k := range keys {
+			if attrs[k] {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch s.SpanKind() {
+	case trace.SpanKindServer:
+		if !has("http.request.method", "http.method", "rpc.system") {
+			broken = append(broken, "server-missing-operation")
+		}
+	case trace.SpanKindClient:
+		if !has("server.address", "peer.service", "net.peer.name") {
+			broken = append(broken, "client-missing-peer")
+		}
+	case trace.SpanKindProducer, trace.SpanKindConsumer:
+		if !has("messaging.destination.name") {
+			broken = append(broken, "messaging-missing-destination")
+		}
+	}
+
+	if s.Status().Code == codes.Error && s.Status().Description == "" {
+		broken = append(broken, "error-without-description")
+	}
+	return broken
+}
@@ -0,0 +1,193 @@
+// Package telemetry measures how much telemetry a service produces: the
+// spans it exports, the log records it writes, the bytes of each signal it
+// sends and the metric series it exposes.
+package telemetry
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc/stats"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Count spans exported, the ones sampled.
+	telemetrySpans = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "go_app_telemetry_spans_total",
+			Help: "Total number of sampled spans ended, and so exported.",
+		},
+	)
+
+	// Count log records written.
+	telemetryLogRecords = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "go_app_telemetry_log_records_total",
+			Help: "Total number of log records written to stdout.",
+		},
+	)
+
+	// Count bytes of telemetry sent, by signal.
+	telemetryBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_telemetry_bytes_total",
+			Help: "Total number of bytes of telemetry produced, by signal: traces as sent over OTLP, logs as written to stdout, profiles as uploaded.",
+		},
+		[]string{"signal"},
+	)
+
+	// Gauge of metric series exposed.
+	telemetrySeries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_telemetry_metric_series",
+			Help: "Number of metric series this service exposes on /metrics, counting each histogram bucket, as of the last count.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(telemetrySpans, telemetryLogRecords, telemetryBytes, telemetrySeries)
+}
+
+// seriesInterval is how often the series exposed are counted.
+// Counting gathers every metric, so it isn't done per scrape.
+const seriesInterval = 15 * time.Second
+
+// SpanProcessor returns a span processor that counts the spans that will be
+// exported.
+func SpanProcessor() sdktrace.SpanProcessor {
+	return spanProcessor{}
+}
+
+// spanProcessor counts the spans that will be exported.
+type spanProcessor struct{}
+
+func (spanProcessor) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+
+func (spanProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	if s.SpanContext().IsSampled() {
+		telemetrySpans.Inc()
+	}
+}
+
+func (spanProcessor) Shutdown(context.Context) error   { return nil }
+func (spanProcessor) ForceFlush(context.Context) error { return nil }
+
+// StatsHandler returns a gRPC stats handler that counts the bytes of signal
+// an OTLP connection sends, as they go over the wire after compression.
+func StatsHandler(signal string) stats.Handler {
+	return exportStats{signal: signal}
+}
+
+// exportStats counts the bytes an OTLP gRPC connection sends.
+type exportStats struct {
+	signal string
+}
+
+func (s exportStats) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context { return ctx }
+
+func (s exportStats) HandleRPC(_ context.Context, rs stats.RPCStats) {
+	if out, ok := rs.(*stats.OutPayload); ok {
+		telemetryBytes.WithLabelValues(s.signal).Add(float64(out.WireLength))
+	}
+}
+
+func (s exportStats) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context { return ctx }
+func (s exportStats) HandleConn(context.Context, stats.ConnStats)                       {}
+
+// LogWriter returns a writer that writes log records to w, counting them
+// and their bytes, one record per line.
+func LogWriter(w io.Writer) io.Writer {
+	return logWriter{w}
+}
+
+// logWriter counts the log records and bytes written through it.
+type logWriter struct {
+	io.Writer
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	telemetryBytes.WithLabelValues("logs").Add(float64(n))
+	telemetryLogRecords.Inc()
+	return n, err
+}
+
+// Uploads returns a transport that counts the bytes of signal uploaded
+// through next, such as profiles or remote written metrics.
+func Uploads(signal string, next http.RoundTripper) http.RoundTripper {
+	return uploads{signal: signal, next: next}
+}
+
+// uploads counts the bytes of a signal uploaded through it.
+type uploads struct {
+	signal string
+	next   http.RoundTripper
+}
+
+func (t uploads) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.ContentLength > 0 {
+		telemetryBytes.WithLabelValues(t.signal).Add(float64(req.ContentLength))
+	}
+	return t.next.RoundTrip(req)
+}
+
+// ProfileClient returns the client for uploading profiles, set up like the
+// profiler's own default but counting what it uploads.
+func ProfileClient() *http.Client {
+	return &http.Client{
+		Transport: Uploads("profiles", http.DefaultTransport),
+		Timeout:   10 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// CountSeries keeps the series gauge up to date. It never returns, so it
+// runs in a goroutine of its own.
+func CountSeries() {
+	for {
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			slog.Warn("Failed to gather metrics to count series:", logfields.Error(err))
+		}
+		series := 0
+		for _, family := range families {
+			series += FamilySeries(family)
+		}
+		telemetrySeries.Set(float64(series))
+		time.Sleep(seriesInterval)
+	}
+}
+
+// FamilySeries counts the series a metric family is exposed as.
+func FamilySeries(family *dto.MetricFamily) int {
+	series := 0
+	for _, m := range family.GetMetric() {
+		series += MetricSeries(family.GetType(), m)
+	}
+	return series
+}
+
+// MetricSeries counts the series one metric of type t is exposed as.
+// Histograms are a series per bucket, +Inf included, plus _sum and
+// _count; summaries a series per quantile plus _sum and _count.
+func MetricSeries(t dto.MetricType, m *dto.Metric) int {
+	switch t {
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		return len(m.GetHistogram().GetBucket()) + 3
+	case dto.MetricType_SUMMARY:
+		return len(m.GetSummary().GetQuantile()) + 2
+	default:
+		return 1
+	}
+}
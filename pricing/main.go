@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Create a new counter vector for total requests.
+	requestCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_http_requests_total",
+			Help: "Total number of HTTP requests.",
+		},
+		[]string{"path", "method", "status_code"},
+	)
+
+	// Create a new histogram for request latencies.
+	requestLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_http_request_duration_seconds",
+			Help:    "HTTP request latency in seconds.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"path"},
+	)
+
+	// Count exchange rate lookups, by where the rates came from.
+	fxLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pricing_fx_lookups_total",
+			Help: "Total number of exchange rate lookups, by result (cached, fetched, stale or failed).",
+		},
+		[]string{"result"},
+	)
+
+	// Gauge of how old the rates being used are.
+	fxRateAge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pricing_fx_rate_age_seconds",
+			Help: "Age of the exchange rates last used to convert prices in seconds.",
+		},
+	)
+
+	// Count priced requests, by currency.
+	conversions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pricing_conversions_total",
+			Help: "Total number of price lookups answered, by currency.",
+		},
+		[]string{"currency"},
+	)
+)
+
+type Config struct {
+	serviceName     string
+	tempoServer     string
+	pricesServer    string
+	fxServer        string
+	defaultCurrency string
+	fxCacheTTL      time.Duration
+	fxMaxStaleness  time.Duration
+}
+
+func init() {
+	// Register the metrics with Prometheus's default registry.
+	prometheus.MustRegister(requestCount, requestLatency, fxLookups, fxRateAge, conversions)
+}
+
+func main() {
+
+	config := Config{
+		serviceName:     os.Getenv("OTEL_SERVICE_NAME"),
+		tempoServer:     os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"),
+		pricesServer:    os.Getenv("PRICES_SERVER_ADDRESS"),
+		fxServer:        os.Getenv("FX_SERVER_ADDRESS"),
+		defaultCurrency: envString("DEFAULT_CURRENCY", "USD"),
+		fxCacheTTL:      time.Duration(envInt("FX_CACHE_TTL_MS", 60000)) * time.Millisecond,
+		fxMaxStaleness:  time.Duration(envInt("FX_MAX_STALENESS_MS", 600000)) * time.Millisecond,
+	}
+
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	})))
+
+	// Setup OpenTelemetry for tracing
+	shutdown := setupTracer(config)
+	defer shutdown()
+
+	slog.Info("Starting pricing service ...")
+
+	client := &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport), Timeout: 2 * time.Second}
+	fx := &fxRates{address: config.fxServer, client: client, ttl: config.fxCacheTTL, maxStaleness: config.fxMaxStaleness}
+
+	// Prices for the requested product IDs, in the currency asked for
+	http.Handle("/prices", otelhttp.NewHandler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "prices-handler")
+			defer span.End()
+			start := time.Now()
+
+			fail := func(err error) {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				slog.ErrorContext(ctx, "Failed to price products", logfields.Path(r.URL.Path), logfields.Error(err))
+				requestCount.WithLabelValues(r.URL.Path, r.Method, strconv.Itoa(http.StatusBadGateway)).Inc()
+				requestLatency.WithLabelValues(r.URL.Path).Observe(time.Since(start).Seconds())
+				http.Error(w, err.Error(), http.StatusBadGateway)
+			}
+
+			currency := strings.ToUpper(r.URL.Query().Get("currency"))
+			if currency == "" {
+				currency = config.defaultCurrency
+			}
+			span.SetAttributes(attribute.String("pricing.currency", currency))
+
+			prices, err := basePrices(ctx, client, config.pricesServer, r.URL.Query().Get("ids"))
+			if err != nil {
+				fail(err)
+				return
+			}
+			if currency != "USD" {
+				rate, err := fx.Rate(ctx, currency)
+				if err != nil {
+					fail(err)
+					return
+				}
+				span.SetAttributes(attribute.Float64("pricing.fx_rate", rate))
+				for id, cents := range prices {
+					prices[id] = int(math.Round(float64(cents) * rate))
+				}
+			}
+
+			conversions.WithLabelValues(currency).Inc()
+			slog.InfoContext(ctx, "Request handled successfully", logfields.Duration(time.Since(start)))
+			requestCount.WithLabelValues(r.URL.Path, r.Method, strconv.Itoa(http.StatusOK)).Inc()
+			requestLatency.WithLabelValues(r.URL.Path).Observe(time.Since(start).Seconds())
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Currency", currency)
+			json.NewEncoder(w).Encode(prices)
+		}),
+		"prices-handler-span",
+	))
+
+	// What the service is, where it listens and what it calls, for
+	// o11yctl topology
+	http.Handle("/topology", otelhttp.NewHandler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{
+				"name":         config.serviceName,
+				"version":      os.Getenv("SERVICE_VERSION"),
+				"listen":       []map[string]string{{"name": "app", "addr": ":8083"}},
+				"dependencies": []map[string]string{dependency(config.pricesServer), dependency(config.fxServer)},
+				"entrypoints":  []string{"/prices?ids=1,2,3&currency=EUR"},
+			})
+		}),
+		"topology-handler-span",
+	))
+
+	// Endpoint to get metrics
+	http.Handle("/metrics", promhttp.Handler())
+
+	slog.Info("Application is listening on port 8083...")
+	// Accept h2c as well as HTTP/1.1, so callers can pick either
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Addr: ":8083", Protocols: &protocols}
+	server.ListenAndServe()
+}
+
+// basePrices fetches the USD prices, in cents, of the comma separated ids
+// from the prices source.
+func basePrices(ctx context.Context, client *http.Client, address, ids string) (map[string]int, error) {
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "fetch-base-prices")
+	defer span.End()
+	span.SetAttributes(attribute.String("peer.service", "flaky-dep"))
+
+	var prices map[string]int
+	if err := getJSON(ctx, client, address+"/prices?ids="+ids, &prices); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, fmt.Errorf("failed to fetch base prices: %w", err)
+	}
+	return prices, nil
+}
+
+// fxRates caches the exchange rates from the FX API. Rates are refetched
+// once they are older than ttl; if that fails, the old rates keep being
+// used until they are older than maxStaleness, so a flaky FX API shows up
+// as stale rates before it shows up as failed requests. Lookups wait for a
+// fetch in progress rather than all fetching at once.
+type fxRates struct {
+	address      string
+	client       *http.Client
+	ttl          time.Duration
+	maxStaleness time.Duration
+
+	mu      sync.Mutex
+	rates   map[string]float64
+	fetched time.Time
+}
+
+// Rate returns the exchange rate from USD to currency.
+func (f *fxRates) Rate(ctx context.Context, currency string) (float64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	result := "cached"
+	if time.Since(f.fetched) >= f.ttl {
+		rates, err := f.fetch(ctx)
+		switch {
+		case err == nil:
+			f.rates, f.fetched = rates, time.Now()
+			result = "fetched"
+		case f.rates != nil && time.Since(f.fetched) < f.maxStaleness:
+			slog.WarnContext(ctx, "Using stale exchange rates", logfields.Error(err), "age_ms", time.Since(f.fetched).Milliseconds())
+			result = "stale"
+		default:
+			fxLookups.WithLabelValues("failed").Inc()
+			return 0, err
+		}
+	}
+	fxLookups.WithLabelValues(result).Inc()
+	fxRateAge.Set(time.Since(f.fetched).Seconds())
+
+	rate, ok := f.rates[currency]
+	if !ok {
+		return 0, fmt.Errorf("no exchange rate for %s", currency)
+	}
+	return rate, nil
+}
+
+// fetch gets the latest rates from the FX API.
+func (f *fxRates) fetch(ctx context.Context) (map[string]float64, error) {
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "fetch-fx-rates")
+	defer span.End()
+	span.SetAttributes(attribute.String("peer.service", "fx-api"))
+
+	var body struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := getJSON(ctx, f.client, f.address+"/rates", &body); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, fmt.Errorf("failed to fetch exchange rates: %w", err)
+	}
+	if len(body.Rates) == 0 {
+		return nil, errors.New("FX API returned no rates")
+	}
+	return body.Rates, nil
+}
+
+// getJSON decodes the JSON body of a GET of url into v.
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func setupTracer(config Config) func() {
+	ctx := context.Background()
+	slog.Info("Setting up traces with config", "config", config.tempoServer)
+	// Tempo gRPC endpoint from docker-compose.yml
+	conn, err := grpc.DialContext(ctx, config.tempoServer,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+	)
+	if err != nil {
+		slog.Error("Failed to create gRPC connection to Tempo:", logfields.Error(err))
+		return func() {}
+	}
+
+	// Create a new OTLP gRPC exporter
+	traceExporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(conn))
+	if err != nil {
+		slog.Error("Failed to create a new OTLP exporter:", logfields.Error(err))
+		return func() {}
+	}
+
+	// Create a new tracer provider with the exporter
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(traceExporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(config.serviceName),
+			attribute.String("application", config.serviceName),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	// Baggage is passed on too, as this sits between store-api and its
+	// dependencies
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return func() {
+		ctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			slog.Error("Failed to shutdown tracer provider:", logfields.Error(err))
+		}
+	}
+}
+
+// envInt returns the integer value of an env var, or def if it is unset or
+// not a number.
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// envString returns the value of an env var, or def if it is unset.
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// dependency describes the service at address for /topology, named by its
+// host, which in docker compose is the service name.
+func dependency(address string) map[string]string {
+	name := address
+	if u, err := url.Parse(address); err == nil && u.Hostname() != "" {
+		name = u.Hostname()
+	}
+	return map[string]string{"name": name, "address": address}
+}
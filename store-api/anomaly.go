@@ -0,0 +1,163 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Count anomalies detected, by kind.
+	anomalies = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_anomalies_total",
+			Help: "Total number of anomalies the service detected in its own metrics, by kind.",
+		},
+		[]string{"kind"},
+	)
+
+	// Gauge of anomalies in progress, by kind.
+	anomalyActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_anomaly_active",
+			Help: "Whether an anomaly of each kind is in progress (1) or not (0).",
+		},
+		[]string{"kind"},
+	)
+
+	// Gauge of the error ratio the detector last saw.
+	errorSpikeRatio = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_error_spike_ratio",
+			Help: "Share of requests that failed with a 5xx over the last detection interval.",
+		},
+	)
+
+	// Gauge of the baseline error ratio spikes are measured against.
+	errorSpikeBaseline = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_error_spike_baseline_ratio",
+			Help: "Moving average of the share of requests that failed with a 5xx, outside spikes.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(anomalies, anomalyActive, errorSpikeRatio, errorSpikeBaseline)
+}
+
+const (
+	// errorSpikeInterval is how often the request counters are checked.
+	errorSpikeInterval = 10 * time.Second
+	// errorSpikeWarmup is how many intervals with traffic make up the
+	// first baseline, before spikes are looked for.
+	errorSpikeWarmup = 6
+	// errorSpikeSmoothing is how much each quiet interval moves the
+	// baseline, as an exponentially weighted moving average.
+	errorSpikeSmoothing = 0.1
+	// errorSpikeMinIncrease is how far above the baseline the error ratio
+	// must be to count as a spike, so a baseline near zero doesn't make
+	// every stray error one.
+	errorSpikeMinIncrease = 0.05
+)
+
+// errorSpikeDetector watches go_app_http_requests_total for a 5xx ratio
+// well above its usual level. It is the kind of check an alerting rule
+// would make, done in process: the service notices its own spikes, logs
+// them as structured events and counts them, for dashboards to annotate.
+type errorSpikeDetector struct {
+	factor      float64
+	minRequests float64
+
+	lastTotal, lastErrors float64
+	baseline              float64
+	intervals             int
+	active                bool
+	since                 time.Time
+}
+
+// newErrorSpikeDetector detects spikes where the error ratio over an
+// interval with at least minRequests requests is factor times the
+// baseline.
+func newErrorSpikeDetector(factor float64, minRequests int) *errorSpikeDetector {
+	d := &errorSpikeDetector{factor: factor, minRequests: float64(minRequests)}
+	d.lastTotal, d.lastErrors = requestTotals()
+	anomalyActive.WithLabelValues("error_spike").Set(0)
+	return d
+}
+
+// Run checks the request counters every interval, forever.
+func (d *errorSpikeDetector) Run() {
+	for range time.Tick(errorSpikeInterval) {
+		total, errs := requestTotals()
+		d.Observe(total, errs, time.Now())
+	}
+}
+
+// Observe takes the counters' current totals and reports a spike starting
+// or ending.
+func (d *errorSpikeDetector) Observe(total, errs float64, now time.Time) {
+	requests, failed := total-d.lastTotal, errs-d.lastErrors
+	d.lastTotal, d.lastErrors = total, errs
+	// Too few requests say nothing either way
+	if requests < d.minRequests {
+		return
+	}
+	ratio := failed / requests
+	errorSpikeRatio.Set(ratio)
+
+	if d.intervals < errorSpikeWarmup {
+		d.intervals++
+		d.baseline += (ratio - d.baseline) / float64(d.intervals)
+		errorSpikeBaseline.Set(d.baseline)
+		return
+	}
+
+	spike := ratio-d.baseline >= errorSpikeMinIncrease && ratio >= d.baseline*d.factor
+	switch {
+	case spike && !d.active:
+		d.active, d.since = true, now
+		anomalies.WithLabelValues("error_spike").Inc()
+		anomalyActive.WithLabelValues("error_spike").Set(1)
+		slog.Warn("Anomaly detected", "anomaly", "error_spike", "error_ratio", ratio, "baseline_ratio", d.baseline, "requests", requests)
+	case !spike && d.active:
+		d.active = false
+		anomalyActive.WithLabelValues("error_spike").Set(0)
+		slog.Info("Anomaly resolved", "anomaly", "error_spike", "error_ratio", ratio, "baseline_ratio", d.baseline, logfields.Duration(now.Sub(d.since)))
+	}
+	// The baseline learns only from normal intervals, so a long spike
+	// doesn't become the new normal
+	if !d.active {
+		d.baseline += errorSpikeSmoothing * (ratio - d.baseline)
+		errorSpikeBaseline.Set(d.baseline)
+	}
+}
+
+// requestTotals sums go_app_http_requests_total, returning all requests
+// and those that failed with a 5xx.
+func requestTotals() (total, errs float64) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		requestCount.Collect(ch)
+		close(ch)
+	}()
+	for m := range ch {
+		var metric dto.Metric
+		if err := m.Write(&metric); err != nil {
+			continue
+		}
+		v := metric.GetCounter().GetValue()
+		total += v
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == "status_code" && strings.HasPrefix(label.GetValue(), "5") {
+				errs += v
+			}
+		}
+	}
+	return total, errs
+}
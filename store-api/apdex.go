@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// Count requests by route and Apdex zone.
+	apdexRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_apdex_requests_total",
+			Help: "Total number of HTTP requests by route and Apdex zone: satisfied within the route's threshold T, tolerating within the frustrated threshold, frustrated beyond it or on a 5xx.",
+		},
+		[]string{"route", "zone"},
+	)
+
+	// Gauge of each route's Apdex threshold, for dashboards to show beside
+	// the score.
+	apdexThreshold = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_apdex_threshold_seconds",
+			Help: "Apdex satisfied threshold T in seconds, by route.",
+		},
+		[]string{"route"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(apdexRequests, apdexThreshold)
+}
+
+// apdexDefaultThreshold is T for routes without one of their own, and
+// apdexFrustratedFactor how many times T a request may take before it
+// frustrates rather than tolerates. The Apdex standard fixes the factor
+// at 4.
+var (
+	apdexDefaultThreshold = 500 * time.Millisecond
+	apdexFrustratedFactor = 4.0
+)
+
+// apdexThresholds maps mux patterns to their own T.
+var apdexThresholds = map[string]time.Duration{}
+
+// parseApdexThresholds parses an APDEX_ROUTE_THRESHOLDS value: comma
+// separated pattern=duration pairs, e.g. "/products=200ms,/orders=1s".
+func parseApdexThresholds(spec string) (map[string]time.Duration, error) {
+	parsed := map[string]time.Duration{}
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("expected pattern=duration, got %q", entry)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(entry[i+1:]))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid threshold in %q", entry)
+		}
+		parsed[strings.TrimSpace(entry[:i])] = d
+	}
+	return parsed, nil
+}
+
+// apdexZone places a request that took d and ended with status in its
+// Apdex zone for a route with threshold t. Server errors frustrate however
+// fast they were.
+func apdexZone(d, t time.Duration, status int) string {
+	switch {
+	case status >= 500:
+		return "frustrated"
+	case d <= t:
+		return "satisfied"
+	case d <= time.Duration(float64(t)*apdexFrustratedFactor):
+		return "tolerating"
+	default:
+		return "frustrated"
+	}
+}
+
+// measureApdex counts each request in its route's Apdex zone. The score,
+// (satisfied + tolerating/2) / total, is an SLI in terms of how users
+// feel about latency: one number per route, where percentiles need a
+// threshold picked for each before they mean anything.
+//
+// T doubles as the route's latency objective: a request slower than it
+// gets slo.violated=true on its span, and an event saying by how much, so
+// { span.slo.violated = true } finds the traces behind a falling score.
+func measureApdex(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := httpsnoop.CaptureMetrics(next, w, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		t, ok := apdexThresholds[route]
+		if !ok {
+			t = apdexDefaultThreshold
+		}
+		apdexThreshold.WithLabelValues(route).Set(t.Seconds())
+		apdexRequests.WithLabelValues(route, apdexZone(m.Duration, t, m.Code)).Inc()
+
+		if m.Duration > t {
+			span := trace.SpanFromContext(r.Context())
+			span.SetAttributes(attribute.Bool("slo.violated", true))
+			span.AddEvent("slo.violated", trace.WithAttributes(
+				attribute.Int64("slo.threshold_ms", t.Milliseconds()),
+				attribute.Int64("slo.duration_ms", m.Duration.Milliseconds()),
+			))
+		}
+	})
+}
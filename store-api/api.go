@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Count calls to deprecated API versions, by who is still making them.
+	deprecatedAPIRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "deprecated_api_requests_total",
+			Help: "Total number of requests to deprecated API routes.",
+		},
+		[]string{"path", "caller"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(deprecatedAPIRequests)
+}
+
+// apiV1Deprecated is when v1 of the API was deprecated, sent as an RFC 9745
+// Deprecation header.
+var apiV1Deprecated = time.Date(2025, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+// ProductList is the v2 product response, which wraps the list so that
+// metadata can be added without breaking clients again.
+type ProductList struct {
+	Items []Product `json:"items"`
+	Total int       `json:"total"`
+	// Degraded is set when a dependency was too slow and the items were
+	// served with stale or fallback data instead
+	Degraded *Degradation `json:"degraded,omitempty"`
+}
+
+// deprecated marks a route as deprecated in favour of successor: responses
+// carry Deprecation and Link headers, and each call is counted by caller so
+// the remaining consumers can be chased down before removal.
+func deprecated(next http.Handler, successor string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		caller := callerName(r)
+
+		w.Header().Set("Deprecation", "@"+strconv.FormatInt(apiV1Deprecated.Unix(), 10))
+		w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.Bool("api.deprecated", true),
+			attribute.String("api.caller", caller),
+		)
+		deprecatedAPIRequests.WithLabelValues(r.URL.Path, caller).Inc()
+		slog.WarnContext(ctx, "Deprecated API called", logfields.Path(r.URL.Path), "caller", caller, "successor", successor)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// knownCallers are the callers counted under their own name: the services
+// and tools in this repo, and the usual HTTP clients by User-Agent product.
+var knownCallers = map[string]bool{
+	"store-client":   true,
+	"o11yctl":        true,
+	"o11yctl-k6":     true,
+	"curl":           true,
+	"k6":             true,
+	"Go-http-client": true,
+	"Mozilla":        true,
+}
+
+// callerName identifies who is calling us, preferring an explicit X-Caller
+// header and falling back to the product name from the User-Agent (so
+// "curl/8.4.0" becomes "curl"). Callers not in knownCallers are "other",
+// so they can't add label values of their own.
+func callerName(r *http.Request) string {
+	caller := r.Header.Get("X-Caller")
+	if caller == "" {
+		caller = r.Header.Get("User-Agent")
+		if i := strings.IndexAny(caller, "/ "); i > 0 {
+			caller = caller[:i]
+		}
+	}
+	if caller == "" {
+		return "unknown"
+	}
+	if !knownCallers[caller] {
+		return "other"
+	}
+	return caller
+}
+
+// productsV1 returns the bare product list, as /products always has.
+func productsV1(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(r.Context(), "products-v1-handler")
+	defer span.End()
+
+	start := time.Now()
+	products := getProducts(ctx)
+	flagDegraded(w, r, priceProducts(ctx, products))
+	writeJSON(w, r, products, time.Since(start))
+}
+
+// productsV2 returns the product list wrapped in a ProductList.
+func productsV2(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(r.Context(), "products-v2-handler")
+	defer span.End()
+
+	start := time.Now()
+	products := getProducts(ctx)
+	degradation := priceProducts(ctx, products)
+	flagDegraded(w, r, degradation)
+	writeJSON(w, r, ProductList{Items: products, Total: len(products), Degraded: degradation}, time.Since(start))
+}
+
+// writeJSON encodes v as the response and records the request metrics.
+func writeJSON(w http.ResponseWriter, r *http.Request, v any, duration time.Duration) {
+	writeJSONStatus(w, r, v, http.StatusOK, duration)
+}
+
+// writeJSONStatus is writeJSON with a status code other than 200.
+func writeJSONStatus(w http.ResponseWriter, r *http.Request, v any, code int, duration time.Duration) {
+	buf, err := encodeJSON(r.Context(), routeTarget(r), v)
+	if err != nil {
+		httpError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	defer releaseJSON(buf)
+
+	slog.InfoContext(r.Context(), "Request handled successfully", logfields.Duration(duration))
+	requestCount.WithLabelValues(routeTarget(r), r.Method, strconv.Itoa(code)).Inc()
+	requestLatency.WithLabelValues(routeTarget(r)).Observe(duration.Seconds())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// checkRouteLabels serves target with handler registered on pattern, and
+// fails the test unless the request was counted under the pattern rather
+// than the path, so IDs in paths don't each get a series.
+func checkRouteLabels(t *testing.T, pattern string, handler http.HandlerFunc, target string) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle(pattern, handler)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	mux.ServeHTTP(w, r)
+	code := strconv.Itoa(w.Code)
+
+	if requestCount.DeleteLabelValues(r.URL.Path, http.MethodGet, code) {
+		t.Errorf("GET %s was counted under its path", target)
+	}
+	if got := testutil.ToFloat64(requestCount.WithLabelValues(pattern, http.MethodGet, code)); got == 0 {
+		t.Errorf("GET %s was not counted under %q", target, pattern)
+	}
+}
+
+func TestEmployeeRoutesLabelledByPattern(t *testing.T) {
+	checkRouteLabels(t, "GET /employees/{id}", employeeHandler, "/employees/2")
+	checkRouteLabels(t, "GET /employees/{id}", employeeHandler, "/employees/abc")
+	checkRouteLabels(t, "GET /employees/{id}/manager", managerHandler, "/employees/3/manager")
+}
+
+func TestCatalogItemLabelledByPattern(t *testing.T) {
+	checkRouteLabels(t, "GET /catalog/{id}", catalogItemHandler, "/catalog/2")
+	checkRouteLabels(t, "GET /catalog/{id}", catalogItemHandler, "/catalog/abc")
+	checkRouteLabels(t, "GET /catalog/{id}", catalogItemHandler, "/catalog/99999")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Gauge of the memory ballast size.
+	ballastBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_gc_ballast_bytes",
+			Help: "Size of the GC memory ballast in bytes, by mode (ballast or memlimit).",
+		},
+		[]string{"mode"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(ballastBytes)
+}
+
+// Ballast modes.
+const (
+	// ballastAlloc allocates a large, never touched slice. It counts towards
+	// the live heap, so the GC waits for the heap to grow by GOGC percent of
+	// ballast plus real data before running again, without the ballast ever
+	// using physical memory.
+	ballastAlloc = "ballast"
+	// ballastMemLimit gets the same effect the modern way: GOGC off and a
+	// GOMEMLIMIT of the ballast size, so the GC only runs as the heap nears it.
+	ballastMemLimit = "memlimit"
+)
+
+// ballaster holds the current ballast, and the GC settings to go back to
+// when a memlimit ballast is removed.
+type ballaster struct {
+	mu              sync.Mutex
+	mode            string
+	size            int64
+	ballast         []byte
+	previousPercent int
+	previousLimit   int64
+}
+
+var ballasts = &ballaster{}
+
+// Set replaces the ballast with one of sizeMB megabytes in the given mode.
+func (b *ballaster) Set(mode string, sizeMB int) error {
+	if sizeMB <= 0 {
+		return errors.New("size must be positive")
+	}
+	if mode != ballastAlloc && mode != ballastMemLimit {
+		return fmt.Errorf("unknown mode %q, want ballast or memlimit", mode)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clear()
+
+	b.mode, b.size = mode, int64(sizeMB)<<20
+	switch mode {
+	case ballastAlloc:
+		b.ballast = make([]byte, b.size)
+	case ballastMemLimit:
+		b.previousPercent = debug.SetGCPercent(-1)
+		b.previousLimit = debug.SetMemoryLimit(b.size)
+	}
+	ballastBytes.WithLabelValues(mode).Set(float64(b.size))
+	slog.Warn("Set GC ballast", "mode", mode, "bytes", b.size)
+	return nil
+}
+
+// Clear removes the ballast, restoring the GC settings if it changed them.
+func (b *ballaster) Clear() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clear()
+	runtime.GC()
+	slog.Info("Removed GC ballast")
+}
+
+// clear removes the ballast; the caller must hold mu.
+func (b *ballaster) clear() {
+	switch b.mode {
+	case ballastAlloc:
+		b.ballast = nil
+	case ballastMemLimit:
+		debug.SetGCPercent(b.previousPercent)
+		debug.SetMemoryLimit(b.previousLimit)
+	}
+	if b.mode != "" {
+		ballastBytes.WithLabelValues(b.mode).Set(0)
+	}
+	b.mode, b.size = "", 0
+}
+
+// ballastHandler controls the GC ballast: POST sets one of size_mb
+// megabytes, in mode ballast (the default) or memlimit, DELETE removes it.
+// Compare go_app_gc_cycles_total and the CPU profile before and after.
+func ballastHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		size, _ := strconv.Atoi(r.URL.Query().Get("size_mb"))
+		mode := r.URL.Query().Get("mode")
+		if mode == "" {
+			mode = ballastAlloc
+		}
+		if err := ballasts.Set(mode, size); err != nil {
+			httpError(w, r, err, http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		ballasts.Clear()
+	default:
+		httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ballasts.mu.Lock()
+	mode, size := ballasts.mode, ballasts.size
+	ballasts.mu.Unlock()
+	limit := debug.SetMemoryLimit(-1)
+	if limit == math.MaxInt64 {
+		limit = 0
+	}
+	writeJSON(w, r, map[string]any{"mode": mode, "bytes": size, "memlimit_bytes": limit}, 0)
+}
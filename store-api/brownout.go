@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+// Reasons a response is degraded: prices from the last successful lookup,
+// or the catalog's own prices when there hasn't been one.
+const (
+	degradedStale    = "stale"
+	degradedFallback = "fallback"
+)
+
+var (
+	// Count responses served degraded, by route, dependency and reason.
+	degradedResponses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_degraded_responses_total",
+			Help: "Total number of successful responses served with degraded data because a dependency was slow or failing, by route, dependency and reason (stale or fallback).",
+		},
+		[]string{"route", "dependency", "reason"},
+	)
+
+	// Gauge of how old the cached prices are.
+	priceCacheAge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "go_app_price_cache_age_seconds",
+			Help: "Age of the cached prices brownout mode serves when pricing is slow, 0 before any are cached.",
+		},
+		func() float64 {
+			_, age, ok := cachedPrices.Get()
+			if !ok {
+				return 0
+			}
+			return age.Seconds()
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(degradedResponses, priceCacheAge)
+}
+
+// brownout turns on brownout mode: a pricing lookup gets brownoutTimeout,
+// and when it takes longer or fails the response is served with the last
+// prices that were fetched, flagged as degraded, rather than waiting on
+// pricing or failing.
+var (
+	brownout        bool
+	brownoutTimeout time.Duration
+)
+
+// Degradation says how a response falls short, so clients and dashboards
+// can tell degraded successes from the real thing.
+type Degradation struct {
+	Dependency   string  `json:"dependency"`
+	Reason       string  `json:"reason"`
+	StaleSeconds float64 `json:"stale_seconds,omitempty"`
+}
+
+// priceCache holds the last price fetched for each product.
+type priceCache struct {
+	mu      sync.RWMutex
+	prices  map[int]int
+	fetched time.Time
+}
+
+var cachedPrices = &priceCache{prices: map[int]int{}}
+
+// Store adds freshly fetched prices to the cache.
+func (c *priceCache) Store(fresh map[int]int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, price := range fresh {
+		c.prices[id] = price
+	}
+	c.fetched = time.Now()
+}
+
+// Get returns a copy of the cached prices and how old they are.
+func (c *priceCache) Get() (map[int]int, time.Duration, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.fetched.IsZero() {
+		return nil, 0, false
+	}
+	cached := make(map[int]int, len(c.prices))
+	for id, price := range c.prices {
+		cached[id] = price
+	}
+	return cached, time.Since(c.fetched), true
+}
+
+// priceProducts applies pricing's current prices to products, when there is
+// a pricing service. Outside brownout mode it falls back to catalog prices
+// if pricing fails, however long that takes. In brownout mode it waits only
+// brownoutTimeout, then serves cached prices instead and returns how the
+// response is degraded.
+func priceProducts(ctx context.Context, products []Product) *Degradation {
+	if pricing == nil {
+		return nil
+	}
+	if !brownout {
+		// Fall back to catalog prices if pricing is having a bad day
+		if fresh, err := pricing.Prices(ctx, products); err != nil {
+			slog.WarnContext(ctx, "Failed to fetch prices, using catalog prices", logfields.PeerService("pricing"), logfields.Error(err))
+		} else {
+			applyPrices(products, fresh)
+		}
+		return nil
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, brownoutTimeout)
+	defer cancel()
+	fresh, err := pricing.Prices(lookupCtx, products)
+	if err == nil {
+		cachedPrices.Store(fresh)
+		applyPrices(products, fresh)
+		return nil
+	}
+
+	degradation := &Degradation{Dependency: "pricing", Reason: degradedFallback}
+	if cached, age, ok := cachedPrices.Get(); ok {
+		applyPrices(products, cached)
+		degradation.Reason, degradation.StaleSeconds = degradedStale, age.Seconds()
+	}
+	slog.WarnContext(ctx, "Serving degraded prices", logfields.PeerService("pricing"), "reason", degradation.Reason, "stale_seconds", degradation.StaleSeconds, logfields.Error(err))
+	return degradation
+}
+
+// flagDegraded marks the response to r as degraded: in the X-Degraded
+// header, for responses without anywhere in the payload to say so, on the
+// server span, and in the metrics. It must be called before the response
+// is written.
+func flagDegraded(w http.ResponseWriter, r *http.Request, d *Degradation) {
+	if d == nil {
+		return
+	}
+	w.Header().Set("X-Degraded", d.Dependency+"="+d.Reason)
+	trace.SpanFromContext(r.Context()).SetAttributes(
+		attribute.Bool("degraded", true),
+		attribute.String("degraded.dependency", d.Dependency),
+		attribute.String("degraded.reason", d.Reason),
+	)
+	degradedResponses.WithLabelValues(routeTarget(r), d.Dependency, d.Reason).Inc()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Histogram of how many items each processed batch held.
+	bulkBatchSize = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "go_app_bulk_batch_size",
+			Help:    "Number of items in each processed bulk batch.",
+			Buckets: []float64{1, 5, 10, 25, 50, 100, 250},
+		},
+	)
+
+	// Histogram of how long each batch took to process.
+	bulkBatchDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "go_app_bulk_batch_duration_seconds",
+			Help:    "Time taken to process a bulk batch in seconds.",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
+	// Count bulk items by outcome, so partial failures show up even when
+	// the request as a whole succeeds.
+	bulkItems = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_bulk_items_total",
+			Help: "Total number of bulk items processed, by result.",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(bulkBatchSize, bulkBatchDuration, bulkItems)
+}
+
+// BulkResult is the response to a bulk upsert.
+type BulkResult struct {
+	Upserted int           `json:"upserted"`
+	Failed   []ItemFailure `json:"failed"`
+}
+
+// bulkUpsertHandler upserts up to maxItems products, processing them in
+// batches of batchSize, each with its own span. When some items fail the
+// rest are still upserted, and the response is a 207 listing the failures.
+func bulkUpsertHandler(maxItems, batchSize int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(r.Context(), "bulk-upsert-handler")
+		defer span.End()
+		start := time.Now()
+
+		var items []Product
+		if err := decodeJSON(ctx, routeTarget(r), r.Body, &items); err != nil {
+			httpError(w, r, fmt.Errorf("invalid bulk payload: %w", err), http.StatusBadRequest)
+			return
+		}
+		if len(items) > maxItems {
+			httpError(w, r, fmt.Errorf("too many items: %d (max %d)", len(items), maxItems), http.StatusRequestEntityTooLarge)
+			return
+		}
+		span.SetAttributes(attribute.Int("bulk.items", len(items)), attribute.Int("bulk.batch_size", batchSize))
+
+		result := BulkResult{Failed: []ItemFailure{}}
+		for offset := 0; offset < len(items); offset += batchSize {
+			end := min(offset+batchSize, len(items))
+			upserted, failed := upsertBatch(ctx, offset/batchSize, offset, items[offset:end])
+			result.Upserted += upserted
+			result.Failed = append(result.Failed, failed...)
+		}
+
+		span.SetAttributes(attribute.Int("bulk.upserted", result.Upserted), attribute.Int("bulk.failed", len(result.Failed)))
+		if len(result.Failed) > 0 {
+			slog.WarnContext(ctx, "Bulk upsert partially failed", "upserted", result.Upserted, "failed", len(result.Failed))
+		}
+		writeItemResults(w, r, result, len(items), len(result.Failed), time.Since(start))
+	}
+}
+
+// upsertBatch processes one batch under its own span, returning how many
+// items were upserted and which failed. offset is the index of the first item
+// in the original request, so failures can be reported against it.
+func upsertBatch(ctx context.Context, index, offset int, batch []Product) (int, []ItemFailure) {
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "upsert-batch")
+	defer span.End()
+	start := time.Now()
+
+	var failed []ItemFailure
+	for i, p := range batch {
+		if err := validateProduct(p); err != nil {
+			failure := ItemFailure{Index: offset + i, ID: p.ID, Error: err.Error()}
+			recordItemFailure(ctx, failure)
+			failed = append(failed, failure)
+			continue
+		}
+		catalog.Upsert(p)
+	}
+
+	upserted := len(batch) - len(failed)
+	span.SetAttributes(
+		attribute.Int("batch.index", index),
+		attribute.Int("batch.size", len(batch)),
+		attribute.Int("batch.failed", len(failed)),
+	)
+	if len(failed) > 0 {
+		span.SetStatus(codes.Error, strconv.Itoa(len(failed))+" items failed")
+	}
+
+	bulkBatchSize.Observe(float64(len(batch)))
+	bulkBatchDuration.Observe(time.Since(start).Seconds())
+	bulkItems.WithLabelValues("upserted").Add(float64(upserted))
+	bulkItems.WithLabelValues("failed").Add(float64(len(failed)))
+	slog.DebugContext(ctx, "Processed bulk batch", "batch", index, "upserted", upserted, logfields.Duration(time.Since(start)))
+
+	return upserted, failed
+}
+
+// validateProduct rejects products that cannot be stored.
+func validateProduct(p Product) error {
+	switch {
+	case p.ID <= 0:
+		return errors.New("id must be positive")
+	case p.Name == "":
+		return errors.New("name is required")
+	case p.Price < 0:
+		return errors.New("price must not be negative")
+	}
+	return nil
+}
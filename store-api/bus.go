@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Count messages published to the bus, by topic.
+	busPublished = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_bus_messages_published_total",
+			Help: "Total number of messages published to the message bus.",
+		},
+		[]string{"topic"},
+	)
+
+	// Histogram of how long messages waited between publish and a consumer
+	// starting on them.
+	busConsumerLag = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_bus_consumer_lag_seconds",
+			Help:    "Time between a message being published and a consumer starting to process it in seconds.",
+			Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30, 60},
+		},
+		[]string{"topic", "consumer"},
+	)
+
+	// Histogram of how long after the event happened a consumer starts on
+	// it, including any time spent in the outbox before publishing.
+	busEndToEndDelay = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_bus_end_to_end_delay_seconds",
+			Help:    "Time between an event being created and a consumer starting to process it in seconds.",
+			Buckets: []float64{.01, .05, .1, .5, 1, 2.5, 5, 10, 30, 60, 300},
+		},
+		[]string{"topic", "consumer"},
+	)
+
+	// Gauge of messages waiting for each consumer.
+	busBacklog = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_bus_backlog_messages",
+			Help: "Number of messages published but not yet picked up by a consumer.",
+		},
+		[]string{"topic", "consumer"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(busPublished, busConsumerLag, busEndToEndDelay, busBacklog)
+}
+
+// Message is a single message on the bus. ID identifies the event it
+// carries, and stays the same when the message is retried or replayed from
+// the dead letter queue. Headers carry the trace context of whatever produced
+// it. CreatedAt is when the event happened, which for an outbox entry is well
+// before it was published. Publish fills in ID and CreatedAt if the producer
+// didn't.
+type Message struct {
+	ID          string
+	Topic       string
+	Key         string
+	Payload     []byte
+	Headers     map[string]string
+	CreatedAt   time.Time
+	PublishedAt time.Time
+}
+
+// newEventID returns a random ID for an event, unique across restarts and
+// instances, unlike the order IDs events are keyed by.
+func newEventID() string {
+	return "evt_" + rand.Text()
+}
+
+// busMaxAttempts is how many times a consumer tries a message before it is
+// moved to the dead letter queue.
+var busMaxAttempts = 3
+
+// subscription is one consumer's queue of messages on a topic.
+type subscription struct {
+	consumer string
+	ch       chan Message
+}
+
+// messageBus is a minimal in-process stand-in for a message broker: each
+// topic fans out to its subscribers over buffered channels.
+type messageBus struct {
+	mu          sync.RWMutex
+	subscribers map[string][]subscription
+}
+
+var bus = &messageBus{subscribers: map[string][]subscription{}}
+
+// Errors a message is dead-lettered with when it can't be queued for a
+// consumer.
+var (
+	errConsumerNotSubscribed = errors.New("consumer not subscribed")
+	errConsumerQueueFull     = errors.New("consumer queue full")
+)
+
+// Publish delivers msg to every subscriber of its topic. A subscriber whose
+// queue is full gets the message dead-lettered instead, so one slow consumer
+// can't hold up the publisher or the others.
+func (b *messageBus) Publish(ctx context.Context, msg Message) {
+	msg.PublishedAt = time.Now()
+	if msg.ID == "" {
+		msg.ID = newEventID()
+	}
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = msg.PublishedAt
+	}
+
+	for _, sub := range b.subscriptions(msg.Topic) {
+		if !sub.offer(msg) {
+			dlq.Add(msg, sub.consumer, errConsumerQueueFull, 0)
+			slog.WarnContext(ctx, "Consumer queue full, dead-lettering message", "topic", msg.Topic, "consumer", sub.consumer, "key", msg.Key)
+		}
+	}
+	busPublished.WithLabelValues(msg.Topic).Inc()
+}
+
+// Redeliver queues msg again for consumer alone. It fails with
+// errConsumerNotSubscribed if no such consumer is subscribed to the
+// message's topic, and errConsumerQueueFull if its queue is full.
+func (b *messageBus) Redeliver(consumer string, msg Message) error {
+	msg.PublishedAt = time.Now()
+
+	for _, sub := range b.subscriptions(msg.Topic) {
+		if sub.consumer != consumer {
+			continue
+		}
+		if !sub.offer(msg) {
+			return errConsumerQueueFull
+		}
+		return nil
+	}
+	return errConsumerNotSubscribed
+}
+
+// subscriptions returns topic's subscriptions, so messages can be queued
+// without holding the lock.
+func (b *messageBus) subscriptions(topic string) []subscription {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.subscribers[topic]
+}
+
+// offer queues msg for the subscription's consumer, reporting false without
+// waiting if its queue is full.
+func (sub subscription) offer(msg Message) bool {
+	// Counted first, or the consumer could take it off the gauge before it
+	// was ever on it
+	backlog := busBacklog.WithLabelValues(msg.Topic, sub.consumer)
+	backlog.Inc()
+	select {
+	case sub.ch <- msg:
+		return true
+	default:
+		backlog.Dec()
+		return false
+	}
+}
+
+// Subscribe runs handle for every message published to topic, in its own
+// goroutine. Each message is handled under a consumer span that is a child
+// of the producer's span, with the producer's baggage, both restored from
+// the message's headers. A message that handle fails
+// is retried with backoff up to busMaxAttempts times, then dead-lettered.
+func (b *messageBus) Subscribe(topic, consumer string, handle func(context.Context, Message) error) {
+	ch := make(chan Message, 100)
+	b.mu.Lock()
+	b.subscribers[topic] = append(b.subscribers[topic], subscription{consumer: consumer, ch: ch})
+	b.mu.Unlock()
+	busBacklog.WithLabelValues(topic, consumer).Set(0)
+
+	go func() {
+		for msg := range ch {
+			busBacklog.WithLabelValues(topic, consumer).Dec()
+			lag := time.Since(msg.PublishedAt)
+			busConsumerLag.WithLabelValues(topic, consumer).Observe(lag.Seconds())
+			busEndToEndDelay.WithLabelValues(topic, consumer).Observe(time.Since(msg.CreatedAt).Seconds())
+
+			ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(msg.Headers))
+			ctx, span := otel.Tracer("go.opentelemetry.io/bus").Start(ctx, topic+" process",
+				trace.WithSpanKind(trace.SpanKindConsumer),
+				trace.WithAttributes(
+					attribute.String("messaging.system", "in-process"),
+					attribute.String("messaging.destination.name", topic),
+					attribute.String("messaging.consumer.group.name", consumer),
+					attribute.String("messaging.message.id", msg.Key),
+					attribute.Int64("messaging.consumer.lag_ms", lag.Milliseconds()),
+				),
+			)
+			handleWithRetries(ctx, consumer, msg, handle)
+			span.End()
+		}
+	}()
+	slog.Info("Subscribed to topic", "topic", topic, "consumer", consumer)
+}
+
+// handleWithRetries calls handle until it succeeds or has failed
+// busMaxAttempts times, recording each failure on the consumer span and
+// moving the message to the dead letter queue after the last one.
+func handleWithRetries(ctx context.Context, consumer string, msg Message, handle func(context.Context, Message) error) {
+	span := trace.SpanFromContext(ctx)
+	for attempt := 1; ; attempt++ {
+		err := handle(ctx, msg)
+		if err == nil {
+			span.SetAttributes(attribute.Int("messaging.attempts", attempt))
+			return
+		}
+
+		span.AddEvent("handle-failed", trace.WithAttributes(
+			attribute.Int("messaging.attempt", attempt),
+			attribute.String("error.message", err.Error()),
+		))
+		if attempt >= busMaxAttempts {
+			letter := dlq.Add(msg, consumer, err, attempt)
+			span.AddEvent("dead-lettered", trace.WithAttributes(
+				attribute.Int("dlq.id", letter.ID),
+				attribute.String("dlq.reason", err.Error()),
+			))
+			span.SetStatus(codes.Error, err.Error())
+			slog.ErrorContext(ctx, "Message dead-lettered", "topic", msg.Topic, "consumer", consumer, "key", msg.Key, "attempts", attempt, logfields.Error(err))
+			return
+		}
+		time.Sleep(time.Duration(attempt*attempt) * 100 * time.Millisecond)
+	}
+}
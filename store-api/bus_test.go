@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans installs a tracer provider that keeps ended spans in memory,
+// and the propagators main installs, for the rest of the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return recorder
+}
+
+// requestContext returns a context with a request span and tenant=acme in
+// its baggage, as a request that enqueues work would have.
+func requestContext(t *testing.T) (context.Context, trace.Span) {
+	t.Helper()
+	member, err := baggage.NewMember("tenant", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bag, err := baggage.New(member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := baggage.ContextWithBaggage(context.Background(), bag)
+	ctx, span := otel.Tracer("test").Start(ctx, "request")
+	t.Cleanup(func() { span.End() })
+	return ctx, span
+}
+
+// subscribeOnce subscribes to topic on b and returns a channel that gets
+// the context each message is handled with.
+func subscribeOnce(b *messageBus, topic string) <-chan context.Context {
+	handled := make(chan context.Context, 1)
+	b.Subscribe(topic, "test", func(ctx context.Context, _ Message) error {
+		handled <- ctx
+		return nil
+	})
+	return handled
+}
+
+// waitHandled returns the context the next message was handled with.
+func waitHandled(t *testing.T, handled <-chan context.Context) context.Context {
+	t.Helper()
+	select {
+	case ctx := <-handled:
+		return ctx
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was never handled")
+		return nil
+	}
+}
+
+// checkContinues fails the test unless span is a child of parent in the
+// same trace.
+func checkContinues(t *testing.T, span sdktrace.ReadOnlySpan, parent trace.SpanContext) {
+	t.Helper()
+	if got, want := span.SpanContext().TraceID(), parent.TraceID(); got != want {
+		t.Errorf("%s: trace ID = %s, want %s", span.Name(), got, want)
+	}
+	if got, want := span.Parent().SpanID(), parent.SpanID(); got != want {
+		t.Errorf("%s: parent span ID = %s, want %s", span.Name(), got, want)
+	}
+}
+
+// checkBaggage fails the test unless ctx still carries tenant=acme.
+func checkBaggage(t *testing.T, ctx context.Context) {
+	t.Helper()
+	if got := baggage.FromContext(ctx).Member("tenant").Value(); got != "acme" {
+		t.Errorf("baggage tenant = %q, want %q", got, "acme")
+	}
+}
+
+func TestSubscribeContinuesProducerTrace(t *testing.T) {
+	recordSpans(t)
+	ctx, producer := requestContext(t)
+
+	b := &messageBus{subscribers: map[string][]subscription{}}
+	handled := subscribeOnce(b, "test.created")
+	headers := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, headers)
+	b.Publish(ctx, Message{Topic: "test.created", Key: "1", Headers: headers})
+
+	handledCtx := waitHandled(t, handled)
+	consumer, ok := trace.SpanFromContext(handledCtx).(sdktrace.ReadOnlySpan)
+	if !ok {
+		t.Fatal("message was handled without a recording span")
+	}
+	checkContinues(t, consumer, producer.SpanContext())
+	checkBaggage(t, handledCtx)
+}
+
+func TestRedeliverKeepsEventID(t *testing.T) {
+	b := &messageBus{subscribers: map[string][]subscription{}}
+	handled := make(chan Message, 2)
+	b.Subscribe("test.created", "test", func(_ context.Context, msg Message) error {
+		handled <- msg
+		return nil
+	})
+
+	b.Publish(context.Background(), Message{Topic: "test.created", Key: "1"})
+	first := <-handled
+	if first.ID == "" {
+		t.Fatal("published message has no event ID")
+	}
+	if err := b.Redeliver("test", first); err != nil {
+		t.Fatal(err)
+	}
+	if got := (<-handled).ID; got != first.ID {
+		t.Errorf("redelivered event ID = %q, want %q", got, first.ID)
+	}
+}
+
+func TestPublishDeadLettersForFullQueue(t *testing.T) {
+	b := &messageBus{subscribers: map[string][]subscription{
+		"test.created": {{consumer: "stuck", ch: make(chan Message)}},
+	}}
+	before := len(dlq.List())
+
+	// Nothing reads the queue, so this would block if Publish waited
+	b.Publish(context.Background(), Message{Topic: "test.created", Key: "1"})
+
+	letters := dlq.List()
+	if len(letters) != before+1 {
+		t.Fatalf("dead letters = %d, want %d", len(letters), before+1)
+	}
+	if got := letters[len(letters)-1]; got.Consumer != "stuck" || got.Reason != errConsumerQueueFull.Error() {
+		t.Errorf("dead letter = %s for %s, want %s for stuck", got.Reason, got.Consumer, errConsumerQueueFull)
+	}
+	if err := b.Redeliver("stuck", Message{Topic: "test.created"}); err != errConsumerQueueFull {
+		t.Errorf("Redeliver to a full queue = %v, want %v", err, errConsumerQueueFull)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	grpccodes "google.golang.org/grpc/codes"
+
+	"github.com/j6nca/o11y-playground/pkg/model"
+)
+
+// ProductDetail is a product along with the details that take an extra
+// lookup to find.
+type ProductDetail = model.ProductDetail
+
+// catalogLookupDelay simulates the round trip to the database backing the
+// catalog, paid once per lookup regardless of how many products it covers.
+const catalogLookupDelay = 15 * time.Millisecond
+
+// catalogListHandler returns all products, without the slow path /products
+// takes.
+func catalogListHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	products := listProducts()
+	observeAPI("rest", "ListProducts", grpccodes.OK, time.Since(start))
+	writeJSON(w, r, products, time.Since(start))
+}
+
+// catalogItemHandler returns the details of a single product.
+func catalogItemHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		observeAPI("rest", "GetProduct", grpccodes.InvalidArgument, time.Since(start))
+		httpError(w, r, fmt.Errorf("invalid product id %q", r.PathValue("id")), http.StatusBadRequest)
+		return
+	}
+
+	detail, ok := getProduct(r.Context(), id)
+	if !ok {
+		observeAPI("rest", "GetProduct", grpccodes.NotFound, time.Since(start))
+		httpError(w, r, fmt.Errorf("product %d not found", id), http.StatusNotFound)
+		return
+	}
+	observeAPI("rest", "GetProduct", grpccodes.OK, time.Since(start))
+	writeJSON(w, r, detail, time.Since(start))
+}
+
+// DetailsResult is the response to a details lookup: the products found,
+// and the requested ids that weren't.
+type DetailsResult struct {
+	Items  []ProductDetail `json:"items"`
+	Failed []ItemFailure   `json:"failed"`
+}
+
+// catalogDetailsHandler returns the details of every product in the ids
+// query parameter (a comma separated list) in one lookup. Ids that aren't
+// numbers or products are listed as failed, and the response is a 207, so
+// one bad id doesn't fail the lot.
+func catalogDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	raw := r.URL.Query().Get("ids")
+	if raw == "" {
+		httpError(w, r, errors.New("ids is required"), http.StatusBadRequest)
+		return
+	}
+
+	var ids []int
+	result := DetailsResult{Items: []ProductDetail{}, Failed: []ItemFailure{}}
+	requested := strings.Split(raw, ",")
+	var positions []int
+	for i, v := range requested {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			result.Failed = append(result.Failed, ItemFailure{Index: i, Error: fmt.Sprintf("invalid product id %q", v)})
+			continue
+		}
+		ids = append(ids, id)
+		positions = append(positions, i)
+	}
+	if len(ids) > 0 {
+		result.Items = lookupDetails(r.Context(), ids)
+	}
+
+	found := make(map[int]bool, len(result.Items))
+	for _, d := range result.Items {
+		found[d.ID] = true
+	}
+	for i, id := range ids {
+		if !found[id] {
+			result.Failed = append(result.Failed, ItemFailure{Index: positions[i], ID: id, Error: fmt.Sprintf("product %d not found", id)})
+		}
+	}
+	sort.Slice(result.Failed, func(i, j int) bool { return result.Failed[i].Index < result.Failed[j].Index })
+	for _, f := range result.Failed {
+		recordItemFailure(r.Context(), f)
+	}
+	writeItemResults(w, r, result, len(requested), len(result.Failed), time.Since(start))
+}
+
+// lookupDetails fetches details for ids in a single simulated query.
+func lookupDetails(ctx context.Context, ids []int) []ProductDetail {
+	_, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "lookup-product-details")
+	defer span.End()
+	span.SetAttributes(attribute.Int("catalog.products", len(ids)))
+
+	time.Sleep(catalogLookupDelay)
+	levels := stock.Levels()
+
+	details := make([]ProductDetail, 0, len(ids))
+	for _, id := range ids {
+		p, ok := catalog.Get(id)
+		if !ok {
+			continue
+		}
+		details = append(details, ProductDetail{
+			Product:     p,
+			Description: "A lovely " + strings.ToLower(p.Name) + " from the kitchen store.",
+			Stock:       levels[id],
+		})
+	}
+	return details
+}
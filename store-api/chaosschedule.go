@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/baggage"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Gauge of whether each scheduled chaos window is open.
+	chaosWindowActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_chaos_window_active",
+			Help: "Whether each scheduled chaos window is open (1) or not (0).",
+		},
+		[]string{"window"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(chaosWindowActive)
+}
+
+// chaosScheduleInterval is how often windows are checked for opening or
+// closing. Schedules have minute resolution, so this is well within it.
+const chaosScheduleInterval = 10 * time.Second
+
+// maxChaosWindow bounds how long a window may stay open.
+const maxChaosWindow = 24 * time.Hour
+
+// cronField is the set of values a cron field matches, as bits.
+type cronField uint64
+
+func (f cronField) has(v int) bool {
+	return f&(1<<uint(v)) != 0
+}
+
+// cronSchedule is a standard five field cron expression: minute, hour, day
+// of month, month and day of week.
+type cronSchedule struct {
+	minute, hour, dom, month, dow cronField
+	// Day of month and day of week match either way when both are
+	// restricted, as in cron
+	domAny, dowAny bool
+}
+
+// parseCron parses a cron expression such as "0 14 * * 1-5". Fields take
+// *, numbers, ranges, lists and steps such as */15. Names are not
+// supported; days of the week run from 0 (Sunday) to 6, with 7 as Sunday
+// too.
+func parseCron(expr string) (cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var parsed [5]cronField
+	for i, field := range fields {
+		f, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return cronSchedule{}, fmt.Errorf("cron expression %q: %w", expr, err)
+		}
+		parsed[i] = f
+	}
+	if parsed[4].has(7) {
+		parsed[4] |= 1
+	}
+	return cronSchedule{
+		minute: parsed[0], hour: parsed[1], dom: parsed[2], month: parsed[3], dow: parsed[4],
+		domAny: fields[2] == "*", dowAny: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(field string, min, max int) (cronField, error) {
+	var f cronField
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if r, s, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rng, step = r, n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("invalid range %q", part)
+				}
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			f |= 1 << uint(v)
+		}
+	}
+	return f, nil
+}
+
+// matches reports whether the schedule fires in t's minute.
+func (c cronSchedule) matches(t time.Time) bool {
+	if !c.minute.has(t.Minute()) || !c.hour.has(t.Hour()) || !c.month.has(int(t.Month())) {
+		return false
+	}
+	dom, dow := c.dom.has(t.Day()), c.dow.has(int(t.Weekday()))
+	switch {
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// ChaosWindow applies Rule for Duration each time Schedule fires. A window
+// without a Key applies to every request, not just a baggage cohort.
+type ChaosWindow struct {
+	Name     string    `json:"name"`
+	Schedule string    `json:"schedule"`
+	Duration string    `json:"duration"`
+	Rule     FaultRule `json:"rule"`
+	Active   bool      `json:"active"`
+	Next     time.Time `json:"next_start,omitzero"`
+
+	cron     cronSchedule
+	duration time.Duration
+}
+
+// openAt returns when the window last opened if it is open at t.
+func (w *ChaosWindow) openAt(t time.Time) (time.Time, bool) {
+	start := t.Truncate(time.Minute)
+	for s := start; t.Sub(s) < w.duration; s = s.Add(-time.Minute) {
+		if w.cron.matches(s) {
+			return s, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// nextStart returns when the window next opens after t, looking up to a
+// year ahead.
+func (w *ChaosWindow) nextStart(t time.Time) time.Time {
+	s := t.Truncate(time.Minute).Add(time.Minute)
+	for end := s.AddDate(1, 0, 0); s.Before(end); s = s.Add(time.Minute) {
+		if w.cron.matches(s) {
+			return s
+		}
+	}
+	return time.Time{}
+}
+
+// applies reports whether the window's rule covers a request with bag.
+func (w *ChaosWindow) applies(bag baggage.Baggage) bool {
+	return w.Rule.Key == "" || bag.Member(w.Rule.Key).Value() == w.Rule.Value
+}
+
+// parseChaosSchedule parses CHAOS_SCHEDULE, windows separated by
+// semicolons. Each is a cron expression, how long the window stays open,
+// then the fault as key=value pairs as the faults endpoint takes them, e.g.
+// "0 14 * * * 10m latency_ms=300; */30 9-17 * * 1-5 5m error_rate=0.2
+// status_code=503 name=flaky-afternoons". key and value limit a window to
+// a baggage cohort. Windows are named window-1, window-2 and so on unless
+// given a name.
+func parseChaosSchedule(spec string) ([]*ChaosWindow, error) {
+	var windows []*ChaosWindow
+	names := map[string]bool{}
+	for i, entry := range strings.Split(spec, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 6 {
+			return nil, fmt.Errorf("window %q needs a cron expression, a duration and a fault", strings.TrimSpace(entry))
+		}
+		cron, err := parseCron(strings.Join(fields[:5], " "))
+		if err != nil {
+			return nil, err
+		}
+		duration, err := time.ParseDuration(fields[5])
+		if err != nil || duration < time.Minute || duration > maxChaosWindow {
+			return nil, fmt.Errorf("window duration %q must be between 1m and %s", fields[5], maxChaosWindow)
+		}
+
+		w := &ChaosWindow{
+			Name:     "window-" + strconv.Itoa(i+1),
+			Schedule: strings.Join(fields[:5], " "),
+			Duration: duration.String(),
+			Rule:     FaultRule{StatusCode: http.StatusInternalServerError},
+			cron:     cron,
+			duration: duration,
+		}
+		for _, param := range fields[6:] {
+			key, value, ok := strings.Cut(param, "=")
+			if !ok {
+				return nil, fmt.Errorf("expected key=value, got %q", param)
+			}
+			switch key {
+			case "name":
+				w.Name = value
+			case "key":
+				w.Rule.Key = value
+			case "value":
+				w.Rule.Value = value
+			case "latency_ms":
+				w.Rule.LatencyMS, err = strconv.Atoi(value)
+			case "error_rate":
+				w.Rule.ErrorRate, err = strconv.ParseFloat(value, 64)
+			case "status_code":
+				w.Rule.StatusCode, err = strconv.Atoi(value)
+			default:
+				return nil, fmt.Errorf("unknown fault parameter %q", key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", key, value)
+			}
+		}
+
+		if (w.Rule.Key == "") != (w.Rule.Value == "") {
+			return nil, fmt.Errorf("window %s needs both key and value, or neither", w.Name)
+		}
+		if w.Rule.LatencyMS <= 0 && w.Rule.ErrorRate <= 0 {
+			return nil, fmt.Errorf("window %s injects nothing, set latency_ms or error_rate", w.Name)
+		}
+		if w.Rule.LatencyMS < 0 || w.Rule.ErrorRate < 0 || w.Rule.ErrorRate > 1 {
+			return nil, fmt.Errorf("window %s: latency_ms must be positive and error_rate between 0 and 1", w.Name)
+		}
+		if w.Rule.StatusCode < 400 || w.Rule.StatusCode > 599 {
+			return nil, fmt.Errorf("window %s: status_code must be an error status", w.Name)
+		}
+		if names[w.Name] {
+			return nil, fmt.Errorf("window name %q is used twice", w.Name)
+		}
+		names[w.Name] = true
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// chaosScheduler opens and closes the configured windows as their schedules
+// say, in the service's local time zone.
+type chaosScheduler struct {
+	mu      sync.RWMutex
+	windows []*ChaosWindow
+	since   map[string]time.Time
+}
+
+var chaosSchedule = &chaosScheduler{since: map[string]time.Time{}}
+
+// Run checks the windows every interval, forever.
+func (s *chaosScheduler) Run(windows []*ChaosWindow) {
+	s.mu.Lock()
+	s.windows = windows
+	s.mu.Unlock()
+	for _, w := range windows {
+		chaosWindowActive.WithLabelValues(w.Name).Set(0)
+	}
+	s.check(time.Now())
+	for range time.Tick(chaosScheduleInterval) {
+		s.check(time.Now())
+	}
+}
+
+// check opens the windows due to be open at now and closes the rest.
+func (s *chaosScheduler) check(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range s.windows {
+		opened, open := w.openAt(now)
+		switch {
+		case open && !w.Active:
+			w.Active, s.since[w.Name] = true, opened
+			chaosWindowActive.WithLabelValues(w.Name).Set(1)
+			slog.Warn("Chaos window opened", "window", w.Name, "schedule", w.Schedule, "until", opened.Add(w.duration), "latency_ms", w.Rule.LatencyMS, "error_rate", w.Rule.ErrorRate)
+		case !open && w.Active:
+			w.Active = false
+			chaosWindowActive.WithLabelValues(w.Name).Set(0)
+			slog.Info("Chaos window closed", "window", w.Name, logfields.Duration(now.Sub(s.since[w.Name])))
+		}
+	}
+}
+
+// match returns the rule of the first open window covering bag, with the
+// window's name as its cohort so the metrics and spans say which window
+// it was.
+func (s *chaosScheduler) match(bag baggage.Baggage) (FaultRule, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, w := range s.windows {
+		if w.Active && w.applies(bag) {
+			return FaultRule{Key: "window", Value: w.Name, LatencyMS: w.Rule.LatencyMS, ErrorRate: w.Rule.ErrorRate, StatusCode: w.Rule.StatusCode}, true
+		}
+	}
+	return FaultRule{}, false
+}
+
+// Windows returns the configured windows and when each next opens.
+func (s *chaosScheduler) Windows() []ChaosWindow {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	windows := make([]ChaosWindow, 0, len(s.windows))
+	for _, w := range s.windows {
+		window := *w
+		window.Next = w.nextStart(now)
+		windows = append(windows, window)
+	}
+	return windows
+}
+
+// chaosScheduleHandler lists the scheduled chaos windows. They come from
+// CHAOS_SCHEDULE, so they survive restarts; changing them means changing
+// the config.
+func chaosScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, r, chaosSchedule.Windows(), 0)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+var (
+	// Gauge of the offset the clock skew chaos mode adds to span timestamps.
+	clockSkewSeconds = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_clock_skew_seconds",
+			Help: "Offset added to exported span timestamps by the clock skew chaos mode.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(clockSkewSeconds)
+}
+
+// clockSkew is the offset added to the timestamps of every span this
+// service exports.
+var clockSkew atomic.Int64
+
+// setClockSkew changes the offset applied to spans ending from now on.
+func setClockSkew(offset time.Duration) {
+	clockSkew.Store(int64(offset))
+	clockSkewSeconds.Set(offset.Seconds())
+	if offset != 0 {
+		slog.Warn("Skewing span timestamps", "offset", offset.String())
+	}
+}
+
+// skewProcessor shifts the timestamps of ended spans before handing them to
+// the next processor, as if this service's clock were off. Because the
+// callers' clocks are not, the usual clock skew artifacts show up in Tempo:
+// a positive offset puts our spans after their parent has ended, a negative
+// one starts them before their parent did. OnStart, ForceFlush and Shutdown
+// pass straight through.
+type skewProcessor struct {
+	sdktrace.SpanProcessor
+}
+
+func (p skewProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	if offset := time.Duration(clockSkew.Load()); offset != 0 {
+		s = skewedSpan{ReadOnlySpan: s, offset: offset}
+	}
+	p.SpanProcessor.OnEnd(s)
+}
+
+// skewedSpan is a span seen through a skewed clock.
+type skewedSpan struct {
+	sdktrace.ReadOnlySpan
+	offset time.Duration
+}
+
+func (s skewedSpan) StartTime() time.Time {
+	return s.ReadOnlySpan.StartTime().Add(s.offset)
+}
+
+func (s skewedSpan) EndTime() time.Time {
+	return s.ReadOnlySpan.EndTime().Add(s.offset)
+}
+
+func (s skewedSpan) Events() []sdktrace.Event {
+	events := s.ReadOnlySpan.Events()
+	skewed := make([]sdktrace.Event, len(events))
+	for i, e := range events {
+		e.Time = e.Time.Add(s.offset)
+		skewed[i] = e
+	}
+	return skewed
+}
+
+// clockSkewHandler controls the clock skew chaos mode: POST sets the offset
+// from the offset_ms query parameter (negative to run behind), DELETE
+// resets it to zero.
+func clockSkewHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		ms, err := strconv.Atoi(r.URL.Query().Get("offset_ms"))
+		if err != nil {
+			httpError(w, r, errors.New("offset_ms must be a number of milliseconds"), http.StatusBadRequest)
+			return
+		}
+		setClockSkew(time.Duration(ms) * time.Millisecond)
+	case http.MethodDelete:
+		setClockSkew(0)
+	default:
+		httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, r, map[string]any{"offset_ms": time.Duration(clockSkew.Load()).Milliseconds()}, 0)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"connectrpc.com/connect"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+	"github.com/j6nca/o11y-playground/pkg/model/modelpb"
+	"store-api/pkg/storepb"
+	"store-api/pkg/storepb/storepbconnect"
+)
+
+// connectHandler serves StoreService on the app port, where Connect
+// clients (and gRPC and gRPC-Web ones, which the same routes accept) can
+// reach it next to the REST API. It returns the path to mount it on.
+func connectHandler() (string, http.Handler) {
+	return storepbconnect.NewStoreServiceHandler(connectStore{},
+		connect.WithInterceptors(connectObserver{}),
+	)
+}
+
+// connectObserver records the calls served over Connect: unary calls as
+// product API calls, labelled with the protocol the client spoke, and
+// streams like the gRPC listener's, counted while open along with the
+// messages sent on them.
+type connectObserver struct{}
+
+func (connectObserver) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		start := time.Now()
+		resp, err := next(ctx, req)
+
+		service, method, _ := strings.Cut(strings.TrimPrefix(req.Spec().Procedure, "/"), "/")
+		code := grpccodes.OK
+		if err != nil {
+			code = grpccodes.Code(connect.CodeOf(err))
+		}
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String("rpc.system", req.Peer().Protocol),
+			attribute.String("rpc.service", service),
+			attribute.String("rpc.method", method),
+		)
+		observeAPI(req.Peer().Protocol, method, code, time.Since(start))
+		return resp, err
+	}
+}
+
+// WrapStreamingClient leaves client streams alone, as store-api only
+// serves StoreService.
+func (connectObserver) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return next
+}
+
+func (connectObserver) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		start := time.Now()
+		procedure := conn.Spec().Procedure
+		grpcStreamsActive.WithLabelValues(procedure).Inc()
+		defer grpcStreamsActive.WithLabelValues(procedure).Dec()
+
+		stream := &countingConn{StreamingHandlerConn: conn}
+		err := next(ctx, stream)
+
+		service, method, _ := strings.Cut(strings.TrimPrefix(procedure, "/"), "/")
+		code := grpccodes.OK
+		if err != nil {
+			code = grpccodes.Code(connect.CodeOf(err))
+		}
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(
+			attribute.String("rpc.system", conn.Peer().Protocol),
+			attribute.String("rpc.service", service),
+			attribute.String("rpc.method", method),
+			attribute.Int("rpc.messages_sent", stream.sent),
+		)
+		// A client hanging up is how a watch normally ends
+		if err != nil && code != grpccodes.Canceled {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		grpcStreams.WithLabelValues(procedure, code.String()).Inc()
+		slog.InfoContext(ctx, "Stream finished", logfields.Method(procedure), "protocol", conn.Peer().Protocol, "code", code.String(), "messages_sent", stream.sent, logfields.Duration(time.Since(start)))
+		return err
+	}
+}
+
+// countingConn is a Connect server stream that counts the messages sent on
+// it.
+type countingConn struct {
+	connect.StreamingHandlerConn
+	sent int
+}
+
+func (c *countingConn) Send(msg any) error {
+	if err := c.StreamingHandlerConn.Send(msg); err != nil {
+		return err
+	}
+	c.sent++
+	grpcMessagesSent.WithLabelValues(c.Spec().Procedure).Inc()
+	return nil
+}
+
+// connectStore implements StoreService for Connect on top of the gRPC
+// implementation.
+type connectStore struct{}
+
+func (connectStore) WatchStock(ctx context.Context, req *connect.Request[storepb.WatchStockRequest], stream *connect.ServerStream[storepb.StockUpdate]) error {
+	return connectError(watchStock(ctx, req.Msg.GetProductIds(), stream.Send))
+}
+
+func (connectStore) ListProducts(ctx context.Context, req *connect.Request[storepb.ListProductsRequest]) (*connect.Response[storepb.ListProductsResponse], error) {
+	resp, err := storeService{}.ListProducts(ctx, req.Msg)
+	if err != nil {
+		return nil, connectError(err)
+	}
+	return connect.NewResponse(resp), nil
+}
+
+func (connectStore) GetProduct(ctx context.Context, req *connect.Request[storepb.GetProductRequest]) (*connect.Response[modelpb.ProductDetail], error) {
+	resp, err := storeService{}.GetProduct(ctx, req.Msg)
+	if err != nil {
+		return nil, connectError(err)
+	}
+	return connect.NewResponse(resp), nil
+}
+
+// connectError turns a gRPC status error into the Connect error with the
+// same code, which Connect numbers the same way.
+func connectError(err error) error {
+	if err == nil {
+		return nil
+	}
+	s := status.Convert(err)
+	return connect.NewError(connect.Code(s.Code()), errors.New(s.Message()))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"connectrpc.com/connect"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"store-api/pkg/storepb"
+	"store-api/pkg/storepb/storepbconnect"
+)
+
+func TestConnectObserverCountsStreams(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle(connectHandler())
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	procedure := storepbconnect.StoreServiceWatchStockProcedure
+	finished := grpcStreams.WithLabelValues(procedure, "InvalidArgument")
+	before := testutil.ToFloat64(finished)
+
+	client := storepbconnect.NewStoreServiceClient(server.Client(), server.URL)
+	stream, err := client.WatchStock(context.Background(), connect.NewRequest(&storepb.WatchStockRequest{ProductIds: []int64{-1}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for stream.Receive() {
+		t.Error("got a stock update for an unknown product")
+	}
+	if got := connect.CodeOf(stream.Err()); got != connect.CodeInvalidArgument {
+		t.Fatalf("stream ended with %v, want %v", got, connect.CodeInvalidArgument)
+	}
+
+	if got := testutil.ToFloat64(finished) - before; got != 1 {
+		t.Errorf("streams finished with InvalidArgument = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(grpcStreamsActive.WithLabelValues(procedure)); got != 0 {
+		t.Errorf("active streams = %v, want 0", got)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// exitAfter logs why, waits delay and then exits the process with code,
+// skipping every deferred shutdown along the way. As far as dashboards are
+// concerned it is a crash: scrapes stop, buffered spans are lost and the
+// container restarts.
+func exitAfter(delay time.Duration, code int, reason string) {
+	slog.Error("Exiting on purpose", "exit_code", code, "delay_ms", delay.Milliseconds(), "reason", reason)
+	time.Sleep(delay)
+	os.Exit(code)
+}
+
+// crashOnStartup exits with code, probability of the time, after delay. Set
+// high enough, the restart policy turns this into a crash loop.
+func crashOnStartup(probability float64, code int, delay time.Duration) {
+	if probability <= 0 || rand.Float64() >= probability {
+		return
+	}
+	go exitAfter(delay, code, "startup chaos")
+}
+
+// exitHandler makes the service exit with the code query parameter (1 by
+// default) after delay_ms, once the response has gone out.
+func exitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	code, err := strconv.Atoi(r.URL.Query().Get("code"))
+	if err != nil {
+		code = 1
+	}
+	delayMS, err := strconv.Atoi(r.URL.Query().Get("delay_ms"))
+	if err != nil || delayMS < 0 {
+		delayMS = 500
+	}
+
+	go exitAfter(time.Duration(delayMS)*time.Millisecond, code, "requested by "+callerName(r))
+
+	requestCount.WithLabelValues(routeTarget(r), r.Method, strconv.Itoa(http.StatusAccepted)).Inc()
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Exiting with code %d in %d ms.\n", code, delayMS)
+}
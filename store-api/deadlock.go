@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+)
+
+var (
+	// Gauge of goroutines stuck in a simulated deadlock.
+	deadlockedGoroutines = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_deadlocked_goroutines",
+			Help: "Number of goroutines blocked in a simulated deadlock.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(deadlockedGoroutines)
+}
+
+// deadlockHandler creates a classic lock-ordering deadlock: two goroutines
+// each take one lock and then wait forever for the other's. The rest of the
+// service keeps working, but the pair never finishes, so they show up in
+// the goroutine dump at /debug/pprof/goroutine?debug=2 and in go_goroutines.
+func deadlockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(r.Context(), "deadlock-handler")
+	defer span.End()
+
+	var ordersLock, paymentsLock sync.Mutex
+	go lockInOrder("orders-then-payments", &ordersLock, &paymentsLock)
+	go lockInOrder("payments-then-orders", &paymentsLock, &ordersLock)
+
+	slog.WarnContext(ctx, "Started simulated deadlock")
+	requestCount.WithLabelValues(routeTarget(r), r.Method, strconv.Itoa(http.StatusAccepted)).Inc()
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Started two deadlocked goroutines. Inspect them at /debug/pprof/goroutine?debug=2\n")
+}
+
+// lockInOrder takes first, pauses long enough for its partner to take the
+// other lock, then blocks forever trying to take second.
+func lockInOrder(name string, first, second *sync.Mutex) {
+	first.Lock()
+	time.Sleep(100 * time.Millisecond)
+
+	slog.Warn("Goroutine waiting for second lock", "goroutine", name)
+	deadlockedGoroutines.Inc()
+	second.Lock()
+
+	// Never reached
+	deadlockedGoroutines.Dec()
+	second.Unlock()
+	first.Unlock()
+}
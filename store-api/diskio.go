@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Count bytes written to disk by the I/O work endpoint.
+	diskBytesWritten = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "go_app_disk_bytes_written_total",
+			Help: "Total number of bytes written to disk.",
+		},
+	)
+
+	// Histogram of disk operation latencies, by operation.
+	diskOpDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_disk_operation_duration_seconds",
+			Help:    "Disk operation latency in seconds.",
+			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"operation"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(diskBytesWritten, diskOpDuration)
+}
+
+// maxDiskWorkMB caps how much a single request may write.
+const maxDiskWorkMB = 500
+
+// diskIOHandler writes mb megabytes to a temp file in 1MB chunks, fsyncing
+// after each one. The time goes on waiting for the disk rather than burning
+// CPU, so it barely registers in a CPU profile but dominates the trace.
+func diskIOHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(r.Context(), "disk-io-handler")
+	defer span.End()
+	start := time.Now()
+
+	mb, err := strconv.Atoi(r.URL.Query().Get("mb"))
+	if err != nil || mb <= 0 {
+		mb = 50
+	}
+	mb = min(mb, maxDiskWorkMB)
+	span.SetAttributes(attribute.Int("io.megabytes", mb))
+
+	if err := writeAndSync(ctx, mb); err != nil {
+		httpError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	duration := time.Since(start)
+	slog.InfoContext(ctx, "Disk work completed", "megabytes", mb, logfields.Duration(duration))
+	requestCount.WithLabelValues(routeTarget(r), r.Method, strconv.Itoa(http.StatusOK)).Inc()
+	requestLatency.WithLabelValues(routeTarget(r)).Observe(duration.Seconds())
+	fmt.Fprintf(w, "Wrote and synced %d MB in %d ms.\n", mb, duration.Milliseconds())
+}
+
+// writeAndSync writes mb chunks of 1MB to a new temp file, with a span for
+// each write and each fsync, then removes the file.
+func writeAndSync(ctx context.Context, mb int) error {
+	tracer := otel.Tracer("go.opentelemetry.io/http")
+
+	f, err := os.CreateTemp("", "store-api-io-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	chunk := make([]byte, 1<<20)
+	for i := range chunk {
+		chunk[i] = byte(i)
+	}
+
+	for i := 0; i < mb; i++ {
+		_, span := tracer.Start(ctx, "disk-write")
+		start := time.Now()
+		n, err := f.Write(chunk)
+		diskOpDuration.WithLabelValues("write").Observe(time.Since(start).Seconds())
+		diskBytesWritten.Add(float64(n))
+		span.SetAttributes(attribute.Int("io.bytes", n))
+		span.End()
+		if err != nil {
+			return fmt.Errorf("failed to write chunk %d: %w", i, err)
+		}
+
+		_, span = tracer.Start(ctx, "disk-fsync")
+		start = time.Now()
+		err = f.Sync()
+		diskOpDuration.WithLabelValues("fsync").Observe(time.Since(start).Seconds())
+		span.End()
+		if err != nil {
+			return fmt.Errorf("failed to sync chunk %d: %w", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Count messages given up on after every retry failed.
+	dlqMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dlq_messages_total",
+			Help: "Total number of messages moved to the dead letter queue, by topic and consumer.",
+		},
+		[]string{"topic", "consumer"},
+	)
+
+	// Gauge of messages sitting in the dead letter queue.
+	dlqSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dlq_messages",
+			Help: "Number of messages currently in the dead letter queue.",
+		},
+	)
+
+	// Count dead letters sent back to their consumer.
+	dlqReplayed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dlq_messages_replayed_total",
+			Help: "Total number of dead letters replayed to their consumer, by topic and consumer.",
+		},
+		[]string{"topic", "consumer"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(dlqMessages, dlqSize, dlqReplayed)
+}
+
+// DeadLetter is a message a consumer failed to handle on every attempt,
+// kept with the reason for its last failure so it can be inspected and,
+// once the problem is fixed, replayed.
+type DeadLetter struct {
+	ID       int       `json:"id"`
+	Topic    string    `json:"topic"`
+	Consumer string    `json:"consumer"`
+	Key      string    `json:"key"`
+	Payload  string    `json:"payload"`
+	Reason   string    `json:"reason"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed_at"`
+	message  Message
+}
+
+// deadLetterQueue holds dead letters in memory until they are replayed.
+type deadLetterQueue struct {
+	mu      sync.Mutex
+	nextID  int
+	letters []DeadLetter
+}
+
+var dlq = &deadLetterQueue{nextID: 1}
+
+// Add stores msg as a dead letter for consumer.
+func (q *deadLetterQueue) Add(msg Message, consumer string, err error, attempts int) DeadLetter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	letter := DeadLetter{
+		ID:       q.nextID,
+		Topic:    msg.Topic,
+		Consumer: consumer,
+		Key:      msg.Key,
+		Payload:  string(msg.Payload),
+		Reason:   err.Error(),
+		Attempts: attempts,
+		FailedAt: time.Now(),
+		message:  msg,
+	}
+	q.nextID++
+	q.letters = append(q.letters, letter)
+
+	dlqMessages.WithLabelValues(msg.Topic, consumer).Inc()
+	dlqSize.Set(float64(len(q.letters)))
+	return letter
+}
+
+// List returns every dead letter, oldest first.
+func (q *deadLetterQueue) List() []DeadLetter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]DeadLetter{}, q.letters...)
+}
+
+// Take removes and returns the dead letter with id, if there is one.
+func (q *deadLetterQueue) Take(id int) (DeadLetter, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, letter := range q.letters {
+		if letter.ID == id {
+			q.letters = append(q.letters[:i], q.letters[i+1:]...)
+			dlqSize.Set(float64(len(q.letters)))
+			return letter, true
+		}
+	}
+	return DeadLetter{}, false
+}
+
+// TakeAll removes and returns every dead letter.
+func (q *deadLetterQueue) TakeAll() []DeadLetter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	taken := q.letters
+	q.letters = nil
+	dlqSize.Set(0)
+	return taken
+}
+
+// dlqHandler lists dead letters on GET. POST replays the dead letter given
+// by the id query parameter, or every one with all=true, to the consumer
+// that failed it, and DELETE discards it.
+func dlqHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, r, dlq.List(), 0)
+		return
+	case http.MethodPost, http.MethodDelete:
+	default:
+		httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var letters []DeadLetter
+	if r.URL.Query().Get("all") == "true" {
+		letters = dlq.TakeAll()
+	} else {
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil || id <= 0 {
+			httpError(w, r, errors.New("id must be a dead letter ID, or all=true for every one"), http.StatusBadRequest)
+			return
+		}
+		letter, ok := dlq.Take(id)
+		if !ok {
+			httpError(w, r, errors.New("no such dead letter"), http.StatusNotFound)
+			return
+		}
+		letters = []DeadLetter{letter}
+	}
+
+	if r.Method == http.MethodPost {
+		for _, letter := range letters {
+			if err := bus.Redeliver(letter.Consumer, letter.message); err != nil {
+				// Keep the letter rather than lose it
+				dlq.Add(letter.message, letter.Consumer, err, letter.Attempts)
+				continue
+			}
+			dlqReplayed.WithLabelValues(letter.Topic, letter.Consumer).Inc()
+		}
+		slog.InfoContext(r.Context(), "Replayed dead letters", "count", len(letters))
+	}
+	writeJSON(w, r, map[string]int{"count": len(letters)}, 0)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDLQHandlerNeedsExplicitTarget(t *testing.T) {
+	dlq.Add(Message{Topic: "test.created", Key: "1"}, "test", errors.New("failed"), 3)
+	defer dlq.TakeAll()
+
+	for _, target := range []string{"/admin/dlq", "/admin/dlq?id=abc", "/admin/dlq?id=0", "/admin/dlq?all=yes"} {
+		for _, method := range []string{http.MethodPost, http.MethodDelete} {
+			w := httptest.NewRecorder()
+			dlqHandler(w, httptest.NewRequest(method, target, nil))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s %s = %d, want %d", method, target, w.Code, http.StatusBadRequest)
+			}
+		}
+	}
+	if len(dlq.List()) == 0 {
+		t.Error("a request without a valid id emptied the dead letter queue")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Count bytes sent by the download endpoint.
+	downloadBytesSent = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "go_app_download_bytes_sent_total",
+			Help: "Total number of bytes sent by the download endpoint.",
+		},
+	)
+
+	// Gauge of the combined send rate of all in-flight downloads.
+	downloadThroughput = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_download_throughput_bytes_per_second",
+			Help: "Combined throughput of in-flight downloads in bytes per second.",
+		},
+	)
+
+	// Gauge of downloads currently in flight.
+	downloadsInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_downloads_in_flight",
+			Help: "Number of downloads currently being sent.",
+		},
+	)
+
+	// Histogram of how long whole transfers took.
+	downloadDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "go_app_download_duration_seconds",
+			Help:    "Time taken to send a whole download in seconds.",
+			Buckets: []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(downloadBytesSent, downloadThroughput, downloadsInFlight, downloadDuration)
+}
+
+const (
+	// maxDownloadMB caps how much a single request may ask for.
+	maxDownloadMB = 1024
+
+	// downloadChunkSize is how much is written between flushes.
+	downloadChunkSize = 64 << 10
+)
+
+// downloadHandler streams mb megabytes of generated data. With rate_mbps
+// set each transfer is paced to that many megabytes a second, otherwise it
+// goes as fast as the network allows, which with a few parallel clients is
+// an easy way to saturate the container's bandwidth.
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(r.Context(), "download-handler")
+	defer span.End()
+	start := time.Now()
+
+	mb, err := strconv.Atoi(r.URL.Query().Get("mb"))
+	if err != nil || mb <= 0 {
+		mb = 10
+	}
+	mb = min(mb, maxDownloadMB)
+	rate, err := strconv.ParseFloat(r.URL.Query().Get("rate_mbps"), 64)
+	if err != nil || rate < 0 {
+		rate = 0
+	}
+	span.SetAttributes(attribute.Int("download.megabytes", mb), attribute.Float64("download.rate_mbps", rate))
+
+	downloadsInFlight.Inc()
+	defer downloadsInFlight.Dec()
+
+	total := int64(mb) << 20
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(total, 10))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="download-%dmb.bin"`, mb))
+	flusher, _ := w.(http.Flusher)
+
+	chunk := make([]byte, downloadChunkSize)
+	for i := range chunk {
+		chunk[i] = byte(i)
+	}
+
+	// Our share of the combined throughput gauge, swapped out as it changes
+	var current float64
+	defer func() { downloadThroughput.Sub(current) }()
+
+	var sent int64
+	for sent < total {
+		n, err := w.Write(chunk[:min(int64(len(chunk)), total-sent)])
+		sent += int64(n)
+		downloadBytesSent.Add(float64(n))
+		if err != nil {
+			// The client hung up, which is theirs to do
+			slog.WarnContext(ctx, "Download aborted", "sent_bytes", sent, logfields.Error(err))
+			span.SetAttributes(attribute.Int64("download.sent_bytes", sent), attribute.Bool("download.aborted", true))
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if rate > 0 {
+			// Sleep off however far ahead of the target rate we are
+			due := start.Add(time.Duration(float64(sent) / (rate * (1 << 20)) * float64(time.Second)))
+			time.Sleep(time.Until(due))
+		}
+
+		bps := float64(sent) / time.Since(start).Seconds()
+		downloadThroughput.Add(bps - current)
+		current = bps
+	}
+
+	duration := time.Since(start)
+	downloadDuration.Observe(duration.Seconds())
+	span.SetAttributes(attribute.Int64("download.sent_bytes", sent))
+	slog.InfoContext(ctx, "Download completed", "megabytes", mb, logfields.Duration(duration))
+	requestCount.WithLabelValues(routeTarget(r), r.Method, strconv.Itoa(http.StatusOK)).Inc()
+	requestLatency.WithLabelValues(routeTarget(r)).Observe(duration.Seconds())
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/j6nca/o11y-playground/pkg/conns"
+	"github.com/j6nca/o11y-playground/pkg/listen"
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Gauge of requests currently being handled.
+	requestsInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_http_requests_in_flight",
+			Help: "Number of HTTP requests currently being handled.",
+		},
+	)
+
+	// Gauge set to 1 once the service has started draining.
+	drainingState = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_draining",
+			Help: "Whether the service is draining connections before shutdown (1) or not (0).",
+		},
+	)
+
+	// Gauge of how long the last drain took.
+	drainDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_drain_duration_seconds",
+			Help: "Time the last connection drain took in seconds.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(requestsInFlight, drainingState, drainDuration)
+}
+
+// draining is set once shutdown has begun. /readyz reports it so load
+// balancers stop sending new work while in-flight requests finish.
+var draining atomic.Bool
+
+// inFlight is the number of requests being handled, mirrored by
+// requestsInFlight but readable while draining.
+var inFlight atomic.Int64
+
+// trackInFlight counts the requests currently inside next.
+func trackInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		requestsInFlight.Inc()
+		defer func() {
+			inFlight.Add(-1)
+			requestsInFlight.Dec()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readyzHandler reports whether the service wants new traffic, which it
+// doesn't until startup has finished or once it has begun draining.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !started.Load() {
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+		return
+	}
+	if draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ready\n"))
+}
+
+// serve runs a server on each listener until one fails or the process is
+// asked to stop, in which case it drains: /readyz starts failing, and after
+// drainDelay (time for load balancers to notice) the servers stop accepting
+// connections and wait up to drainTimeout for in-flight requests to finish.
+func serve(listeners []listen.Listener, drainDelay, drainTimeout time.Duration) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	servers := make([]*http.Server, len(listeners))
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		servers[i] = newServer(l.Handler)
+		servers[i].ConnState = conns.NewTracker(l.Name).ConnState
+		servers[i].RegisterOnShutdown(endStreams)
+		go func() { errs <- servers[i].Serve(l.Listener) }()
+	}
+
+	select {
+	case err := <-errs:
+		slog.Error("Server stopped unexpectedly:", logfields.Error(err))
+		return
+	case <-ctx.Done():
+	}
+
+	start := time.Now()
+	draining.Store(true)
+	drainingState.Set(1)
+	slog.Info("Draining connections", "in_flight", inFlight.Load(), "delay_ms", drainDelay.Milliseconds())
+	time.Sleep(drainDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	shutdownErrs := make([]error, len(servers))
+	for i, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shutdownErrs[i] = server.Shutdown(shutdownCtx)
+		}()
+	}
+	wg.Wait()
+
+	duration := time.Since(start)
+	drainDuration.Set(duration.Seconds())
+	if errors.Is(errors.Join(shutdownErrs...), context.DeadlineExceeded) {
+		slog.Warn("Drain timed out, abandoning requests", "in_flight", inFlight.Load(), logfields.Duration(duration))
+		return
+	}
+	slog.Info("Drain complete", "in_flight", inFlight.Load(), logfields.Duration(duration))
+}
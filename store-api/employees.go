@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// employeeLookupDelay simulates the round trip to the directory backing the
+// org chart, paid once per employee looked up.
+const employeeLookupDelay = 10 * time.Millisecond
+
+var errNoEmployee = errors.New("employee not found")
+
+// lookupEmployee fetches one employee in its own span.
+func lookupEmployee(ctx context.Context, id int) (Employee, error) {
+	_, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "lookup-employee")
+	defer span.End()
+	span.SetAttributes(attribute.Int("employee.id", id))
+
+	time.Sleep(employeeLookupDelay)
+	for _, e := range getEmployees() {
+		if e.ID == id {
+			return e, nil
+		}
+	}
+	span.SetStatus(codes.Error, errNoEmployee.Error())
+	return Employee{}, fmt.Errorf("%w: %d", errNoEmployee, id)
+}
+
+// managementChain looks up employee's managers, nearest first, up to the
+// top of the org chart or levels of them, whichever comes first; a negative
+// levels means no limit. Each lookup nests under the one before it, so the
+// trace is as deep as the chain is long.
+func managementChain(ctx context.Context, employee Employee, levels int) ([]Employee, error) {
+	if employee.ManagerID == 0 || levels == 0 {
+		return nil, nil
+	}
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "walk-org-chart")
+	defer span.End()
+	span.SetAttributes(
+		attribute.Int("employee.id", employee.ID),
+		attribute.Int("employee.manager_id", employee.ManagerID),
+	)
+
+	manager, err := lookupEmployee(ctx, employee.ManagerID)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	above, err := managementChain(ctx, manager, levels-1)
+	if err != nil {
+		return nil, err
+	}
+	return append([]Employee{manager}, above...), nil
+}
+
+// employeeHandler returns a single employee.
+func employeeHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		httpError(w, r, fmt.Errorf("invalid employee id %q", r.PathValue("id")), http.StatusBadRequest)
+		return
+	}
+
+	employee, err := lookupEmployee(r.Context(), id)
+	if err != nil {
+		httpError(w, r, err, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, r, employee, time.Since(start))
+}
+
+// managerHandler returns an employee's manager, or with all=true their
+// whole management chain, nearest first.
+func managerHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		httpError(w, r, fmt.Errorf("invalid employee id %q", r.PathValue("id")), http.StatusBadRequest)
+		return
+	}
+
+	employee, err := lookupEmployee(r.Context(), id)
+	if err != nil {
+		httpError(w, r, err, http.StatusNotFound)
+		return
+	}
+	levels := 1
+	if r.URL.Query().Get("all") == "true" {
+		levels = -1
+	}
+	chain, err := managementChain(r.Context(), employee, levels)
+	if err != nil {
+		// The org chart points at someone who isn't in it
+		httpError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	if levels == 1 {
+		if len(chain) == 0 {
+			httpError(w, r, fmt.Errorf("employee %d has no manager", id), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, r, chain[0], time.Since(start))
+		return
+	}
+	writeJSON(w, r, chain, time.Since(start))
+}
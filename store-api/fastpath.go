@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+// fastPath switches /products to a handler that avoids allocating where it
+// can, so the difference shows up in Pyroscope's alloc profiles and in
+// BenchmarkProductsStandard and BenchmarkProductsFast.
+var fastPath bool
+
+// productsResponse is the encoded catalog, for the catalog version it was
+// encoded from.
+type productsResponse struct {
+	version uint64
+	body    []byte
+}
+
+// productsCache holds the last encoded catalog. Prices from the pricing
+// service vary by request, so it is only used without one.
+var productsCache atomic.Pointer[productsResponse]
+
+// cachedProducts returns the encoded catalog, encoding it again only when
+// the catalog has changed since.
+func cachedProducts(ctx context.Context, target string) ([]byte, error) {
+	version := catalog.Version()
+	if cached := productsCache.Load(); cached != nil && cached.version == version {
+		return cached.body, nil
+	}
+	buf, err := encodeJSON(ctx, target, catalog.List())
+	if err != nil {
+		return nil, err
+	}
+	defer releaseJSON(buf)
+	body := bytes.Clone(buf.Bytes())
+	productsCache.Store(&productsResponse{version: version, body: body})
+	return body, nil
+}
+
+// pooledEncoder is a buffer with an encoder writing to it, reused whole so
+// neither is allocated per response.
+type pooledEncoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+var encoderPool = sync.Pool{
+	New: func() any {
+		e := &pooledEncoder{}
+		e.enc = json.NewEncoder(&e.buf)
+		return e
+	},
+}
+
+// jsonContentType is assigned to the header map directly, since Set would
+// allocate a new slice for it on every response.
+var jsonContentType = []string{"application/json"}
+
+// requestMetrics are the request counter and latency observer for one path,
+// looked up once instead of by label values on every request.
+type requestMetrics struct {
+	count   prometheus.Counter
+	latency prometheus.Observer
+}
+
+func newRequestMetrics(path string) requestMetrics {
+	return requestMetrics{
+		count:   requestCount.WithLabelValues(path, http.MethodGet, strconv.Itoa(http.StatusOK)),
+		latency: requestLatency.WithLabelValues(path),
+	}
+}
+
+var productsMetrics = sync.OnceValue(func() requestMetrics { return newRequestMetrics("/products") })
+
+// The fast path only serves the v1 product schema, so its version header
+// and payload counter are fixed too.
+var (
+	schemaV1Header   = []string{strconv.Itoa(productSchemaV1)}
+	productsSchemaV1 = sync.OnceValue(func() prometheus.Counter { return schemaPayloads.WithLabelValues("/products", schemaV1Header[0]) })
+)
+
+// productsFastHandler serves /products like the usual handler does, with the
+// same spans, logs, metrics and simulated slow lookup, but without the
+// allocations that don't need to happen on every request.
+func productsFastHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(r.Context(), "products-handler")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	slog.InfoContext(ctx, "Received request on products path", logfields.Path(r.URL.Path))
+	start := time.Now()
+	simulateBottleneck(ctx)
+
+	w.Header()[schemaVersionHeader] = schemaV1Header
+	productsSchemaV1().Inc()
+	writeProductsFast(w, r, start, productsMetrics())
+}
+
+// writeProductsFast writes the catalog as the response: the cached encoding
+// without a pricing service, or one encoded with a pooled encoder with one.
+func writeProductsFast(w http.ResponseWriter, r *http.Request, start time.Time, metrics requestMetrics) {
+	ctx := r.Context()
+	var body []byte
+	if pricing == nil {
+		var err error
+		if body, err = cachedProducts(ctx, routeTarget(r)); err != nil {
+			httpError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+	} else {
+		products := catalog.List()
+		flagDegraded(w, r, priceProducts(ctx, products))
+		e := encoderPool.Get().(*pooledEncoder)
+		defer func() {
+			if e.buf.Cap() <= maxPooledBuffer {
+				e.buf.Reset()
+				encoderPool.Put(e)
+			}
+		}()
+		encodeStart := time.Now()
+		err := e.enc.Encode(products)
+		observeCodec(ctx, "encode", routeTarget(r), encodeStart, int64(e.buf.Len()), err)
+		if err != nil {
+			httpError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		body = e.buf.Bytes()
+	}
+
+	duration := time.Since(start)
+	slog.InfoContext(ctx, "Request handled successfully", logfields.Duration(duration))
+	metrics.count.Inc()
+	metrics.latency.Observe(duration.Seconds())
+	w.Header()["Content-Type"] = jsonContentType
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
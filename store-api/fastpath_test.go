@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// discardWriter is a ResponseWriter that throws the response away, reusing
+// its header map so it allocates nothing itself.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+// benchmarkProducts writes the /products response with write on every
+// iteration, without the simulated delay. Records logged meanwhile are
+// dropped, rather than flood the output.
+func benchmarkProducts(b *testing.B, write func(w http.ResponseWriter, r *http.Request)) {
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+
+	r := httptest.NewRequest(http.MethodGet, "/products", nil)
+	r.Pattern = "/products"
+	w := &discardWriter{header: http.Header{}}
+	for b.Loop() {
+		write(w, r)
+	}
+}
+
+func BenchmarkProductsStandard(b *testing.B) {
+	b.ReportAllocs()
+	benchmarkProducts(b, func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		products := catalog.List()
+		priceProducts(r.Context(), products)
+		writeJSON(w, r, products, time.Since(start))
+	})
+}
+
+func BenchmarkProductsFast(b *testing.B) {
+	b.ReportAllocs()
+	metrics := productsMetrics()
+	benchmarkProducts(b, func(w http.ResponseWriter, r *http.Request) {
+		writeProductsFast(w, r, time.Now(), metrics)
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/j6nca/o11y-playground/pkg/listen"
+)
+
+var (
+	// Counter of faults injected by baggage rules, by cohort.
+	faultsInjected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_chaos_faults_injected_total",
+			Help: "Faults injected into requests matching a baggage rule, by cohort and kind.",
+		},
+		[]string{"cohort", "kind"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(faultsInjected)
+}
+
+// FaultRule slows down or fails requests whose baggage has Key set to
+// Value, so a chaos experiment only hits one cohort (user.tier=free, say,
+// or synthetic=true) and its impact can be compared against everyone else.
+type FaultRule struct {
+	Key        string  `json:"key"`
+	Value      string  `json:"value"`
+	LatencyMS  int     `json:"latency_ms"`
+	ErrorRate  float64 `json:"error_rate"`
+	StatusCode int     `json:"status_code"`
+}
+
+// cohort names the requests a rule matches, as in the metrics.
+func (f FaultRule) cohort() string {
+	return f.Key + "=" + f.Value
+}
+
+// faultInjector holds the active rules, keyed by cohort.
+type faultInjector struct {
+	mu    sync.RWMutex
+	rules map[string]FaultRule
+}
+
+var faults = &faultInjector{rules: map[string]FaultRule{}}
+
+// Set adds a rule, replacing any rule for the same cohort.
+func (f *faultInjector) Set(rule FaultRule) error {
+	if rule.Key == "" || rule.Value == "" {
+		return errors.New("key and value are required")
+	}
+	if rule.LatencyMS < 0 || rule.ErrorRate < 0 || rule.ErrorRate > 1 {
+		return errors.New("latency_ms must be positive and error_rate between 0 and 1")
+	}
+	if rule.StatusCode == 0 {
+		rule.StatusCode = http.StatusInternalServerError
+	}
+	if rule.StatusCode < 400 || rule.StatusCode > 599 {
+		return errors.New("status_code must be an error status")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules[rule.cohort()] = rule
+	slog.Warn("Injecting faults for cohort", "cohort", rule.cohort(), "latency_ms", rule.LatencyMS, "error_rate", rule.ErrorRate)
+	return nil
+}
+
+// Remove drops the rule for a cohort, or every rule when key is empty.
+func (f *faultInjector) Remove(key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if key == "" {
+		clear(f.rules)
+	} else {
+		delete(f.rules, key+"="+value)
+	}
+	slog.Info("Stopped injecting faults", "key", key, "value", value, "remaining", len(f.rules))
+}
+
+// Rules returns the active rules, ordered by cohort.
+func (f *faultInjector) Rules() []FaultRule {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	rules := make([]FaultRule, 0, len(f.rules))
+	for _, rule := range f.rules {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].cohort() < rules[j].cohort() })
+	return rules
+}
+
+// match returns the first rule the baggage matches.
+func (f *faultInjector) match(bag baggage.Baggage) (FaultRule, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if len(f.rules) == 0 {
+		return FaultRule{}, false
+	}
+	for _, member := range bag.Members() {
+		if rule, ok := f.rules[member.Key()+"="+member.Value()]; ok {
+			return rule, true
+		}
+	}
+	return FaultRule{}, false
+}
+
+// injectFaults applies the matching fault rule, if any, before next runs,
+// falling back to an open chaos window's, then to the rule degrading the
+// zone serving the request. The cohort is recorded on the
+// span whether or not the dice say fail, so traces of the affected cohort
+// can be found and compared.
+func injectFaults(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bag := baggage.FromContext(r.Context())
+		rule, ok := faults.match(bag)
+		if !ok {
+			rule, ok = chaosSchedule.match(bag)
+		}
+		// A zone outage spares the admin API, so it can be ended
+		if !ok && !listen.IsAdminPath(r.URL.Path) {
+			rule, ok = zoneFault(zoneFromContext(r.Context()))
+		}
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(attribute.String("chaos.cohort", rule.cohort()))
+
+		if rule.LatencyMS > 0 {
+			faultsInjected.WithLabelValues(rule.cohort(), "latency").Inc()
+			span.AddEvent("chaos-latency", trace.WithAttributes(attribute.Int("chaos.latency_ms", rule.LatencyMS)))
+			select {
+			case <-time.After(time.Duration(rule.LatencyMS) * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if rule.ErrorRate > 0 && rand.Float64() < rule.ErrorRate {
+			faultsInjected.WithLabelValues(rule.cohort(), "error").Inc()
+			httpError(w, r, fmt.Errorf("injected fault for cohort %s", rule.cohort()), rule.StatusCode)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// faultsHandler controls baggage-keyed fault injection: POST adds a rule
+// from the key, value, latency_ms, error_rate and status_code query
+// parameters, DELETE removes the rule for key and value (every rule when no
+// key is given). Both return the active rules.
+func faultsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		latency, _ := strconv.Atoi(query.Get("latency_ms"))
+		errorRate, _ := strconv.ParseFloat(query.Get("error_rate"), 64)
+		status, _ := strconv.Atoi(query.Get("status_code"))
+		rule := FaultRule{
+			Key:        query.Get("key"),
+			Value:      query.Get("value"),
+			LatencyMS:  latency,
+			ErrorRate:  errorRate,
+			StatusCode: status,
+		}
+		if err := faults.Set(rule); err != nil {
+			httpError(w, r, err, http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		faults.Remove(query.Get("key"), query.Get("value"))
+	default:
+		httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, r, faults.Rules(), 0)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(newGCCollector())
+}
+
+// gcPauseBuckets are the bounds GC pauses are reported in; the runtime's
+// own histogram has far more buckets than a dashboard needs.
+var gcPauseBuckets = []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1}
+
+// gcCollector exports the GC settings and how the GC behaves under them, read
+// from runtime/metrics at scrape time: how often it runs, how long it stops
+// the world, and how much CPU it costs.
+type gcCollector struct {
+	percent, limit, cycles, cpu, pauses *prometheus.Desc
+}
+
+func newGCCollector() gcCollector {
+	return gcCollector{
+		percent: prometheus.NewDesc("go_app_gc_percent", "Current GOGC value, -1 when the GC is off.", nil, nil),
+		limit:   prometheus.NewDesc("go_app_gc_memory_limit_bytes", "Current GOMEMLIMIT in bytes, math.MaxInt64 when unset.", nil, nil),
+		cycles:  prometheus.NewDesc("go_app_gc_cycles_total", "Total number of completed GC cycles.", nil, nil),
+		cpu:     prometheus.NewDesc("go_app_gc_cpu_seconds_total", "CPU time spent on garbage collection in seconds.", nil, nil),
+		pauses:  prometheus.NewDesc("go_app_gc_pause_seconds", "Stop-the-world pauses caused by the GC in seconds.", nil, nil),
+	}
+}
+
+func (c gcCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.percent
+	ch <- c.limit
+	ch <- c.cycles
+	ch <- c.cpu
+	ch <- c.pauses
+}
+
+func (c gcCollector) Collect(ch chan<- prometheus.Metric) {
+	samples := []metrics.Sample{
+		{Name: "/gc/gogc:percent"},
+		{Name: "/gc/gomemlimit:bytes"},
+		{Name: "/gc/cycles/total:gc-cycles"},
+		{Name: "/cpu/classes/gc/total:cpu-seconds"},
+		{Name: "/sched/pauses/total/gc:seconds"},
+	}
+	metrics.Read(samples)
+
+	// GOGC=off is stored as -1, which comes back as a wrapped uint64
+	ch <- prometheus.MustNewConstMetric(c.percent, prometheus.GaugeValue, float64(int64(samples[0].Value.Uint64())))
+	ch <- prometheus.MustNewConstMetric(c.limit, prometheus.GaugeValue, float64(samples[1].Value.Uint64()))
+	ch <- prometheus.MustNewConstMetric(c.cycles, prometheus.CounterValue, float64(samples[2].Value.Uint64()))
+	ch <- prometheus.MustNewConstMetric(c.cpu, prometheus.CounterValue, samples[3].Value.Float64())
+
+	// Fold the runtime's buckets into ours, estimating the sum from
+	// bucket midpoints
+	hist := samples[4].Value.Float64Histogram()
+	buckets := make(map[float64]uint64, len(gcPauseBuckets))
+	var count uint64
+	var sum float64
+	for i, n := range hist.Counts {
+		if n == 0 {
+			continue
+		}
+		lower, upper := hist.Buckets[i], hist.Buckets[i+1]
+		if math.IsInf(lower, -1) {
+			lower = 0
+		}
+		if math.IsInf(upper, 1) {
+			upper = lower
+		}
+		count += n
+		sum += float64(n) * (lower + upper) / 2
+		for _, bound := range gcPauseBuckets {
+			if upper <= bound {
+				buckets[bound] += n
+			}
+		}
+	}
+	ch <- prometheus.MustNewConstHistogram(c.pauses, count, sum, buckets)
+}
+
+// gcHandler shows the GC settings on GET. POST changes them from the gogc
+// (a percentage, or "off") and memlimit_mb (megabytes, or "off") query
+// parameters, like setting GOGC and GOMEMLIMIT without a restart; with
+// gc=true it also collects and returns freed memory to the OS straight away.
+func gcHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		percent, limit := -2, int64(-2)
+		switch v := query.Get("gogc"); v {
+		case "":
+		case "off":
+			percent = -1
+		default:
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				httpError(w, r, errors.New("gogc must be a percentage or off"), http.StatusBadRequest)
+				return
+			}
+			percent = n
+		}
+		switch v := query.Get("memlimit_mb"); v {
+		case "":
+		case "off":
+			limit = math.MaxInt64
+		default:
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				httpError(w, r, errors.New("memlimit_mb must be a positive number of megabytes or off"), http.StatusBadRequest)
+				return
+			}
+			limit = n << 20
+		}
+
+		if percent != -2 {
+			previous := debug.SetGCPercent(percent)
+			slog.WarnContext(r.Context(), "Changed GOGC", "gogc", percent, "previous", previous)
+		}
+		if limit != -2 {
+			previous := debug.SetMemoryLimit(limit)
+			slog.WarnContext(r.Context(), "Changed GOMEMLIMIT", "bytes", limit, "previous", previous)
+		}
+		if query.Get("gc") == "true" {
+			debug.FreeOSMemory()
+		}
+	default:
+		httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	samples := []metrics.Sample{{Name: "/gc/gogc:percent"}, {Name: "/gc/gomemlimit:bytes"}, {Name: "/gc/cycles/total:gc-cycles"}}
+	metrics.Read(samples)
+	writeJSON(w, r, map[string]any{
+		"gogc":           int64(samples[0].Value.Uint64()),
+		"memlimit_bytes": int64(samples[1].Value.Uint64()),
+		"gc_cycles":      samples[2].Value.Uint64(),
+	}, 0)
+}
@@ -3,39 +3,88 @@ module store-api
 go 1.24
 
 require (
+	connectrpc.com/connect v1.18.1
+	github.com/felixge/httpsnoop v1.0.4
 	github.com/grafana/pyroscope-go v1.2.7
+	github.com/j6nca/o11y-playground/pkg/cgroup v0.0.0
+	github.com/j6nca/o11y-playground/pkg/clientpool v0.0.0
+	github.com/j6nca/o11y-playground/pkg/conns v0.0.0
+	github.com/j6nca/o11y-playground/pkg/errreport v0.0.0
+	github.com/j6nca/o11y-playground/pkg/health v0.0.0
+	github.com/j6nca/o11y-playground/pkg/highres v0.0.0
+	github.com/j6nca/o11y-playground/pkg/listen v0.0.0
+	github.com/j6nca/o11y-playground/pkg/logfields v0.0.0
+	github.com/j6nca/o11y-playground/pkg/model v0.0.0
+	github.com/j6nca/o11y-playground/pkg/overhead v0.0.0
+	github.com/j6nca/o11y-playground/pkg/priority v0.0.0
+	github.com/j6nca/o11y-playground/pkg/profiling v0.0.0
+	github.com/j6nca/o11y-playground/pkg/recorder v0.0.0
+	github.com/j6nca/o11y-playground/pkg/remotewrite v0.0.0
+	github.com/j6nca/o11y-playground/pkg/routelimit v0.0.0
+	github.com/j6nca/o11y-playground/pkg/routetimeout v0.0.0
+	github.com/j6nca/o11y-playground/pkg/servicegraph v0.0.0
+	github.com/j6nca/o11y-playground/pkg/spanaudit v0.0.0
+	github.com/j6nca/o11y-playground/pkg/telemetry v0.0.0
+	github.com/j6nca/o11y-playground/pkg/tracehints v0.0.0
 	github.com/prometheus/client_golang v1.23.0
+	github.com/prometheus/client_model v0.6.2
 	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.63.0
 	go.opentelemetry.io/otel v1.38.0
 	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.38.0
+	go.opentelemetry.io/otel/exporters/prometheus v0.60.0
 	go.opentelemetry.io/otel/sdk v1.38.0
+	go.opentelemetry.io/otel/sdk/metric v1.38.0
+	go.opentelemetry.io/otel/trace v1.38.0
 	google.golang.org/grpc v1.75.0
+	google.golang.org/protobuf v1.36.8
 )
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cenkalti/backoff/v5 v5.0.3 // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
-	github.com/felixge/httpsnoop v1.0.4 // indirect
 	github.com/go-logr/logr v1.4.3 // indirect
 	github.com/go-logr/stdr v1.2.2 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/grafana/pyroscope-go/godeltaprof v0.1.9 // indirect
+	github.com/grafana/regexp v0.0.0-20240518133315-a468a5bfb3bc // indirect
 	github.com/grpc-ecosystem/grpc-gateway/v2 v2.27.2 // indirect
 	github.com/klauspost/compress v1.18.0 // indirect
+	github.com/kylelemons/godebug v1.1.0 // indirect
 	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
-	github.com/prometheus/client_model v0.6.2 // indirect
 	github.com/prometheus/common v0.65.0 // indirect
-	github.com/prometheus/procfs v0.16.1 // indirect
+	github.com/prometheus/otlptranslator v0.0.2 // indirect
+	github.com/prometheus/procfs v0.17.0 // indirect
 	go.opentelemetry.io/auto/sdk v1.1.0 // indirect
 	go.opentelemetry.io/otel/exporters/otlp/otlptrace v1.38.0 // indirect
 	go.opentelemetry.io/otel/metric v1.38.0 // indirect
-	go.opentelemetry.io/otel/trace v1.38.0 // indirect
 	go.opentelemetry.io/proto/otlp v1.7.1 // indirect
 	golang.org/x/net v0.43.0 // indirect
 	golang.org/x/sys v0.35.0 // indirect
 	golang.org/x/text v0.28.0 // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20250825161204-c5933d9347a5 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20250825161204-c5933d9347a5 // indirect
-	google.golang.org/protobuf v1.36.8 // indirect
+)
+
+replace (
+	github.com/j6nca/o11y-playground/pkg/cgroup => ../pkg/cgroup
+	github.com/j6nca/o11y-playground/pkg/clientpool => ../pkg/clientpool
+	github.com/j6nca/o11y-playground/pkg/conns => ../pkg/conns
+	github.com/j6nca/o11y-playground/pkg/errreport => ../pkg/errreport
+	github.com/j6nca/o11y-playground/pkg/health => ../pkg/health
+	github.com/j6nca/o11y-playground/pkg/highres => ../pkg/highres
+	github.com/j6nca/o11y-playground/pkg/listen => ../pkg/listen
+	github.com/j6nca/o11y-playground/pkg/logfields => ../pkg/logfields
+	github.com/j6nca/o11y-playground/pkg/model => ../pkg/model
+	github.com/j6nca/o11y-playground/pkg/overhead => ../pkg/overhead
+	github.com/j6nca/o11y-playground/pkg/priority => ../pkg/priority
+	github.com/j6nca/o11y-playground/pkg/profiling => ../pkg/profiling
+	github.com/j6nca/o11y-playground/pkg/recorder => ../pkg/recorder
+	github.com/j6nca/o11y-playground/pkg/remotewrite => ../pkg/remotewrite
+	github.com/j6nca/o11y-playground/pkg/routelimit => ../pkg/routelimit
+	github.com/j6nca/o11y-playground/pkg/routetimeout => ../pkg/routetimeout
+	github.com/j6nca/o11y-playground/pkg/servicegraph => ../pkg/servicegraph
+	github.com/j6nca/o11y-playground/pkg/spanaudit => ../pkg/spanaudit
+	github.com/j6nca/o11y-playground/pkg/telemetry => ../pkg/telemetry
+	github.com/j6nca/o11y-playground/pkg/tracehints => ../pkg/tracehints
 )
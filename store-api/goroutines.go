@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(goroutineCollector{
+		desc: prometheus.NewDesc(
+			"go_app_goroutines_by_state",
+			"Number of goroutines, by scheduler state.",
+			[]string{"state"}, nil,
+		),
+	})
+}
+
+// GoroutineGroup is a set of goroutines sharing a stack.
+type GoroutineGroup struct {
+	Count  int            `json:"count"`
+	States map[string]int `json:"states"`
+	Stack  []string       `json:"stack"`
+}
+
+// GoroutineSummary is the response of the goroutine endpoint.
+type GoroutineSummary struct {
+	Total   int              `json:"total"`
+	ByState map[string]int   `json:"by_state"`
+	Groups  []GoroutineGroup `json:"groups"`
+	Raw     string           `json:"raw,omitempty"`
+}
+
+// goroutine is one goroutine parsed out of a full goroutine dump.
+type goroutine struct {
+	state string
+	stack []string
+}
+
+// goroutineDump returns the full dump of every goroutine's stack, as
+// served by /debug/pprof/goroutine?debug=2.
+func goroutineDump() string {
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 2)
+	return buf.String()
+}
+
+// parseGoroutines splits a full goroutine dump into goroutines. Each one is
+// a header line like "goroutine 7 [chan receive, 2 minutes]:" followed by
+// pairs of function and file:line lines; only the functions are kept, so
+// goroutines parked at the same place group together.
+func parseGoroutines(dump string) []goroutine {
+	var goroutines []goroutine
+	for _, block := range strings.Split(strings.TrimSpace(dump), "\n\n") {
+		lines := strings.Split(block, "\n")
+		header := lines[0]
+		open, end := strings.Index(header, "["), strings.Index(header, "]")
+		if !strings.HasPrefix(header, "goroutine ") || open < 0 || end < open {
+			continue
+		}
+
+		// Drop the ", 5 minutes" a long wait adds to the state
+		state, _, _ := strings.Cut(header[open+1:end], ",")
+
+		var stack []string
+		for _, line := range lines[1:] {
+			if strings.HasPrefix(line, "\t") {
+				continue
+			}
+			// Strip what differs per goroutine: the argument list on a call,
+			// the parent's ID on "created by ... in goroutine 12"
+			if created, _, ok := strings.Cut(line, " in goroutine "); ok {
+				line = created
+			} else if i := strings.LastIndex(line, "("); i > 0 && strings.HasSuffix(line, ")") {
+				line = line[:i]
+			}
+			stack = append(stack, line)
+		}
+		goroutines = append(goroutines, goroutine{state: state, stack: stack})
+	}
+	return goroutines
+}
+
+// summarizeGoroutines groups goroutines by stack, largest group first.
+func summarizeGoroutines(goroutines []goroutine) GoroutineSummary {
+	summary := GoroutineSummary{Total: len(goroutines), ByState: map[string]int{}}
+	groups := map[string]*GoroutineGroup{}
+	for _, g := range goroutines {
+		summary.ByState[g.state]++
+
+		signature := strings.Join(g.stack, "\n")
+		group, ok := groups[signature]
+		if !ok {
+			group = &GoroutineGroup{States: map[string]int{}, Stack: g.stack}
+			groups[signature] = group
+		}
+		group.Count++
+		group.States[g.state]++
+	}
+
+	summary.Groups = make([]GoroutineGroup, 0, len(groups))
+	for _, group := range groups {
+		summary.Groups = append(summary.Groups, *group)
+	}
+	sort.Slice(summary.Groups, func(i, j int) bool { return summary.Groups[i].Count > summary.Groups[j].Count })
+	return summary
+}
+
+// goroutinesHandler returns every goroutine grouped by stack and counted by
+// state, which makes a leak (hundreds of goroutines parked in the same
+// place) stand out immediately. With raw=true the full dump is included too.
+func goroutinesHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	dump := goroutineDump()
+	summary := summarizeGoroutines(parseGoroutines(dump))
+	if r.URL.Query().Get("raw") == "true" {
+		summary.Raw = dump
+	}
+	writeJSON(w, r, summary, time.Since(start))
+}
+
+// goroutineCollector counts goroutines by state (running, chan receive,
+// select, semacquire ...) at scrape time.
+type goroutineCollector struct {
+	desc *prometheus.Desc
+}
+
+func (c goroutineCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c goroutineCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := map[string]int{}
+	for _, g := range parseGoroutines(goroutineDump()) {
+		counts[g.state]++
+	}
+	for state, n := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), state)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+//go:generate protoc -I . -I ../pkg/model --go_out=. --go_opt=module=store-api --go-grpc_out=. --go-grpc_opt=module=store-api --connect-go_out=. --connect-go_opt=module=store-api proto/store.proto
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/j6nca/o11y-playground/pkg/listen"
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+	"github.com/j6nca/o11y-playground/pkg/model/modelpb"
+	"store-api/pkg/storepb"
+)
+
+var (
+	// Gauge of gRPC streams currently open, by method.
+	grpcStreamsActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_grpc_streams_active",
+			Help: "Number of gRPC streams currently open, by method.",
+		},
+		[]string{"method"},
+	)
+
+	// Count messages sent on gRPC streams, by method.
+	grpcMessagesSent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_grpc_stream_messages_sent_total",
+			Help: "Total number of messages sent on gRPC streams, by method.",
+		},
+		[]string{"method"},
+	)
+
+	// Count finished gRPC streams, by method and status code.
+	grpcStreams = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_grpc_streams_total",
+			Help: "Total number of gRPC streams finished, by method and status code.",
+		},
+		[]string{"method", "code"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(grpcStreamsActive, grpcMessagesSent, grpcStreams)
+}
+
+// streamsDone is closed once shutdown begins. Streams never go idle by
+// themselves, so without it they would hold the drain open until it timed
+// out.
+var (
+	streamsDone    = make(chan struct{})
+	endStreamsOnce sync.Once
+)
+
+func endStreams() {
+	endStreamsOnce.Do(func() { close(streamsDone) })
+}
+
+// listenGRPC opens the gRPC listener. The gRPC server is served as a
+// handler by the same h2c capable servers as the REST API, so it drains
+// and has its connections tracked like any other listener.
+func listenGRPC(addr string) (listen.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return listen.Listener{}, err
+	}
+	server := grpc.NewServer(grpc.UnaryInterceptor(traceUnary), grpc.StreamInterceptor(traceStream))
+	storepb.RegisterStoreServiceServer(server, storeService{})
+	// So grpcurl can find its way around without the .proto
+	reflection.Register(server)
+	return listen.Listener{Listener: ln, Name: "grpc", Handler: server}, nil
+}
+
+// traceUnary gives every call a server span, continuing the caller's trace
+// from the request metadata, and records it as a product API call.
+func traceUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	ctx, span := startRPCSpan(ctx, info.FullMethod)
+	defer span.End()
+
+	resp, err := handler(ctx, req)
+
+	code := status.Code(err)
+	span.SetAttributes(attribute.Int("rpc.grpc.status_code", int(code)))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	_, method, _ := strings.Cut(strings.TrimPrefix(info.FullMethod, "/"), "/")
+	observeAPI("grpc", method, code, time.Since(start))
+	return resp, err
+}
+
+// traceStream gives every stream a server span, continuing the caller's
+// trace from the request metadata, and counts the stream while it is open
+// and the messages sent on it.
+func traceStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx, span := startRPCSpan(ss.Context(), info.FullMethod)
+	defer span.End()
+
+	grpcStreamsActive.WithLabelValues(info.FullMethod).Inc()
+	defer grpcStreamsActive.WithLabelValues(info.FullMethod).Dec()
+
+	stream := &countingStream{ServerStream: ss, ctx: ctx, method: info.FullMethod}
+	err := handler(srv, stream)
+
+	code := status.Code(err)
+	span.SetAttributes(
+		attribute.Int("rpc.grpc.status_code", int(code)),
+		attribute.Int("rpc.messages_sent", stream.sent),
+	)
+	// A client hanging up is how a watch normally ends
+	if err != nil && code != grpccodes.Canceled {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	grpcStreams.WithLabelValues(info.FullMethod, code.String()).Inc()
+	slog.InfoContext(ctx, "Stream finished", logfields.Method(info.FullMethod), "code", code.String(), "messages_sent", stream.sent, logfields.Duration(time.Since(start)))
+	return err
+}
+
+// startRPCSpan starts the server span for fullMethod, continuing the trace
+// from the incoming metadata.
+func startRPCSpan(ctx context.Context, fullMethod string) (context.Context, trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	service, method, _ := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	return otel.Tracer("go.opentelemetry.io/grpc").Start(ctx, service+"/"+method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.service", service),
+			attribute.String("rpc.method", method),
+		),
+	)
+}
+
+// countingStream is a server stream that counts the messages sent on it,
+// and carries the stream span in its context.
+type countingStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	method string
+	sent   int
+}
+
+func (s *countingStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *countingStream) SendMsg(m any) error {
+	if err := s.ServerStream.SendMsg(m); err != nil {
+		return err
+	}
+	s.sent++
+	grpcMessagesSent.WithLabelValues(s.method).Inc()
+	return nil
+}
+
+// metadataCarrier lets the propagator read trace context from gRPC
+// metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	return slices.Collect(maps.Keys(c))
+}
+
+// storeService implements the gRPC StoreService.
+type storeService struct {
+	storepb.UnimplementedStoreServiceServer
+}
+
+func (storeService) WatchStock(req *storepb.WatchStockRequest, stream grpc.ServerStreamingServer[storepb.StockUpdate]) error {
+	return watchStock(stream.Context(), req.GetProductIds(), stream.Send)
+}
+
+func (storeService) ListProducts(ctx context.Context, req *storepb.ListProductsRequest) (*storepb.ListProductsResponse, error) {
+	resp := &storepb.ListProductsResponse{}
+	for _, p := range listProducts() {
+		resp.Products = append(resp.Products, productMessage(p))
+	}
+	return resp, nil
+}
+
+func (storeService) GetProduct(ctx context.Context, req *storepb.GetProductRequest) (*modelpb.ProductDetail, error) {
+	detail, ok := getProduct(ctx, int(req.GetId()))
+	if !ok {
+		return nil, status.Errorf(grpccodes.NotFound, "product %d not found", req.GetId())
+	}
+	return productDetailMessage(detail), nil
+}
+
+// watchStock sends the current stock of the products productIDs, then every
+// change to it. Changes the stream fell too far behind to send are counted
+// on the span from the gaps in the versions.
+func watchStock(ctx context.Context, productIDs []int64, send func(*storepb.StockUpdate) error) error {
+	span := trace.SpanFromContext(ctx)
+
+	ids := slices.Sorted(maps.Keys(stock.Levels()))
+	watched := map[int]bool{}
+	for _, id := range productIDs {
+		if _, _, err := stock.Read(int(id)); err != nil {
+			return status.Error(grpccodes.InvalidArgument, err.Error())
+		}
+		watched[int(id)] = true
+	}
+	if len(watched) > 0 {
+		ids = slices.Sorted(maps.Keys(watched))
+	}
+	span.SetAttributes(attribute.IntSlice("stock.product_ids", ids))
+
+	// Watch before reading the current levels, so no change slips in
+	// between the two
+	changes, stop := stock.Watch()
+	defer stop()
+
+	sent := map[int]int{}
+	for _, id := range ids {
+		level, version, _ := stock.Read(id)
+		if err := send(stockUpdate(stockChange{id: id, stock: level, version: version, at: time.Now()})); err != nil {
+			return err
+		}
+		sent[id] = version
+	}
+
+	missed := 0
+	defer func() { span.SetAttributes(attribute.Int("stock.updates_missed", missed)) }()
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-streamsDone:
+			return status.Error(grpccodes.Unavailable, "server shutting down")
+		case change := <-changes:
+			last, ok := sent[change.id]
+			if !ok || change.version <= last {
+				continue
+			}
+			missed += change.version - last - 1
+			if err := send(stockUpdate(change)); err != nil {
+				return err
+			}
+			sent[change.id] = change.version
+		}
+	}
+}
+
+func stockUpdate(change stockChange) *storepb.StockUpdate {
+	return &storepb.StockUpdate{
+		ProductId: int64(change.id),
+		Stock:     int64(change.stock),
+		Version:   int64(change.version),
+		UpdatedAt: timestamppb.New(change.at),
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+// HeapDump describes a heap profile written by the heapdump endpoint.
+type HeapDump struct {
+	Path     string `json:"path"`
+	Bytes    int    `json:"bytes"`
+	Reason   string `json:"reason"`
+	Uploaded bool   `json:"uploaded"`
+}
+
+// heapDumpHandler writes a heap profile to dir, named after the time it
+// was taken, and POSTs a copy to uploadURL if one is set. The reason query
+// parameter is logged alongside the path, so whoever picks the file up later
+// knows why it was taken. The result can be read with `go tool pprof`.
+func heapDumpHandler(dir, uploadURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(r.Context(), "heapdump-handler")
+		defer span.End()
+		start := time.Now()
+
+		reason := r.URL.Query().Get("reason")
+		if reason == "" {
+			reason = "unspecified"
+		}
+
+		// Collect first so the profile reflects live memory, not garbage
+		runtime.GC()
+		var profile bytes.Buffer
+		if err := pprof.Lookup("heap").WriteTo(&profile, 0); err != nil {
+			httpError(w, r, fmt.Errorf("failed to write heap profile: %w", err), http.StatusInternalServerError)
+			return
+		}
+
+		dump := HeapDump{
+			Path:   filepath.Join(dir, fmt.Sprintf("heap-%s.pb.gz", time.Now().UTC().Format("20060102T150405.000"))),
+			Bytes:  profile.Len(),
+			Reason: reason,
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			httpError(w, r, fmt.Errorf("failed to create heap dump directory: %w", err), http.StatusInternalServerError)
+			return
+		}
+		if err := os.WriteFile(dump.Path, profile.Bytes(), 0o644); err != nil {
+			httpError(w, r, fmt.Errorf("failed to save heap dump: %w", err), http.StatusInternalServerError)
+			return
+		}
+
+		if uploadURL != "" {
+			if err := uploadHeapDump(ctx, uploadURL, &profile); err != nil {
+				// The local copy is still there, so this is not fatal
+				slog.WarnContext(ctx, "Failed to upload heap dump", "heapdump_path", dump.Path, logfields.Error(err))
+			} else {
+				dump.Uploaded = true
+			}
+		}
+
+		span.SetAttributes(
+			attribute.String("heapdump.path", dump.Path),
+			attribute.String("heapdump.reason", reason),
+			attribute.Int("heapdump.bytes", dump.Bytes),
+		)
+		slog.InfoContext(ctx, "Heap dump written", "heapdump_path", dump.Path, "reason", reason, "bytes", dump.Bytes, "uploaded", dump.Uploaded)
+		writeJSON(w, r, dump, time.Since(start))
+	}
+}
+
+// uploadHeapDump POSTs profile to url.
+func uploadHeapDump(ctx context.Context, url string, profile *bytes.Buffer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(profile.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	client := http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport), Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+	return nil
+}
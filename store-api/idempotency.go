@@ -0,0 +1,190 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Count requests answered from the idempotency cache instead of being
+	// processed again.
+	idempotentReplays = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "idempotent_replays_total",
+			Help: "Total number of requests replayed from the idempotency cache.",
+		},
+		[]string{"path", "result"},
+	)
+
+	// Count keys dropped before they expired, to keep the cache under its
+	// cap.
+	idempotentEvictions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "idempotent_evictions_total",
+			Help: "Total number of idempotency keys evicted before they expired because the cache was full.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(idempotentReplays, idempotentEvictions)
+}
+
+// idempotencyMaxKeys caps how many keys the order idempotency cache holds,
+// and idempotencySweepInterval is how often expired keys are dropped from
+// it.
+const (
+	idempotencyMaxKeys       = 100000
+	idempotencySweepInterval = time.Minute
+)
+
+// idempotencyCache remembers the result of writes by their Idempotency-Key,
+// so a retried request gets the original result rather than repeating the
+// write. Each entry also remembers a hash of the request body, to catch a
+// key being reused for a different request. A key is reserved before the
+// write starts, so a duplicate arriving while it is still in flight is
+// turned away rather than repeating the write alongside it. Once it holds
+// maxKeys, the key closest to expiring makes room for a new one.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	maxKeys int
+	entries map[string]*list.Element
+	// byExpiry holds the entries soonest to expire first, so sweeping and
+	// evicting only look at the front
+	byExpiry *list.List
+}
+
+type idempotencyEntry struct {
+	key      string
+	bodyHash [32]byte
+	result   any
+	expires  time.Time
+	// pending is set while the request that reserved the key runs
+	pending bool
+}
+
+// idempotencyState is what Reserve found for a key.
+type idempotencyState int
+
+const (
+	// idempotencyReserved means the key was free and is now held for the
+	// caller, who must Store or Release it
+	idempotencyReserved idempotencyState = iota
+	// idempotencyReplay means the key has a stored result for this body
+	idempotencyReplay
+	// idempotencyConflict means the key was used with a different body
+	idempotencyConflict
+	// idempotencyInFlight means another request with the key is running
+	idempotencyInFlight
+)
+
+var orderIdempotency = newIdempotencyCache(24*time.Hour, idempotencyMaxKeys)
+
+func newIdempotencyCache(ttl time.Duration, maxKeys int) *idempotencyCache {
+	return &idempotencyCache{ttl: ttl, maxKeys: maxKeys, entries: map[string]*list.Element{}, byExpiry: list.New()}
+}
+
+// Reserve checks key and, if it is free, holds it for a request with body.
+// For a replay it also returns the stored result.
+func (c *idempotencyCache) Reserve(key string, body []byte) (any, idempotencyState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	hash := sha256.Sum256(body)
+	elem, ok := c.entries[key]
+	if !ok || now.After(elem.Value.(*idempotencyEntry).expires) {
+		if ok {
+			c.remove(elem)
+		} else if len(c.entries) >= c.maxKeys {
+			c.evict()
+		}
+		c.entries[key] = c.byExpiry.PushBack(&idempotencyEntry{key: key, bodyHash: hash, expires: now.Add(c.ttl), pending: true})
+		return nil, idempotencyReserved
+	}
+
+	entry := elem.Value.(*idempotencyEntry)
+	switch {
+	case entry.bodyHash != hash:
+		return nil, idempotencyConflict
+	case entry.pending:
+		return nil, idempotencyInFlight
+	}
+	return entry.result, idempotencyReplay
+}
+
+// Store remembers result for a key the caller reserved.
+func (c *idempotencyCache) Store(key string, result any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		// Evicted while the request ran
+		return
+	}
+	entry := elem.Value.(*idempotencyEntry)
+	entry.result, entry.pending = result, false
+	entry.expires = time.Now().Add(c.ttl)
+	c.byExpiry.MoveToBack(elem)
+}
+
+// Release frees key if the request that reserved it never stored a result,
+// so a failed request can be retried. It does nothing once it has.
+func (c *idempotencyCache) Release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok && elem.Value.(*idempotencyEntry).pending {
+		c.remove(elem)
+	}
+}
+
+// Sweep drops the keys that have expired by now, so keys that are never
+// retried don't pile up.
+func (c *idempotencyCache) Sweep(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.byExpiry.Front(); elem != nil && now.After(elem.Value.(*idempotencyEntry).expires); elem = c.byExpiry.Front() {
+		c.remove(elem)
+	}
+}
+
+// Run sweeps the cache every idempotencySweepInterval, forever.
+func (c *idempotencyCache) Run() {
+	for range time.Tick(idempotencySweepInterval) {
+		c.Sweep(time.Now())
+	}
+}
+
+// evict drops the key closest to expiring to make room for another,
+// passing over keys whose requests are still running, since dropping one
+// would let a duplicate repeat the write. The caller must hold mu.
+func (c *idempotencyCache) evict() {
+	for elem := c.byExpiry.Front(); elem != nil; elem = elem.Next() {
+		if !elem.Value.(*idempotencyEntry).pending {
+			c.remove(elem)
+			idempotentEvictions.Inc()
+			return
+		}
+	}
+}
+
+// remove drops elem's key. The caller must hold mu.
+func (c *idempotencyCache) remove(elem *list.Element) {
+	delete(c.entries, elem.Value.(*idempotencyEntry).key)
+	c.byExpiry.Remove(elem)
+}
+
+// Len returns how many keys are cached.
+func (c *idempotencyCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyCacheEvictsAtCap(t *testing.T) {
+	c := newIdempotencyCache(time.Hour, 3)
+	// Still running, so never evicted, though it is the oldest
+	c.Reserve("pending", nil)
+	for i := range 2 {
+		key := strconv.Itoa(i)
+		c.Reserve(key, nil)
+		c.Store(key, i)
+	}
+	c.Reserve("new", nil)
+
+	if got := c.Len(); got != 3 {
+		t.Errorf("Len() = %d, want 3", got)
+	}
+	if _, state := c.Reserve("pending", nil); state != idempotencyInFlight {
+		t.Errorf("pending key was evicted, Reserve found state %d", state)
+	}
+	if result, state := c.Reserve("1", nil); state != idempotencyReplay || result != 1 {
+		t.Errorf("Reserve(1) = %v, %d, want a replay of 1", result, state)
+	}
+	if _, state := c.Reserve("0", nil); state != idempotencyReserved {
+		t.Errorf("oldest stored key was kept, Reserve found state %d", state)
+	}
+}
+
+func TestIdempotencyCacheSweepDropsExpired(t *testing.T) {
+	c := newIdempotencyCache(time.Minute, 10)
+	c.Reserve("old", nil)
+	c.Store("old", 1)
+	c.Sweep(time.Now())
+	if got := c.Len(); got != 1 {
+		t.Fatalf("Len() after sweeping nothing expired = %d, want 1", got)
+	}
+
+	c.Sweep(time.Now().Add(2 * time.Minute))
+	if got := c.Len(); got != 0 {
+		t.Errorf("Len() after sweeping = %d, want 0", got)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/j6nca/o11y-playground/pkg/listen"
+)
+
+var (
+	// Count requests by the instance, or virtual replica, that served them.
+	instanceRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_instance_requests_total",
+			Help: "Total number of HTTP requests, by the instance or virtual replica that served them, its zone and the status code.",
+		},
+		[]string{"instance_id", "zone", "status_code"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(instanceRequests)
+}
+
+// instanceID tells this process apart from the service's other replicas.
+// It is set at startup, before anything is logged or exported, and goes on
+// the trace and metric resource (so target_info carries it), on every log
+// record and on the profiles.
+var instanceID string
+
+// newInstanceID returns INSTANCE_ID if it is set, or otherwise an ID made
+// from where the service runs: its host, container and listen address. The
+// same place gives the same ID across restarts, so dashboards keep
+// following one series, and replicas get different ones because docker
+// compose and Kubernetes give each its own hostname.
+func newInstanceID(config Config) string {
+	if config.instanceID != "" {
+		return config.instanceID
+	}
+	hostname, _ := os.Hostname()
+	sum := sha256.Sum256([]byte(strings.Join([]string{config.serviceName, hostname, containerID(), config.listenAddr}, "\x00")))
+	return config.serviceName + "-" + hex.EncodeToString(sum[:4])
+}
+
+// replica is a virtual replica serving a request.
+type replica struct {
+	id   string
+	zone string
+}
+
+type replicaKey struct{}
+
+// withReplica marks the requests next serves as served by virtual replica
+// rep.
+func withReplica(rep replica, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), replicaKey{}, rep)))
+	})
+}
+
+// instanceFromContext returns the ID of the instance serving the request
+// in ctx: a virtual replica's, or the process's own.
+func instanceFromContext(ctx context.Context) string {
+	if rep, ok := ctx.Value(replicaKey{}).(replica); ok {
+		return rep.id
+	}
+	return instanceID
+}
+
+// zoneFromContext returns the zone of the instance serving the request in
+// ctx, which for a virtual replica need not be the process's.
+func zoneFromContext(ctx context.Context) string {
+	if rep, ok := ctx.Value(replicaKey{}).(replica); ok {
+		return rep.zone
+	}
+	return instanceZone
+}
+
+// tagInstance counts the request against the instance serving it and its
+// zone. Virtual replicas share the process's resource, so their spans
+// carry their own ID and zone as span attributes instead.
+func tagInstance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, zone := instanceFromContext(r.Context()), zoneFromContext(r.Context())
+		if id != instanceID {
+			span := trace.SpanFromContext(r.Context())
+			span.SetAttributes(attribute.String("service.instance.id", id))
+			if zone != "" {
+				span.SetAttributes(attribute.String("cloud.availability_zone", zone))
+			}
+		}
+
+		status := http.StatusOK
+		w = httpsnoop.Wrap(w, httpsnoop.Hooks{
+			WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+				return func(code int) {
+					status = code
+					next(code)
+				}
+			},
+		})
+		next.ServeHTTP(w, r)
+		instanceRequests.WithLabelValues(id, zone, strconv.Itoa(status)).Inc()
+	})
+}
+
+// replicaAddr is where virtual replica n listens: n ports above appAddr.
+func replicaAddr(appAddr string, n int) (string, error) {
+	host, port, err := net.SplitHostPort(appAddr)
+	if err != nil {
+		return "", err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", fmt.Errorf("invalid port in %q", appAddr)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p+n)), nil
+}
+
+// openReplicas opens the listeners of virtual replicas 1 to n-1, the app
+// listener being replica 0. Each serves handler on a port of its own as an
+// instance of its own, so a single process can stand in for n replicas
+// behind a load balancer, or store-client's static discovery. Replica i is
+// in zones[i % len(zones)], or the process's zone when zones is empty.
+func openReplicas(appAddr string, n int, zones []string, handler http.Handler) ([]listen.Listener, error) {
+	var replicas []listen.Listener
+	for i := 1; i < n; i++ {
+		addr, err := replicaAddr(appAddr, i)
+		if err != nil {
+			listen.Close(replicas)
+			return nil, err
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			listen.Close(replicas)
+			return nil, err
+		}
+		replicas = append(replicas, listen.Listener{
+			Listener: ln,
+			Name:     "replica-" + strconv.Itoa(i),
+			Handler:  withReplica(replica{id: fmt.Sprintf("%s-%d", instanceID, i), zone: replicaZone(zones, i)}, handler),
+		})
+	}
+	return replicas, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Histogram of how long requests waited to acquire the inventory lock.
+	inventoryLockWait = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "go_app_inventory_lock_wait_seconds",
+			Help:    "Time spent waiting for the inventory lock in seconds.",
+			Buckets: []float64{.0001, .0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(inventoryLockWait)
+}
+
+var errOutOfStock = errors.New("out of stock")
+
+// inventory tracks stock levels behind one big lock, which every decrement
+// holds while it "checks the warehouse". Under load the lock becomes the
+// bottleneck, showing up in mutex profiles and the lock-wait histogram.
+//
+// In unsafe mode the lock is skipped entirely: requests get faster, stock
+// counts quietly drift, and `go run -race` reports the data race.
+type inventory struct {
+	mu    sync.Mutex
+	stock []int
+	// versions count the writes to each product's stock, for optimistic
+	// concurrency control
+	versions []int
+	unsafe   bool
+
+	watchMu  sync.Mutex
+	watchers map[chan stockChange]struct{}
+}
+
+// stockChange is a write to a product's stock, as sent to watchers.
+type stockChange struct {
+	id, stock, version int
+	at                 time.Time
+}
+
+var stock = newInventory(10, 1000)
+
+func newInventory(items, initial int) *inventory {
+	inv := &inventory{
+		stock:    make([]int, items+1),
+		versions: make([]int, items+1),
+		watchers: map[chan stockChange]struct{}{},
+	}
+	for id := 1; id <= items; id++ {
+		inv.stock[id] = initial
+	}
+	return inv
+}
+
+// Decrement removes qty of product id from stock, returning what is left.
+func (inv *inventory) Decrement(id, qty int) (int, error) {
+	if id <= 0 || id >= len(inv.stock) {
+		return 0, fmt.Errorf("unknown product %d", id)
+	}
+
+	if !inv.unsafe {
+		waitStart := time.Now()
+		inv.mu.Lock()
+		inventoryLockWait.Observe(time.Since(waitStart).Seconds())
+		defer inv.mu.Unlock()
+	}
+
+	remaining := inv.stock[id]
+	// Simulate checking the warehouse while holding the lock
+	time.Sleep(2 * time.Millisecond)
+	if remaining < qty {
+		return remaining, errOutOfStock
+	}
+	inv.stock[id] = remaining - qty
+	inv.versions[id]++
+	inv.notify(id)
+	return inv.stock[id], nil
+}
+
+// Read returns product id's stock and its version, like a SELECT outside
+// any transaction.
+func (inv *inventory) Read(id int) (stock, version int, err error) {
+	if id <= 0 || id >= len(inv.stock) {
+		return 0, 0, fmt.Errorf("unknown product %d", id)
+	}
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return inv.stock[id], inv.versions[id], nil
+}
+
+// CompareAndSet sets product id's stock if its version is still version,
+// like an UPDATE ... WHERE version = ?, reporting whether it did.
+func (inv *inventory) CompareAndSet(id, version, stock int) bool {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if inv.versions[id] != version {
+		return false
+	}
+	inv.stock[id] = stock
+	inv.versions[id]++
+	inv.notify(id)
+	return true
+}
+
+// Watch returns a channel that receives every change to stock from now
+// on, and a function to stop watching. A watcher that falls behind misses
+// changes rather than holding up the writes; the gap shows in the versions.
+func (inv *inventory) Watch() (<-chan stockChange, func()) {
+	ch := make(chan stockChange, 64)
+	inv.watchMu.Lock()
+	inv.watchers[ch] = struct{}{}
+	inv.watchMu.Unlock()
+	return ch, func() {
+		inv.watchMu.Lock()
+		delete(inv.watchers, ch)
+		inv.watchMu.Unlock()
+	}
+}
+
+// notify tells the watchers about a write to product id, which the caller
+// has just made.
+func (inv *inventory) notify(id int) {
+	change := stockChange{id: id, stock: inv.stock[id], version: inv.versions[id], at: time.Now()}
+	inv.watchMu.Lock()
+	defer inv.watchMu.Unlock()
+	for ch := range inv.watchers {
+		select {
+		case ch <- change:
+		default:
+		}
+	}
+}
+
+// Levels returns the current stock of each product by ID.
+func (inv *inventory) Levels() map[int]int {
+	if !inv.unsafe {
+		inv.mu.Lock()
+		defer inv.mu.Unlock()
+	}
+
+	levels := make(map[int]int, len(inv.stock))
+	for id := 1; id < len(inv.stock); id++ {
+		levels[id] = inv.stock[id]
+	}
+	return levels
+}
+
+// inventoryHandler lists stock levels on GET, and decrements stock on POST
+// using the id and qty query parameters. qty defaults to 1.
+func inventoryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(r.Context(), "inventory-handler")
+	defer span.End()
+	start := time.Now()
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, r, stock.Levels(), time.Since(start))
+	case http.MethodPost:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil || id <= 0 {
+			httpError(w, r, errors.New("id must be a product ID"), http.StatusBadRequest)
+			return
+		}
+		qty := 1
+		if raw := r.URL.Query().Get("qty"); raw != "" {
+			if qty, err = strconv.Atoi(raw); err != nil || qty <= 0 {
+				httpError(w, r, errors.New("qty must be a positive integer"), http.StatusBadRequest)
+				return
+			}
+		}
+		span.SetAttributes(attribute.Int("inventory.product_id", id), attribute.Int("inventory.quantity", qty))
+
+		remaining, err := stock.Decrement(id, qty)
+		switch {
+		case errors.Is(err, errOutOfStock):
+			httpError(w, r, err, http.StatusConflict)
+			return
+		case err != nil:
+			httpError(w, r, err, http.StatusNotFound)
+			return
+		}
+
+		slog.InfoContext(ctx, "Decremented stock", logfields.ProductID(id), "remaining", remaining, logfields.Duration(time.Since(start)))
+		writeJSON(w, r, map[string]int{"id": id, "remaining": remaining}, time.Since(start))
+	default:
+		httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+	}
+}
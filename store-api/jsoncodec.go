@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// Histogram of time spent encoding and decoding JSON.
+	jsonCodecDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_json_codec_duration_seconds",
+			Help:    "Time spent encoding and decoding JSON in seconds, by operation (encode or decode) and target (the route for requests and responses served, the peer for responses received).",
+			Buckets: []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+		},
+		[]string{"operation", "target"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(jsonCodecDuration)
+}
+
+// jsonSpanThreshold is how long encoding or decoding has to take to get a
+// span of its own. Most calls take microseconds, and a span for each would
+// bury the spans around them.
+var jsonSpanThreshold = time.Millisecond
+
+// observeCodec records an encode or decode of size bytes for target that
+// began at start. Whether it is worth a span is only known once it is over,
+// so slow ones get a span after the fact, backdated to when they began.
+func observeCodec(ctx context.Context, operation, target string, start time.Time, size int64, err error) {
+	end := time.Now()
+	duration := end.Sub(start)
+	jsonCodecDuration.WithLabelValues(operation, target).Observe(duration.Seconds())
+	if duration < jsonSpanThreshold {
+		return
+	}
+
+	_, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "json-"+operation,
+		trace.WithTimestamp(start),
+		trace.WithAttributes(
+			attribute.String("json.target", target),
+			attribute.Int64("json.bytes", size),
+		),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+// decodeJSON decodes the JSON read from body into v.
+func decodeJSON(ctx context.Context, target string, body io.Reader, v any) error {
+	start := time.Now()
+	counted := &countingReader{ReadCloser: io.NopCloser(body)}
+	err := json.NewDecoder(counted).Decode(v)
+	observeCodec(ctx, "decode", target, start, counted.n, err)
+	return err
+}
+
+// unmarshalJSON decodes the JSON in data into v.
+func unmarshalJSON(ctx context.Context, target string, data []byte, v any) error {
+	start := time.Now()
+	err := json.Unmarshal(data, v)
+	observeCodec(ctx, "decode", target, start, int64(len(data)), err)
+	return err
+}
+
+// routeTarget is the route a request was served on: the codec target, and
+// what its request metrics are labelled with, so IDs in paths don't each
+// get a series.
+func routeTarget(r *http.Request) string {
+	if r.Pattern == "" {
+		return "unmatched"
+	}
+	return r.Pattern
+}
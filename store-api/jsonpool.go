@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Count encode buffers allocated, by whether pooling was on. With
+	// pooling this levels off once the pool is warm.
+	jsonBuffersAllocated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_json_buffers_allocated_total",
+			Help: "Total number of JSON encode buffers allocated, by whether buffer pooling was enabled.",
+		},
+		[]string{"pooled"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(jsonBuffersAllocated)
+}
+
+// jsonPooling toggles reuse of encode buffers in writeJSON, so the
+// difference shows up side by side in the alloc profiles.
+var jsonPooling bool
+
+// maxPooledBuffer is the largest buffer put back in the pool. One huge
+// response shouldn't pin its buffer in memory forever.
+const maxPooledBuffer = 1 << 20
+
+var jsonBufferPool = sync.Pool{
+	New: func() any {
+		jsonBuffersAllocated.WithLabelValues("true").Inc()
+		return new(bytes.Buffer)
+	},
+}
+
+// encodeJSON encodes v for target into a buffer, taken from the pool when
+// pooling is on. Callers must hand the buffer back with releaseJSON once
+// they are done with it.
+func encodeJSON(ctx context.Context, target string, v any) (*bytes.Buffer, error) {
+	start := time.Now()
+	var buf *bytes.Buffer
+	if jsonPooling {
+		buf = jsonBufferPool.Get().(*bytes.Buffer)
+	} else {
+		jsonBuffersAllocated.WithLabelValues("false").Inc()
+		buf = new(bytes.Buffer)
+	}
+
+	err := json.NewEncoder(buf).Encode(v)
+	observeCodec(ctx, "encode", target, start, int64(buf.Len()), err)
+	if err != nil {
+		releaseJSON(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// releaseJSON returns buf to the pool, if it came from there.
+func releaseJSON(buf *bytes.Buffer) {
+	if !jsonPooling || buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	jsonBufferPool.Put(buf)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// benchmarkEncodeJSON encodes the catalog as writeJSON would, handing each
+// buffer back, with buffer pooling set to pooling.
+func benchmarkEncodeJSON(b *testing.B, pooling bool) {
+	defer func(was bool) { jsonPooling = was }(jsonPooling)
+	jsonPooling = pooling
+
+	ctx := context.Background()
+	products := catalog.List()
+	b.ReportAllocs()
+	for b.Loop() {
+		buf, err := encodeJSON(ctx, "products", products)
+		if err != nil {
+			b.Fatal(err)
+		}
+		releaseJSON(buf)
+	}
+}
+
+func BenchmarkEncodeJSONPooled(b *testing.B) {
+	benchmarkEncodeJSON(b, true)
+}
+
+func BenchmarkEncodeJSONUnpooled(b *testing.B) {
+	benchmarkEncodeJSON(b, false)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Gauge of resources deliberately leaked by the leak chaos mode.
+	leakedResources = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_leaked_resources",
+			Help: "Number of resources leaked by the leak chaos mode, by kind.",
+		},
+		[]string{"kind"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(leakedResources, fdCollector{
+		desc: prometheus.NewDesc(
+			"go_app_open_fds",
+			"Number of open file descriptors, by type.",
+			[]string{"type"}, nil,
+		),
+	})
+}
+
+// leaker is a chaos mode that leaks file handles or HTTP client connections
+// at a steady rate, so fd exhaustion can be rehearsed and spotted on
+// process_open_fds / go_app_open_fds long before it takes the service down.
+type leaker struct {
+	mu     sync.Mutex
+	stop   chan struct{}
+	kind   string
+	rate   int
+	target string
+	leaked []io.Closer
+}
+
+var leaks = &leaker{}
+
+// Start begins leaking rate resources of kind ("file" or "conn") per second,
+// replacing any leak already running. Connections are leaked by calling
+// target and never closing the response.
+func (l *leaker) Start(kind string, rate int, target string) error {
+	if kind != "file" && kind != "conn" {
+		return fmt.Errorf("unknown leak kind %q", kind)
+	}
+	if rate <= 0 {
+		return errors.New("rate must be positive")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop != nil {
+		close(l.stop)
+	}
+	l.stop = make(chan struct{})
+	l.kind, l.rate, l.target = kind, rate, target
+
+	go l.run(l.stop, kind, rate, target)
+	slog.Warn("Started leaking resources", "kind", kind, "rate_per_second", rate)
+	return nil
+}
+
+// Stop stops leaking, optionally releasing everything leaked so far.
+func (l *leaker) Stop(release bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+	if release {
+		for _, c := range l.leaked {
+			c.Close()
+		}
+		l.leaked = nil
+		leakedResources.Reset()
+	}
+	slog.Info("Stopped leaking resources", "released", release)
+}
+
+func (l *leaker) run(stop chan struct{}, kind string, rate int, target string) {
+	// A dedicated client so leaked connections can't starve anything else
+	client := &http.Client{Transport: &http.Transport{}, Timeout: 5 * time.Second}
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		var leaked io.Closer
+		switch kind {
+		case "file":
+			f, err := os.Open(os.Args[0])
+			if err != nil {
+				slog.Error("Failed to leak file handle", logfields.Error(err))
+				continue
+			}
+			leaked = f
+		case "conn":
+			resp, err := client.Get(target)
+			if err != nil {
+				slog.Error("Failed to leak connection", logfields.Error(err))
+				continue
+			}
+			// Holding the unread body keeps the connection checked out
+			leaked = resp.Body
+		}
+
+		l.mu.Lock()
+		l.leaked = append(l.leaked, leaked)
+		l.mu.Unlock()
+		leakedResources.WithLabelValues(kind).Inc()
+	}
+}
+
+// localURL is the URL the app listener on listenAddr can be reached at from
+// this process, for leaking connections to itself.
+func localURL(listenAddr string) string {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		// Listening on it fails too, and says why
+		return "http://" + listenAddr + "/"
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/"
+}
+
+// leakHandler controls the leak chaos mode: POST starts it with the kind and
+// rate query parameters, DELETE stops it (and releases everything leaked if
+// release=true).
+func leakHandler(target string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			rate, _ := strconv.Atoi(r.URL.Query().Get("rate"))
+			if err := leaks.Start(r.URL.Query().Get("kind"), rate, target); err != nil {
+				httpError(w, r, err, http.StatusBadRequest)
+				return
+			}
+		case http.MethodDelete:
+			leaks.Stop(r.URL.Query().Get("release") == "true")
+		default:
+			httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+
+		leaks.mu.Lock()
+		running, kind, rate, count := leaks.stop != nil, leaks.kind, leaks.rate, len(leaks.leaked)
+		leaks.mu.Unlock()
+		writeJSON(w, r, map[string]any{"running": running, "kind": kind, "rate": rate, "leaked": count}, 0)
+	}
+}
+
+// fdCollector breaks down this process's open file descriptors by what they
+// point at (file, socket, pipe, anon_inode ...), which tells you what is
+// leaking once process_open_fds starts climbing.
+type fdCollector struct {
+	desc *prometheus.Desc
+}
+
+func (c fdCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c fdCollector) Collect(ch chan<- prometheus.Metric) {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return
+	}
+
+	counts := map[string]int{}
+	for _, e := range entries {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", e.Name()))
+		if err != nil {
+			continue
+		}
+		counts[fdType(target)]++
+	}
+	for typ, n := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), typ)
+	}
+}
+
+// fdType classifies a /proc/self/fd link target, e.g. "socket:[1234]" is a
+// socket and "/tmp/x" is a file.
+func fdType(target string) string {
+	if strings.HasPrefix(target, "/") {
+		return "file"
+	}
+	if i := strings.IndexAny(target, ":["); i > 0 {
+		return target[:i]
+	}
+	return "other"
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestLocalURL(t *testing.T) {
+	for _, tc := range []struct {
+		listenAddr string
+		want       string
+	}{
+		{":8080", "http://localhost:8080/"},
+		{":9000", "http://localhost:9000/"},
+		{"0.0.0.0:8081", "http://localhost:8081/"},
+		{"[::]:8082", "http://localhost:8082/"},
+		{"127.0.0.1:8083", "http://127.0.0.1:8083/"},
+		{"[::1]:8084", "http://[::1]:8084/"},
+		{"store-api:8085", "http://store-api:8085/"},
+	} {
+		if got := localURL(tc.listenAddr); got != tc.want {
+			t.Errorf("localURL(%q) = %q, want %q", tc.listenAddr, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Histogram of how long converting the catalog to legacy XML takes.
+	legacyConversionLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "go_app_legacy_conversion_duration_seconds",
+			Help:    "Time spent converting the catalog to the legacy XML format in seconds.",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
+	// Count legacy fields whose values don't match the legacy schema.
+	legacyInvalidFields = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_legacy_invalid_fields_total",
+			Help: "Total number of fields written to legacy XML that don't match the legacy schema's pattern, by element.",
+		},
+		[]string{"element"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(legacyConversionLatency, legacyInvalidFields)
+}
+
+// legacyRecord is a product variant as the legacy system sees it: one
+// record per SKU, with the price as a decimal string.
+type legacyRecord struct {
+	SKU         string `json:"sku"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Price       string `json:"price"`
+	Currency    string `json:"currency"`
+}
+
+// legacyField maps a field of a legacyRecord onto an element of the legacy
+// XML, with the pattern the legacy schema says its value must match.
+type legacyField struct {
+	key     string
+	element string
+	pattern string
+}
+
+var legacyFields = []legacyField{
+	{"sku", "SKU", `^[0-9]+-[0-9]+$`},
+	{"name", "Name", `^[A-Za-z0-9 .,'-]+$`},
+	{"description", "Description", `^[A-Za-z0-9 .,'-]+$`},
+	{"price", "Price", `^[0-9]+\.[0-9]{2}$`},
+	{"currency", "Currency", `^[A-Z]{3}$`},
+}
+
+// legacyProductsHandler serves the catalog as the XML the legacy warehouse
+// system reads, every variant of every product a record. The conversion is
+// the slow part, on purpose: see convertLegacyXML.
+func legacyProductsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(r.Context(), "legacy-products-handler")
+	defer span.End()
+	start := time.Now()
+
+	products := catalog.List()
+	sort.Slice(products, func(i, j int) bool { return products[i].ID < products[j].ID })
+
+	var body []byte
+	err := cpuPool.Run(ctx, "legacy-xml-convert", func(ctx context.Context) {
+		convertStart := time.Now()
+		body = convertLegacyXML(ctx, products)
+		legacyConversionLatency.Observe(time.Since(convertStart).Seconds())
+	})
+	if errors.Is(err, errPoolFull) {
+		httpError(w, r, err, http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		// The client went away, so there is nobody to answer
+		slog.WarnContext(ctx, "Legacy conversion abandoned", logfields.Error(err))
+		return
+	}
+
+	duration := time.Since(start)
+	slog.InfoContext(ctx, "Request handled successfully", logfields.Duration(duration))
+	requestCount.WithLabelValues(routeTarget(r), r.Method, strconv.Itoa(http.StatusOK)).Inc()
+	requestLatency.WithLabelValues(routeTarget(r)).Observe(duration.Seconds())
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(body)
+}
+
+// convertLegacyXML is the conversion layer between the catalog and the
+// legacy XML, written the way such layers tend to be: each record takes a
+// trip through JSON into a generic map, each field's pattern is compiled
+// afresh to check it, and each product's element is built up by string
+// concatenation. It is the hot spot of /legacy/products.xml, both in the
+// trace (the convert-legacy-xml span) and in the CPU and alloc profiles, and
+// is left slow for the exercise of making it fast without changing its
+// output.
+func convertLegacyXML(ctx context.Context, products []Product) []byte {
+	_, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "convert-legacy-xml")
+	defer span.End()
+
+	currency := productCurrency()
+	doc := []string{xml.Header + "<Catalog>\n"}
+	records := 0
+	for _, p := range products {
+		element := fmt.Sprintf("  <Product id=\"%d\">\n", p.ID)
+		for i, description := range variantDescriptions(p) {
+			record := legacyRecord{
+				SKU:         fmt.Sprintf("%d-%d", p.ID, i),
+				Name:        p.Name,
+				Description: description,
+				Price:       fmt.Sprintf("%d.%02d", p.Price/100, p.Price%100),
+				Currency:    currency,
+			}
+			element += legacyRecordXML(record)
+			records++
+		}
+		doc = append(doc, element+"  </Product>\n")
+	}
+	out := []byte(strings.Join(append(doc, "</Catalog>\n"), ""))
+
+	span.SetAttributes(attribute.Int("legacy.records", records), attribute.Int("legacy.bytes", len(out)))
+	return out
+}
+
+// legacyRecordXML converts one record to its Record element.
+func legacyRecordXML(record legacyRecord) string {
+	encoded, _ := json.Marshal(record)
+	fields := map[string]any{}
+	json.Unmarshal(encoded, &fields)
+
+	out := "    <Record>\n"
+	for _, f := range legacyFields {
+		value := strings.TrimSpace(fmt.Sprint(fields[f.key]))
+		if !regexp.MustCompile(f.pattern).MatchString(value) {
+			legacyInvalidFields.WithLabelValues(f.element).Inc()
+		}
+		var escaped bytes.Buffer
+		xml.EscapeText(&escaped, []byte(value))
+		out += "      <" + f.element + ">" + escaped.String() + "</" + f.element + ">\n"
+	}
+	return out + "    </Record>\n"
+}
@@ -2,28 +2,54 @@ package main
 
 import (
 	"context"
+	crand "crypto/rand"
 	"fmt"
 	"log/slog"
 	"math/rand"
 	"net/http"
 	"time"
 	"os"
-	"encoding/json"
+	"path/filepath"
+	"runtime"
+	"errors"
 	"strconv"
+	"strings"
 
 	"github.com/grafana/pyroscope-go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
 	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/j6nca/o11y-playground/pkg/cgroup"
+	"github.com/j6nca/o11y-playground/pkg/clientpool"
+	"github.com/j6nca/o11y-playground/pkg/errreport"
+	"github.com/j6nca/o11y-playground/pkg/health"
+	"github.com/j6nca/o11y-playground/pkg/highres"
+	"github.com/j6nca/o11y-playground/pkg/listen"
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+	"github.com/j6nca/o11y-playground/pkg/model"
+	"github.com/j6nca/o11y-playground/pkg/overhead"
+	"github.com/j6nca/o11y-playground/pkg/priority"
+	"github.com/j6nca/o11y-playground/pkg/profiling"
+	"github.com/j6nca/o11y-playground/pkg/recorder"
+	"github.com/j6nca/o11y-playground/pkg/remotewrite"
+	"github.com/j6nca/o11y-playground/pkg/routelimit"
+	"github.com/j6nca/o11y-playground/pkg/routetimeout"
+	"github.com/j6nca/o11y-playground/pkg/servicegraph"
+	"github.com/j6nca/o11y-playground/pkg/spanaudit"
+	"github.com/j6nca/o11y-playground/pkg/telemetry"
+	"github.com/j6nca/o11y-playground/pkg/tracehints"
 )
 
 var (
@@ -58,24 +84,119 @@ var (
 type Config struct {
 	serviceName string
 	pyroscopeServer string
+	profilingMode string
+	pprofToken string
+	profileTypes string
+	profileMemRate int
+	profileMutexFraction int
+	profileBlockRate int
+	profileUploadInterval time.Duration
 	tempoServer string
+	serviceVersion string
+	sentryDSN string
+	errorAggregatorURL string
+	spanLimits sdktrace.SpanLimits
+	bulkMaxItems int
+	bulkBatchSize int
+	inventoryUnsafe bool
+	inventoryTxAttempts int
+	adminToken string
+	leakKind string
+	leakRate int
+	pricingServer string
+	pricingCurrency string
+	brownout bool
+	brownoutTimeout time.Duration
+	paymentsServer string
+	paymentsTimeout time.Duration
+	webhookURLs string
+	webhookSecret string
+	webhookMaxAttempts int
+	webhookTimeout time.Duration
+	notifications bool
+	notificationTimeout time.Duration
+	cpuWorkers int
+	cpuQueueSize int
+	jsonPooling bool
+	fastPath bool
+	productSchema int
+	spanAudit bool
+	sampleRatio float64
+	samplingComparison bool
+	latencyHighRes bool
+	overheadAccounting bool
+	logLevel string
+	apdexThreshold time.Duration
+	apdexFrustratedFactor float64
+	apdexRouteThresholds string
+	chaosSchedule string
+	errorSpikeDetection bool
+	errorSpikeFactor float64
+	errorSpikeMinRequests int
+	remoteWriteURL string
+	remoteWriteInterval time.Duration
+	remoteWriteUsername string
+	remoteWritePassword string
+	remoteWriteLabels string
+	remoteWriteWALDir string
+	remoteWriteWALMaxMB int
+	tenantQuotas string
+	quotaDefault string
+	quotaEnforce bool
+	jsonSpanThreshold time.Duration
+	optimizedRecommendations bool
+	clientH2C bool
+	clientMaxIdlePerHost int
+	clientIdleTimeout time.Duration
+	clientDisableKeepAlives bool
+	uploadMaxMB int
+	drainDelay time.Duration
+	drainTimeout time.Duration
+	healthInterval time.Duration
+	exitProbability float64
+	exitCode int
+	exitDelay time.Duration
+	oomRateMB int
+	oomCapMB int
+	heapDumpDir string
+	heapDumpUploadURL string
+	recordFile string
+	clockSkew time.Duration
+	busMaxAttempts int
+	orderEventErrorRate float64
+	retryMaxAttempts int
+	retryBudgetRatio float64
+	retryBudgetMin float64
+	routeTimeouts string
+	maxConcurrentRequests int
+	priorityQueueSize int
+	routePriorities string
+	routeConcurrency string
+	ballastMB int
+	listenAddr string
+	adminListenAddr string
+	unixSocketPath string
+	grpcListenAddr string
+	instanceID string
+	virtualReplicas int
+	region string
+	zone string
+	replicaZones string
 }
 
-type Product struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
-	Price int   `json:"price"`
-}
+// pricing is the client for the pricing dependency, nil when not configured.
+var pricing *pricingClient
 
-type Employee struct {
-	ID   int    		`json:"id"`
-	Name string 		`json:"name"`
-	Position string `json:"position"`
-}
+// The domain types are shared with the other services
+type (
+	Product  = model.Product
+	Employee = model.Employee
+)
 
 func init() {
 	// Register the metrics with Prometheus's default registry.
 	prometheus.MustRegister(requestCount, requestLatency, workLevel)
+	prometheus.MustRegister(cgroup.NewCollector("/sys/fs/cgroup"))
 }
 
 func main() {
@@ -83,121 +204,722 @@ func main() {
 	config := Config{
 		serviceName: os.Getenv("OTEL_SERVICE_NAME"),
 		pyroscopeServer: os.Getenv("PYROSCOPE_SERVER_ADDRESS"),
+		profilingMode: envString("PROFILING_MODE", profiling.Push),
+		pprofToken: os.Getenv("PPROF_TOKEN"),
+		profileTypes: envString("PROFILE_TYPES", "cpu,alloc,inuse,mutex"),
+		profileMemRate: envInt("PROFILE_MEM_RATE_BYTES", runtime.MemProfileRate),
+		profileMutexFraction: envInt("PROFILE_MUTEX_FRACTION", 5),
+		profileBlockRate: envInt("PROFILE_BLOCK_RATE_NS", 10000),
+		profileUploadInterval: time.Duration(envInt("PROFILE_UPLOAD_INTERVAL_MS", 15000)) * time.Millisecond,
 		tempoServer: os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"),
+		serviceVersion: os.Getenv("SERVICE_VERSION"),
+		sentryDSN: os.Getenv("SENTRY_DSN"),
+		errorAggregatorURL: os.Getenv("ERROR_AGGREGATOR_URL"),
+		spanLimits: spanLimitsFromEnv(),
+		bulkMaxItems: envInt("BULK_MAX_ITEMS", 1000),
+		bulkBatchSize: envInt("BULK_BATCH_SIZE", 50),
+		inventoryUnsafe: os.Getenv("INVENTORY_UNSAFE") == "true",
+		inventoryTxAttempts: envInt("INVENTORY_TX_ATTEMPTS", 5),
+		adminToken: os.Getenv("ADMIN_TOKEN"),
+		leakKind: os.Getenv("CHAOS_LEAK_KIND"),
+		leakRate: envInt("CHAOS_LEAK_RATE", 0),
+		pricingServer: os.Getenv("PRICING_SERVER_ADDRESS"),
+		pricingCurrency: os.Getenv("PRICING_CURRENCY"),
+		brownout: os.Getenv("BROWNOUT") == "true",
+		brownoutTimeout: time.Duration(envInt("BROWNOUT_PRICING_TIMEOUT_MS", 500)) * time.Millisecond,
+		paymentsServer: os.Getenv("PAYMENTS_SERVER_ADDRESS"),
+		paymentsTimeout: time.Duration(envInt("PAYMENTS_TIMEOUT_MS", 3000)) * time.Millisecond,
+		webhookURLs: os.Getenv("WEBHOOK_URLS"),
+		webhookSecret: os.Getenv("WEBHOOK_SECRET"),
+		webhookMaxAttempts: envInt("WEBHOOK_MAX_ATTEMPTS", 5),
+		webhookTimeout: time.Duration(envInt("WEBHOOK_TIMEOUT_MS", 2000)) * time.Millisecond,
+		notifications: os.Getenv("NOTIFICATIONS") == "true",
+		notificationTimeout: time.Duration(envInt("NOTIFICATION_TIMEOUT_MS", 1000)) * time.Millisecond,
+		cpuWorkers: envInt("CPU_WORKERS", runtime.NumCPU()),
+		cpuQueueSize: envInt("CPU_QUEUE_SIZE", 64),
+		jsonPooling: os.Getenv("JSON_BUFFER_POOL") == "true",
+		fastPath: os.Getenv("FAST_PATH") == "true",
+		productSchema: envInt("PRODUCT_SCHEMA_VERSION", 1),
+		spanAudit: os.Getenv("SPAN_AUDIT") == "true",
+		sampleRatio: envFloat("TRACE_SAMPLE_RATIO", 1),
+		samplingComparison: os.Getenv("SAMPLING_COMPARISON") == "true",
+		latencyHighRes: os.Getenv("LATENCY_HIGHRES") == "true",
+		overheadAccounting: os.Getenv("INSTRUMENTATION_OVERHEAD") == "true",
+		logLevel: envString("LOG_LEVEL", "info"),
+		apdexThreshold: time.Duration(envInt("APDEX_THRESHOLD_MS", 500)) * time.Millisecond,
+		apdexFrustratedFactor: envFloat("APDEX_FRUSTRATED_FACTOR", 4),
+		apdexRouteThresholds: os.Getenv("APDEX_ROUTE_THRESHOLDS"),
+		chaosSchedule: os.Getenv("CHAOS_SCHEDULE"),
+		errorSpikeDetection: os.Getenv("ERROR_SPIKE_DETECTION") == "true",
+		errorSpikeFactor: envFloat("ERROR_SPIKE_FACTOR", 3),
+		errorSpikeMinRequests: envInt("ERROR_SPIKE_MIN_REQUESTS", 20),
+		remoteWriteURL: os.Getenv("REMOTE_WRITE_URL"),
+		remoteWriteInterval: time.Duration(envInt("REMOTE_WRITE_INTERVAL_MS", 15000)) * time.Millisecond,
+		remoteWriteUsername: os.Getenv("REMOTE_WRITE_USERNAME"),
+		remoteWritePassword: os.Getenv("REMOTE_WRITE_PASSWORD"),
+		remoteWriteLabels: os.Getenv("REMOTE_WRITE_LABELS"),
+		remoteWriteWALDir: envString("REMOTE_WRITE_WAL_DIR", filepath.Join(os.TempDir(), "remote-write-wal")),
+		remoteWriteWALMaxMB: envInt("REMOTE_WRITE_WAL_MAX_MB", 64),
+		tenantQuotas: os.Getenv("TENANT_QUOTAS"),
+		quotaDefault: os.Getenv("QUOTA_DEFAULT"),
+		quotaEnforce: os.Getenv("QUOTA_ENFORCE") == "true",
+		jsonSpanThreshold: time.Duration(envFloat("JSON_SPAN_THRESHOLD_MS", 1) * float64(time.Millisecond)),
+		optimizedRecommendations: os.Getenv("RECOMMENDATIONS_OPTIMIZED") == "true",
+		clientH2C: os.Getenv("HTTP_CLIENT_H2C") == "true",
+		clientMaxIdlePerHost: envInt("HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST", http.DefaultMaxIdleConnsPerHost),
+		clientIdleTimeout: time.Duration(envInt("HTTP_CLIENT_IDLE_CONN_TIMEOUT_MS", 90000)) * time.Millisecond,
+		clientDisableKeepAlives: os.Getenv("HTTP_CLIENT_DISABLE_KEEPALIVES") == "true",
+		uploadMaxMB: envInt("UPLOAD_MAX_MB", 100),
+		drainDelay: time.Duration(envInt("DRAIN_DELAY_MS", 2000)) * time.Millisecond,
+		drainTimeout: time.Duration(envInt("DRAIN_TIMEOUT_MS", 5000)) * time.Millisecond,
+		healthInterval: time.Duration(envInt("HEALTH_CHECK_INTERVAL_MS", 15000)) * time.Millisecond,
+		exitProbability: envFloat("CHAOS_EXIT_PROBABILITY", 0),
+		exitCode: envInt("CHAOS_EXIT_CODE", 1),
+		exitDelay: time.Duration(envInt("CHAOS_EXIT_DELAY_MS", 0)) * time.Millisecond,
+		oomRateMB: envInt("CHAOS_OOM_RATE_MB", 0),
+		oomCapMB: envInt("CHAOS_OOM_CAP_MB", 1024),
+		heapDumpDir: envString("HEAPDUMP_DIR", filepath.Join(os.TempDir(), "heapdumps")),
+		heapDumpUploadURL: os.Getenv("HEAPDUMP_UPLOAD_URL"),
+		recordFile: os.Getenv("RECORD_TRAFFIC_FILE"),
+		clockSkew: time.Duration(envInt("CHAOS_CLOCK_SKEW_MS", 0)) * time.Millisecond,
+		busMaxAttempts: envInt("BUS_MAX_ATTEMPTS", 3),
+		orderEventErrorRate: envFloat("CHAOS_ORDER_EVENT_ERROR_RATE", 0),
+		retryMaxAttempts: envInt("RETRY_MAX_ATTEMPTS", 3),
+		retryBudgetRatio: envFloat("RETRY_BUDGET_RATIO", 0.1),
+		retryBudgetMin: envFloat("RETRY_BUDGET_MIN", 10),
+		routeTimeouts: os.Getenv("ROUTE_TIMEOUTS"),
+		maxConcurrentRequests: envInt("MAX_CONCURRENT_REQUESTS", 0),
+		priorityQueueSize: envInt("PRIORITY_QUEUE_SIZE", 100),
+		routePriorities: os.Getenv("ROUTE_PRIORITIES"),
+		routeConcurrency: os.Getenv("ROUTE_CONCURRENCY"),
+		ballastMB: envInt("GC_BALLAST_MB", 0),
+		listenAddr: envString("LISTEN_ADDR", ":8080"),
+		adminListenAddr: os.Getenv("ADMIN_LISTEN_ADDR"),
+		unixSocketPath: os.Getenv("UNIX_SOCKET_PATH"),
+		grpcListenAddr: envString("GRPC_LISTEN_ADDR", ":50051"),
+		instanceID: os.Getenv("INSTANCE_ID"),
+		virtualReplicas: envInt("VIRTUAL_REPLICAS", 1),
+		region: os.Getenv("REGION"),
+		zone: os.Getenv("ZONE"),
+		replicaZones: os.Getenv("REPLICA_ZONES"),
 	}
 
-	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		Level: slog.LevelInfo,
-	})))
+	// Tell this process apart from other replicas in every signal
+	instanceID = newInstanceID(config)
+	instanceRegion, instanceZone = config.region, config.zone
+	replicaZones = parseZones(config.replicaZones)
+
+	// Stamp every log record with host/container/pod/region details
+	slog.SetDefault(slog.New(newInfraHandler(levelHandler{slog.NewJSONHandler(telemetry.LogWriter(os.Stdout), &slog.HandlerOptions{
+		// levelHandler decides what is logged, by route
+		Level: slog.LevelDebug,
+	})}, config)))
+	if err := logLevelDefault.UnmarshalText([]byte(config.logLevel)); err != nil {
+		slog.Error("Ignoring invalid LOG_LEVEL:", logfields.Error(err))
+	}
+	logLevel.Set(logLevelDefault)
+	if config.inventoryTxAttempts < 1 {
+		slog.Error("Ignoring invalid INVENTORY_TX_ATTEMPTS:", logfields.Error(fmt.Errorf("%d is less than 1", config.inventoryTxAttempts)))
+		config.inventoryTxAttempts = 5
+	}
 
 	// Setup OpenTelemetry for tracing
 	shutdown := setupTracer(config)
 	defer shutdown()
 
-	// Setup Pyroscope for continuous profiling
+	// Setup OpenTelemetry metrics, exposed on /metrics beside our own
+	shutdownMeter := setupMeter(config)
+	defer shutdownMeter()
+
+	// Count the metric series this service exposes
+	go telemetry.CountSeries()
+
+	// Setup continuous profiling, pushed to Pyroscope or pulled from pprof
 	setupProfiler(config)
 
+	// Setup error reporting for exception tracking
+	setupErrorReporter(config)
+
+	// Record incoming traffic for replay, if asked to
+	if config.recordFile != "" {
+		if err := recorder.Start(config.recordFile, config.serviceName); err != nil {
+			slog.Error("Failed to start recording traffic:", logfields.Error(err))
+		}
+	}
+
+	// Admit requests by priority once MAX_CONCURRENT_REQUESTS are running
+	if config.maxConcurrentRequests > 0 {
+		priority.SetLimit(config.maxConcurrentRequests, config.priorityQueueSize)
+	}
+	if parsed, err := priority.Parse(config.routePriorities); err != nil {
+		slog.Error("Ignoring invalid ROUTE_PRIORITIES:", logfields.Error(err))
+	} else {
+		priority.Set(parsed)
+	}
+
+	// Per-route concurrency caps, so one busy endpoint can't starve the rest
+	if parsed, err := routelimit.Parse(config.routeConcurrency); err != nil {
+		slog.Error("Ignoring invalid ROUTE_CONCURRENCY:", logfields.Error(err))
+	} else {
+		routelimit.Set(parsed)
+	}
+
+	// Per-route handler timeouts
+	if parsed, err := routetimeout.Parse(config.routeTimeouts); err != nil {
+		slog.Error("Ignoring invalid ROUTE_TIMEOUTS:", logfields.Error(err))
+	} else {
+		routetimeout.Set(parsed)
+	}
+
+	// Retries on outbound calls, capped by a budget shared between clients
+	retryMaxAttempts = config.retryMaxAttempts
+	retries.Configure(config.retryBudgetRatio, config.retryBudgetMin)
+
+	// Connection pool settings for outbound clients
+	clientpool.Configure(clientpool.Tuning{
+		MaxIdleConnsPerHost: config.clientMaxIdlePerHost,
+		IdleConnTimeout:     config.clientIdleTimeout,
+		DisableKeepAlives:   config.clientDisableKeepAlives,
+	})
+
+	// Setup the pricing dependency, if one is configured
+	if config.pricingServer != "" {
+		pricing = newPricingClient(config.pricingServer, config.pricingCurrency, config.clientH2C)
+	}
+	// Serve stale prices rather than wait on a slow pricing service
+	brownout = config.brownout
+	brownoutTimeout = config.brownoutTimeout
+
+	// Setup the payments dependency orders are charged through, if one is
+	// configured
+	if config.paymentsServer != "" {
+		payments = newPaymentsClient(config.paymentsServer, config.paymentsTimeout, config.clientH2C)
+	}
+
+	// Bound how much CPU heavy work may run at once
+	cpuPool = newWorkerPool(config.cpuWorkers, config.cpuQueueSize)
+
+	// Reuse JSON encode buffers, if asked to
+	jsonPooling = config.jsonPooling
+
+	// Serve /products without the avoidable allocations, if asked to
+	fastPath = config.fastPath
+
+	// The product schema version /products emits
+	if err := setProductSchema(config.productSchema); err != nil {
+		slog.Error("Ignoring invalid product schema version:", logfields.Error(err))
+		setProductSchema(productSchemaV1)
+	} else {
+		defaultProductSchema = config.productSchema
+	}
+
+	// Only give JSON encoding and decoding a span when it is slow
+	jsonSpanThreshold = config.jsonSpanThreshold
+
+	// Score recommendations the cheap way, if asked to
+	optimizedRecommendations = config.optimizedRecommendations
+
+	// Observe latency in fine buckets too, if asked to
+	if config.latencyHighRes {
+		highres.Enable()
+	}
+
+	// Measure what the instrumentation itself costs, if asked to
+	if config.overheadAccounting {
+		overhead.Enable()
+		slog.SetDefault(slog.New(overhead.LogHandler{Handler: slog.Default().Handler()}))
+	}
+
+	// Apdex thresholds, a default T and any per route
+	apdexDefaultThreshold = config.apdexThreshold
+	apdexFrustratedFactor = config.apdexFrustratedFactor
+	if parsed, err := parseApdexThresholds(config.apdexRouteThresholds); err != nil {
+		slog.Error("Ignoring invalid APDEX_ROUTE_THRESHOLDS:", logfields.Error(err))
+	} else {
+		apdexThresholds = parsed
+	}
+
+	// Faults on a schedule, for patterns that recur across days
+	if windows, err := parseChaosSchedule(config.chaosSchedule); err != nil {
+		slog.Error("Ignoring invalid CHAOS_SCHEDULE:", logfields.Error(err))
+	} else if len(windows) > 0 {
+		go chaosSchedule.Run(windows)
+	}
+
+	// Watch our own error ratio for spikes, logging and counting them
+	if config.errorSpikeDetection {
+		go newErrorSpikeDetector(config.errorSpikeFactor, config.errorSpikeMinRequests).Run()
+	}
+
+	// Push metrics to a remote write endpoint too, if one is configured
+	if config.remoteWriteURL != "" {
+		labels, err := remotewrite.ParseLabels(config.remoteWriteLabels)
+		if err != nil {
+			slog.Error("Ignoring invalid REMOTE_WRITE_LABELS:", logfields.Error(err))
+			labels = map[string]string{}
+		}
+		// Stand in for the labels a scrape would have added
+		hostname, _ := os.Hostname()
+		for name, value := range map[string]string{"service_name": config.serviceName, "instance": hostname} {
+			if _, ok := labels[name]; !ok {
+				labels[name] = value
+			}
+		}
+		writer, err := remotewrite.New(config.remoteWriteURL, config.remoteWriteUsername, config.remoteWritePassword, labels,
+			config.remoteWriteInterval, config.remoteWriteWALDir, int64(config.remoteWriteWALMaxMB)<<20)
+		if err != nil {
+			slog.Error("Failed to start remote write:", logfields.Error(err))
+		} else {
+			writer.Client.Transport = telemetry.Uploads("metrics", http.DefaultTransport)
+			go writer.Run()
+		}
+	}
+
+	// Account requests and bytes to tenants, if any have quotas
+	if config.tenantQuotas != "" || config.quotaDefault != "" {
+		tenants, err := parseTenantQuotas(config.tenantQuotas)
+		if err != nil {
+			slog.Error("Ignoring invalid TENANT_QUOTAS:", logfields.Error(err))
+		}
+		other := Quota{}
+		if config.quotaDefault != "" {
+			if other, err = parseQuota(config.quotaDefault); err != nil {
+				slog.Error("Ignoring invalid QUOTA_DEFAULT:", logfields.Error(err))
+			}
+		}
+		quotas = newQuotaMeter(tenants, other, config.quotaEnforce)
+	}
+
 	// Logger setup for Loki
 	slog.Info("Starting Go application...")
 
 	// Define HTTP handlers
-	http.Handle("/", otelhttp.NewHandler(
+	http.Handle("/", instrument(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
 			_, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "example-api-handler")
 			defer span.End()
 
-			slog.InfoContext(ctx, "Received request on root path", "path", r.URL.Path)
+			slog.InfoContext(ctx, "Received request on root path", logfields.Path(r.URL.Path))
 
 			// Simulating some work
 			workDuration := time.Duration(rand.Intn(1000)) * time.Millisecond
 			time.Sleep(workDuration)
 			workLevel.Set(float64(workDuration.Milliseconds()))
 
-			requestCount.WithLabelValues(r.URL.Path, r.Method, strconv.Itoa(http.StatusOK)).Inc()
-			requestLatency.WithLabelValues(r.URL.Path).Observe(workDuration.Seconds())
+			requestCount.WithLabelValues(routeTarget(r), r.Method, strconv.Itoa(http.StatusOK)).Inc()
+			requestLatency.WithLabelValues(routeTarget(r)).Observe(workDuration.Seconds())
 
-			slog.InfoContext(ctx, "Request handled successfully", "duration_ms", workDuration.Milliseconds())
+			slog.InfoContext(ctx, "Request handled successfully", logfields.Duration(workDuration))
 			fmt.Fprintf(w, "This is the kitchen store api. Work completed in %d ms.\n", workDuration.Milliseconds())
 		}),
 		"store-api-handler-span",
 	))
 
 	// Path to demonstrate an error
-	http.Handle("/error", otelhttp.NewHandler(
+	http.Handle("/error", instrument(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			slog.Error("An intentional error occurred.", "path", r.URL.Path)
-			requestCount.WithLabelValues(r.URL.Path, r.Method, strconv.Itoa(http.StatusInternalServerError)).Inc()
-			http.Error(w, "An intentional error occurred.", http.StatusInternalServerError)
+			httpError(w, r, errors.New("An intentional error occurred."), http.StatusInternalServerError)
 		}),
 		"error-handler-span",
 	))
 
-	http.Handle("/products", otelhttp.NewHandler(
+	// Path to demonstrate a panic being recovered and reported
+	http.Handle("/panic", instrument(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var employees []Employee
+			fmt.Fprintf(w, "Employee of the month: %s\n", employees[rand.Intn(10)].Name)
+		}),
+		"panic-handler-span",
+	))
+
+	// Path to demonstrate span limits, by producing a span well over them
+	http.Handle("/oversized-span", instrument(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
-			_, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "products-handler")
+			_, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "oversized-span",
+				trace.WithLinks(oversizedLinks(500)...))
 			defer span.End()
 
-			slog.InfoContext(ctx, "Received request on products path", "path", r.URL.Path)
-			start := time.Now()
-			products := getProducts()
-			duration := time.Since(start)
-			
-
-			slog.InfoContext(ctx, "Request handled successfully", "duration_ms", duration.Milliseconds())
-			
-			jsonData, err := json.Marshal(products)
-			if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
+			for i := 0; i < 500; i++ {
+				span.SetAttributes(attribute.String(fmt.Sprintf("demo.attribute.%d", i), strings.Repeat("x", 4096)))
+				span.AddEvent(fmt.Sprintf("demo-event-%d", i))
+			}
+
+			slog.InfoContext(ctx, "Generated oversized span", logfields.Path(r.URL.Path))
+			requestCount.WithLabelValues(routeTarget(r), r.Method, strconv.Itoa(http.StatusOK)).Inc()
+			fmt.Fprintf(w, "Generated a span with 500 attributes, events and links. Check Tempo to see what survived.\n")
+		}),
+		"oversized-span-handler-span",
+	))
+
+	http.Handle("/products", instrument(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if fastPath && productSchema.Load() == productSchemaV1 {
+				productsFastHandler(w, r)
+				return
 			}
+			ctx := r.Context()
+			ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "products-handler")
+			defer span.End()
 
-			requestCount.WithLabelValues(r.URL.Path, r.Method, strconv.Itoa(http.StatusOK)).Inc()
-			requestLatency.WithLabelValues(r.URL.Path).Observe(duration.Seconds())
-			
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			w.Write(jsonData)
+			slog.InfoContext(ctx, "Received request on products path", logfields.Path(r.URL.Path))
+			start := time.Now()
+			products := getProducts(ctx)
+			flagDegraded(w, r, priceProducts(ctx, products))
+			writeJSON(w, r, versionedProducts(w, r, products), time.Since(start))
 		}),
 		"products-handler-span",
 	))
 
-	http.Handle("/employees", otelhttp.NewHandler(
+	// Bulk product upserts, processed in instrumented batches
+	http.Handle("/products/bulk", instrument(
+		bulkUpsertHandler(config.bulkMaxItems, config.bulkBatchSize),
+		"bulk-upsert-handler-span",
+	))
+
+	// Lots of products, buffered or streamed to compare memory profiles
+	http.Handle("/products/all", instrument(
+		http.HandlerFunc(allProductsHandler),
+		"all-products-handler-span",
+	))
+
+	// Product search, intentionally slow for profiling exercises and run on
+	// the CPU worker pool
+	http.Handle("/products/search", instrument(
+		http.HandlerFunc(searchHandler),
+		"search-handler-span",
+	))
+
+	// Product recommendations, allocation heavy unless the optimized scorer
+	// is switched on
+	http.Handle("/recommendations", instrument(
+		http.HandlerFunc(recommendationsHandler),
+		"recommendations-handler-span",
+	))
+
+	// Inventory, guarded by a deliberately hot mutex
+	stock.unsafe = config.inventoryUnsafe
+	http.Handle("/inventory", instrument(
+		http.HandlerFunc(inventoryHandler),
+		"inventory-handler-span",
+	))
+
+	// Stock reservations, written with optimistic concurrency control
+	inventoryTxAttempts = config.inventoryTxAttempts
+	http.Handle("POST /inventory/reserve", instrument(
+		http.HandlerFunc(reserveHandler),
+		"reserve-handler-span",
+	))
+	http.Handle("POST /inventory/release", instrument(
+		http.HandlerFunc(releaseHandler),
+		"release-handler-span",
+	))
+
+	// Multipart file uploads, read in traced chunks
+	http.Handle("/upload", instrument(
+		uploadHandler(int64(config.uploadMaxMB)<<20),
+		"upload-handler-span",
+	))
+
+	// Generated downloads, optionally rate limited, for bandwidth bottlenecks
+	http.Handle("/download", instrument(
+		http.HandlerFunc(downloadHandler),
+		"download-handler-span",
+	))
+
+	// Disk heavy work, to compare against the CPU and sleep bottlenecks
+	http.Handle("/work/io", instrument(
+		http.HandlerFunc(diskIOHandler),
+		"disk-io-handler-span",
+	))
+
+	// Catalog lookups, for fetching one, some or all products quickly
+	http.Handle("GET /catalog", instrument(
+		http.HandlerFunc(catalogListHandler),
+		"catalog-list-handler-span",
+	))
+	http.Handle("GET /catalog/{id}", instrument(
+		http.HandlerFunc(catalogItemHandler),
+		"catalog-item-handler-span",
+	))
+	http.Handle("GET /catalog/details", instrument(
+		http.HandlerFunc(catalogDetailsHandler),
+		"catalog-details-handler-span",
+	))
+
+	// Orders, published to the message bus through a transactional outbox
+	busMaxAttempts = config.busMaxAttempts
+	orderEventErrorRate = config.orderEventErrorRate
+	bus.Subscribe("order.created", "order-events-logger", logOrderEvent)
+	// Order events are also sent on to any webhook destinations configured
+	if config.webhookURLs != "" {
+		if webhooks, err := newWebhookPublisher(config.webhookURLs, config.webhookSecret, config.webhookMaxAttempts, config.webhookTimeout, config.clientH2C); err != nil {
+			slog.Error("Ignoring invalid WEBHOOK_URLS:", logfields.Error(err))
+		} else {
+			bus.Subscribe("order.created", "webhooks", webhooks.Handle)
+		}
+	}
+	// Order confirmations by email and SMS, each with a fallback provider
+	if config.notifications {
+		notifications = newNotificationRouter(config.notificationTimeout)
+		bus.Subscribe("order.created", "notifications", notifyOrder)
+	}
+	go runOutboxRelay(500 * time.Millisecond)
+	// Drop idempotency keys once they expire
+	go orderIdempotency.Run()
+	http.Handle("/orders", instrument(
+		http.HandlerFunc(ordersHandler),
+		"orders-handler-span",
+	))
+
+	// The catalog as XML for the legacy warehouse system, with a slow
+	// conversion layer to optimize
+	http.Handle("/legacy/products.xml", instrument(
+		http.HandlerFunc(legacyProductsHandler),
+		"legacy-products-handler-span",
+	))
+
+	// Versioned product routes, v1 is deprecated in favour of v2
+	http.Handle("/api/v1/products", instrument(
+		deprecated(http.HandlerFunc(productsV1), "/api/v2/products"),
+		"products-v1-handler-span",
+	))
+	http.Handle("/api/v2/products", instrument(
+		http.HandlerFunc(productsV2),
+		"products-v2-handler-span",
+	))
+
+	// The gRPC service again, for Connect clients on the app port
+	connectPath, connectStoreHandler := connectHandler()
+	http.Handle(connectPath, instrument(connectStoreHandler, "connect-handler-span"))
+
+	http.Handle("/employees", instrument(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
 			_, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "employees-handler")
 			defer span.End()
 
-			slog.InfoContext(ctx, "Received request on employees path", "path", r.URL.Path)
+			slog.InfoContext(ctx, "Received request on employees path", logfields.Path(r.URL.Path))
 			start := time.Now()
 			employees := getEmployees()
-			duration := time.Since(start)
+			writeJSON(w, r, employees, time.Since(start))
+		}),
+		"employees-handler-span",
+	))
 
-			slog.InfoContext(ctx, "Request handled successfully", "duration_ms", duration.Milliseconds())
+	// Single employees and their managers, walking up the org chart
+	http.Handle("GET /employees/{id}", instrument(
+		http.HandlerFunc(employeeHandler),
+		"employee-handler-span",
+	))
+	http.Handle("GET /employees/{id}/manager", instrument(
+		http.HandlerFunc(managerHandler),
+		"manager-handler-span",
+	))
 
-			jsonData, err := json.Marshal(employees)
-			if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-			}
+	// Admin endpoints for simulating failures
+	adminToken = config.adminToken
+	http.Handle("/admin/deadlock", instrument(
+		requireAdmin(http.HandlerFunc(deadlockHandler)),
+		"deadlock-handler-span",
+	))
 
-			// For sake of this example, set latency to 0
-			requestCount.WithLabelValues(r.URL.Path, r.Method, strconv.Itoa(http.StatusOK)).Inc()
-			requestLatency.WithLabelValues(r.URL.Path).Observe(duration.Seconds())
+	http.Handle("/admin/chaos/leak", instrument(
+		requireAdmin(leakHandler(localURL(config.listenAddr))),
+		"leak-handler-span",
+	))
+	if config.leakRate > 0 {
+		if err := leaks.Start(config.leakKind, config.leakRate, localURL(config.listenAddr)); err != nil {
+			slog.Error("Failed to start leak chaos mode:", logfields.Error(err))
+		}
+	}
 
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			w.Write(jsonData)
-		}),
-		"employees-handler-span",
+	http.Handle("/admin/chaos/exit", instrument(
+		requireAdmin(http.HandlerFunc(exitHandler)),
+		"exit-handler-span",
+	))
+	crashOnStartup(config.exitProbability, config.exitCode, config.exitDelay)
+
+	http.Handle("/admin/chaos/oom", instrument(
+		requireAdmin(oomHandler(config.oomCapMB)),
+		"oom-handler-span",
+	))
+	if config.oomRateMB > 0 {
+		if err := ooms.Start(config.oomRateMB, config.oomCapMB); err != nil {
+			slog.Error("Failed to start OOM chaos mode:", logfields.Error(err))
+		}
+	}
+
+	// Latency and errors for requests carrying matching baggage
+	http.Handle("/admin/chaos/faults", instrument(
+		requireAdmin(http.HandlerFunc(faultsHandler)),
+		"faults-handler-span",
+	))
+
+	// Latency and errors for the simulated notification providers
+	http.Handle("/admin/chaos/notifications", instrument(
+		requireAdmin(http.HandlerFunc(notificationsHandler)),
+		"notifications-handler-span",
+	))
+
+	// Slow down or fail only the requests served in one simulated zone
+	http.Handle("/admin/chaos/zone", instrument(
+		requireAdmin(http.HandlerFunc(zoneChaosHandler)),
+		"zone-chaos-handler-span",
+	))
+
+	// Span timestamps as seen through a skewed clock
+	http.Handle("/admin/chaos/clockskew", instrument(
+		requireAdmin(http.HandlerFunc(clockSkewHandler)),
+		"clockskew-handler-span",
+	))
+	setClockSkew(config.clockSkew)
+
+	// The chaos windows CHAOS_SCHEDULE sets up, and when they next open
+	http.Handle("/admin/chaos/schedule", instrument(
+		requireAdmin(http.HandlerFunc(chaosScheduleHandler)),
+		"chaos-schedule-handler-span",
+	))
+
+	// Less parallelism than the CPUs allow, to study CPU starvation
+	http.Handle("/admin/chaos/parallelism", instrument(
+		requireAdmin(http.HandlerFunc(parallelismHandler)),
+		"parallelism-handler-span",
+	))
+
+	// Each tenant's quota and usage this window
+	http.Handle("/admin/quotas", instrument(
+		requireAdmin(http.HandlerFunc(quotasHandler)),
+		"quotas-handler-span",
+	))
+
+	// Messages consumers gave up on, to inspect and replay
+	http.Handle("/admin/dlq", instrument(
+		requireAdmin(http.HandlerFunc(dlqHandler)),
+		"dlq-handler-span",
+	))
+
+	// Heap profiles on demand, for ad-hoc memory investigations
+	http.Handle("/admin/heapdump", instrument(
+		requireAdmin(heapDumpHandler(config.heapDumpDir, config.heapDumpUploadURL)),
+		"heapdump-handler-span",
+	))
+
+	// The product schema version /products emits, to roll v2 out and back
+	http.Handle("/admin/schema", instrument(
+		requireAdmin(http.HandlerFunc(schemaHandler)),
+		"schema-handler-span",
+	))
+
+	// GOGC and GOMEMLIMIT, adjustable at runtime for GC tuning experiments
+	http.Handle("/admin/gc", instrument(
+		requireAdmin(http.HandlerFunc(gcHandler)),
+		"gc-handler-span",
+	))
+
+	// A GC ballast, to compare GC frequency and CPU with and without one
+	http.Handle("/admin/ballast", instrument(
+		requireAdmin(http.HandlerFunc(ballastHandler)),
+		"ballast-handler-span",
+	))
+	if config.ballastMB > 0 {
+		if err := ballasts.Set(ballastAlloc, config.ballastMB); err != nil {
+			slog.Error("Failed to set GC ballast:", logfields.Error(err))
+		}
+	}
+
+	// Series per metric and label value, to find where cardinality comes from
+	http.Handle("/admin/metrics/cardinality", instrument(
+		requireAdmin(http.HandlerFunc(cardinalityHandler)),
+		"cardinality-handler-span",
+	))
+
+	// Goroutines grouped by stack, for quick leak triage
+	http.Handle("/admin/goroutines", instrument(
+		requireAdmin(http.HandlerFunc(goroutinesHandler)),
+		"goroutines-handler-span",
+	))
+
+	// Warm up in the background, /readyz fails until this is done
+	steps := []startupStep{{name: "warm-json-buffers", run: warmJSONBuffers}}
+	if pricing != nil {
+		steps = append(steps, startupStep{name: "dial-pricing", run: pricing.Warm})
+	}
+	go runStartup(steps)
+
+	// Check on our dependencies in the background
+	health.Register("trace-exporter", checkTraceExporter)
+	if pricing != nil {
+		health.Register("pricing", pricing.Check)
+	}
+	health.Start(config.healthInterval, 2*time.Second)
+	http.Handle("/healthz/dependencies", health.Handler())
+
+	// What the service is, where it listens and what it calls
+	http.Handle("/topology", instrument(
+		topologyHandler(newTopology(config)),
+		"topology-handler-span",
 	))
 
 	// Endpoint to get metrics
 	http.Handle("/metrics", promhttp.Handler())
 
-	slog.Info("Application is listening on port 8080...")
-	http.ListenAndServe(":8080", nil)
+	// Application state as JSON on /debug/vars
+	version := publishVars(config)
+
+	// The resolved configuration, secrets redacted, logged once and kept on
+	// /admin/config so what an instance runs with is always answerable
+	resolved := resolvedConfig(config)
+	slog.Info("Resolved configuration", "config_version", version, "config", resolved)
+	http.Handle("/admin/config", instrument(
+		requireAdmin(configHandler(resolved, version)),
+		"config-handler-span",
+	))
+
+	// The trace sampling ratio, changeable without a restart
+	http.Handle("/admin/sampling", instrument(
+		requireAdmin(http.HandlerFunc(samplingHandler)),
+		"sampling-handler-span",
+	))
+
+	// The log level, and per-route overrides that expire on their own
+	http.Handle("/admin/loglevel", instrument(
+		requireAdmin(http.HandlerFunc(logLevelHandler)),
+		"loglevel-handler-span",
+	))
+
+	// Readiness, which fails once the service starts draining
+	http.HandleFunc("/readyz", readyzHandler)
+
+	// The app port, plus an admin port and Unix socket if configured, pprof
+	// asking for PPROF_TOKEN on all of them
+	listeners, err := listen.Open(config.listenAddr, config.adminListenAddr, config.unixSocketPath, profiling.RequireToken(config.pprofToken, httpError)(http.DefaultServeMux))
+	if err != nil {
+		slog.Error("Failed to listen:", logfields.Error(err))
+		return
+	}
+	// Virtual replicas of the app listener, each an instance of its own
+	replicas, err := openReplicas(config.listenAddr, config.virtualReplicas, replicaZones, listeners[0].Handler)
+	if err != nil {
+		slog.Error("Failed to listen:", logfields.Error(err))
+		listen.Close(listeners)
+		return
+	}
+	for _, l := range replicas {
+		slog.Info("Listening", "listener", l.Name, "addr", l.Addr().String())
+	}
+	listeners = append(listeners, replicas...)
+	// And the gRPC API, on a port of its own
+	grpcListener, err := listenGRPC(config.grpcListenAddr)
+	if err != nil {
+		slog.Error("Failed to listen:", logfields.Error(err))
+		listen.Close(listeners)
+		return
+	}
+	listeners = append(listeners, grpcListener)
+	slog.Info("Listening", "listener", grpcListener.Name, "addr", grpcListener.Addr().String())
+	serve(listeners, config.drainDelay, config.drainTimeout)
 }
 
 func setupTracer(config Config) func() {
@@ -207,95 +929,253 @@ func setupTracer(config Config) func() {
 	conn, err := grpc.DialContext(ctx, config.tempoServer,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
 		grpc.WithBlock(),
+		grpc.WithStatsHandler(telemetry.StatsHandler("traces")),
 	)
 	if err != nil {
-		slog.Error("Failed to create gRPC connection to Tempo:", "error", err)
+		slog.Error("Failed to create gRPC connection to Tempo:", logfields.Error(err))
 		return func() {}
 	}
+	traceConn = conn
 
 	// Create a new OTLP gRPC exporter
 	traceExporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(conn))
 	if err != nil {
-		slog.Error("Failed to create a new OTLP exporter:", "error", err)
+		slog.Error("Failed to create a new OTLP exporter:", logfields.Error(err))
 		return func() {}
 	}
 
 	// Create a new tracer provider with the exporter
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(traceExporter),
-		sdktrace.WithResource(resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceName(config.serviceName),
-			attribute.String("application", config.serviceName),
-		)),
-	)
+	slog.Info("Applying span limits", "attributes", config.spanLimits.AttributeCountLimit,
+		"attribute_length", config.spanLimits.AttributeValueLengthLimit,
+		"events", config.spanLimits.EventCountLimit, "links", config.spanLimits.LinkCountLimit)
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithSpanProcessor(skewProcessor{sdktrace.NewBatchSpanProcessor(traceExporter)}),
+		sdktrace.WithSpanProcessor(servicegraph.NewProcessor(config.serviceName)),
+		sdktrace.WithSpanProcessor(telemetry.SpanProcessor()),
+		sdktrace.WithRawSpanLimits(config.spanLimits),
+		sdktrace.WithResource(newResource(config)),
+	}
+	// Check spans against the instrumentation conventions, in dev mode
+	if config.spanAudit {
+		slog.Info("Auditing spans against instrumentation conventions")
+		options = append(options, sdktrace.WithSpanProcessor(spanaudit.NewProcessor()))
+	}
+	// Sample, if asked to, and count what sampling loses in comparison mode.
+	// The sampler is always set, so /admin/sampling can change the ratio
+	if config.sampleRatio < 1 || config.samplingComparison {
+		slog.Info("Sampling traces", "ratio", config.sampleRatio, "comparison", config.samplingComparison)
+	}
+	options = append(options, sdktrace.WithSampler(newSampler(config.sampleRatio, config.samplingComparison)))
+	if config.samplingComparison {
+		options = append(options, sdktrace.WithSpanProcessor(samplingProcessor{}))
+	}
+	tp := sdktrace.NewTracerProvider(options...)
 	otel.SetTracerProvider(tp)
-	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}, tracehints.Propagator{}))
 
 	return func() {
 		ctx, cancel := context.WithTimeout(ctx, time.Second)
 		defer cancel()
 		if err := tp.Shutdown(ctx); err != nil {
-			slog.Error("Failed to shutdown tracer provider:", "error", err)
+			slog.Error("Failed to shutdown tracer provider:", logfields.Error(err))
+		}
+	}
+}
+
+// setupMeter registers an OpenTelemetry meter provider whose metrics are
+// exported through the default Prometheus registry. otelhttp picks this up to
+// emit the semconv HTTP metrics (http_server_request_duration_seconds etc.)
+// alongside our hand-rolled go_app_* ones.
+func setupMeter(config Config) func() {
+	exporter, err := otelprom.New()
+	if err != nil {
+		slog.Error("Failed to create Prometheus metrics exporter:", logfields.Error(err))
+		return func() {}
+	}
+
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(exporter),
+		sdkmetric.WithResource(newResource(config)),
+	)
+	otel.SetMeterProvider(mp)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := mp.Shutdown(ctx); err != nil {
+			slog.Error("Failed to shutdown meter provider:", logfields.Error(err))
 		}
 	}
 }
 
+// newResource describes this service for all telemetry signals.
+func newResource(config Config) *resource.Resource {
+	attrs := []attribute.KeyValue{
+		semconv.ServiceName(config.serviceName),
+		semconv.ServiceInstanceID(instanceID),
+		attribute.String("application", config.serviceName),
+	}
+	// The simulated failure domain, for slicing by region and zone
+	if config.region != "" {
+		attrs = append(attrs, semconv.CloudRegion(config.region))
+	}
+	if config.zone != "" {
+		attrs = append(attrs, semconv.CloudAvailabilityZone(config.zone))
+	}
+	return resource.NewWithAttributes(semconv.SchemaURL, attrs...)
+}
+
+// spanLimitsFromEnv reads the span limits using the standard OTel env var
+// names. Unlike the SDK defaults, attribute values are capped at 1024
+// characters so truncation is easy to observe.
+func spanLimitsFromEnv() sdktrace.SpanLimits {
+	return sdktrace.SpanLimits{
+		AttributeCountLimit:         envInt("OTEL_SPAN_ATTRIBUTE_COUNT_LIMIT", sdktrace.DefaultAttributeCountLimit),
+		AttributeValueLengthLimit:   envInt("OTEL_SPAN_ATTRIBUTE_VALUE_LENGTH_LIMIT", 1024),
+		EventCountLimit:             envInt("OTEL_SPAN_EVENT_COUNT_LIMIT", sdktrace.DefaultEventCountLimit),
+		LinkCountLimit:              envInt("OTEL_SPAN_LINK_COUNT_LIMIT", sdktrace.DefaultLinkCountLimit),
+		AttributePerEventCountLimit: envInt("OTEL_EVENT_ATTRIBUTE_COUNT_LIMIT", sdktrace.DefaultAttributePerEventCountLimit),
+		AttributePerLinkCountLimit:  envInt("OTEL_LINK_ATTRIBUTE_COUNT_LIMIT", sdktrace.DefaultAttributePerLinkCountLimit),
+	}
+}
+
+// envInt returns the integer value of an env var, or def if it is unset or
+// not a number.
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// envString returns the value of an env var, or def if it is unset.
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envFloat returns the float value of an env var, or def if it is unset or
+// not a number.
+func envFloat(key string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
 func setupProfiler(config Config) {
-	slog.Info("Setting up profiler with config", "config", config.pyroscopeServer)
-	_, err := pyroscope.Start(pyroscope.Config{
+	mode, err := profiling.ParseMode(config.profilingMode)
+	if err != nil {
+		slog.Error("Ignoring invalid PROFILING_MODE:", logfields.Error(err))
+		mode = profiling.Push
+	}
+	profiling.SetMode(mode)
+	enabled, err := profiling.ParseTypes(config.profileTypes)
+	if err != nil {
+		slog.Error("Ignoring invalid PROFILE_TYPES:", logfields.Error(err))
+		enabled, _ = profiling.ParseTypes("cpu,alloc,inuse")
+	}
+	// Sample only what is collected; the mutex profile shows contention on
+	// locks like the inventory mutex
+	types := profiling.Apply(enabled, profiling.Rates{
+		MemBytes:      config.profileMemRate,
+		MutexFraction: config.profileMutexFraction,
+		BlockNanos:    config.profileBlockRate,
+	})
+	if mode == profiling.Pull {
+		// Alloy scrapes /debug/pprof/ instead
+		slog.Info("Serving profiles for scraping", "mode", mode, logfields.Path("/debug/pprof/"), "token_required", config.pprofToken != "")
+		return
+	}
+	if len(types) == 0 {
+		slog.Info("Not profiling, PROFILE_TYPES is empty")
+		return
+	}
+	slog.Info("Setting up profiler with config", "config", config.pyroscopeServer, "profile_types", types)
+	_, err = pyroscope.Start(pyroscope.Config{
 		ApplicationName: config.serviceName,
 		ServerAddress:   config.pyroscopeServer, // Pyroscope address from docker-compose.yml
 		Logger:          pyroscope.StandardLogger,
+		HTTPClient:      telemetry.ProfileClient(),
+		ProfileTypes:    types,
+		UploadRate:      config.profileUploadInterval,
 		// Example tags for profiling data
 		Tags: map[string]string{
-			"environment": "workshop",
-			"service":     config.serviceName,
+			"environment":    "workshop",
+			"service":        config.serviceName,
+			"instance_id":    instanceID,
+			"region":         config.region,
+			"zone":           config.zone,
+			"profiling_mode": mode,
 		},
 	})
 	if err != nil {
-		slog.Error("Failed to start Pyroscope profiler:", "error", err)
+		slog.Error("Failed to start Pyroscope profiler:", logfields.Error(err))
+	}
+}
+
+func setupErrorReporter(config Config) {
+	transport, err := errreport.NewTransport(config.sentryDSN, config.errorAggregatorURL)
+	if err != nil {
+		slog.Error("Failed to setup error reporter:", logfields.Error(err))
+		return
+	}
+	// Report each distinct error at most 10 times a minute
+	errorReporter = errreport.New(config.serviceName, transport, 10, time.Minute)
+}
+
+// oversizedLinks fabricates n links to random span contexts.
+func oversizedLinks(n int) []trace.Link {
+	links := make([]trace.Link, n)
+	for i := range links {
+		var traceID trace.TraceID
+		var spanID trace.SpanID
+		crand.Read(traceID[:])
+		crand.Read(spanID[:])
+		links[i] = trace.Link{SpanContext: trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID: traceID,
+			SpanID:  spanID,
+		})}
 	}
+	return links
 }
 
 func getEmployees() []Employee {
 	employees := []Employee{
 			{ID: 1, Name: "Jeff", Position: "Manager"},
-			{ID: 2, Name: "Benny", Position: "Sales Associate"},
-			{ID: 3, Name: "Lisa", Position: "Assistant Manager"},
-			{ID: 4, Name: "Craig", Position: "Sales Associate"},
-			{ID: 5, Name: "Greg", Position: "Sales Associate"},
-			{ID: 6, Name: "Sheila", Position: "Product Tester"},
-			{ID: 7, Name: "Steven", Position: "Clerk"},
-			{ID: 8, Name: "Kelly", Position: "Clerk"},
-			{ID: 9, Name: "Dina", Position: "Cashier"},
-			{ID: 10, Name: "Kevin", Position: "Cashier"},
+			{ID: 2, Name: "Benny", Position: "Sales Associate", ManagerID: 3},
+			{ID: 3, Name: "Lisa", Position: "Assistant Manager", ManagerID: 1},
+			{ID: 4, Name: "Craig", Position: "Sales Associate", ManagerID: 3},
+			{ID: 5, Name: "Greg", Position: "Sales Associate", ManagerID: 3},
+			{ID: 6, Name: "Sheila", Position: "Product Tester", ManagerID: 1},
+			{ID: 7, Name: "Steven", Position: "Clerk", ManagerID: 3},
+			{ID: 8, Name: "Kelly", Position: "Clerk", ManagerID: 7},
+			{ID: 9, Name: "Dina", Position: "Cashier", ManagerID: 7},
+			{ID: 10, Name: "Kevin", Position: "Cashier", ManagerID: 9},
 	}
 	
 	return employees
 }
 
-func getProducts() []Product {
-	products := []Product{
-			{ID: 1, Name: "Mug", Price: 1099},
-			{ID: 2, Name: "Bowl", Price: 1599},
-			{ID: 3, Name: "Plate", Price: 1299},
-			{ID: 4, Name: "Fork", Price: 599},
-			{ID: 5, Name: "Spoon", Price: 799},
-			{ID: 6, Name: "Knife", Price: 1099},
-			{ID: 7, Name: "Cup", Price: 899},
-			{ID: 8, Name: "Saucer", Price: 699},
-			{ID: 9, Name: "Dish", Price: 1499},
-			{ID: 10, Name: "Glass", Price: 1199},
-	}
+func getProducts(ctx context.Context) []Product {
+	products := catalog.List()
+	simulateBottleneck(ctx)
+	return products
+}
 
+// simulateBottleneck is the intentional delay behind /products. Its notice is
+// a constant written straight to stdout rather than formatted, so the fast
+// path can share it without allocating.
+func simulateBottleneck(ctx context.Context) {
 	// Simulate a slow operation that "hangs"
-	fmt.Println("Handling request, simulating slow operation...")
+	os.Stdout.WriteString("Handling request, simulating slow operation...\n")
 	time.Sleep(5 * time.Second) // The intentional delay
 
 	// This is the part that will show up as a bottleneck in Pyroscope
-	_, productSpan := tr.Start(ctx, "fetch-products-data")
-	defer productSpan.End()
-	
-	return products
+	_, productSpan := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "fetch-products-data")
+	productSpan.End()
 }
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/grafana/pyroscope-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/j6nca/o11y-playground/pkg/errreport"
+	"github.com/j6nca/o11y-playground/pkg/highres"
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+	"github.com/j6nca/o11y-playground/pkg/overhead"
+	"github.com/j6nca/o11y-playground/pkg/priority"
+	"github.com/j6nca/o11y-playground/pkg/recorder"
+	"github.com/j6nca/o11y-playground/pkg/routelimit"
+	"github.com/j6nca/o11y-playground/pkg/routetimeout"
+)
+
+var (
+	// Histogram of request body sizes, by route.
+	requestSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_http_request_size_bytes",
+			Help:    "HTTP request body size in bytes.",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 10),
+		},
+		[]string{"route", "method", "http_version"},
+	)
+
+	// Histogram of response body sizes, by route.
+	responseSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_http_response_size_bytes",
+			Help:    "HTTP response body size in bytes.",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 10),
+		},
+		[]string{"route", "method", "http_version"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(requestSize, responseSize)
+}
+
+// errorReporter forwards errors and panics to the configured exception
+// tracker. It is nil (and therefore a no-op) until main sets it up.
+var errorReporter *errreport.Reporter
+
+// instrument wraps a handler with the shared middleware stack, outermost
+// first. The otelhttp handler is outermost so the span is available to
+// everything inside it. The telemetry middleware is accounted, so its own
+// cost can be measured.
+func instrument(h http.Handler, operation string) http.Handler {
+	otel := func(next http.Handler) http.Handler { return otelhttp.NewHandler(next, operation) }
+	stack := []func(http.Handler) http.Handler{
+		overhead.Accounted("otelhttp", otel),
+		overhead.Accounted("logging", logRoute),
+		overhead.Accounted("recording", recorder.Middleware),
+		overhead.Accounted("metrics", trackInFlight),
+		overhead.Accounted("metrics", highres.Middleware),
+		overhead.Accounted("metrics", measureApdex),
+		overhead.Accounted("tracing", traceHeaders),
+		overhead.Accounted("metrics", tagInstance),
+		meterQuotas,
+		priority.Middleware(httpError),
+		overhead.Accounted("metrics", measureSizes),
+		recoverPanics,
+		routetimeout.Middleware(countRequest),
+		routelimit.Middleware,
+		injectFaults,
+		overhead.Accounted("profiling", profileTags),
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		h = stack[i](h)
+	}
+	return overhead.Account(h)
+}
+
+// traceHeaders echoes the current trace back to the caller, as X-Trace-ID and
+// as a Server-Timing traceparent entry. Browsers expose Server-Timing to
+// devtools and the Resource Timing API, which is how RUM tooling links a
+// frontend timing to its backend trace.
+func traceHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			w.Header().Set("X-Trace-ID", sc.TraceID().String())
+			w.Header().Add("Server-Timing", fmt.Sprintf(`traceparent;desc="00-%s-%s-%s"`, sc.TraceID(), sc.SpanID(), sc.TraceFlags()))
+			w.Header().Set("Timing-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Expose-Headers", "X-Trace-ID, Server-Timing")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// measureSizes records how many bytes of request body the handler read and
+// how many bytes of response body it wrote. Sizes are labelled with the mux
+// pattern rather than the path, so /catalog/1 and /catalog/2 share a series,
+// and with the protocol version so HTTP/1.1 and h2c can be compared.
+func measureSizes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("http_version", r.Proto))
+
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+
+		// httpsnoop keeps Flusher and friends working on the wrapped writer
+		var written int64
+		w = httpsnoop.Wrap(w, httpsnoop.Hooks{
+			Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+				return func(b []byte) (int, error) {
+					n, err := next(b)
+					written += int64(n)
+					return n, err
+				}
+			},
+		})
+
+		next.ServeHTTP(w, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		requestSize.WithLabelValues(route, r.Method, r.Proto).Observe(float64(body.n))
+		responseSize.WithLabelValues(route, r.Method, r.Proto).Observe(float64(written))
+	})
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// profileTags labels the profiling samples taken while next runs with the
+// route, method, instance and zone, so Pyroscope can break CPU and
+// allocations down by endpoint, and by virtual replica and zone, rather
+// than only by service.
+func profileTags(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		pyroscope.TagWrapper(r.Context(), pyroscope.Labels("route", route, "method", r.Method, "instance_id", instanceFromContext(r.Context()), "zone", zoneFromContext(r.Context())), func(ctx context.Context) {
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	})
+}
+
+// recoverPanics turns a panic in the handler into a 500 response, records it
+// on the span and reports it, rather than letting net/http drop the
+// connection.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				// Deliberate aborts are net/http's business, not ours
+				panic(recovered)
+			}
+
+			ctx := r.Context()
+			stack := debug.Stack()
+			if p, ok := recovered.(*routetimeout.Panic); ok {
+				// Raised in the handler's own goroutine, whose stack it kept
+				recovered, stack = p.Value, p.Stack
+			}
+			span := trace.SpanFromContext(ctx)
+			span.RecordError(fmt.Errorf("panic: %v", recovered))
+			span.SetStatus(codes.Error, "panic")
+
+			slog.ErrorContext(ctx, "Recovered from panic", logfields.Path(r.URL.Path), "panic", fmt.Sprint(recovered), "stack", string(stack))
+			errorReporter.ReportPanic(ctx, recovered, stack, map[string]string{"path": r.URL.Path, "method": r.Method})
+
+			requestCount.WithLabelValues(routeTarget(r), r.Method, strconv.Itoa(http.StatusInternalServerError)).Inc()
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// countRequest counts a request answered with code by middleware rather
+// than by its handler.
+func countRequest(r *http.Request, code int) {
+	requestCount.WithLabelValues(routeTarget(r), r.Method, strconv.Itoa(code)).Inc()
+}
+
+// httpError is the common way for handlers to fail a request: it logs the
+// error, marks the span as failed, counts and reports it, then writes the
+// response.
+func httpError(w http.ResponseWriter, r *http.Request, err error, code int) {
+	ctx := r.Context()
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+
+	slog.ErrorContext(ctx, "Request failed", logfields.Path(r.URL.Path), logfields.StatusCode(code), logfields.Error(err))
+	if code >= http.StatusInternalServerError {
+		errorReporter.Report(ctx, err, map[string]string{"path": r.URL.Path, "method": r.Method})
+	}
+
+	requestCount.WithLabelValues(routeTarget(r), r.Method, strconv.Itoa(code)).Inc()
+	http.Error(w, err.Error(), code)
+}
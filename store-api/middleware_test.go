@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/j6nca/o11y-playground/pkg/routetimeout"
+)
+
+func panickingHandler(w http.ResponseWriter, r *http.Request) {
+	panic("out of stock")
+}
+
+func TestRecoverPanicsKeepsHandlerStackUnderTimeout(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	var logs bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	defer routetimeout.Set(map[string]time.Duration{})
+	routetimeout.Set(map[string]time.Duration{"GET /panic": time.Minute})
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /panic", recoverPanics(routetimeout.Middleware(countRequest)(http.HandlerFunc(panickingHandler))))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	var record struct {
+		Panic string `json:"panic"`
+		Stack string `json:"stack"`
+	}
+	if err := json.Unmarshal(logs.Bytes(), &record); err != nil {
+		t.Fatalf("decoding log record %q: %v", logs.String(), err)
+	}
+	if record.Panic != "out of stock" {
+		t.Errorf("panic = %q, want %q", record.Panic, "out of stock")
+	}
+	if !strings.Contains(record.Stack, "panickingHandler") {
+		t.Errorf("logged stack does not include the handler:\n%s", record.Stack)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Count calls to each notification provider, by outcome. The success
+	// rate per provider is the SLI for that vendor.
+	notificationProviderRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_notification_provider_requests_total",
+			Help: "Total number of sends attempted through each notification provider, by channel, provider and outcome (success, error or timeout).",
+		},
+		[]string{"channel", "provider", "outcome"},
+	)
+
+	// Histogram of each notification provider's latency.
+	notificationProviderLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_notification_provider_duration_seconds",
+			Help:    "Latency of sends through each notification provider in seconds, by channel and provider.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"channel", "provider"},
+	)
+
+	// Count failovers from one provider to the next.
+	notificationFailovers = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_notification_failovers_total",
+			Help: "Total number of notifications failed over from one provider to the next, by channel and the providers failed over from and to.",
+		},
+		[]string{"channel", "from", "to"},
+	)
+
+	// Count notifications, by whether any provider managed to send them.
+	notificationsSent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_notifications_total",
+			Help: "Total number of notifications, by channel and outcome (sent by some provider, or failed by all of them).",
+		},
+		[]string{"channel", "outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(notificationProviderRequests, notificationProviderLatency, notificationFailovers, notificationsSent)
+}
+
+// notification is a message to a customer over one channel.
+type notification struct {
+	Channel string
+	To      string
+	Body    string
+}
+
+// notifier is a notification provider, a vendor that delivers messages
+// over some channel.
+type notifier interface {
+	Name() string
+	Send(ctx context.Context, n notification) error
+}
+
+// ProviderProfile describes how a simulated provider behaves.
+type ProviderProfile struct {
+	Name      string  `json:"name"`
+	Channel   string  `json:"channel"`
+	LatencyMS int     `json:"latency_ms"`
+	JitterMS  int     `json:"jitter_ms"`
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// simulatedProvider stands in for a vendor's email or SMS API, with a
+// profile that can be changed at runtime to brown it out.
+type simulatedProvider struct {
+	mu       sync.RWMutex
+	profile  ProviderProfile
+	defaults ProviderProfile
+}
+
+func newSimulatedProvider(profile ProviderProfile) *simulatedProvider {
+	return &simulatedProvider{profile: profile, defaults: profile}
+}
+
+func (p *simulatedProvider) Name() string {
+	return p.Profile().Name
+}
+
+func (p *simulatedProvider) Profile() ProviderProfile {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.profile
+}
+
+func (p *simulatedProvider) SetProfile(profile ProviderProfile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.profile = profile
+}
+
+// Reset puts the provider back to the profile it started with.
+func (p *simulatedProvider) Reset() {
+	p.SetProfile(p.defaults)
+}
+
+func (p *simulatedProvider) Send(ctx context.Context, n notification) error {
+	profile := p.Profile()
+	delay := time.Duration(profile.LatencyMS) * time.Millisecond
+	if profile.JitterMS > 0 {
+		delay += time.Duration(rand.Intn(profile.JitterMS)) * time.Millisecond
+	}
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if rand.Float64() < profile.ErrorRate {
+		return fmt.Errorf("%s: service unavailable", profile.Name)
+	}
+	return nil
+}
+
+// notificationProviders are the simulated vendors, a primary and a
+// fallback for each channel, in the order they are tried.
+var notificationProviders = []*simulatedProvider{
+	newSimulatedProvider(ProviderProfile{Name: "mailhop", Channel: "email", LatencyMS: 80, JitterMS: 40, ErrorRate: 0.02}),
+	newSimulatedProvider(ProviderProfile{Name: "postbox", Channel: "email", LatencyMS: 150, JitterMS: 100, ErrorRate: 0.05}),
+	newSimulatedProvider(ProviderProfile{Name: "textwave", Channel: "sms", LatencyMS: 120, JitterMS: 60, ErrorRate: 0.03}),
+	newSimulatedProvider(ProviderProfile{Name: "smsline", Channel: "sms", LatencyMS: 200, JitterMS: 150, ErrorRate: 0.05}),
+}
+
+// notificationRouter sends each channel's notifications through its
+// providers in order, failing over to the next whenever one fails or
+// takes longer than timeout.
+type notificationRouter struct {
+	channels map[string][]notifier
+	timeout  time.Duration
+}
+
+func newNotificationRouter(timeout time.Duration) *notificationRouter {
+	r := &notificationRouter{channels: map[string][]notifier{}, timeout: timeout}
+	for _, p := range notificationProviders {
+		channel := p.Profile().Channel
+		r.channels[channel] = append(r.channels[channel], p)
+	}
+	return r
+}
+
+// Send delivers n through the first of its channel's providers that
+// manages to, returning an error only if they all fail.
+func (r *notificationRouter) Send(ctx context.Context, n notification) error {
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "notify-"+n.Channel,
+		trace.WithAttributes(attribute.String("notification.channel", n.Channel)),
+	)
+	defer span.End()
+
+	providers := r.channels[n.Channel]
+	var errs []error
+	for i, provider := range providers {
+		err := r.sendWith(ctx, provider, n)
+		if err == nil {
+			span.SetAttributes(
+				attribute.String("notification.provider", provider.Name()),
+				attribute.Int("notification.failovers", i),
+			)
+			notificationsSent.WithLabelValues(n.Channel, "sent").Inc()
+			return nil
+		}
+		errs = append(errs, err)
+		if i+1 < len(providers) {
+			next := providers[i+1].Name()
+			notificationFailovers.WithLabelValues(n.Channel, provider.Name(), next).Inc()
+			span.AddEvent("failover", trace.WithAttributes(
+				attribute.String("notification.from", provider.Name()),
+				attribute.String("notification.to", next),
+				attribute.String("error.message", err.Error()),
+			))
+			slog.WarnContext(ctx, "Notification provider failed, failing over", "channel", n.Channel, "provider", provider.Name(), "next", next, logfields.Error(err))
+		}
+	}
+
+	err := fmt.Errorf("every %s provider failed: %w", n.Channel, errors.Join(errs...))
+	span.SetStatus(codes.Error, err.Error())
+	notificationsSent.WithLabelValues(n.Channel, "failed").Inc()
+	return err
+}
+
+// sendWith makes one attempt through provider, under a client span.
+func (r *notificationRouter) sendWith(ctx context.Context, provider notifier, n notification) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "notification-provider-send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("peer.service", provider.Name()),
+			attribute.String("notification.channel", n.Channel),
+		),
+	)
+	defer span.End()
+
+	start := time.Now()
+	err := provider.Send(ctx, n)
+	notificationProviderLatency.WithLabelValues(n.Channel, provider.Name()).Observe(time.Since(start).Seconds())
+
+	outcome := "success"
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		outcome = "timeout"
+	case err != nil:
+		outcome = "error"
+	}
+	notificationProviderRequests.WithLabelValues(n.Channel, provider.Name(), outcome).Inc()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// notifications is the router order confirmations go through, nil when
+// notifications are off.
+var notifications *notificationRouter
+
+// notifyOrder sends the confirmations for an order.created event, by
+// email and by SMS. A message is only redelivered when a channel failed on
+// every provider.
+func notifyOrder(ctx context.Context, msg Message) error {
+	body := "Your order " + msg.Key + " has been placed"
+	return errors.Join(
+		notifications.Send(ctx, notification{Channel: "email", To: "customer-" + msg.Key + "@example.com", Body: body}),
+		notifications.Send(ctx, notification{Channel: "sms", To: "+1555" + msg.Key, Body: body}),
+	)
+}
+
+// notificationsHandler shows the simulated providers' profiles. POST
+// changes the one named by provider from the latency_ms, jitter_ms and
+// error_rate query parameters, and DELETE puts every provider back to its
+// defaults.
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		query := r.URL.Query()
+		var provider *simulatedProvider
+		for _, p := range notificationProviders {
+			if p.Name() == query.Get("provider") {
+				provider = p
+			}
+		}
+		if provider == nil {
+			httpError(w, r, fmt.Errorf("unknown provider %q", query.Get("provider")), http.StatusBadRequest)
+			return
+		}
+		profile := provider.Profile()
+		if v, err := strconv.Atoi(query.Get("latency_ms")); err == nil {
+			profile.LatencyMS = v
+		}
+		if v, err := strconv.Atoi(query.Get("jitter_ms")); err == nil {
+			profile.JitterMS = v
+		}
+		if v, err := strconv.ParseFloat(query.Get("error_rate"), 64); err == nil {
+			profile.ErrorRate = v
+		}
+		if profile.LatencyMS < 0 || profile.JitterMS < 0 || profile.ErrorRate < 0 || profile.ErrorRate > 1 {
+			httpError(w, r, errors.New("latency_ms and jitter_ms must be positive and error_rate between 0 and 1"), http.StatusBadRequest)
+			return
+		}
+		provider.SetProfile(profile)
+		slog.Warn("Notification provider profile changed", "provider", profile.Name, "latency_ms", profile.LatencyMS, "jitter_ms", profile.JitterMS, "error_rate", profile.ErrorRate)
+	case http.MethodDelete:
+		for _, p := range notificationProviders {
+			p.Reset()
+		}
+		slog.Info("Notification provider profiles reset")
+	default:
+		httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	profiles := make([]ProviderProfile, 0, len(notificationProviders))
+	for _, p := range notificationProviders {
+		profiles = append(profiles, p.Profile())
+	}
+	writeJSON(w, r, profiles, 0)
+}
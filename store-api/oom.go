@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Gauge of memory held by the OOM chaos mode.
+	oomAllocatedBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_oom_allocated_bytes",
+			Help: "Bytes of memory held by the OOM chaos mode.",
+		},
+	)
+
+	// Gauge of the container memory limit, 0 when there is none.
+	memoryLimitBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_memory_limit_bytes",
+			Help: "Container memory limit in bytes, 0 if no limit was detected.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(oomAllocatedBytes, memoryLimitBytes)
+	memoryLimitBytes.Set(float64(containerMemoryLimit()))
+}
+
+// oomChunkSize is how much memory is grabbed per allocation.
+const oomChunkSize = 1 << 20
+
+// oomer is a chaos mode that allocates memory at a steady rate and never
+// lets go, until the container's memory limit gets the process OOMKilled.
+// Without a limit there is nothing to hit, so it stops at a safety cap
+// instead of taking the whole host down with it.
+type oomer struct {
+	mu   sync.Mutex
+	stop chan struct{}
+	rate int
+	held [][]byte
+}
+
+var ooms = &oomer{}
+
+// Start begins allocating rateMB megabytes per second, holding at most
+// capMB when no container limit is detected. It replaces any run already
+// going.
+func (o *oomer) Start(rateMB, capMB int) error {
+	if rateMB <= 0 {
+		return errors.New("rate must be positive")
+	}
+
+	limit := containerMemoryLimit()
+	maxBytes := int64(capMB) << 20
+	if limit > 0 {
+		// No cap needed, the limit is the point
+		maxBytes = 0
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stop != nil {
+		close(o.stop)
+	}
+	o.stop = make(chan struct{})
+	o.rate = rateMB
+
+	go o.run(o.stop, rateMB, maxBytes)
+	slog.Warn("Started allocating towards OOM", "rate_mb_per_second", rateMB, "limit_bytes", limit, "cap_bytes", maxBytes)
+	return nil
+}
+
+// Stop stops allocating, optionally releasing everything held so far.
+func (o *oomer) Stop(release bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stop != nil {
+		close(o.stop)
+		o.stop = nil
+	}
+	if release {
+		o.held = nil
+		oomAllocatedBytes.Set(0)
+		runtime.GC()
+	}
+	slog.Info("Stopped allocating towards OOM", "released", release)
+}
+
+func (o *oomer) run(stop chan struct{}, rateMB int, maxBytes int64) {
+	ticker := time.NewTicker(time.Second / time.Duration(rateMB))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		// Touch every page so the memory is resident, not just reserved
+		chunk := make([]byte, oomChunkSize)
+		for i := 0; i < len(chunk); i += os.Getpagesize() {
+			chunk[i] = 1
+		}
+
+		o.mu.Lock()
+		o.held = append(o.held, chunk)
+		held := int64(len(o.held)) * oomChunkSize
+		o.mu.Unlock()
+		oomAllocatedBytes.Set(float64(held))
+
+		if maxBytes > 0 && held >= maxBytes {
+			slog.Warn("No memory limit detected, stopping at safety cap", "held_bytes", held)
+			o.mu.Lock()
+			if o.stop == stop {
+				o.stop = nil
+			}
+			o.mu.Unlock()
+			return
+		}
+	}
+}
+
+// containerMemoryLimit returns the cgroup memory limit in bytes, or 0 if
+// there is none (or we aren't in a cgroup we can read).
+func containerMemoryLimit() int64 {
+	for _, path := range []string{
+		"/sys/fs/cgroup/memory.max",                   // cgroup v2
+		"/sys/fs/cgroup/memory/memory.limit_in_bytes", // cgroup v1
+	} {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		limit, err := strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64)
+		// v2 says "max" when unlimited, v1 a number close to MaxInt64
+		if err != nil || limit >= 1<<60 {
+			return 0
+		}
+		return limit
+	}
+	return 0
+}
+
+// oomHandler controls the OOM chaos mode: POST starts it with the rate_mb
+// query parameter (megabytes per second), DELETE stops it (and frees what
+// it holds if release=true).
+func oomHandler(capMB int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			rate, _ := strconv.Atoi(r.URL.Query().Get("rate_mb"))
+			if err := ooms.Start(rate, capMB); err != nil {
+				httpError(w, r, err, http.StatusBadRequest)
+				return
+			}
+		case http.MethodDelete:
+			ooms.Stop(r.URL.Query().Get("release") == "true")
+		default:
+			httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+
+		ooms.mu.Lock()
+		running, rate, held := ooms.stop != nil, ooms.rate, len(ooms.held)*oomChunkSize
+		ooms.mu.Unlock()
+		writeJSON(w, r, map[string]any{
+			"running":     running,
+			"rate_mb":     rate,
+			"held_bytes":  held,
+			"limit_bytes": containerMemoryLimit(),
+		}, 0)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+	"github.com/j6nca/o11y-playground/pkg/model"
+)
+
+var (
+	// Gauge of outbox entries written but not yet published.
+	outboxPending = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_outbox_pending",
+			Help: "Number of outbox entries waiting to be published.",
+		},
+	)
+
+	// Histogram of how long entries sat in the outbox before publishing.
+	outboxLag = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "go_app_outbox_publish_lag_seconds",
+			Help:    "Time between an outbox entry being written and published in seconds.",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(outboxPending, outboxLag)
+}
+
+// Order is a customer order for a single product.
+type Order = model.Order
+
+// outboxEntry is an event waiting to be published, stored alongside the
+// order it describes. EventID is minted when the entry is written, so every
+// delivery of the event carries the same one. Carrier holds the trace context
+// of the request that wrote it.
+type outboxEntry struct {
+	ID        int
+	EventID   string
+	Topic     string
+	Key       string
+	Payload   []byte
+	Carrier   map[string]string
+	CreatedAt time.Time
+}
+
+// orderStore simulates a database with an orders table and an outbox table.
+// Writing an order and its outbox entry happens in one "transaction" (under
+// one lock), so an event is recorded if and only if the order is.
+type orderStore struct {
+	mu     sync.Mutex
+	nextID int
+	orders map[int]Order
+	outbox []outboxEntry
+}
+
+var orders = &orderStore{nextID: 1, orders: map[int]Order{}}
+
+// Create stores the order and its order.created outbox entry together.
+func (s *orderStore) Create(ctx context.Context, productID, quantity int) Order {
+	_, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "orders-insert-transaction")
+	defer span.End()
+
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order := Order{ID: s.nextID, ProductID: productID, Quantity: quantity, Status: "created", CreatedAt: time.Now()}
+	s.nextID++
+	s.orders[order.ID] = order
+
+	payload, _ := json.Marshal(order)
+	s.outbox = append(s.outbox, outboxEntry{
+		ID:        order.ID,
+		EventID:   newEventID(),
+		Topic:     "order.created",
+		Key:       strconv.Itoa(order.ID),
+		Payload:   payload,
+		Carrier:   carrier,
+		CreatedAt: order.CreatedAt,
+	})
+	outboxPending.Set(float64(len(s.outbox)))
+
+	span.SetAttributes(attribute.Int("order.id", order.ID))
+	return order
+}
+
+// List returns every order.
+func (s *orderStore) List() []Order {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]Order, 0, len(s.orders))
+	for id := 1; id < s.nextID; id++ {
+		if o, ok := s.orders[id]; ok {
+			list = append(list, o)
+		}
+	}
+	return list
+}
+
+// takeOutbox removes and returns everything waiting in the outbox.
+func (s *orderStore) takeOutbox() []outboxEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := s.outbox
+	s.outbox = nil
+	outboxPending.Set(0)
+	return entries
+}
+
+// runOutboxRelay polls the outbox and publishes its entries to the bus.
+func runOutboxRelay(interval time.Duration) {
+	for range time.Tick(interval) {
+		relayOutbox()
+	}
+}
+
+// relayOutbox publishes everything waiting in the outbox. Each publish span
+// continues the trace of the request that wrote the entry, restored from
+// the entry along with its baggage, so the event shows up under the request
+// that caused it even though the relay runs after it finished.
+func relayOutbox() {
+	for _, entry := range orders.takeOutbox() {
+		ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(entry.Carrier))
+		ctx, span := otel.Tracer("go.opentelemetry.io/bus").Start(ctx, entry.Topic+" publish",
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(
+				attribute.String("messaging.destination.name", entry.Topic),
+				attribute.String("messaging.message.id", entry.Key),
+			),
+		)
+
+		// Carry the publish span's context on the message for consumers
+		headers := propagation.MapCarrier{}
+		otel.GetTextMapPropagator().Inject(ctx, headers)
+		bus.Publish(ctx, Message{ID: entry.EventID, Topic: entry.Topic, Key: entry.Key, Payload: entry.Payload, Headers: headers, CreatedAt: entry.CreatedAt})
+
+		outboxLag.Observe(time.Since(entry.CreatedAt).Seconds())
+		span.End()
+	}
+}
+
+// maxOrderBytes caps the size of an order's body.
+const maxOrderBytes = 64 << 10
+
+// ordersHandler lists orders on GET, and creates one on POST from a JSON body
+// with product_id and quantity. POSTs may carry an Idempotency-Key header to
+// make retries safe.
+func ordersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(r.Context(), "orders-handler")
+	defer span.End()
+	start := time.Now()
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, r, orders.List(), time.Since(start))
+	case http.MethodPost:
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxOrderBytes))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				httpError(w, r, fmt.Errorf("order too large (max %d bytes)", maxOrderBytes), http.StatusRequestEntityTooLarge)
+				return
+			}
+			httpError(w, r, fmt.Errorf("failed to read order: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		// Retries carrying the same Idempotency-Key get the original order.
+		// The key is held from here until the order is stored, so a retry
+		// racing the original is turned away instead of ordering twice.
+		key := r.Header.Get("Idempotency-Key")
+		span.SetAttributes(attribute.Bool("idempotency.key_present", key != ""))
+		if key != "" {
+			result, state := orderIdempotency.Reserve(key, body)
+			switch state {
+			case idempotencyConflict:
+				idempotentReplays.WithLabelValues(r.URL.Path, "conflict").Inc()
+				httpError(w, r, errors.New("Idempotency-Key was already used for a different order"), http.StatusUnprocessableEntity)
+				return
+			case idempotencyInFlight:
+				idempotentReplays.WithLabelValues(r.URL.Path, "in_flight").Inc()
+				httpError(w, r, errors.New("an order with this Idempotency-Key is still being processed"), http.StatusConflict)
+				return
+			case idempotencyReplay:
+				idempotentReplays.WithLabelValues(r.URL.Path, "replayed").Inc()
+				span.SetAttributes(attribute.Bool("idempotency.replayed", true))
+				slog.InfoContext(ctx, "Replayed order from idempotency cache", "idempotency_key", key)
+				w.Header().Set("Idempotent-Replayed", "true")
+				writeJSON(w, r, result, time.Since(start))
+				return
+			}
+			// Free the key if the order fails, so it can be retried
+			defer orderIdempotency.Release(key)
+		}
+
+		var req struct {
+			ProductID int `json:"product_id"`
+			Quantity  int `json:"quantity"`
+		}
+		if err := unmarshalJSON(ctx, routeTarget(r), body, &req); err != nil {
+			httpError(w, r, fmt.Errorf("invalid order: %w", err), http.StatusBadRequest)
+			return
+		}
+		product, ok := catalog.Get(req.ProductID)
+		if !ok || req.Quantity <= 0 {
+			httpError(w, r, errors.New("order needs a known product_id and a positive quantity"), http.StatusBadRequest)
+			return
+		}
+
+		// Take payment before the order is written, when there is a
+		// payments dependency to take it with
+		if payments != nil {
+			paymentID, err := payments.Charge(ctx, key, product.Price*req.Quantity)
+			if err != nil {
+				paymentFailed(w, r, err)
+				return
+			}
+			span.SetAttributes(attribute.String("payment.id", paymentID))
+		}
+
+		order := orders.Create(ctx, req.ProductID, req.Quantity)
+		if key != "" {
+			orderIdempotency.Store(key, order)
+			span.SetAttributes(attribute.Bool("idempotency.replayed", false))
+		}
+		slog.InfoContext(ctx, "Order created", "order_id", order.ID, logfields.Duration(time.Since(start)))
+		writeJSON(w, r, order, time.Since(start))
+	default:
+		httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+	}
+}
+
+// orderEventErrorRate is the fraction of order events logOrderEvent fails,
+// to exercise retries and the dead letter queue.
+var orderEventErrorRate float64
+
+// logOrderEvent is a bus consumer that records order events as they arrive.
+func logOrderEvent(ctx context.Context, msg Message) error {
+	if orderEventErrorRate > 0 && rand.Float64() < orderEventErrorRate {
+		return fmt.Errorf("order %s: event store unavailable", msg.Key)
+	}
+	slog.InfoContext(ctx, "Received order event", "topic", msg.Topic, "order_id", msg.Key)
+	return nil
+}
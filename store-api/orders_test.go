@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestOutboxRelayContinuesRequestTrace(t *testing.T) {
+	recorder := recordSpans(t)
+	ctx, request := requestContext(t)
+
+	handled := subscribeOnce(bus, "order.created")
+	orders.Create(ctx, 1, 1)
+	relayOutbox()
+
+	var publish sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "order.created publish" {
+			publish = span
+		}
+	}
+	if publish == nil {
+		t.Fatal("outbox entry was never published")
+	}
+	checkContinues(t, publish, request.SpanContext())
+
+	handledCtx := waitHandled(t, handled)
+	consumer, ok := trace.SpanFromContext(handledCtx).(sdktrace.ReadOnlySpan)
+	if !ok {
+		t.Fatal("order event was handled without a recording span")
+	}
+	checkContinues(t, consumer, publish.SpanContext())
+	checkBaggage(t, handledCtx)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Gauge of the current GOMAXPROCS.
+	gomaxprocs = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_gomaxprocs",
+			Help: "Current GOMAXPROCS, the number of OS threads that may run Go code at once.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gomaxprocs)
+	gomaxprocs.Set(float64(defaultGOMAXPROCS))
+}
+
+// defaultGOMAXPROCS is what the service started with, from the GOMAXPROCS
+// environment variable or the number of CPUs, and what DELETE restores.
+var defaultGOMAXPROCS = runtime.GOMAXPROCS(0)
+
+// setGOMAXPROCS changes GOMAXPROCS, logging the change.
+func setGOMAXPROCS(n int) {
+	previous := runtime.GOMAXPROCS(n)
+	gomaxprocs.Set(float64(n))
+	if n != previous {
+		slog.Warn("Changed GOMAXPROCS", "gomaxprocs", n, "previous", previous)
+	}
+}
+
+// parallelismHandler controls the parallelism chaos mode, which starves the
+// service of CPU without touching its container limits. POST lowers
+// GOMAXPROCS from the gomaxprocs query parameter, and how many worker pool
+// jobs may run at once from workers. Either can be left out. DELETE restores
+// both. Starved, requests queue for the worker pool and for the scheduler
+// while the CPU profile looks the same, just stretched out.
+func parallelismHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		procs, workers := 0, 0
+		if v := query.Get("gomaxprocs"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				httpError(w, r, errors.New("gomaxprocs must be a positive number"), http.StatusBadRequest)
+				return
+			}
+			procs = n
+		}
+		if v := query.Get("workers"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				httpError(w, r, errors.New("workers must be a positive number"), http.StatusBadRequest)
+				return
+			}
+			workers = n
+		}
+
+		if procs != 0 {
+			setGOMAXPROCS(procs)
+		}
+		if workers != 0 {
+			limit := cpuPool.SetLimit(workers)
+			slog.WarnContext(r.Context(), "Limited worker pool parallelism", "workers", limit)
+		}
+	case http.MethodDelete:
+		setGOMAXPROCS(defaultGOMAXPROCS)
+		cpuPool.SetLimit(0)
+	default:
+		httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, r, map[string]any{
+		"gomaxprocs":         runtime.GOMAXPROCS(0),
+		"default_gomaxprocs": defaultGOMAXPROCS,
+		"num_cpu":            runtime.NumCPU(),
+		"worker_pool":        cpuPool.Stats(),
+	}, 0)
+}
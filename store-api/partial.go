@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// Count items in multi-item requests by route and result.
+	itemResults = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_item_results_total",
+			Help: "Total number of items handled by multi-item requests, by route and result (ok or failed).",
+		},
+		[]string{"route", "result"},
+	)
+
+	// Count multi-item responses by route and outcome.
+	partialResponses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_multi_item_responses_total",
+			Help: "Total number of multi-item responses, by route and outcome: complete, partial (some items failed) or failed (every item failed). Partial and failed responses are still 207s.",
+		},
+		[]string{"route", "outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(itemResults, partialResponses)
+}
+
+// ItemFailure describes an item in a multi-item request that failed, by its
+// position in the request.
+type ItemFailure struct {
+	Index int    `json:"index"`
+	ID    int    `json:"id"`
+	Error string `json:"error"`
+}
+
+// recordItemFailure adds an item.failed event for f to the span in ctx, so
+// the trace says which items failed even though the request succeeded.
+func recordItemFailure(ctx context.Context, f ItemFailure) {
+	trace.SpanFromContext(ctx).AddEvent("item.failed", trace.WithAttributes(
+		attribute.Int("item.index", f.Index),
+		attribute.Int("item.id", f.ID),
+		attribute.String("error.message", f.Error),
+	))
+}
+
+// writeItemResults writes v, the response to a request for total items of
+// which failed failed. A request where any item failed gets a 207 Multi-Status
+// rather than a 200: still a success to anything watching status codes, which
+// is the point, so the item metrics are what show the failures. The server
+// span gets the counts too, and an error status when every item failed.
+func writeItemResults(w http.ResponseWriter, r *http.Request, v any, total, failed int, duration time.Duration) {
+	route := routeTarget(r)
+	itemResults.WithLabelValues(route, "ok").Add(float64(total - failed))
+	itemResults.WithLabelValues(route, "failed").Add(float64(failed))
+
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(attribute.Int("items.total", total), attribute.Int("items.failed", failed))
+	code, outcome := http.StatusOK, "complete"
+	switch {
+	case failed > 0 && failed == total:
+		code, outcome = http.StatusMultiStatus, "failed"
+		span.SetStatus(codes.Error, "every item failed")
+	case failed > 0:
+		code, outcome = http.StatusMultiStatus, "partial"
+	}
+	partialResponses.WithLabelValues(route, outcome).Inc()
+	writeJSONStatus(w, r, v, code, duration)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+var (
+	// Count orders that failed at payment, by kind and reason.
+	checkoutFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_checkout_failures_total",
+			Help: "Total number of orders that failed at payment, by kind (business for declines, system for everything else) and reason.",
+		},
+		[]string{"kind", "reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(checkoutFailures)
+}
+
+// payments is the client for the payments dependency, nil when not
+// configured.
+var payments *paymentsClient
+
+// declineError is a payment the processor turned down, a business failure
+// rather than a system one.
+type declineError struct {
+	reason string
+}
+
+func (e *declineError) Error() string {
+	return "payment declined: " + e.reason
+}
+
+// paymentsClient charges orders through the payments dependency.
+type paymentsClient struct {
+	address string
+	client  http.Client
+}
+
+func newPaymentsClient(address string, timeout time.Duration, h2c bool) *paymentsClient {
+	return &paymentsClient{
+		address: address,
+		client: http.Client{
+			// No retries: a payment isn't safe to repeat
+			Transport: newTransport("payments", h2c),
+			Timeout:   timeout,
+		},
+	}
+}
+
+// Charge takes amount for an order, returning the payment ID. A declined
+// payment is a *declineError.
+func (c *paymentsClient) Charge(ctx context.Context, orderRef string, amount int) (string, error) {
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "charge-payment")
+	defer span.End()
+	span.SetAttributes(attribute.String("peer.service", "payments"), attribute.Int("payment.amount", amount))
+
+	body, _ := json.Marshal(map[string]any{"amount": amount, "currency": "USD", "order_ref": orderRef})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, c.address+"/payments", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		ID     string `json:"id"`
+		Reason string `json:"reason"`
+	}
+	decodeJSON(ctx, "payments", resp.Body, &result)
+	span.SetAttributes(attribute.String("payment.id", result.ID))
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return result.ID, nil
+	case http.StatusPaymentRequired:
+		span.SetAttributes(attribute.String("payment.decline_reason", result.Reason))
+		return result.ID, &declineError{reason: result.Reason}
+	default:
+		err := fmt.Errorf("payments returned status %d", resp.StatusCode)
+		span.SetStatus(codes.Error, err.Error())
+		return result.ID, err
+	}
+}
+
+// paymentFailed responds to an order whose payment failed, telling declines
+// (402, the customer's problem) apart from everything else (a 5xx, ours).
+func paymentFailed(w http.ResponseWriter, r *http.Request, err error) {
+	var decline *declineError
+	switch {
+	case errors.As(err, &decline):
+		checkoutFailures.WithLabelValues("business", decline.reason).Inc()
+		httpError(w, r, err, http.StatusPaymentRequired)
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || isTimeout(err):
+		checkoutFailures.WithLabelValues("system", "timeout").Inc()
+		httpError(w, r, fmt.Errorf("payment timed out: %w", err), http.StatusGatewayTimeout)
+	default:
+		checkoutFailures.WithLabelValues("system", "error").Inc()
+		httpError(w, r, fmt.Errorf("payment failed: %w", err), http.StatusBadGateway)
+	}
+}
+
+// isTimeout reports whether err is a timeout, such as an http.Client one.
+func isTimeout(err error) bool {
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
@@ -0,0 +1,353 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.8
+// 	protoc        (unknown)
+// source: proto/store.proto
+
+package storepb
+
+import (
+	modelpb "github.com/j6nca/o11y-playground/pkg/model/modelpb"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type WatchStockRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Products to watch, every product if empty
+	ProductIds    []int64 `protobuf:"varint,1,rep,packed,name=product_ids,json=productIds,proto3" json:"product_ids,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WatchStockRequest) Reset() {
+	*x = WatchStockRequest{}
+	mi := &file_proto_store_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchStockRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchStockRequest) ProtoMessage() {}
+
+func (x *WatchStockRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_store_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchStockRequest.ProtoReflect.Descriptor instead.
+func (*WatchStockRequest) Descriptor() ([]byte, []int) {
+	return file_proto_store_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *WatchStockRequest) GetProductIds() []int64 {
+	if x != nil {
+		return x.ProductIds
+	}
+	return nil
+}
+
+// StockUpdate is a product's stock level after a change.
+type StockUpdate struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	ProductId int64                  `protobuf:"varint,1,opt,name=product_id,json=productId,proto3" json:"product_id,omitempty"`
+	Stock     int64                  `protobuf:"varint,2,opt,name=stock,proto3" json:"stock,omitempty"`
+	// Counts the writes to the product's stock
+	Version       int64                  `protobuf:"varint,3,opt,name=version,proto3" json:"version,omitempty"`
+	UpdatedAt     *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=updated_at,json=updatedAt,proto3" json:"updated_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StockUpdate) Reset() {
+	*x = StockUpdate{}
+	mi := &file_proto_store_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StockUpdate) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StockUpdate) ProtoMessage() {}
+
+func (x *StockUpdate) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_store_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StockUpdate.ProtoReflect.Descriptor instead.
+func (*StockUpdate) Descriptor() ([]byte, []int) {
+	return file_proto_store_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *StockUpdate) GetProductId() int64 {
+	if x != nil {
+		return x.ProductId
+	}
+	return 0
+}
+
+func (x *StockUpdate) GetStock() int64 {
+	if x != nil {
+		return x.Stock
+	}
+	return 0
+}
+
+func (x *StockUpdate) GetVersion() int64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *StockUpdate) GetUpdatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.UpdatedAt
+	}
+	return nil
+}
+
+type ListProductsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListProductsRequest) Reset() {
+	*x = ListProductsRequest{}
+	mi := &file_proto_store_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListProductsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListProductsRequest) ProtoMessage() {}
+
+func (x *ListProductsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_store_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListProductsRequest.ProtoReflect.Descriptor instead.
+func (*ListProductsRequest) Descriptor() ([]byte, []int) {
+	return file_proto_store_proto_rawDescGZIP(), []int{2}
+}
+
+type ListProductsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Products      []*modelpb.Product     `protobuf:"bytes,1,rep,name=products,proto3" json:"products,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListProductsResponse) Reset() {
+	*x = ListProductsResponse{}
+	mi := &file_proto_store_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListProductsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListProductsResponse) ProtoMessage() {}
+
+func (x *ListProductsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_store_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListProductsResponse.ProtoReflect.Descriptor instead.
+func (*ListProductsResponse) Descriptor() ([]byte, []int) {
+	return file_proto_store_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ListProductsResponse) GetProducts() []*modelpb.Product {
+	if x != nil {
+		return x.Products
+	}
+	return nil
+}
+
+type GetProductRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            int64                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetProductRequest) Reset() {
+	*x = GetProductRequest{}
+	mi := &file_proto_store_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetProductRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetProductRequest) ProtoMessage() {}
+
+func (x *GetProductRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_store_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetProductRequest.ProtoReflect.Descriptor instead.
+func (*GetProductRequest) Descriptor() ([]byte, []int) {
+	return file_proto_store_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *GetProductRequest) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+var File_proto_store_proto protoreflect.FileDescriptor
+
+const file_proto_store_proto_rawDesc = "" +
+	"\n" +
+	"\x11proto/store.proto\x12\bstore.v1\x1a\x1fgoogle/protobuf/timestamp.proto\x1a\vmodel.proto\"4\n" +
+	"\x11WatchStockRequest\x12\x1f\n" +
+	"\vproduct_ids\x18\x01 \x03(\x03R\n" +
+	"productIds\"\x97\x01\n" +
+	"\vStockUpdate\x12\x1d\n" +
+	"\n" +
+	"product_id\x18\x01 \x01(\x03R\tproductId\x12\x14\n" +
+	"\x05stock\x18\x02 \x01(\x03R\x05stock\x12\x18\n" +
+	"\aversion\x18\x03 \x01(\x03R\aversion\x129\n" +
+	"\n" +
+	"updated_at\x18\x04 \x01(\v2\x1a.google.protobuf.TimestampR\tupdatedAt\"\x15\n" +
+	"\x13ListProductsRequest\"B\n" +
+	"\x14ListProductsResponse\x12*\n" +
+	"\bproducts\x18\x01 \x03(\v2\x0e.model.ProductR\bproducts\"#\n" +
+	"\x11GetProductRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x03R\x02id2\xe2\x01\n" +
+	"\fStoreService\x12B\n" +
+	"\n" +
+	"WatchStock\x12\x1b.store.v1.WatchStockRequest\x1a\x15.store.v1.StockUpdate0\x01\x12M\n" +
+	"\fListProducts\x12\x1d.store.v1.ListProductsRequest\x1a\x1e.store.v1.ListProductsResponse\x12?\n" +
+	"\n" +
+	"GetProduct\x12\x1b.store.v1.GetProductRequest\x1a\x14.model.ProductDetailB\x17Z\x15store-api/pkg/storepbb\x06proto3"
+
+var (
+	file_proto_store_proto_rawDescOnce sync.Once
+	file_proto_store_proto_rawDescData []byte
+)
+
+func file_proto_store_proto_rawDescGZIP() []byte {
+	file_proto_store_proto_rawDescOnce.Do(func() {
+		file_proto_store_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_proto_store_proto_rawDesc), len(file_proto_store_proto_rawDesc)))
+	})
+	return file_proto_store_proto_rawDescData
+}
+
+var file_proto_store_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_proto_store_proto_goTypes = []any{
+	(*WatchStockRequest)(nil),     // 0: store.v1.WatchStockRequest
+	(*StockUpdate)(nil),           // 1: store.v1.StockUpdate
+	(*ListProductsRequest)(nil),   // 2: store.v1.ListProductsRequest
+	(*ListProductsResponse)(nil),  // 3: store.v1.ListProductsResponse
+	(*GetProductRequest)(nil),     // 4: store.v1.GetProductRequest
+	(*timestamppb.Timestamp)(nil), // 5: google.protobuf.Timestamp
+	(*modelpb.Product)(nil),       // 6: model.Product
+	(*modelpb.ProductDetail)(nil), // 7: model.ProductDetail
+}
+var file_proto_store_proto_depIdxs = []int32{
+	5, // 0: store.v1.StockUpdate.updated_at:type_name -> google.protobuf.Timestamp
+	6, // 1: store.v1.ListProductsResponse.products:type_name -> model.Product
+	0, // 2: store.v1.StoreService.WatchStock:input_type -> store.v1.WatchStockRequest
+	2, // 3: store.v1.StoreService.ListProducts:input_type -> store.v1.ListProductsRequest
+	4, // 4: store.v1.StoreService.GetProduct:input_type -> store.v1.GetProductRequest
+	1, // 5: store.v1.StoreService.WatchStock:output_type -> store.v1.StockUpdate
+	3, // 6: store.v1.StoreService.ListProducts:output_type -> store.v1.ListProductsResponse
+	7, // 7: store.v1.StoreService.GetProduct:output_type -> model.ProductDetail
+	5, // [5:8] is the sub-list for method output_type
+	2, // [2:5] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_proto_store_proto_init() }
+func file_proto_store_proto_init() {
+	if File_proto_store_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_store_proto_rawDesc), len(file_proto_store_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_proto_store_proto_goTypes,
+		DependencyIndexes: file_proto_store_proto_depIdxs,
+		MessageInfos:      file_proto_store_proto_msgTypes,
+	}.Build()
+	File_proto_store_proto = out.File
+	file_proto_store_proto_goTypes = nil
+	file_proto_store_proto_depIdxs = nil
+}
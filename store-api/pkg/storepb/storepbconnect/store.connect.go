@@ -0,0 +1,174 @@
+// Code generated by protoc-gen-connect-go. DO NOT EDIT.
+//
+// Source: proto/store.proto
+
+package storepbconnect
+
+import (
+	connect "connectrpc.com/connect"
+	context "context"
+	errors "errors"
+	modelpb "github.com/j6nca/o11y-playground/pkg/model/modelpb"
+	http "net/http"
+	storepb "store-api/pkg/storepb"
+	strings "strings"
+)
+
+// This is a compile-time assertion to ensure that this generated file and the connect package are
+// compatible. If you get a compiler error that this constant is not defined, this code was
+// generated with a version of connect newer than the one compiled into your binary. You can fix the
+// problem by either regenerating this code with an older version of connect or updating the connect
+// version compiled into your binary.
+const _ = connect.IsAtLeastVersion1_13_0
+
+const (
+	// StoreServiceName is the fully-qualified name of the StoreService service.
+	StoreServiceName = "store.v1.StoreService"
+)
+
+// These constants are the fully-qualified names of the RPCs defined in this package. They're
+// exposed at runtime as Spec.Procedure and as the final two segments of the HTTP route.
+//
+// Note that these are different from the fully-qualified method names used by
+// google.golang.org/protobuf/reflect/protoreflect. To convert from these constants to
+// reflection-formatted method names, remove the leading slash and convert the remaining slash to a
+// period.
+const (
+	// StoreServiceWatchStockProcedure is the fully-qualified name of the StoreService's WatchStock RPC.
+	StoreServiceWatchStockProcedure = "/store.v1.StoreService/WatchStock"
+	// StoreServiceListProductsProcedure is the fully-qualified name of the StoreService's ListProducts
+	// RPC.
+	StoreServiceListProductsProcedure = "/store.v1.StoreService/ListProducts"
+	// StoreServiceGetProductProcedure is the fully-qualified name of the StoreService's GetProduct RPC.
+	StoreServiceGetProductProcedure = "/store.v1.StoreService/GetProduct"
+)
+
+// StoreServiceClient is a client for the store.v1.StoreService service.
+type StoreServiceClient interface {
+	// WatchStock streams the stock of the requested products: their current
+	// levels first, then every change until the client goes away.
+	WatchStock(context.Context, *connect.Request[storepb.WatchStockRequest]) (*connect.ServerStreamForClient[storepb.StockUpdate], error)
+	// ListProducts returns every product in the catalog, like GET /catalog.
+	ListProducts(context.Context, *connect.Request[storepb.ListProductsRequest]) (*connect.Response[storepb.ListProductsResponse], error)
+	// GetProduct returns the details of one product, like GET /catalog/{id}.
+	GetProduct(context.Context, *connect.Request[storepb.GetProductRequest]) (*connect.Response[modelpb.ProductDetail], error)
+}
+
+// NewStoreServiceClient constructs a client for the store.v1.StoreService service. By default, it
+// uses the Connect protocol with the binary Protobuf Codec, asks for gzipped responses, and sends
+// uncompressed requests. To use the gRPC or gRPC-Web protocols, supply the connect.WithGRPC() or
+// connect.WithGRPCWeb() options.
+//
+// The URL supplied here should be the base URL for the Connect or gRPC server (for example,
+// http://api.acme.com or https://acme.com/grpc).
+func NewStoreServiceClient(httpClient connect.HTTPClient, baseURL string, opts ...connect.ClientOption) StoreServiceClient {
+	baseURL = strings.TrimRight(baseURL, "/")
+	storeServiceMethods := storepb.File_proto_store_proto.Services().ByName("StoreService").Methods()
+	return &storeServiceClient{
+		watchStock: connect.NewClient[storepb.WatchStockRequest, storepb.StockUpdate](
+			httpClient,
+			baseURL+StoreServiceWatchStockProcedure,
+			connect.WithSchema(storeServiceMethods.ByName("WatchStock")),
+			connect.WithClientOptions(opts...),
+		),
+		listProducts: connect.NewClient[storepb.ListProductsRequest, storepb.ListProductsResponse](
+			httpClient,
+			baseURL+StoreServiceListProductsProcedure,
+			connect.WithSchema(storeServiceMethods.ByName("ListProducts")),
+			connect.WithClientOptions(opts...),
+		),
+		getProduct: connect.NewClient[storepb.GetProductRequest, modelpb.ProductDetail](
+			httpClient,
+			baseURL+StoreServiceGetProductProcedure,
+			connect.WithSchema(storeServiceMethods.ByName("GetProduct")),
+			connect.WithClientOptions(opts...),
+		),
+	}
+}
+
+// storeServiceClient implements StoreServiceClient.
+type storeServiceClient struct {
+	watchStock   *connect.Client[storepb.WatchStockRequest, storepb.StockUpdate]
+	listProducts *connect.Client[storepb.ListProductsRequest, storepb.ListProductsResponse]
+	getProduct   *connect.Client[storepb.GetProductRequest, modelpb.ProductDetail]
+}
+
+// WatchStock calls store.v1.StoreService.WatchStock.
+func (c *storeServiceClient) WatchStock(ctx context.Context, req *connect.Request[storepb.WatchStockRequest]) (*connect.ServerStreamForClient[storepb.StockUpdate], error) {
+	return c.watchStock.CallServerStream(ctx, req)
+}
+
+// ListProducts calls store.v1.StoreService.ListProducts.
+func (c *storeServiceClient) ListProducts(ctx context.Context, req *connect.Request[storepb.ListProductsRequest]) (*connect.Response[storepb.ListProductsResponse], error) {
+	return c.listProducts.CallUnary(ctx, req)
+}
+
+// GetProduct calls store.v1.StoreService.GetProduct.
+func (c *storeServiceClient) GetProduct(ctx context.Context, req *connect.Request[storepb.GetProductRequest]) (*connect.Response[modelpb.ProductDetail], error) {
+	return c.getProduct.CallUnary(ctx, req)
+}
+
+// StoreServiceHandler is an implementation of the store.v1.StoreService service.
+type StoreServiceHandler interface {
+	// WatchStock streams the stock of the requested products: their current
+	// levels first, then every change until the client goes away.
+	WatchStock(context.Context, *connect.Request[storepb.WatchStockRequest], *connect.ServerStream[storepb.StockUpdate]) error
+	// ListProducts returns every product in the catalog, like GET /catalog.
+	ListProducts(context.Context, *connect.Request[storepb.ListProductsRequest]) (*connect.Response[storepb.ListProductsResponse], error)
+	// GetProduct returns the details of one product, like GET /catalog/{id}.
+	GetProduct(context.Context, *connect.Request[storepb.GetProductRequest]) (*connect.Response[modelpb.ProductDetail], error)
+}
+
+// NewStoreServiceHandler builds an HTTP handler from the service implementation. It returns the
+// path on which to mount the handler and the handler itself.
+//
+// By default, handlers support the Connect, gRPC, and gRPC-Web protocols with the binary Protobuf
+// and JSON codecs. They also support gzip compression.
+func NewStoreServiceHandler(svc StoreServiceHandler, opts ...connect.HandlerOption) (string, http.Handler) {
+	storeServiceMethods := storepb.File_proto_store_proto.Services().ByName("StoreService").Methods()
+	storeServiceWatchStockHandler := connect.NewServerStreamHandler(
+		StoreServiceWatchStockProcedure,
+		svc.WatchStock,
+		connect.WithSchema(storeServiceMethods.ByName("WatchStock")),
+		connect.WithHandlerOptions(opts...),
+	)
+	storeServiceListProductsHandler := connect.NewUnaryHandler(
+		StoreServiceListProductsProcedure,
+		svc.ListProducts,
+		connect.WithSchema(storeServiceMethods.ByName("ListProducts")),
+		connect.WithHandlerOptions(opts...),
+	)
+	storeServiceGetProductHandler := connect.NewUnaryHandler(
+		StoreServiceGetProductProcedure,
+		svc.GetProduct,
+		connect.WithSchema(storeServiceMethods.ByName("GetProduct")),
+		connect.WithHandlerOptions(opts...),
+	)
+	return "/store.v1.StoreService/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case StoreServiceWatchStockProcedure:
+			storeServiceWatchStockHandler.ServeHTTP(w, r)
+		case StoreServiceListProductsProcedure:
+			storeServiceListProductsHandler.ServeHTTP(w, r)
+		case StoreServiceGetProductProcedure:
+			storeServiceGetProductHandler.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// UnimplementedStoreServiceHandler returns CodeUnimplemented from all methods.
+type UnimplementedStoreServiceHandler struct{}
+
+func (UnimplementedStoreServiceHandler) WatchStock(context.Context, *connect.Request[storepb.WatchStockRequest], *connect.ServerStream[storepb.StockUpdate]) error {
+	return connect.NewError(connect.CodeUnimplemented, errors.New("store.v1.StoreService.WatchStock is not implemented"))
+}
+
+func (UnimplementedStoreServiceHandler) ListProducts(context.Context, *connect.Request[storepb.ListProductsRequest]) (*connect.Response[storepb.ListProductsResponse], error) {
+	return nil, connect.NewError(connect.CodeUnimplemented, errors.New("store.v1.StoreService.ListProducts is not implemented"))
+}
+
+func (UnimplementedStoreServiceHandler) GetProduct(context.Context, *connect.Request[storepb.GetProductRequest]) (*connect.Response[modelpb.ProductDetail], error) {
+	return nil, connect.NewError(connect.CodeUnimplemented, errors.New("store.v1.StoreService.GetProduct is not implemented"))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// pricingClient fetches current prices from the pricing dependency.
+type pricingClient struct {
+	address string
+	// currency is the one prices are asked for in, or "" for the
+	// dependency's default
+	currency string
+	client   http.Client
+}
+
+func newPricingClient(address, currency string, h2c bool) *pricingClient {
+	return &pricingClient{
+		address:  address,
+		currency: currency,
+		client: http.Client{
+			Transport: newRetryTransport("pricing", newTransport("pricing", h2c)),
+			Timeout:   3 * time.Second,
+		},
+	}
+}
+
+// Prices returns the current price of each product, keyed by ID.
+func (c *pricingClient) Prices(ctx context.Context, products []Product) (map[int]int, error) {
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "fetch-prices")
+	defer span.End()
+
+	ids := make([]string, len(products))
+	for i, p := range products {
+		ids[i] = strconv.Itoa(p.ID)
+	}
+	span.SetAttributes(attribute.String("peer.service", "pricing"), attribute.Int("pricing.products", len(ids)))
+
+	url := c.address + "/prices?ids=" + strings.Join(ids, ",")
+	if c.currency != "" {
+		url += "&currency=" + c.currency
+		span.SetAttributes(attribute.String("pricing.currency", c.currency))
+	}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("pricing returned status %d", resp.StatusCode)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	var raw map[string]int
+	if err := decodeJSON(ctx, "pricing", resp.Body, &raw); err != nil {
+		return nil, err
+	}
+	prices := make(map[int]int, len(raw))
+	for id, price := range raw {
+		if n, err := strconv.Atoi(id); err == nil {
+			prices[n] = price
+		}
+	}
+	return prices, nil
+}
+
+// Warm opens a connection to the pricing dependency ahead of the first real
+// request. Any response will do, it is the pooled connection we are after.
+func (c *pricingClient) Warm(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.address+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to dial pricing: %w", err)
+	}
+	return resp.Body.Close()
+}
+
+// Check is the pricing health check: a price lookup has to succeed.
+func (c *pricingClient) Check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.address+"/prices?ids=1", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from pricing", resp.StatusCode)
+	}
+	return nil
+}
+
+// applyPrices overwrites catalog prices with the priced ones.
+func applyPrices(products []Product, prices map[int]int) {
+	for i := range products {
+		if price, ok := prices[products[i].ID]; ok {
+			products[i].Price = price
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	grpccodes "google.golang.org/grpc/codes"
+
+	"github.com/j6nca/o11y-playground/pkg/model/modelpb"
+)
+
+var (
+	// Count product API calls, by the transport they came in on.
+	apiRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_api_requests_total",
+			Help: "Total number of product API calls, by transport (rest, grpc, connect or grpcweb), operation and gRPC status code.",
+		},
+		[]string{"transport", "operation", "code"},
+	)
+
+	// Histogram of product API latency, by the transport it came in on.
+	apiLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_api_request_duration_seconds",
+			Help:    "Product API latency in seconds, by transport and operation.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"transport", "operation"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(apiRequests, apiLatency)
+}
+
+// observeAPI records a product API call the same way whichever transport
+// served it, so the transports can be compared on one dashboard. Outcomes
+// are gRPC status codes, REST ones mapped from the HTTP status.
+func observeAPI(transport, operation string, code grpccodes.Code, duration time.Duration) {
+	apiRequests.WithLabelValues(transport, operation, code.String()).Inc()
+	apiLatency.WithLabelValues(transport, operation).Observe(duration.Seconds())
+}
+
+// listProducts is ListProducts and GET /catalog, whatever the transport.
+func listProducts() []Product {
+	time.Sleep(catalogLookupDelay)
+	return catalog.List()
+}
+
+// getProduct is GetProduct and GET /catalog/{id}, whatever the transport.
+func getProduct(ctx context.Context, id int) (ProductDetail, bool) {
+	details := lookupDetails(ctx, []int{id})
+	if len(details) == 0 {
+		return ProductDetail{}, false
+	}
+	return details[0], true
+}
+
+func productMessage(p Product) *modelpb.Product {
+	return &modelpb.Product{Id: int64(p.ID), Name: p.Name, Price: int64(p.Price)}
+}
+
+func productDetailMessage(d ProductDetail) *modelpb.ProductDetail {
+	return &modelpb.ProductDetail{Product: productMessage(d.Product), Description: d.Description, Stock: int64(d.Stock)}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+
+	"github.com/j6nca/o11y-playground/pkg/clientpool"
+)
+
+// newServer returns a server for handler that speaks HTTP/1.1 and, for clients
+// that know to ask for it, unencrypted HTTP/2 (h2c). Serving both lets the
+// same load be replayed over either protocol and compared.
+func newServer(handler http.Handler) *http.Server {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Server{Handler: handler, Protocols: &protocols}
+}
+
+// newTransport returns a traced transport that talks h2c when h2c is set,
+// and plain HTTP/1.1 otherwise, with the configured pool settings and pool
+// statistics labelled client.
+func newTransport(client string, h2c bool) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if h2c {
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+	clientpool.Apply(transport)
+	return otelhttp.NewTransport(clientpool.Track(client, transport))
+}
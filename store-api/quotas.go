@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/j6nca/o11y-playground/pkg/tracehints"
+)
+
+var (
+	// Count requests per tenant.
+	tenantRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_tenant_requests_total",
+			Help: "Total number of HTTP requests by tenant (other for tenants without a quota of their own).",
+		},
+		[]string{"tenant"},
+	)
+
+	// Count bytes transferred per tenant.
+	tenantBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_tenant_bytes_total",
+			Help: "Total number of request and response body bytes transferred by tenant and direction (in or out).",
+		},
+		[]string{"tenant", "direction"},
+	)
+
+	// Gauge of each tenant's usage in the current quota window.
+	tenantQuotaUsed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_tenant_quota_used",
+			Help: "Usage of each quota in the current one minute window, by tenant and resource (requests or bytes).",
+		},
+		[]string{"tenant", "resource"},
+	)
+
+	// Gauge of each tenant's quotas.
+	tenantQuotaLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_tenant_quota_limit",
+			Help: "Quota per one minute window, by tenant and resource (requests or bytes). Unlimited resources have no series.",
+		},
+		[]string{"tenant", "resource"},
+	)
+
+	// Count requests made over quota.
+	tenantQuotaExceeded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_tenant_quota_exceeded_total",
+			Help: "Total number of requests made with a quota already used up, by tenant and resource (requests or bytes). They are rejected with a 429 when quotas are enforced.",
+		},
+		[]string{"tenant", "resource"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(tenantRequests, tenantBytes, tenantQuotaUsed, tenantQuotaLimit, tenantQuotaExceeded)
+}
+
+// quotaWindow is how long quota usage accumulates before it resets.
+const quotaWindow = time.Minute
+
+// Quota is how much a tenant may use per window, zero meaning unlimited.
+type Quota struct {
+	Requests int64 `json:"requests_per_minute"`
+	Bytes    int64 `json:"bytes_per_minute"`
+}
+
+// TenantUsage is a tenant's quota and what it has used of it this window.
+type TenantUsage struct {
+	Tenant       string    `json:"tenant"`
+	Quota        Quota     `json:"quota"`
+	Requests     int64     `json:"requests"`
+	Bytes        int64     `json:"bytes"`
+	WindowResets time.Time `json:"window_resets"`
+}
+
+// quotaMeter accounts each tenant's requests and bytes against its quota,
+// in fixed one minute windows. Tenants are named by the caller, so only
+// those with a quota configured get a series of their own; the rest share
+// the default quota as "other", between them, keeping label cardinality
+// bounded whatever callers send.
+type quotaMeter struct {
+	mu      sync.Mutex
+	quotas  map[string]Quota
+	other   Quota
+	enforce bool
+	window  time.Time
+	usage   map[string]*TenantUsage
+}
+
+// quotas meters tenants' usage, nil until main sets it up.
+var quotas *quotaMeter
+
+func newQuotaMeter(quotas map[string]Quota, other Quota, enforce bool) *quotaMeter {
+	m := &quotaMeter{quotas: quotas, other: other, enforce: enforce, usage: map[string]*TenantUsage{}}
+	for tenant, q := range quotas {
+		setQuotaLimits(tenant, q)
+	}
+	setQuotaLimits("other", other)
+	return m
+}
+
+func setQuotaLimits(tenant string, q Quota) {
+	if q.Requests > 0 {
+		tenantQuotaLimit.WithLabelValues(tenant, "requests").Set(float64(q.Requests))
+	}
+	if q.Bytes > 0 {
+		tenantQuotaLimit.WithLabelValues(tenant, "bytes").Set(float64(q.Bytes))
+	}
+}
+
+// tenant returns the label for the tenant a request names.
+func (m *quotaMeter) tenant(name string) string {
+	if _, ok := m.quotas[name]; ok {
+		return name
+	}
+	return "other"
+}
+
+// usageLocked returns the tenant's usage in the current window, starting
+// a new window for everyone if the last one is over.
+func (m *quotaMeter) usageLocked(tenant string, now time.Time) *TenantUsage {
+	if now.Sub(m.window) >= quotaWindow {
+		m.window = now.Truncate(quotaWindow)
+		clear(m.usage)
+		tenantQuotaUsed.Reset()
+	}
+	u, ok := m.usage[tenant]
+	if !ok {
+		q, ok := m.quotas[tenant]
+		if !ok {
+			q = m.other
+		}
+		u = &TenantUsage{Tenant: tenant, Quota: q, WindowResets: m.window.Add(quotaWindow)}
+		m.usage[tenant] = u
+	}
+	return u
+}
+
+// Admit counts a request for tenant, returning the resource it has
+// already used up, if any, and whether the request may go ahead.
+func (m *quotaMeter) Admit(tenant string) (exceeded string, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.usageLocked(tenant, time.Now())
+	switch {
+	case u.Quota.Requests > 0 && u.Requests >= u.Quota.Requests:
+		exceeded = "requests"
+	case u.Quota.Bytes > 0 && u.Bytes >= u.Quota.Bytes:
+		exceeded = "bytes"
+	}
+	if exceeded != "" {
+		tenantQuotaExceeded.WithLabelValues(tenant, exceeded).Inc()
+		if m.enforce {
+			return exceeded, false
+		}
+	}
+	u.Requests++
+	tenantQuotaUsed.WithLabelValues(tenant, "requests").Set(float64(u.Requests))
+	return exceeded, true
+}
+
+// Transferred counts bytes moved for a request tenant made.
+func (m *quotaMeter) Transferred(tenant string, bytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.usageLocked(tenant, time.Now())
+	u.Bytes += bytes
+	tenantQuotaUsed.WithLabelValues(tenant, "bytes").Set(float64(u.Bytes))
+}
+
+// Usage returns every tenant's usage this window, ordered by tenant.
+func (m *quotaMeter) Usage() []TenantUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	// Tenants with a quota are listed even when they haven't used any
+	for tenant := range m.quotas {
+		m.usageLocked(tenant, now)
+	}
+	m.usageLocked("other", now)
+	usage := make([]TenantUsage, 0, len(m.usage))
+	for _, u := range m.usage {
+		usage = append(usage, *u)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Tenant < usage[j].Tenant })
+	return usage
+}
+
+// requestTenant names the tenant a request is for: its X-Tenant header,
+// or the tenant hint a caller passed on in tracestate.
+func requestTenant(r *http.Request) string {
+	if tenant := r.Header.Get("X-Tenant"); tenant != "" {
+		return tenant
+	}
+	tenant, _ := tracehints.Get(r.Context(), "tenant")
+	return tenant
+}
+
+// meterQuotas accounts each request and the bytes it transfers to its
+// tenant, rejecting it with a 429 when the tenant's quota is used up and
+// quotas are enforced.
+func meterQuotas(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if quotas == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tenant := quotas.tenant(requestTenant(r))
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(attribute.String("tenant", tenant))
+		tenantRequests.WithLabelValues(tenant).Inc()
+
+		exceeded, ok := quotas.Admit(tenant)
+		if exceeded != "" {
+			span.SetAttributes(attribute.String("tenant.quota_exceeded", exceeded))
+		}
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(time.Now().Truncate(quotaWindow).Add(quotaWindow)).Seconds())+1))
+			httpError(w, r, fmt.Errorf("tenant %s is over its %s quota", tenant, exceeded), http.StatusTooManyRequests)
+			return
+		}
+
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		m := httpsnoop.CaptureMetrics(next, w, r)
+
+		tenantBytes.WithLabelValues(tenant, "in").Add(float64(body.n))
+		tenantBytes.WithLabelValues(tenant, "out").Add(float64(m.Written))
+		quotas.Transferred(tenant, body.n+m.Written)
+	})
+}
+
+// parseQuota parses a quota, "<requests>/<bytes>", where either may be 0
+// for unlimited and bytes may have a KB, MB or GB suffix, e.g. "600/10MB".
+func parseQuota(spec string) (Quota, error) {
+	requests, bytes, ok := strings.Cut(strings.TrimSpace(spec), "/")
+	if !ok {
+		return Quota{}, fmt.Errorf("expected requests/bytes, got %q", spec)
+	}
+	var q Quota
+	var err error
+	if q.Requests, err = strconv.ParseInt(requests, 10, 64); err != nil || q.Requests < 0 {
+		return Quota{}, fmt.Errorf("invalid request quota in %q", spec)
+	}
+	multiplier := int64(1)
+	for suffix, m := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(bytes, suffix) {
+			bytes, multiplier = strings.TrimSuffix(bytes, suffix), m
+		}
+	}
+	n, err := strconv.ParseInt(bytes, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+		return Quota{}, fmt.Errorf("invalid byte quota in %q", spec)
+	}
+	q.Bytes = n * multiplier
+	return q, nil
+}
+
+// parseTenantQuotas parses a TENANT_QUOTAS value: comma separated
+// tenant=quota pairs, e.g. "acme=600/10MB,globex=60/0".
+func parseTenantQuotas(spec string) (map[string]Quota, error) {
+	parsed := map[string]Quota{}
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		tenant, quota, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected tenant=quota, got %q", entry)
+		}
+		q, err := parseQuota(quota)
+		if err != nil {
+			return nil, err
+		}
+		parsed[strings.TrimSpace(tenant)] = q
+	}
+	return parsed, nil
+}
+
+// quotasHandler shows each tenant's quota and usage this window.
+func quotasHandler(w http.ResponseWriter, r *http.Request) {
+	if quotas == nil {
+		httpError(w, r, errors.New("quota accounting is off, set TENANT_QUOTAS or QUOTA_DEFAULT"), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, r, quotas.Usage(), 0)
+}
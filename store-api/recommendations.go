@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Histogram of recommendation latency, by which scorer produced them.
+	recommendationLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_recommendation_duration_seconds",
+			Help:    "Recommendation latency in seconds, by implementation (naive or optimized).",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"implementation"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(recommendationLatency)
+}
+
+// optimizedRecommendations switches /recommendations from the naive scorer
+// to the optimized one, so the two can be compared in the alloc profiles.
+var optimizedRecommendations bool
+
+// recommendationLimit is how many products are recommended.
+const recommendationLimit = 10
+
+// Recommendation is a product and how well it suits the user.
+type Recommendation struct {
+	Product
+	Score float64 `json:"score"`
+}
+
+// RecommendationResult is the response to a recommendations request.
+type RecommendationResult struct {
+	User            string           `json:"user"`
+	Implementation  string           `json:"implementation"`
+	Recommendations []Recommendation `json:"recommendations"`
+}
+
+// recommendationsHandler recommends products to the user parameter, scoring
+// every variant of every product against the words the user is interested
+// in. Both scorers give the same answer; the naive one just allocates its
+// way there.
+func recommendationsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(r.Context(), "recommendations-handler")
+	defer span.End()
+	start := time.Now()
+
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		httpError(w, r, errors.New("user is required"), http.StatusBadRequest)
+		return
+	}
+	implementation, score := "naive", naiveRecommendations
+	if optimizedRecommendations {
+		implementation, score = "optimized", optimizedRecommendationsFor
+	}
+
+	result := RecommendationResult{User: user, Implementation: implementation}
+	err := cpuPool.Run(ctx, "recommendations-score", func(context.Context) {
+		result.Recommendations = score(user, catalog.List())
+	})
+	if errors.Is(err, errPoolFull) {
+		httpError(w, r, err, http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		// The client went away, so there is nobody to answer
+		slog.WarnContext(ctx, "Recommendations abandoned", logfields.Error(err))
+		return
+	}
+
+	duration := time.Since(start)
+	span.SetAttributes(
+		attribute.String("recommendations.implementation", implementation),
+		attribute.Int("recommendations.count", len(result.Recommendations)),
+	)
+	recommendationLatency.WithLabelValues(implementation).Observe(duration.Seconds())
+	slog.InfoContext(ctx, "Recommendations computed", "implementation", implementation, logfields.Duration(duration))
+
+	writeJSON(w, r, result, duration)
+}
+
+// userInterests is how much user likes each word that can appear in a
+// variant description, derived from a hash of the user so the same user
+// always gets the same recommendations.
+func userInterests(user string) map[string]float64 {
+	interests := map[string]float64{}
+	for _, words := range [][]string{searchColors, searchMaterials, searchSizes} {
+		for _, word := range words {
+			for _, w := range strings.Fields(strings.ToLower(word)) {
+				h := fnv.New32a()
+				h.Write([]byte(user + "/" + w))
+				interests["word:"+w] = float64(h.Sum32()%100) / 100
+			}
+		}
+	}
+	return interests
+}
+
+// naiveRecommendations builds every variant description, splits it into a
+// fresh feature map and rebuilds the user's interests for each one, then
+// sorts every scored variant to find the best. Each step allocates, which
+// is the point.
+func naiveRecommendations(user string, products []Product) []Recommendation {
+	var scored []Recommendation
+	for _, p := range products {
+		for _, description := range variantDescriptions(p) {
+			features := map[string]float64{}
+			for _, word := range strings.Fields(strings.ToLower(description)) {
+				features[fmt.Sprintf("word:%s", word)]++
+			}
+			interests := userInterests(user)
+			score := 0.0
+			for feature, count := range features {
+				score += count * interests[feature]
+			}
+			scored = append(scored, Recommendation{Product: p, Score: roundScore(score)})
+		}
+	}
+
+	// Keep the best variant of each product
+	best := map[int]Recommendation{}
+	for _, s := range scored {
+		if current, ok := best[s.ID]; !ok || s.Score > current.Score {
+			best[s.ID] = s
+		}
+	}
+	var recommendations []Recommendation
+	for _, s := range best {
+		recommendations = append(recommendations, s)
+	}
+	sortRecommendations(recommendations)
+	if len(recommendations) > recommendationLimit {
+		recommendations = recommendations[:recommendationLimit]
+	}
+	return recommendations
+}
+
+// optimizedRecommendationsFor gets the same answer without building any
+// variant. A variant scores the sum of its parts, so a product's best
+// variant is its best size, color and material together; those are found
+// once per request, and only the top few products are kept as they go.
+func optimizedRecommendationsFor(user string, products []Product) []Recommendation {
+	interests := userInterests(user)
+	best := 0.0
+	for _, words := range [][]string{searchColors, searchMaterials, searchSizes} {
+		top := 0.0
+		for _, word := range words {
+			top = max(top, wordsScore(interests, word))
+		}
+		best += top
+	}
+
+	recommendations := make([]Recommendation, 0, recommendationLimit+1)
+	for _, p := range products {
+		s := Recommendation{Product: p, Score: roundScore(best + wordsScore(interests, p.Name))}
+		if len(recommendations) == recommendationLimit && !ranksAbove(s, recommendations[len(recommendations)-1]) {
+			continue
+		}
+		i := sort.Search(len(recommendations), func(i int) bool { return ranksAbove(s, recommendations[i]) })
+		recommendations = append(recommendations, Recommendation{})
+		copy(recommendations[i+1:], recommendations[i:])
+		recommendations[i] = s
+		if len(recommendations) > recommendationLimit {
+			recommendations = recommendations[:recommendationLimit]
+		}
+	}
+	return recommendations
+}
+
+// wordsScore is the score of the words in text, like naiveRecommendations
+// counts them.
+func wordsScore(interests map[string]float64, text string) float64 {
+	score := 0.0
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		score += interests["word:"+word]
+	}
+	return score
+}
+
+// roundScore rounds a score to the hundredths interests come in, so the
+// scorers agree on ties whatever order they added things up in.
+func roundScore(score float64) float64 {
+	return math.Round(score*100) / 100
+}
+
+// ranksAbove orders recommendations by score, then by ID so ties come out
+// the same every time.
+func ranksAbove(a, b Recommendation) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	return a.ID < b.ID
+}
+
+func sortRecommendations(recommendations []Recommendation) {
+	sort.Slice(recommendations, func(i, j int) bool { return ranksAbove(recommendations[i], recommendations[j]) })
+}
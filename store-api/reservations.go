@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Count optimistic concurrency conflicts, by operation.
+	inventoryConflicts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_inventory_conflicts_total",
+			Help: "Total number of inventory writes that lost an optimistic concurrency race, by operation (reserve or release).",
+		},
+		[]string{"operation"},
+	)
+
+	// Histogram of how many attempts inventory transactions took.
+	inventoryAttempts = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_inventory_transaction_attempts",
+			Help:    "Number of attempts inventory transactions took, by operation and outcome (committed, rejected or conflict).",
+			Buckets: []float64{1, 2, 3, 4, 5, 7, 10},
+		},
+		[]string{"operation", "outcome"},
+	)
+
+	// Gauge of reservations not yet released.
+	openReservations = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_inventory_reservations",
+			Help: "Number of stock reservations held.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(inventoryConflicts, inventoryAttempts, openReservations)
+}
+
+var errConflict = errors.New("too much contention, gave up")
+
+// inventoryTxAttempts is how many times a reservation or release is tried
+// before giving up on a conflict.
+var inventoryTxAttempts = 5
+
+// Reservation is stock held for a customer until it is released.
+type Reservation struct {
+	ID        int       `json:"id"`
+	ProductID int       `json:"product_id"`
+	Quantity  int       `json:"quantity"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// reservationStore holds the reservations not yet released.
+type reservationStore struct {
+	mu           sync.Mutex
+	nextID       int
+	reservations map[int]Reservation
+}
+
+var reservations = &reservationStore{nextID: 1, reservations: map[int]Reservation{}}
+
+func (s *reservationStore) add(productID, quantity int) Reservation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := Reservation{ID: s.nextID, ProductID: productID, Quantity: quantity, CreatedAt: time.Now()}
+	s.nextID++
+	s.reservations[r.ID] = r
+	openReservations.Set(float64(len(s.reservations)))
+	return r
+}
+
+func (s *reservationStore) take(id int) (Reservation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.reservations[id]
+	delete(s.reservations, id)
+	openReservations.Set(float64(len(s.reservations)))
+	return r, ok
+}
+
+func (s *reservationStore) put(r Reservation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reservations[r.ID] = r
+	openReservations.Set(float64(len(s.reservations)))
+}
+
+// stockTransaction changes product id's stock with change using optimistic
+// concurrency: read the stock and its version, work out the new stock
+// without holding any lock, and write it only if nobody else has in the
+// meantime, retrying from the top if they have. Each attempt gets its own
+// span, so contention shows up in traces as retried transactions.
+func stockTransaction(ctx context.Context, operation string, id int, change func(stock int) (int, error)) (int, error) {
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "inventory-transaction")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("inventory.operation", operation),
+		attribute.Int("inventory.product_id", id),
+	)
+
+	for attempt := 1; ; attempt++ {
+		stock, committed, err := stockAttempt(ctx, id, attempt, change)
+		if err != nil {
+			span.SetAttributes(attribute.Int("inventory.attempts", attempt))
+			inventoryAttempts.WithLabelValues(operation, "rejected").Observe(float64(attempt))
+			return 0, err
+		}
+		if committed {
+			span.SetAttributes(attribute.Int("inventory.attempts", attempt))
+			inventoryAttempts.WithLabelValues(operation, "committed").Observe(float64(attempt))
+			return stock, nil
+		}
+
+		inventoryConflicts.WithLabelValues(operation).Inc()
+		if attempt >= inventoryTxAttempts {
+			span.SetAttributes(attribute.Int("inventory.attempts", attempt))
+			span.SetStatus(codes.Error, errConflict.Error())
+			inventoryAttempts.WithLabelValues(operation, "conflict").Observe(float64(attempt))
+			return 0, errConflict
+		}
+		// Back off a little, so the retries don't collide all over again
+		time.Sleep(time.Duration(rand.Intn(attempt*2)+1) * time.Millisecond)
+	}
+}
+
+// stockAttempt is one try of a stock transaction, reporting whether it
+// committed.
+func stockAttempt(ctx context.Context, id, attempt int, change func(stock int) (int, error)) (int, bool, error) {
+	_, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "inventory-transaction-attempt")
+	defer span.End()
+	span.SetAttributes(attribute.Int("inventory.attempt", attempt))
+
+	current, version, err := stock.Read(id)
+	if err != nil {
+		return 0, false, err
+	}
+	// Simulate the round trips between reading and writing, which is the
+	// window other writers can slip into
+	time.Sleep(2*time.Millisecond + time.Duration(rand.Intn(2000))*time.Microsecond)
+	updated, err := change(current)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return 0, false, err
+	}
+	if !stock.CompareAndSet(id, version, updated) {
+		span.AddEvent("version-conflict", trace.WithAttributes(attribute.Int("inventory.version", version)))
+		return 0, false, nil
+	}
+	return updated, true, nil
+}
+
+// reserveHandler holds qty of product id, taking it out of stock until it
+// is released.
+func reserveHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil || id <= 0 {
+		httpError(w, r, errors.New("id must be a product ID"), http.StatusBadRequest)
+		return
+	}
+	qty := 1
+	if raw := r.URL.Query().Get("qty"); raw != "" {
+		if qty, err = strconv.Atoi(raw); err != nil || qty <= 0 {
+			httpError(w, r, errors.New("qty must be a positive integer"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	remaining, err := stockTransaction(r.Context(), "reserve", id, func(stock int) (int, error) {
+		if stock < qty {
+			return 0, errOutOfStock
+		}
+		return stock - qty, nil
+	})
+	if err != nil {
+		reservationError(w, r, err)
+		return
+	}
+
+	reservation := reservations.add(id, qty)
+	slog.InfoContext(r.Context(), "Reserved stock", "reservation_id", reservation.ID, logfields.ProductID(id), "remaining", remaining, logfields.Duration(time.Since(start)))
+	writeJSON(w, r, reservation, time.Since(start))
+}
+
+// releaseHandler puts a reservation's stock back.
+func releaseHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	id, err := strconv.Atoi(r.URL.Query().Get("reservation"))
+	if err != nil || id <= 0 {
+		httpError(w, r, errors.New("reservation must be a reservation ID"), http.StatusBadRequest)
+		return
+	}
+	reservation, ok := reservations.take(id)
+	if !ok {
+		httpError(w, r, fmt.Errorf("reservation %d not found", id), http.StatusNotFound)
+		return
+	}
+
+	remaining, err := stockTransaction(r.Context(), "release", reservation.ProductID, func(stock int) (int, error) {
+		return stock + reservation.Quantity, nil
+	})
+	if err != nil {
+		// Still held, so it can be released again later
+		reservations.put(reservation)
+		reservationError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Released stock", "reservation_id", reservation.ID, logfields.ProductID(reservation.ProductID), "remaining", remaining, logfields.Duration(time.Since(start)))
+	writeJSON(w, r, map[string]int{"id": reservation.ProductID, "remaining": remaining}, time.Since(start))
+}
+
+func reservationError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errConflict):
+		w.Header().Set("Retry-After", "1")
+		httpError(w, r, err, http.StatusConflict)
+	case errors.Is(err, errOutOfStock):
+		httpError(w, r, err, http.StatusConflict)
+	default:
+		httpError(w, r, err, http.StatusNotFound)
+	}
+}
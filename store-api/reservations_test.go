@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReservationHandlersRejectBadParameters(t *testing.T) {
+	for _, tc := range []struct {
+		handler http.HandlerFunc
+		target  string
+	}{
+		{reserveHandler, "/inventory/reserve"},
+		{reserveHandler, "/inventory/reserve?id=abc"},
+		{reserveHandler, "/inventory/reserve?id=0"},
+		{reserveHandler, "/inventory/reserve?id=1&qty=abc"},
+		{reserveHandler, "/inventory/reserve?id=1&qty=0"},
+		{releaseHandler, "/inventory/release"},
+		{releaseHandler, "/inventory/release?reservation=abc"},
+	} {
+		w := httptest.NewRecorder()
+		tc.handler(w, httptest.NewRequest(http.MethodPost, tc.target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("POST %s = %d, want %d", tc.target, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// Gauge of retries the budget can currently pay for.
+	retryBudgetRemaining = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_retry_budget_remaining",
+			Help: "Number of retries the shared retry budget can currently afford.",
+		},
+	)
+
+	// Count retries, by client and whether the budget allowed them.
+	retriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_client_retries_total",
+			Help: "Total number of outbound request retries, by client and outcome (allowed or budget_exhausted).",
+		},
+		[]string{"client", "outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(retryBudgetRemaining, retriesTotal)
+}
+
+// retryBudget caps retries to a fraction of successful requests, so that
+// when a dependency browns out the retries stop rather than multiplying
+// its load. Every success deposits ratio of a token and every retry spends
+// a whole one. The bucket starts full and holds at most maxTokens, so a
+// quiet service can still retry a little but a brownout soon drains it.
+type retryBudget struct {
+	mu        sync.Mutex
+	tokens    float64
+	ratio     float64
+	maxTokens float64
+}
+
+// retries is the budget shared by every retrying client in the service.
+var retries = newRetryBudget(0.1, 10)
+
+func newRetryBudget(ratio, minTokens float64) *retryBudget {
+	b := &retryBudget{tokens: minTokens, ratio: ratio, maxTokens: minTokens}
+	retryBudgetRemaining.Set(minTokens)
+	return b
+}
+
+// Configure changes the budget's ratio and reserve, refilling it.
+func (b *retryBudget) Configure(ratio, minTokens float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ratio, b.maxTokens, b.tokens = ratio, minTokens, minTokens
+	retryBudgetRemaining.Set(b.tokens)
+}
+
+// Succeeded pays into the budget for a successful request.
+func (b *retryBudget) Succeeded() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.tokens+b.ratio, b.maxTokens)
+	retryBudgetRemaining.Set(b.tokens)
+}
+
+// Withdraw takes a token for a retry, reporting false if there isn't one.
+func (b *retryBudget) Withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	retryBudgetRemaining.Set(b.tokens)
+	return true
+}
+
+// retryTransport retries idempotent requests that failed on the network or
+// with a 502, 503 or 504, up to maxAttempts in all, with jittered backoff,
+// for as long as the shared budget allows. It sits outside the traced
+// transport so every attempt gets its own client span.
+type retryTransport struct {
+	name        string
+	next        http.RoundTripper
+	maxAttempts int
+}
+
+// retryMaxAttempts is how many attempts retryTransport makes in total.
+var retryMaxAttempts = 3
+
+func newRetryTransport(name string, next http.RoundTripper) *retryTransport {
+	return &retryTransport{name: name, next: next, maxAttempts: retryMaxAttempts}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead
+	span := trace.SpanFromContext(req.Context())
+
+	for attempt := 1; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if req.Context().Err() != nil || !retryable(resp, err) {
+			if err == nil && resp.StatusCode < http.StatusInternalServerError {
+				retries.Succeeded()
+			}
+			return resp, err
+		}
+		if !idempotent || attempt >= t.maxAttempts {
+			return resp, err
+		}
+		if !retries.Withdraw() {
+			retriesTotal.WithLabelValues(t.name, "budget_exhausted").Inc()
+			span.AddEvent("retry-budget-exhausted", trace.WithAttributes(attribute.Int("http.attempt", attempt)))
+			slog.WarnContext(req.Context(), "Retry budget exhausted, not retrying", "client", t.name, "attempt", attempt)
+			return resp, err
+		}
+
+		retriesTotal.WithLabelValues(t.name, "allowed").Inc()
+		span.AddEvent("retry", trace.WithAttributes(attribute.Int("http.attempt", attempt+1)))
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		// Exponential backoff with full jitter: 0-50ms, then 0-100ms, ...
+		backoff := time.Duration(rand.Int63n(int64(50*time.Millisecond) << (attempt - 1)))
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// retryable reports whether a response or error is worth another attempt.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// Count product payloads written, by route and schema version.
+	schemaPayloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_payload_schema_emitted_total",
+			Help: "Total number of product payloads written, by route and schema version.",
+		},
+		[]string{"route", "version"},
+	)
+
+	// Gauge of the product schema version being emitted.
+	schemaVersionGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_payload_schema_version",
+			Help: "Version of the product JSON schema /products currently emits.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(schemaPayloads, schemaVersionGauge)
+}
+
+// The versions of the product JSON schema. v1 is a bare array of products
+// with integer prices, as /products has always returned. v2 wraps them in an
+// envelope saying which version it is, and gives each price its currency,
+// which v1 clients can't decode.
+const (
+	productSchemaV1 = 1
+	productSchemaV2 = 2
+)
+
+// schemaVersionHeader names the product schema version of a response, so
+// clients needn't guess from the body.
+const schemaVersionHeader = "X-Schema-Version"
+
+// productSchema is the product schema version /products emits, set from
+// PRODUCT_SCHEMA_VERSION and changed on /admin/schema to roll v2 out and
+// back while watching what clients manage to decode.
+var productSchema atomic.Int64
+
+// defaultProductSchema is the version PRODUCT_SCHEMA_VERSION set, which
+// DELETE on /admin/schema restores.
+var defaultProductSchema = productSchemaV1
+
+// setProductSchema switches the product schema version, logging the change.
+func setProductSchema(version int) error {
+	if version != productSchemaV1 && version != productSchemaV2 {
+		return fmt.Errorf("unknown product schema version %d", version)
+	}
+	previous := productSchema.Swap(int64(version))
+	schemaVersionGauge.Set(float64(version))
+	if previous != 0 && previous != int64(version) {
+		slog.Warn("Changed product schema version", "version", version, "previous", previous)
+	}
+	return nil
+}
+
+// PriceV2 is a price as the v2 schema has it, with its currency.
+type PriceV2 struct {
+	Amount   int    `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// ProductV2 is a product as the v2 schema has it.
+type ProductV2 struct {
+	ID    int     `json:"id"`
+	Name  string  `json:"name"`
+	Price PriceV2 `json:"price"`
+}
+
+// ProductsV2 is the v2 products payload.
+type ProductsV2 struct {
+	SchemaVersion int         `json:"schema_version"`
+	Products      []ProductV2 `json:"products"`
+}
+
+// productCurrency is the currency prices are in: the one they're asked of
+// pricing in, or the catalog's own.
+func productCurrency() string {
+	if pricing != nil && pricing.currency != "" {
+		return pricing.currency
+	}
+	return "USD"
+}
+
+// versionedProducts returns products as the payload of the product schema
+// version being emitted, and labels the response to r with the version.
+func versionedProducts(w http.ResponseWriter, r *http.Request, products []Product) any {
+	version := int(productSchema.Load())
+	w.Header().Set(schemaVersionHeader, strconv.Itoa(version))
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.Int("payload.schema_version", version))
+	schemaPayloads.WithLabelValues(routeTarget(r), strconv.Itoa(version)).Inc()
+	if version != productSchemaV2 {
+		return products
+	}
+
+	currency := productCurrency()
+	payload := ProductsV2{SchemaVersion: productSchemaV2, Products: make([]ProductV2, len(products))}
+	for i, p := range products {
+		payload.Products[i] = ProductV2{ID: p.ID, Name: p.Name, Price: PriceV2{Amount: p.Price, Currency: currency}}
+	}
+	return payload
+}
+
+// schemaHandler shows the product schema version /products emits. POST
+// changes it from the version query parameter, and DELETE restores the
+// configured one.
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		version, err := strconv.Atoi(r.URL.Query().Get("version"))
+		if err != nil {
+			httpError(w, r, errors.New("version must be a number"), http.StatusBadRequest)
+			return
+		}
+		if err := setProductSchema(version); err != nil {
+			httpError(w, r, err, http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		setProductSchema(defaultProductSchema)
+	default:
+		httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, r, map[string]any{
+		"version":         productSchema.Load(),
+		"default_version": defaultProductSchema,
+		"supported":       []int{productSchemaV1, productSchemaV2},
+	}, 0)
+}
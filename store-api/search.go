@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Histogram of search latency, by how expensive the query is expected
+	// to be.
+	searchLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_search_duration_seconds",
+			Help:    "Product search latency in seconds, by query complexity.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"complexity"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(searchLatency)
+}
+
+// Every product is searchable in every variant, which gives the naive
+// matcher a few thousand descriptions to chew through per query.
+var (
+	searchColors    = []string{"Red", "Blue", "Green", "Black", "White", "Yellow", "Grey", "Teal"}
+	searchMaterials = []string{"Ceramic", "Porcelain", "Glass", "Steel", "Bamboo", "Stoneware", "Enamel", "Copper"}
+	searchSizes     = []string{"Small", "Medium", "Large", "Extra Large", "Family Size"}
+)
+
+// SearchResult is the response to a product search.
+type SearchResult struct {
+	Query    string    `json:"query"`
+	Matches  int       `json:"matches"`
+	Products []Product `json:"products"`
+}
+
+// searchHandler finds products whose name or any variant description contains
+// the q parameter. It is deliberately slow: every variant description is
+// rebuilt and scanned character by character for every query, O(n·m) in the
+// corpus and query size, making it a good target for profile-driven
+// optimization.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(r.Context(), "search-handler")
+	defer span.End()
+	start := time.Now()
+
+	query := strings.ToLower(r.URL.Query().Get("q"))
+	complexity := queryComplexity(query)
+
+	// The matcher is pure CPU, so run it on the pool rather than letting
+	// every concurrent search burn a core of its own
+	result := SearchResult{Query: query, Products: []Product{}}
+	err := cpuPool.Run(ctx, "search-match", func(context.Context) {
+		for _, p := range catalog.List() {
+			matched := false
+			for _, description := range variantDescriptions(p) {
+				if naiveContains(strings.ToLower(description), query) {
+					result.Matches++
+					matched = true
+				}
+			}
+			if matched {
+				result.Products = append(result.Products, p)
+			}
+		}
+	})
+	if errors.Is(err, errPoolFull) {
+		httpError(w, r, err, http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		// The client went away, so there is nobody to answer
+		slog.WarnContext(ctx, "Search abandoned", logfields.Error(err))
+		return
+	}
+
+	duration := time.Since(start)
+	span.SetAttributes(
+		attribute.Int("search.query_length", len(query)),
+		attribute.String("search.complexity", complexity),
+		attribute.Int("search.matches", result.Matches),
+	)
+	searchLatency.WithLabelValues(complexity).Observe(duration.Seconds())
+	slog.InfoContext(ctx, "Search completed", "query_length", len(query), "matches", result.Matches, logfields.Duration(duration))
+
+	writeJSON(w, r, result, duration)
+}
+
+// queryComplexity buckets a query by length, which is what drives the cost of
+// the naive matcher.
+func queryComplexity(query string) string {
+	switch {
+	case len(query) <= 3:
+		return "simple"
+	case len(query) <= 10:
+		return "moderate"
+	default:
+		return "complex"
+	}
+}
+
+// variantDescriptions builds every variant description of p.
+func variantDescriptions(p Product) []string {
+	var descriptions []string
+	for _, color := range searchColors {
+		for _, material := range searchMaterials {
+			for _, size := range searchSizes {
+				descriptions = append(descriptions, fmt.Sprintf("%s %s %s %s", size, color, material, p.Name))
+			}
+		}
+	}
+	return descriptions
+}
+
+// naiveContains reports whether needle is in haystack by trying every offset,
+// without any of the tricks strings.Contains uses.
+func naiveContains(haystack, needle string) bool {
+	for i := 0; i+len(needle) <= len(haystack); i++ {
+		j := 0
+		for j < len(needle) && haystack[i+j] == needle[j] {
+			j++
+		}
+		if j == len(needle) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// productStore is the in-memory product catalog, seeded with the kitchen
+// store's stock and updatable through the bulk endpoint.
+type productStore struct {
+	mu       sync.RWMutex
+	products map[int]Product
+	version  uint64
+}
+
+var catalog = newProductStore([]Product{
+	{ID: 1, Name: "Mug", Price: 1099},
+	{ID: 2, Name: "Bowl", Price: 1599},
+	{ID: 3, Name: "Plate", Price: 1299},
+	{ID: 4, Name: "Fork", Price: 599},
+	{ID: 5, Name: "Spoon", Price: 799},
+	{ID: 6, Name: "Knife", Price: 1099},
+	{ID: 7, Name: "Cup", Price: 899},
+	{ID: 8, Name: "Saucer", Price: 699},
+	{ID: 9, Name: "Dish", Price: 1499},
+	{ID: 10, Name: "Glass", Price: 1199},
+})
+
+func newProductStore(seed []Product) *productStore {
+	s := &productStore{products: make(map[int]Product, len(seed))}
+	for _, p := range seed {
+		s.products[p.ID] = p
+	}
+	return s
+}
+
+// List returns all products ordered by ID.
+func (s *productStore) List() []Product {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]Product, 0, len(s.products))
+	for _, p := range s.products {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Get returns the product with the given ID.
+func (s *productStore) Get(id int) (Product, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.products[id]
+	return p, ok
+}
+
+// Upsert creates or replaces the product with p's ID.
+func (s *productStore) Upsert(p Product) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.products[p.ID] = p
+	s.version++
+}
+
+// Version returns a number that changes whenever the catalog does.
+func (s *productStore) Version() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.version
+}
+
+// Len returns how many products there are.
+func (s *productStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.products)
+}
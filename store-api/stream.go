@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Histogram of large response sizes, by whether they were buffered or
+	// streamed.
+	largeResponseSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_large_response_size_bytes",
+			Help:    "Size of /products/all responses in bytes, by encoding mode.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+		},
+		[]string{"mode"},
+	)
+
+	// Count flushes made while streaming responses.
+	responseFlushes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "go_app_response_flushes_total",
+			Help: "Total number of flushes made while streaming responses.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(largeResponseSize, responseFlushes)
+}
+
+const (
+	// maxAllProducts caps how many products a single request may ask for.
+	maxAllProducts = 1_000_000
+
+	// streamFlushEvery is how many products are written between flushes.
+	streamFlushEvery = 1000
+)
+
+// allProductsHandler returns count products (the catalog repeated, with
+// fresh IDs) either marshaled in one go (mode=buffer) or streamed as NDJSON
+// (the default). Buffering holds the whole slice and its encoding in memory
+// at once, which stands out in the inuse space profile next to streaming.
+func allProductsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(r.Context(), "all-products-handler")
+	defer span.End()
+	start := time.Now()
+
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count <= 0 {
+		count = 10000
+	}
+	count = min(count, maxAllProducts)
+	mode := r.URL.Query().Get("mode")
+	if mode != "buffer" {
+		mode = "stream"
+	}
+	span.SetAttributes(attribute.Int("products.count", count), attribute.String("response.mode", mode))
+
+	cw := &countingWriter{w: w}
+	var flushes int
+	if mode == "buffer" {
+		w.Header().Set("Content-Type", "application/json")
+		err = writeBuffered(cw, count)
+	} else {
+		flushes, err = writeStreamed(cw, w, count)
+	}
+	if err != nil {
+		// Headers are gone by now, all that is left is to record it
+		slog.ErrorContext(ctx, "Failed to write products", logfields.Path(r.URL.Path), logfields.Error(err))
+		return
+	}
+
+	duration := time.Since(start)
+	span.SetAttributes(attribute.Int64("response.bytes", cw.n), attribute.Int("response.flushes", flushes))
+	largeResponseSize.WithLabelValues(mode).Observe(float64(cw.n))
+	slog.InfoContext(ctx, "Request handled successfully", "mode", mode, "count", count, "bytes", cw.n, logfields.Duration(duration))
+	requestCount.WithLabelValues(routeTarget(r), r.Method, strconv.Itoa(http.StatusOK)).Inc()
+	requestLatency.WithLabelValues(routeTarget(r)).Observe(duration.Seconds())
+}
+
+// generatedProduct returns the i-th of an endless run of products, cycling
+// through the catalog.
+func generatedProduct(base []Product, i int) Product {
+	p := base[i%len(base)]
+	p.ID = i + 1
+	return p
+}
+
+// writeBuffered builds all count products, marshals them as one JSON array
+// and writes the lot.
+func writeBuffered(w io.Writer, count int) error {
+	base := catalog.List()
+	products := make([]Product, count)
+	for i := range products {
+		products[i] = generatedProduct(base, i)
+	}
+
+	jsonData, err := json.Marshal(products)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(jsonData)
+	return err
+}
+
+// writeStreamed encodes count products one per line to w, flushing f every
+// streamFlushEvery products, and returns how many flushes it made.
+func writeStreamed(w io.Writer, f http.ResponseWriter, count int) (int, error) {
+	flusher, _ := f.(http.Flusher)
+	f.Header().Set("Content-Type", "application/x-ndjson")
+
+	base := catalog.List()
+	enc := json.NewEncoder(w)
+	flushes := 0
+	for i := 0; i < count; i++ {
+		if err := enc.Encode(generatedProduct(base, i)); err != nil {
+			return flushes, fmt.Errorf("failed to encode product %d: %w", i, err)
+		}
+		if flusher != nil && (i+1)%streamFlushEvery == 0 {
+			flusher.Flush()
+			flushes++
+			responseFlushes.Inc()
+		}
+	}
+	return flushes, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Topology is what the service says about itself on /topology: who it is,
+// where it listens, what it calls and which of its routes are safe to send
+// load to. o11yctl topology collects it from every service into one file.
+type Topology struct {
+	Name         string               `json:"name"`
+	Version      string               `json:"version,omitempty"`
+	Listen       []TopologyListener   `json:"listen"`
+	Dependencies []TopologyDependency `json:"dependencies"`
+	// Entrypoints are GET paths, with any query they need, that load can
+	// be sent to
+	Entrypoints []string `json:"entrypoints"`
+}
+
+// TopologyListener is an address the service listens on.
+type TopologyListener struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+}
+
+// TopologyDependency is a service this one calls, named by its host, which
+// in docker compose is the service name.
+type TopologyDependency struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// dependency describes the service at address.
+func dependency(address string) TopologyDependency {
+	name := address
+	if u, err := url.Parse(address); err == nil && u.Hostname() != "" {
+		name = u.Hostname()
+	}
+	return TopologyDependency{Name: name, Address: address}
+}
+
+// newTopology describes the service as config sets it up.
+func newTopology(config Config) Topology {
+	t := Topology{
+		Name:    config.serviceName,
+		Version: config.serviceVersion,
+		Listen: []TopologyListener{
+			{Name: "app", Addr: config.listenAddr},
+			{Name: "grpc", Addr: config.grpcListenAddr},
+		},
+		Dependencies: []TopologyDependency{},
+		Entrypoints: []string{
+			"/products",
+			"/products/all",
+			"/products/search?q=mug",
+			"/recommendations?user=o11yctl",
+			"/catalog",
+			"/catalog/1",
+			"/catalog/details?ids=1,2,3",
+			"/api/v2/products",
+			"/employees",
+			"/legacy/products.xml",
+		},
+	}
+	for i := 1; i < config.virtualReplicas; i++ {
+		if addr, err := replicaAddr(config.listenAddr, i); err == nil {
+			t.Listen = append(t.Listen, TopologyListener{Name: "replica-" + strconv.Itoa(i), Addr: addr})
+		}
+	}
+	if config.adminListenAddr != "" {
+		t.Listen = append(t.Listen, TopologyListener{Name: "admin", Addr: config.adminListenAddr})
+	}
+	if config.unixSocketPath != "" {
+		t.Listen = append(t.Listen, TopologyListener{Name: "unix", Addr: config.unixSocketPath})
+	}
+	for _, address := range []string{config.pricingServer, config.paymentsServer} {
+		if address != "" {
+			t.Dependencies = append(t.Dependencies, dependency(address))
+		}
+	}
+	for _, address := range strings.Split(config.webhookURLs, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			t.Dependencies = append(t.Dependencies, dependency(address))
+		}
+	}
+	return t
+}
+
+// topologyHandler serves the service's topology.
+func topologyHandler(topology Topology) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, topology, 0)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Histogram of uploaded file sizes.
+	uploadFileSize = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "go_app_upload_file_size_bytes",
+			Help:    "Size of each uploaded file in bytes.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+		},
+	)
+
+	// Count uploads turned away, by why.
+	uploadRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_upload_rejections_total",
+			Help: "Total number of rejected uploads, by reason.",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(uploadFileSize, uploadRejections)
+}
+
+// uploadChunkSize is how much of a file is read per chunk, and so per span.
+const uploadChunkSize = 1 << 20
+
+// UploadResult is the response to an upload.
+type UploadResult struct {
+	Files []UploadedFile `json:"files"`
+	Bytes int64          `json:"bytes"`
+}
+
+// UploadedFile describes one received file.
+type UploadedFile struct {
+	Field string `json:"field"`
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+}
+
+// uploadHandler accepts multipart uploads of up to maxBytes in total. Files
+// are streamed rather than buffered, in uploadChunkSize chunks with a span
+// each, so a slow client shows up as gaps between the chunk spans.
+func uploadHandler(maxBytes int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(r.Context(), "upload-handler")
+		defer span.End()
+		start := time.Now()
+
+		if r.ContentLength > maxBytes {
+			uploadRejections.WithLabelValues("too_large").Inc()
+			httpError(w, r, fmt.Errorf("upload too large: %d bytes (max %d)", r.ContentLength, maxBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+
+		reader, err := r.MultipartReader()
+		if err != nil {
+			uploadRejections.WithLabelValues("not_multipart").Inc()
+			httpError(w, r, fmt.Errorf("invalid upload: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		result := UploadResult{Files: []UploadedFile{}}
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err == nil && part.FileName() == "" {
+				// Plain form fields aren't files, skip them
+				continue
+			}
+			var n int64
+			if err == nil {
+				n, err = readUpload(ctx, part)
+			}
+			if err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					uploadRejections.WithLabelValues("too_large").Inc()
+					httpError(w, r, fmt.Errorf("upload too large (max %d bytes)", maxBytes), http.StatusRequestEntityTooLarge)
+					return
+				}
+				uploadRejections.WithLabelValues("read_error").Inc()
+				httpError(w, r, fmt.Errorf("failed to read upload: %w", err), http.StatusBadRequest)
+				return
+			}
+
+			uploadFileSize.Observe(float64(n))
+			result.Files = append(result.Files, UploadedFile{Field: part.FormName(), Name: part.FileName(), Bytes: n})
+			result.Bytes += n
+		}
+
+		span.SetAttributes(attribute.Int("upload.files", len(result.Files)), attribute.Int64("upload.bytes", result.Bytes))
+		slog.InfoContext(ctx, "Upload received", "files", len(result.Files), "bytes", result.Bytes, logfields.Path(r.URL.Path))
+		writeJSON(w, r, result, time.Since(start))
+	}
+}
+
+// readUpload reads part to the end in chunks, with a span for each, and
+// returns how many bytes it held. The contents are discarded; it is the
+// transfer that is interesting here.
+func readUpload(ctx context.Context, part *multipart.Part) (int64, error) {
+	tracer := otel.Tracer("go.opentelemetry.io/http")
+	buf := make([]byte, uploadChunkSize)
+
+	var total int64
+	for chunk := 0; ; chunk++ {
+		_, span := tracer.Start(ctx, "upload-read-chunk")
+		n, err := io.ReadFull(part, buf)
+		total += int64(n)
+		span.SetAttributes(
+			attribute.String("upload.file", part.FileName()),
+			attribute.Int("upload.chunk", chunk),
+			attribute.Int("upload.chunk_bytes", n),
+		)
+		span.End()
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, fmt.Errorf("chunk %d of %q: %w", chunk, part.FileName(), err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"hash/crc32"
+	"runtime"
+)
+
+// publishVars exposes application state on /debug/vars (registered by
+// importing expvar) for quick JSON introspection, without having to know
+// which metric to look for. It returns the config version.
+func publishVars(config Config) string {
+	expvar.NewString("service_version").Set(config.serviceVersion)
+	// Not a setting: it differs between instances with the same config
+	expvar.NewString("instance_id").Set(instanceID)
+
+	// The settings that change behaviour, and a short hash of them so two
+	// instances can be checked for the same config at a glance
+	settings := map[string]any{
+		"cpu_workers":               config.cpuWorkers,
+		"cpu_queue_size":            config.cpuQueueSize,
+		"json_pooling":              config.jsonPooling,
+		"fast_path":                 config.fastPath,
+		"product_schema_version":    config.productSchema,
+		"span_audit":                config.spanAudit,
+		"profiling_mode":            config.profilingMode,
+		"profile_types":             config.profileTypes,
+		"profile_mem_rate_bytes":    config.profileMemRate,
+		"profile_mutex_fraction":    config.profileMutexFraction,
+		"profile_block_rate_ns":     config.profileBlockRate,
+		"trace_sample_ratio":        config.sampleRatio,
+		"sampling_comparison":       config.samplingComparison,
+		"latency_highres":           config.latencyHighRes,
+		"instrumentation_overhead":  config.overheadAccounting,
+		"log_level":                 config.logLevel,
+		"apdex_threshold_ms":        config.apdexThreshold.Milliseconds(),
+		"apdex_frustrated_factor":   config.apdexFrustratedFactor,
+		"apdex_route_thresholds":    config.apdexRouteThresholds,
+		"chaos_schedule":            config.chaosSchedule,
+		"error_spike_detection":     config.errorSpikeDetection,
+		"error_spike_factor":        config.errorSpikeFactor,
+		"error_spike_min_requests":  config.errorSpikeMinRequests,
+		"remote_write_enabled":      config.remoteWriteURL != "",
+		"remote_write_interval_ms":  config.remoteWriteInterval.Milliseconds(),
+		"remote_write_labels":       config.remoteWriteLabels,
+		"remote_write_wal_max_mb":   config.remoteWriteWALMaxMB,
+		"tenant_quotas":             config.tenantQuotas,
+		"quota_default":             config.quotaDefault,
+		"quota_enforce":             config.quotaEnforce,
+		"json_span_threshold_ms":    config.jsonSpanThreshold.Milliseconds(),
+		"recommendations_optimized": config.optimizedRecommendations,
+		"client_h2c":                config.clientH2C,
+		"client_max_idle_per_host":  config.clientMaxIdlePerHost,
+		"client_idle_timeout_ms":    config.clientIdleTimeout.Milliseconds(),
+		"client_disable_keepalives": config.clientDisableKeepAlives,
+		"inventory_unsafe":          config.inventoryUnsafe,
+		"pricing_enabled":           config.pricingServer != "",
+		"brownout":                  config.brownout,
+		"brownout_timeout_ms":       config.brownoutTimeout.Milliseconds(),
+		"webhook_destinations":      redactURLs(config.webhookURLs),
+		"webhook_max_attempts":      config.webhookMaxAttempts,
+		"notifications":             config.notifications,
+		"upload_max_mb":             config.uploadMaxMB,
+		"bulk_max_items":            config.bulkMaxItems,
+		"bulk_batch_size":           config.bulkBatchSize,
+		"leak_kind":                 config.leakKind,
+		"leak_rate":                 config.leakRate,
+		"virtual_replicas":          config.virtualReplicas,
+		"replica_zones":             config.replicaZones,
+	}
+	expvar.Publish("config", expvar.Func(func() any { return settings }))
+	version := configVersion(settings)
+	expvar.NewString("config_version").Set(version)
+
+	expvar.Publish("caches", expvar.Func(func() any {
+		return map[string]int{
+			"catalog_products": catalog.Len(),
+			"idempotency_keys": orderIdempotency.Len(),
+		}
+	}))
+	expvar.Publish("worker_pool", expvar.Func(func() any {
+		return cpuPool.Stats()
+	}))
+	expvar.Publish("goroutines", expvar.Func(func() any {
+		return runtime.NumGoroutine()
+	}))
+	return version
+}
+
+// configVersion hashes settings into a short, stable identifier.
+func configVersion(settings map[string]any) string {
+	// Map keys are sorted when marshaled, so equal settings hash the same
+	raw, _ := json.Marshal(settings)
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE(raw))
+}
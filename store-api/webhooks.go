@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Count webhook deliveries, by destination and outcome.
+	webhookDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_webhook_deliveries_total",
+			Help: "Total number of webhook events sent, by destination and outcome (delivered, rejected for a 4xx, failed after every attempt, or dropped when the destination's queue was full).",
+		},
+		[]string{"destination", "outcome"},
+	)
+
+	// Count delivery attempts, by destination and response status.
+	webhookAttempts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_webhook_attempts_total",
+			Help: "Total number of webhook delivery attempts, by destination and response status code (error when there was no response).",
+		},
+		[]string{"destination", "status_code"},
+	)
+
+	// Histogram of how long delivering an event took, retries included.
+	webhookDeliveryDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_webhook_delivery_duration_seconds",
+			Help:    "Time from a webhook event being queued to its delivery finishing in seconds, retries included, by destination.",
+			Buckets: []float64{.01, .05, .1, .5, 1, 2.5, 5, 10, 30, 60},
+		},
+		[]string{"destination"},
+	)
+
+	// Gauge of events waiting for each destination.
+	webhookQueued = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_webhook_queued_events",
+			Help: "Number of webhook events waiting to be delivered, by destination.",
+		},
+		[]string{"destination"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(webhookDeliveries, webhookAttempts, webhookDeliveryDuration, webhookQueued)
+}
+
+// webhookEvent is the body POSTed to webhook destinations.
+type webhookEvent struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// webhookDelivery is an event queued for one destination, with the context
+// of the bus consumer that queued it.
+type webhookDelivery struct {
+	ctx      context.Context
+	event    webhookEvent
+	queuedAt time.Time
+}
+
+// webhookDestination delivers events to one URL, in order, from its own
+// queue, so a slow or failing destination only holds up its own events.
+type webhookDestination struct {
+	url   string
+	name  string
+	queue chan webhookDelivery
+}
+
+// webhookPublisher signs and POSTs events to every destination, retrying
+// failures with backoff. Destinations are third parties as far as store-api
+// is concerned: their failures are counted and traced, never returned to
+// the bus.
+type webhookPublisher struct {
+	secret       []byte
+	maxAttempts  int
+	client       http.Client
+	destinations []*webhookDestination
+}
+
+// newWebhookPublisher returns a publisher for the comma separated urls,
+// signing with secret, and starts a sender for each destination.
+func newWebhookPublisher(urls, secret string, maxAttempts int, timeout time.Duration, h2c bool) (*webhookPublisher, error) {
+	p := &webhookPublisher{
+		secret:      []byte(secret),
+		maxAttempts: max(maxAttempts, 1),
+		client: http.Client{
+			// Retries are done here, per event, not by the transport
+			Transport: newTransport("webhooks", h2c),
+			Timeout:   timeout,
+		},
+	}
+	for _, raw := range strings.Split(urls, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid webhook URL %q", raw)
+		}
+		d := &webhookDestination{url: raw, name: u.Host, queue: make(chan webhookDelivery, 100)}
+		p.destinations = append(p.destinations, d)
+	}
+	for _, d := range p.destinations {
+		webhookQueued.WithLabelValues(d.name).Set(0)
+		go p.send(d)
+	}
+	return p, nil
+}
+
+// Handle queues an order event from the bus for every destination. The
+// event keeps the message's ID, so receivers can recognise a redelivery of
+// it as a duplicate.
+func (p *webhookPublisher) Handle(ctx context.Context, msg Message) error {
+	event := webhookEvent{
+		ID:        msg.ID,
+		Type:      msg.Topic,
+		CreatedAt: msg.CreatedAt,
+		Data:      msg.Payload,
+	}
+	for _, d := range p.destinations {
+		select {
+		case d.queue <- webhookDelivery{ctx: ctx, event: event, queuedAt: time.Now()}:
+			webhookQueued.WithLabelValues(d.name).Inc()
+		default:
+			webhookDeliveries.WithLabelValues(d.name, "dropped").Inc()
+			slog.WarnContext(ctx, "Webhook queue full, dropping event", "destination", d.name, "event_id", event.ID)
+		}
+	}
+	return nil
+}
+
+// send delivers d's queued events one at a time.
+func (p *webhookPublisher) send(d *webhookDestination) {
+	for delivery := range d.queue {
+		webhookQueued.WithLabelValues(d.name).Dec()
+		outcome := p.deliver(delivery.ctx, d, delivery.event)
+		webhookDeliveries.WithLabelValues(d.name, outcome).Inc()
+		webhookDeliveryDuration.WithLabelValues(d.name).Observe(time.Since(delivery.queuedAt).Seconds())
+	}
+}
+
+// deliver POSTs event to d until it is accepted, refused with a 4xx other
+// than 429, or has failed maxAttempts times, returning the outcome. The
+// delivery gets a span of its own, with a child for each attempt.
+func (p *webhookPublisher) deliver(ctx context.Context, d *webhookDestination, event webhookEvent) string {
+	// The attempts are the client spans; this one groups them
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "webhook-deliver",
+		trace.WithAttributes(
+			attribute.String("server.address", d.name),
+			attribute.String("webhook.event_id", event.ID),
+			attribute.String("webhook.event_type", event.Type),
+		),
+	)
+	defer span.End()
+
+	body, _ := json.Marshal(event)
+	for attempt := 1; ; attempt++ {
+		span.SetAttributes(attribute.Int("webhook.attempts", attempt))
+		status, err := p.post(ctx, d, event, body)
+		label := "error"
+		if err == nil {
+			label = strconv.Itoa(status)
+		}
+		webhookAttempts.WithLabelValues(d.name, label).Inc()
+
+		switch {
+		case err == nil && status < 300:
+			return "delivered"
+		case err == nil && status < 500 && status != http.StatusTooManyRequests:
+			// The destination refused it; sending it again won't help
+			err := fmt.Errorf("webhook rejected with status %d", status)
+			span.SetStatus(codes.Error, err.Error())
+			slog.WarnContext(ctx, "Webhook rejected", "destination", d.name, "event_id", event.ID, logfields.StatusCode(status))
+			return "rejected"
+		case err == nil:
+			err = fmt.Errorf("webhook failed with status %d", status)
+		}
+
+		span.AddEvent("attempt-failed", trace.WithAttributes(
+			attribute.Int("webhook.attempt", attempt),
+			attribute.String("error.message", err.Error()),
+		))
+		if attempt >= p.maxAttempts {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			slog.ErrorContext(ctx, "Webhook delivery failed", "destination", d.name, "event_id", event.ID, "attempts", attempt, logfields.Error(err))
+			return "failed"
+		}
+		// Exponential backoff with full jitter, from 200ms up to 10s
+		backoff := min(200*time.Millisecond<<min(attempt-1, 6), 10*time.Second)
+		time.Sleep(time.Duration(rand.Int63n(int64(backoff))))
+	}
+}
+
+// post makes one delivery attempt, returning the response status.
+func (p *webhookPublisher) post(ctx context.Context, d *webhookDestination, event webhookEvent, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Webhook-Id", event.ID)
+	req.Header.Set("Webhook-Event", event.Type)
+	req.Header.Set("Webhook-Signature", p.sign(time.Now(), body))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// sign returns the Webhook-Signature header for body sent at t:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">". Signing the
+// timestamp with the body lets receivers reject replays of old deliveries.
+func (p *webhookPublisher) sign(t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
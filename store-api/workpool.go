@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// Gauge of workers currently running a job.
+	poolBusyWorkers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_worker_pool_busy_workers",
+			Help: "Number of worker pool workers currently running a job.",
+		},
+	)
+
+	// Gauge of the number of workers in the pool.
+	poolWorkers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_worker_pool_workers",
+			Help: "Number of workers in the worker pool.",
+		},
+	)
+
+	// Gauge of jobs waiting for a free worker.
+	poolQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_worker_pool_queue_depth",
+			Help: "Number of jobs waiting for a worker.",
+		},
+	)
+
+	// Histogram of how long jobs waited for a worker.
+	poolQueueWait = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "go_app_worker_pool_queue_wait_seconds",
+			Help:    "Time jobs spent waiting for a worker in seconds.",
+			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+	)
+
+	// Gauge of how many workers may run a job at once.
+	poolLimit = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_worker_pool_limit",
+			Help: "Number of worker pool workers allowed to run a job at once, less than the pool's size when parallelism is being starved.",
+		},
+	)
+
+	// Count jobs turned away because the queue was full.
+	poolRejected = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "go_app_worker_pool_rejected_total",
+			Help: "Total number of jobs rejected because the worker pool queue was full.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(poolBusyWorkers, poolWorkers, poolLimit, poolQueueDepth, poolQueueWait, poolRejected)
+}
+
+var errPoolFull = errors.New("worker pool queue is full")
+
+// workerPool runs CPU heavy jobs on a fixed number of workers, so a burst of
+// expensive requests queues up (visibly, in the queue metrics) instead of
+// every request burning CPU at once and starving the whole process.
+type workerPool struct {
+	jobs    chan poolJob
+	workers int
+	busy    atomic.Int64
+
+	// limit is how many workers may run a job at once. Workers over it
+	// hold on to the job they took until another finishes, and the time
+	// it waits there counts toward the queue depth and wait metrics.
+	mu      sync.Mutex
+	slots   *sync.Cond
+	limit   int
+	running int
+}
+
+// poolJob is a queued job. Like a message on a real queue it carries the
+// submitter's trace context and baggage serialized in carrier rather than
+// the submitter's context itself, which may well be cancelled by the time
+// a worker gets to the job.
+type poolJob struct {
+	name     string
+	fn       func(context.Context)
+	carrier  map[string]string
+	done     chan struct{}
+	enqueued time.Time
+}
+
+var cpuPool *workerPool
+
+// newWorkerPool starts workers goroutines consuming a queue of queueSize.
+func newWorkerPool(workers, queueSize int) *workerPool {
+	p := &workerPool{jobs: make(chan poolJob, queueSize), workers: workers, limit: workers}
+	p.slots = sync.NewCond(&p.mu)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	poolWorkers.Set(float64(workers))
+	poolLimit.Set(float64(workers))
+	return p
+}
+
+// SetLimit lets only n workers run a job at once, or all of them when n is
+// 0 or more than the pool has. It returns the limit in effect.
+func (p *workerPool) SetLimit(n int) int {
+	if n <= 0 || n > p.workers {
+		n = p.workers
+	}
+	p.mu.Lock()
+	p.limit = n
+	p.mu.Unlock()
+	p.slots.Broadcast()
+	poolLimit.Set(float64(n))
+	return n
+}
+
+// acquire waits until the worker is within the limit.
+func (p *workerPool) acquire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.running >= p.limit {
+		p.slots.Wait()
+	}
+	p.running++
+}
+
+func (p *workerPool) release() {
+	p.mu.Lock()
+	p.running--
+	p.mu.Unlock()
+	p.slots.Signal()
+}
+
+func (p *workerPool) work() {
+	for job := range p.jobs {
+		p.acquire()
+		poolQueueDepth.Dec()
+		wait := time.Since(job.enqueued)
+		poolQueueWait.Observe(wait.Seconds())
+
+		// Restore the submitter's trace so the job's span is its child
+		ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(job.carrier))
+		ctx, span := otel.Tracer("go.opentelemetry.io/workpool").Start(ctx, job.name,
+			trace.WithAttributes(attribute.Int64("worker_pool.queue_wait_ms", wait.Milliseconds())),
+		)
+
+		poolBusyWorkers.Inc()
+		p.busy.Add(1)
+		job.fn(ctx)
+		p.busy.Add(-1)
+		poolBusyWorkers.Dec()
+		p.release()
+		span.End()
+		close(job.done)
+	}
+}
+
+// PoolStats is a point in time view of a worker pool.
+type PoolStats struct {
+	Workers   int   `json:"workers"`
+	Limit     int   `json:"limit"`
+	Busy      int64 `json:"busy"`
+	Queued    int   `json:"queued"`
+	QueueSize int   `json:"queue_size"`
+}
+
+// Stats returns the pool's current utilization.
+func (p *workerPool) Stats() PoolStats {
+	p.mu.Lock()
+	limit := p.limit
+	p.mu.Unlock()
+	return PoolStats{Workers: p.workers, Limit: limit, Busy: p.busy.Load(), Queued: len(p.jobs), QueueSize: cap(p.jobs)}
+}
+
+// Run queues fn and waits for a worker to run it, under a span called name
+// in ctx's trace. It fails fast with errPoolFull when the queue is full, and
+// stops waiting (leaving fn to run anyway) if ctx is cancelled.
+func (p *workerPool) Run(ctx context.Context, name string, fn func(context.Context)) error {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	job := poolJob{name: name, fn: fn, carrier: carrier, done: make(chan struct{}), enqueued: time.Now()}
+
+	select {
+	case p.jobs <- job:
+		poolQueueDepth.Inc()
+	default:
+		poolRejected.Inc()
+		return errPoolFull
+	}
+
+	select {
+	case <-job.done:
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("worker_pool.total_ms", time.Since(job.enqueued).Milliseconds()))
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
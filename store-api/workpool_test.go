@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestWorkerPoolContinuesSubmitterTrace(t *testing.T) {
+	recordSpans(t)
+	ctx, submitter := requestContext(t)
+
+	var jobCtx context.Context
+	if err := newWorkerPool(1, 1).Run(ctx, "test-job", func(ctx context.Context) { jobCtx = ctx }); err != nil {
+		t.Fatal(err)
+	}
+
+	job, ok := trace.SpanFromContext(jobCtx).(sdktrace.ReadOnlySpan)
+	if !ok {
+		t.Fatal("job ran without a recording span")
+	}
+	checkContinues(t, job, submitter.SpanContext())
+	checkBaggage(t, jobCtx)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// instanceRegion and instanceZone are the simulated failure domain the
+// process runs in, from REGION and ZONE. They go on the resource as
+// cloud.region and cloud.availability_zone, and on logs and profiles, so
+// dashboards and traces can be sliced by them.
+var (
+	instanceRegion string
+	instanceZone   string
+)
+
+// replicaZones are the zones virtual replicas are spread over, from
+// REPLICA_ZONES. Empty leaves them all in the process's zone.
+var replicaZones []string
+
+// parseZones parses a comma-separated list of zones.
+func parseZones(list string) []string {
+	var zones []string
+	for _, zone := range strings.Split(list, ",") {
+		if zone = strings.TrimSpace(zone); zone != "" {
+			zones = append(zones, zone)
+		}
+	}
+	return zones
+}
+
+// replicaZone is the zone virtual replica i is in. Replica 0, the app
+// listener, is in the process's zone.
+func replicaZone(zones []string, i int) string {
+	if i == 0 || len(zones) == 0 {
+		return instanceZone
+	}
+	return zones[i%len(zones)]
+}
+
+// knownZones returns the zones this process serves from.
+func knownZones() []string {
+	zones := []string{}
+	if instanceZone != "" {
+		zones = append(zones, instanceZone)
+	}
+	for _, zone := range replicaZones {
+		if !slices.Contains(zones, zone) {
+			zones = append(zones, zone)
+		}
+	}
+	return zones
+}
+
+// zoneFaults degrades the requests served in one zone, whatever their
+// baggage, as an outage of a failure domain would. Its rules are keyed
+// zone=<zone>, which is also the cohort they are counted under.
+var zoneFaults = &faultInjector{rules: map[string]FaultRule{}}
+
+// zoneFault returns the rule degrading zone, if there is one.
+func zoneFault(zone string) (FaultRule, bool) {
+	zoneFaults.mu.RLock()
+	defer zoneFaults.mu.RUnlock()
+	rule, ok := zoneFaults.rules["zone="+zone]
+	return rule, ok
+}
+
+// zoneChaosHandler degrades one simulated zone: POST slows down or fails
+// the requests served in zone with the latency_ms, error_rate and
+// status_code query parameters, DELETE restores zone (every zone when none
+// is given). Both return the zones and the active rules.
+func zoneChaosHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		zone := query.Get("zone")
+		if !slices.Contains(knownZones(), zone) {
+			httpError(w, r, fmt.Errorf("unknown zone %q, want one of %s", zone, strings.Join(knownZones(), ", ")), http.StatusBadRequest)
+			return
+		}
+		latency, _ := strconv.Atoi(query.Get("latency_ms"))
+		errorRate, _ := strconv.ParseFloat(query.Get("error_rate"), 64)
+		status, _ := strconv.Atoi(query.Get("status_code"))
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		rule := FaultRule{
+			Key:        "zone",
+			Value:      zone,
+			LatencyMS:  latency,
+			ErrorRate:  errorRate,
+			StatusCode: status,
+		}
+		if err := zoneFaults.Set(rule); err != nil {
+			httpError(w, r, err, http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		if zone := query.Get("zone"); zone != "" {
+			zoneFaults.Remove("zone", zone)
+		} else {
+			zoneFaults.Remove("", "")
+		}
+	default:
+		httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, r, map[string]any{"zones": knownZones(), "rules": zoneFaults.Rules()}, 0)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	_ "net/http/pprof"
+	"strings"
+)
+
+// adminToken guards the /admin endpoints. When it is empty (the workshop
+// default) the admin endpoints are open to anyone who can reach the service.
+var adminToken string
+
+// requireAdmin only lets a request through if it carries the admin token as
+// a bearer token.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminToken != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+				httpError(w, r, errors.New("admin token required"), http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
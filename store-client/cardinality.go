@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/j6nca/o11y-playground/pkg/telemetry"
+)
+
+// Cardinality is how many series the service exposes, and which metrics
+// and label values they come from.
+type Cardinality struct {
+	TotalSeries int                 `json:"total_series"`
+	Metrics     []MetricCardinality `json:"metrics"`
+}
+
+// MetricCardinality is one metric's series, and its labels by how many
+// values each has.
+type MetricCardinality struct {
+	Name   string             `json:"name"`
+	Type   string             `json:"type"`
+	Series int                `json:"series"`
+	Labels []LabelCardinality `json:"labels"`
+}
+
+// LabelCardinality is one label's distinct values, and the values with
+// the most series.
+type LabelCardinality struct {
+	Name   string       `json:"name"`
+	Values int          `json:"values"`
+	Top    []LabelValue `json:"top"`
+}
+
+// LabelValue is a label value and the number of series carrying it.
+type LabelValue struct {
+	Value  string `json:"value"`
+	Series int    `json:"series"`
+}
+
+// cardinalityReport walks the registry and reports the limit metrics with
+// the most series, each with its top label values. Series are counted as
+// exposed, so a histogram's buckets count too: a label on a histogram
+// costs a dozen series per value where one on a counter costs one.
+func cardinalityReport(limit, top int) (Cardinality, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return Cardinality{}, err
+	}
+
+	var report Cardinality
+	for _, family := range families {
+		metric := MetricCardinality{
+			Name:   family.GetName(),
+			Type:   family.GetType().String(),
+			Series: telemetry.FamilySeries(family),
+			Labels: []LabelCardinality{},
+		}
+		report.TotalSeries += metric.Series
+
+		// Series per value, for each label
+		values := map[string]map[string]int{}
+		var names []string
+		for _, m := range family.GetMetric() {
+			series := telemetry.MetricSeries(family.GetType(), m)
+			for _, pair := range m.GetLabel() {
+				if values[pair.GetName()] == nil {
+					values[pair.GetName()] = map[string]int{}
+					names = append(names, pair.GetName())
+				}
+				values[pair.GetName()][pair.GetValue()] += series
+			}
+		}
+		for _, name := range names {
+			label := LabelCardinality{Name: name, Values: len(values[name])}
+			for value, series := range values[name] {
+				label.Top = append(label.Top, LabelValue{Value: value, Series: series})
+			}
+			sort.Slice(label.Top, func(i, j int) bool {
+				if label.Top[i].Series != label.Top[j].Series {
+					return label.Top[i].Series > label.Top[j].Series
+				}
+				return label.Top[i].Value < label.Top[j].Value
+			})
+			label.Top = label.Top[:min(top, len(label.Top))]
+			metric.Labels = append(metric.Labels, label)
+		}
+		sort.Slice(metric.Labels, func(i, j int) bool { return metric.Labels[i].Values > metric.Labels[j].Values })
+		report.Metrics = append(report.Metrics, metric)
+	}
+
+	sort.Slice(report.Metrics, func(i, j int) bool { return report.Metrics[i].Series > report.Metrics[j].Series })
+	report.Metrics = report.Metrics[:min(limit, len(report.Metrics))]
+	return report, nil
+}
+
+// cardinalityHandler reports the series this service exposes, for the
+// limit (default 20) metrics with the most, with each label's top (default
+// 5) values.
+func cardinalityHandler(w http.ResponseWriter, r *http.Request) {
+	limit, top := 20, 5
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 {
+		limit = v
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("top")); err == nil && v > 0 {
+		top = v
+	}
+
+	report, err := cardinalityReport(limit, top)
+	if err != nil {
+		httpError(w, r, fmt.Errorf("failed to gather metrics: %w", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
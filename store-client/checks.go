@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// traceConn is the gRPC connection traces are exported over, nil until
+// setupTracer has dialled it.
+var traceConn *grpc.ClientConn
+
+// checkTraceExporter reports the trace exporter unhealthy while its
+// connection to the collector is down.
+func checkTraceExporter(ctx context.Context) error {
+	if traceConn == nil {
+		return errors.New("trace exporter is not connected")
+	}
+	switch state := traceConn.GetState(); state {
+	case connectivity.Ready:
+		return nil
+	case connectivity.Idle:
+		// Idle just means nothing has been sent lately, so nudge it
+		traceConn.Connect()
+		return nil
+	default:
+		return fmt.Errorf("trace exporter connection is %s", state)
+	}
+}
+
+// checkStoreAPI is the store-api health check: it has to report itself
+// ready.
+func checkStoreAPI(ctx context.Context, client *http.Client, base string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/readyz", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("store-api is not ready (status %d)", resp.StatusCode)
+	}
+	return nil
+}
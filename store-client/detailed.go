@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"store-client/pkg/flags"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+	"github.com/j6nca/o11y-playground/pkg/model"
+)
+
+// flagBatchedDetails switches /products/detailed from one store-api call
+// per product (the N+1 pattern) to a single batched call.
+const flagBatchedDetails = "batched_details"
+
+// ProductDetail is a product with the extra details from store-api.
+type ProductDetail = model.ProductDetail
+
+// apiBase returns the scheme and host of the store-api address, so other
+// store-api routes can be called.
+func apiBase(apiServer string) string {
+	u, err := url.Parse(apiServer)
+	if err != nil {
+		return apiServer
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// fetchJSON GETs url and decodes the JSON response into v. A 207 is
+// decoded too: it is how store-api answers when some items in a
+// multi-item request failed, and the body says which.
+func fetchJSON(ctx context.Context, client *http.Client, url, caller string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Caller", caller)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusMultiStatus {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// detailedProductsHandler renders every product with its details. With the
+// batched_details flag off it makes one store-api call per product, which
+// shows up in the trace as a staircase of sequential client spans; with it on
+// there is a single call for all of them.
+func detailedProductsHandler(client *http.Client, config Config) http.HandlerFunc {
+	base := apiBase(config.apiServer)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(r.Context(), "detailed-products-handler")
+		defer span.End()
+
+		var products []Product
+		if err := fetchJSON(ctx, client, base+"/catalog", config.serviceName, &products); err != nil {
+			httpError(w, r, fmt.Errorf("Failed to list products: %w", err), http.StatusBadGateway)
+			return
+		}
+
+		var details []ProductDetail
+		var err error
+		if flags.Enabled(flagBatchedDetails) {
+			details, err = fetchDetailsBatched(ctx, client, base, config.serviceName, products)
+		} else {
+			details, err = fetchDetailsNaive(ctx, client, base, config.serviceName, products)
+		}
+		if err != nil {
+			httpError(w, r, fmt.Errorf("Failed to fetch product details: %w", err), http.StatusBadGateway)
+			return
+		}
+		if payloadVerify {
+			products, stock := make([]Product, len(details)), make([]int, len(details))
+			for i, d := range details {
+				products[i], stock[i] = d.Product, d.Stock
+			}
+			verifyProducts(ctx, "details", products, stock)
+		}
+
+		if !renderPage(w, r, "detailed", details) {
+			return
+		}
+
+		requestCount.WithLabelValues(routeTarget(r), r.Method, strconv.Itoa(http.StatusOK)).Inc()
+	}
+}
+
+// fetchDetailsNaive calls store-api once per product.
+func fetchDetailsNaive(ctx context.Context, client *http.Client, base, caller string, products []Product) ([]ProductDetail, error) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("details.mode", "naive"), attribute.Int("details.calls", len(products)))
+
+	details := make([]ProductDetail, 0, len(products))
+	for _, p := range products {
+		var d ProductDetail
+		if err := fetchJSON(ctx, client, base+"/catalog/"+strconv.Itoa(p.ID), caller, &d); err != nil {
+			return nil, err
+		}
+		details = append(details, d)
+	}
+	return details, nil
+}
+
+// fetchDetailsBatched fetches every product's details in one call. Products
+// store-api couldn't find are left out, and noted on the span and in the
+// logs.
+func fetchDetailsBatched(ctx context.Context, client *http.Client, base, caller string, products []Product) ([]ProductDetail, error) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("details.mode", "batched"), attribute.Int("details.calls", 1))
+
+	ids := make([]string, len(products))
+	for i, p := range products {
+		ids[i] = strconv.Itoa(p.ID)
+	}
+
+	var result struct {
+		Items  []ProductDetail `json:"items"`
+		Failed []struct {
+			ID    int    `json:"id"`
+			Error string `json:"error"`
+		} `json:"failed"`
+	}
+	if err := fetchJSON(ctx, client, base+"/catalog/details?ids="+strings.Join(ids, ","), caller, &result); err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("details.failed", len(result.Failed)))
+	if len(result.Failed) > 0 {
+		slog.WarnContext(ctx, "Some product details were missing", "failed", len(result.Failed), logfields.Error(errors.New(result.Failed[0].Error)))
+	}
+	return result.Items, nil
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Histogram of how long resolving a service's endpoints takes.
+	discoveryResolveDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_discovery_resolve_duration_seconds",
+			Help:    "Time resolving a service's endpoints took in seconds, by mechanism and outcome.",
+			Buckets: []float64{.0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 5},
+		},
+		[]string{"mechanism", "outcome"},
+	)
+
+	// Gauge of the endpoints each service resolved to last.
+	discoveryEndpoints = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "go_app_discovery_endpoints",
+			Help: "Number of endpoints each service last resolved to.",
+		},
+		[]string{"service"},
+	)
+
+	// Count changes to the endpoints a service resolves to.
+	discoveryChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_discovery_changes_total",
+			Help: "Total number of times a service's endpoints changed.",
+		},
+		[]string{"service"},
+	)
+
+	// Count requests sent to endpoints kept from before a failed resolve.
+	discoveryStale = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_discovery_stale_total",
+			Help: "Total number of requests sent to the last known endpoints because resolving the service failed.",
+		},
+		[]string{"service"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(discoveryResolveDuration, discoveryEndpoints, discoveryChanges, discoveryStale)
+}
+
+// discoveryResolveTimeout bounds each resolve, and discoveryRetryBackoff is
+// how long after a failed one the next is tried, doubling with each failure
+// in a row up to the refresh interval.
+const (
+	discoveryResolveTimeout = 5 * time.Second
+	discoveryRetryBackoff   = time.Second
+)
+
+// Discovery finds the endpoints a service can be reached at, as base URLs
+// like http://10.0.0.3:8080.
+type Discovery interface {
+	// Name is the mechanism, for metrics and spans.
+	Name() string
+	Resolve(ctx context.Context, service string) ([]string, error)
+}
+
+// staticDiscovery resolves services to endpoints given up front.
+type staticDiscovery map[string][]string
+
+func (staticDiscovery) Name() string { return "static" }
+
+func (d staticDiscovery) Resolve(ctx context.Context, service string) ([]string, error) {
+	endpoints, ok := d[service]
+	if !ok {
+		return nil, fmt.Errorf("no static endpoints for %s", service)
+	}
+	return endpoints, nil
+}
+
+// parseStaticEndpoints parses endpoints given as service=url,url;service=url.
+func parseStaticEndpoints(spec string) (staticDiscovery, error) {
+	d := staticDiscovery{}
+	for _, entry := range strings.Split(spec, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		service, list, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q: want service=url,url", entry)
+		}
+		for _, endpoint := range strings.Split(list, ",") {
+			u, err := url.Parse(strings.TrimSpace(endpoint))
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return nil, fmt.Errorf("%q: invalid endpoint %q", entry, endpoint)
+			}
+			d[strings.TrimSpace(service)] = append(d[strings.TrimSpace(service)], u.Scheme+"://"+u.Host)
+		}
+	}
+	return d, nil
+}
+
+// dnsDiscovery resolves a service to every address its hostname has, on
+// the port and scheme it is configured with, so each replica behind a
+// headless service or round-robin record is an endpoint of its own.
+type dnsDiscovery struct {
+	resolver *net.Resolver
+	targets  map[string]*url.URL
+}
+
+func (dnsDiscovery) Name() string { return "dns" }
+
+func (d dnsDiscovery) Resolve(ctx context.Context, service string) ([]string, error) {
+	target, ok := d.targets[service]
+	if !ok {
+		return nil, fmt.Errorf("no address configured for %s", service)
+	}
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addrs, err := d.resolver.LookupHost(ctx, target.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	endpoints := make([]string, len(addrs))
+	for i, addr := range addrs {
+		endpoints[i] = target.Scheme + "://" + net.JoinHostPort(addr, port)
+	}
+	return endpoints, nil
+}
+
+// consulDiscovery resolves a service to the instances Consul's catalog
+// has passing health checks for.
+type consulDiscovery struct {
+	address string
+	client  *http.Client
+}
+
+func (consulDiscovery) Name() string { return "consul" }
+
+func (d consulDiscovery) Resolve(ctx context.Context, service string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.address+"/v1/health/service/"+url.PathEscape(service)+"?passing=true", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul returned %d", resp.StatusCode)
+	}
+
+	var entries []struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			Address string
+			Port    int
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("decoding consul response: %w", err)
+	}
+	endpoints := make([]string, 0, len(entries))
+	for _, e := range entries {
+		// Services registered without an address are on their node's
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		endpoints = append(endpoints, "http://"+net.JoinHostPort(host, strconv.Itoa(e.Service.Port)))
+	}
+	return endpoints, nil
+}
+
+// newDiscovery returns the mechanism config asks for, or nil if discovery
+// is off and services are called at their configured addresses.
+func newDiscovery(config Config) (Discovery, error) {
+	switch config.discovery {
+	case "":
+		return nil, nil
+	case "static":
+		if config.discoveryStatic == "" {
+			return staticDiscovery{"store-api": {apiBase(config.apiServer)}}, nil
+		}
+		return parseStaticEndpoints(config.discoveryStatic)
+	case "dns":
+		target, err := url.Parse(apiBase(config.apiServer))
+		if err != nil {
+			return nil, err
+		}
+		return dnsDiscovery{resolver: net.DefaultResolver, targets: map[string]*url.URL{"store-api": target}}, nil
+	case "consul":
+		// Consul is asked directly, not through the traced transport, so
+		// its calls show up in the discovery-resolve span's timing only
+		return consulDiscovery{address: strings.TrimSuffix(config.consulAddress, "/"), client: &http.Client{Timeout: 2 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("unknown discovery mechanism %q, want static, dns or consul", config.discovery)
+	}
+}
+
+// discoverer resolves services through a Discovery, keeping the answer for
+// refresh and handing out its endpoints round robin. When resolving fails
+// it carries on with the endpoints it had, if any, as clients of a real
+// registry would.
+type discoverer struct {
+	discovery Discovery
+	refresh   time.Duration
+	group     singleflight.Group
+
+	mu       sync.Mutex
+	services map[string]*discovered
+	chaos    discoveryChaos
+}
+
+type discovered struct {
+	endpoints []string
+	resolved  time.Time
+	// failed is when resolving last failed and err why, failures how many
+	// times in a row it has; err is nil once a resolve succeeds
+	failed   time.Time
+	err      error
+	failures int
+	next     atomic.Uint64
+}
+
+// discoveryChaos is what the discovery chaos mode does to each resolve.
+type discoveryChaos struct {
+	LatencyMS int     `json:"latency_ms"`
+	ErrorRate float64 `json:"error_rate"`
+	// Empty makes services resolve to no endpoints, as when every
+	// instance is failing its health checks
+	Empty bool `json:"empty"`
+}
+
+// serviceDiscovery is nil when discovery is off.
+var serviceDiscovery *discoverer
+
+func newDiscoverer(d Discovery, refresh time.Duration) *discoverer {
+	return &discoverer{discovery: d, refresh: refresh, services: map[string]*discovered{}}
+}
+
+// Endpoint returns the next endpoint of service to send a request to.
+func (d *discoverer) Endpoint(ctx context.Context, service string) (string, error) {
+	var err error
+	d.mu.Lock()
+	s := d.services[service]
+	fresh := s != nil && time.Since(s.resolved) < d.refresh
+	if !fresh && s != nil && s.err != nil && time.Since(s.failed) < d.retryBackoff(s.failures) {
+		// Resolving failed moments ago, so don't ask again on every request
+		fresh, err = true, s.err
+	}
+	d.mu.Unlock()
+
+	if !fresh {
+		_, err, _ = d.group.Do(service, func() (any, error) {
+			// Every request waiting on the resolve shares it, so the one that
+			// started it giving up mustn't cancel it for the rest
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), discoveryResolveTimeout)
+			defer cancel()
+			return nil, d.refreshService(ctx, service)
+		})
+	}
+
+	d.mu.Lock()
+	s = d.services[service]
+	var endpoints []string
+	if s != nil {
+		endpoints = s.endpoints
+	}
+	d.mu.Unlock()
+	if len(endpoints) == 0 {
+		if err == nil {
+			err = errors.New("no endpoints")
+		}
+		return "", fmt.Errorf("discovering %s: %w", service, err)
+	}
+	if err != nil {
+		discoveryStale.WithLabelValues(service).Inc()
+	}
+	return endpoints[s.next.Add(1)%uint64(len(endpoints))], nil
+}
+
+// retryBackoff is how long to wait before resolving a service again after
+// failures failed resolves in a row.
+func (d *discoverer) retryBackoff(failures int) time.Duration {
+	return min(discoveryRetryBackoff<<min(failures-1, 10), d.refresh)
+}
+
+// service returns what is known of service, adding it if nothing is yet.
+// The caller must hold mu.
+func (d *discoverer) service(service string) *discovered {
+	s := d.services[service]
+	if s == nil {
+		s = &discovered{}
+		d.services[service] = s
+	}
+	return s
+}
+
+// refreshService resolves service in a traced lookup and records any change
+// to its endpoints. An empty answer counts as a failure, so the last known
+// endpoints keep being used.
+func (d *discoverer) refreshService(ctx context.Context, service string) error {
+	ctx, span := otel.Tracer("go.opentelemetry.io/discovery").Start(ctx, "discovery-resolve")
+	defer span.End()
+	mechanism := d.discovery.Name()
+	span.SetAttributes(
+		attribute.String("discovery.mechanism", mechanism),
+		attribute.String("discovery.service", service),
+	)
+
+	start := time.Now()
+	endpoints, err := d.resolve(ctx, service)
+	if err == nil && len(endpoints) == 0 {
+		err = errors.New("no endpoints")
+	}
+	if err != nil {
+		discoveryResolveDuration.WithLabelValues(mechanism, "error").Observe(time.Since(start).Seconds())
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.WarnContext(ctx, "Service discovery failed", "service", service, "mechanism", mechanism, logfields.Error(err))
+		d.mu.Lock()
+		s := d.service(service)
+		s.failed, s.err = time.Now(), err
+		s.failures++
+		d.mu.Unlock()
+		return err
+	}
+	discoveryResolveDuration.WithLabelValues(mechanism, "ok").Observe(time.Since(start).Seconds())
+	endpoints = slices.Sorted(slices.Values(endpoints))
+	span.SetAttributes(attribute.StringSlice("discovery.endpoints", endpoints))
+
+	d.mu.Lock()
+	s := d.service(service)
+	previous := s.endpoints
+	s.endpoints, s.resolved = endpoints, time.Now()
+	s.err, s.failures = nil, 0
+	d.mu.Unlock()
+	discoveryEndpoints.WithLabelValues(service).Set(float64(len(endpoints)))
+
+	if previous != nil && !slices.Equal(previous, endpoints) {
+		added, removed := diffEndpoints(previous, endpoints)
+		discoveryChanges.WithLabelValues(service).Inc()
+		span.AddEvent("discovery.changed", trace.WithAttributes(
+			attribute.StringSlice("discovery.added", added),
+			attribute.StringSlice("discovery.removed", removed),
+		))
+		slog.WarnContext(ctx, "Service endpoints changed", "service", service, "mechanism", mechanism, "added", added, "removed", removed)
+	}
+	return nil
+}
+
+// resolve asks the mechanism, after whatever the chaos mode does first.
+func (d *discoverer) resolve(ctx context.Context, service string) ([]string, error) {
+	chaos := d.Chaos()
+	if chaos.LatencyMS > 0 {
+		select {
+		case <-time.After(time.Duration(chaos.LatencyMS) * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if rand.Float64() < chaos.ErrorRate {
+		return nil, errors.New("simulated discovery failure")
+	}
+	if chaos.Empty {
+		return nil, nil
+	}
+	return d.discovery.Resolve(ctx, service)
+}
+
+// diffEndpoints returns what after has that before hadn't, and the other
+// way round.
+func diffEndpoints(before, after []string) (added, removed []string) {
+	for _, e := range after {
+		if !slices.Contains(before, e) {
+			added = append(added, e)
+		}
+	}
+	for _, e := range before {
+		if !slices.Contains(after, e) {
+			removed = append(removed, e)
+		}
+	}
+	return added, removed
+}
+
+// SetChaos changes what resolves suffer, and forgets what was resolved so
+// it applies straight away.
+func (d *discoverer) SetChaos(chaos discoveryChaos) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.chaos = chaos
+	for _, s := range d.services {
+		s.resolved, s.failed = time.Time{}, time.Time{}
+	}
+}
+
+func (d *discoverer) Chaos() discoveryChaos {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.chaos
+}
+
+// Snapshot returns the endpoints each service last resolved to.
+func (d *discoverer) Snapshot() map[string][]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	snapshot := make(map[string][]string, len(d.services))
+	for service, s := range d.services {
+		snapshot[service] = s.endpoints
+	}
+	return snapshot
+}
+
+// discoveryTransport sends the requests a client of service makes to the
+// endpoints discovery finds for it, rather than the configured address. The
+// Host header stays the configured one, as it would behind a load balancer.
+type discoveryTransport struct {
+	service string
+	next    http.RoundTripper
+}
+
+func (t discoveryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if serviceDiscovery == nil {
+		return t.next.RoundTrip(r)
+	}
+	endpoint, err := serviceDiscovery.Endpoint(r.Context(), t.service)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("discovery.endpoint", endpoint))
+
+	r = r.Clone(r.Context())
+	if r.Host == "" {
+		r.Host = r.URL.Host
+	}
+	r.URL.Scheme, r.URL.Host = u.Scheme, u.Host
+	return t.next.RoundTrip(r)
+}
+
+// discoveryChaosHandler makes discovery misbehave: POST sets any of
+// latency_ms, error_rate and empty=true, DELETE stops it. Both, and GET,
+// answer with the chaos and the endpoints each service resolved to.
+func discoveryChaosHandler(w http.ResponseWriter, r *http.Request) {
+	if serviceDiscovery == nil {
+		httpError(w, r, errors.New("service discovery is off, set DISCOVERY to use it"), http.StatusConflict)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		q := r.URL.Query()
+		var chaos discoveryChaos
+		if v := q.Get("latency_ms"); v != "" {
+			ms, err := strconv.Atoi(v)
+			if err != nil || ms < 0 {
+				httpError(w, r, fmt.Errorf("invalid latency_ms %q", v), http.StatusBadRequest)
+				return
+			}
+			chaos.LatencyMS = ms
+		}
+		if v := q.Get("error_rate"); v != "" {
+			rate, err := strconv.ParseFloat(v, 64)
+			if err != nil || rate < 0 || rate > 1 {
+				httpError(w, r, fmt.Errorf("invalid error_rate %q", v), http.StatusBadRequest)
+				return
+			}
+			chaos.ErrorRate = rate
+		}
+		chaos.Empty = q.Get("empty") == "true"
+		serviceDiscovery.SetChaos(chaos)
+		slog.WarnContext(r.Context(), "Started discovery chaos", "latency_ms", chaos.LatencyMS, "error_rate", chaos.ErrorRate, "empty", chaos.Empty)
+	case http.MethodDelete:
+		serviceDiscovery.SetChaos(discoveryChaos{})
+		slog.InfoContext(r.Context(), "Stopped discovery chaos")
+	default:
+		httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"mechanism": serviceDiscovery.discovery.Name(),
+		"chaos":     serviceDiscovery.Chaos(),
+		"endpoints": serviceDiscovery.Snapshot(),
+	})
+}
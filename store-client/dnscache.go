@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+var (
+	// Count cache lookups, by result.
+	dnsCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_dns_cache_lookups_total",
+			Help: "Total number of DNS cache lookups, by result (hit, miss or expired).",
+		},
+		[]string{"result"},
+	)
+
+	// Histogram of lookups that went to the resolver.
+	dnsResolveDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_dns_resolve_duration_seconds",
+			Help:    "Time lookups that missed the cache took to resolve in seconds, by outcome.",
+			Buckets: []float64{.0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 5},
+		},
+		[]string{"outcome"},
+	)
+
+	// Gauge of cached hosts.
+	dnsCacheEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_dns_cache_entries",
+			Help: "Number of hosts in the DNS cache.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(dnsCacheLookups, dnsResolveDuration, dnsCacheEntries)
+}
+
+// dnsCache resolves outbound hostnames through resolver and keeps the
+// answers for ttl. Go's resolver doesn't report record TTLs, so ttl is
+// configured instead; 0 turns caching off, so every new connection resolves.
+// Expiring the cache under load shows the latency a cold resolver adds to
+// connection setup.
+type dnsCache struct {
+	resolver   *net.Resolver
+	mu         sync.Mutex
+	ttl        time.Duration
+	configured time.Duration
+	entries    map[string]dnsEntry
+	transports []*http.Transport
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// dnsCaching is shared by every outbound transport.
+var dnsCaching = newDNSCache(net.DefaultResolver, 30*time.Second)
+
+func newDNSCache(resolver *net.Resolver, ttl time.Duration) *dnsCache {
+	return &dnsCache{resolver: resolver, ttl: ttl, configured: ttl, entries: map[string]dnsEntry{}}
+}
+
+// Configure sets the TTL to use, and to go back to after chaos.
+func (c *dnsCache) Configure(ttl time.Duration) {
+	c.mu.Lock()
+	c.configured = ttl
+	c.mu.Unlock()
+	c.SetTTL(ttl)
+}
+
+// Install makes t's dials resolve hostnames through the cache.
+func (c *dnsCache) Install(t *http.Transport) {
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		addrs, err := c.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		// Try each address in turn, like the dialer does
+		var errs []error
+		for _, ip := range addrs {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+		}
+		return nil, errors.Join(errs...)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.transports = append(c.transports, t)
+}
+
+// LookupHost returns host's addresses, from the cache if it has a fresh
+// answer, and otherwise from the resolver in a traced lookup. Failed
+// lookups aren't cached.
+func (c *dnsCache) LookupHost(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	ttl := c.ttl
+	c.mu.Unlock()
+
+	result := "miss"
+	if ok {
+		if time.Now().Before(entry.expires) {
+			dnsCacheLookups.WithLabelValues("hit").Inc()
+			return entry.addrs, nil
+		}
+		result = "expired"
+	}
+	dnsCacheLookups.WithLabelValues(result).Inc()
+
+	ctx, span := otel.Tracer("go.opentelemetry.io/dns").Start(ctx, "dns-lookup")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("dns.question.name", host),
+		attribute.String("dns.cache.result", result),
+	)
+
+	start := time.Now()
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err != nil {
+		dnsResolveDuration.WithLabelValues("error").Observe(time.Since(start).Seconds())
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	dnsResolveDuration.WithLabelValues("ok").Observe(time.Since(start).Seconds())
+	span.SetAttributes(attribute.StringSlice("dns.answers", addrs))
+
+	if ttl > 0 {
+		c.mu.Lock()
+		c.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(ttl)}
+		dnsCacheEntries.Set(float64(len(c.entries)))
+		c.mu.Unlock()
+	}
+	return addrs, nil
+}
+
+// Expire drops every cached answer, and the idle connections made with
+// them, so the next request to each host resolves again.
+func (c *dnsCache) Expire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+	dnsCacheEntries.Set(0)
+	for _, t := range c.transports {
+		t.CloseIdleConnections()
+	}
+}
+
+// SetTTL changes how long answers are kept, expiring the cache.
+func (c *dnsCache) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	c.ttl = ttl
+	c.mu.Unlock()
+	c.Expire()
+}
+
+// Restore goes back to the configured TTL.
+func (c *dnsCache) Restore() {
+	c.mu.Lock()
+	ttl := c.configured
+	c.mu.Unlock()
+	c.SetTTL(ttl)
+}
+
+func (c *dnsCache) TTL() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ttl
+}
+
+// dnsChaosHandler expires the DNS cache: POST expires it once, or with
+// ttl_ms changes the TTL, 0 turning caching off; DELETE goes back to the
+// configured TTL.
+func dnsChaosHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		v := r.URL.Query().Get("ttl_ms")
+		if v == "" {
+			dnsCaching.Expire()
+			slog.WarnContext(r.Context(), "Expired DNS cache")
+			break
+		}
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			httpError(w, r, fmt.Errorf("invalid ttl_ms %q", v), http.StatusBadRequest)
+			return
+		}
+		dnsCaching.SetTTL(time.Duration(ms) * time.Millisecond)
+		slog.WarnContext(r.Context(), "Changed DNS cache TTL", "ttl_ms", ms)
+	case http.MethodDelete:
+		dnsCaching.Restore()
+		slog.InfoContext(r.Context(), "Restored DNS cache TTL", "ttl_ms", dnsCaching.TTL().Milliseconds())
+	default:
+		httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"ttl_ms": dnsCaching.TTL().Milliseconds()})
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+)
+
+// instanceID tells this process apart from the service's other replicas.
+// It is set at startup, before anything is logged or exported, and goes on
+// the trace and metric resource (so target_info carries it), on every log
+// record and on the profiles.
+var instanceID string
+
+// newInstanceID returns INSTANCE_ID if it is set, or otherwise an ID made
+// from where the service runs: its host, container and listen address. The
+// same place gives the same ID across restarts, so dashboards keep
+// following one series, and replicas get different ones because docker
+// compose and Kubernetes give each its own hostname.
+func newInstanceID(config Config) string {
+	if config.instanceID != "" {
+		return config.instanceID
+	}
+	hostname, _ := os.Hostname()
+	sum := sha256.Sum256([]byte(strings.Join([]string{config.serviceName, hostname, containerID(), config.listenAddr}, "\x00")))
+	return config.serviceName + "-" + hex.EncodeToString(sum[:4])
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// infraHandler decorates another slog.Handler, stamping every record with
+// details about where the service is running (host, container, pod, region,
+// zone, version and instance). These are useful for demonstrating which
+// values belong as Loki labels versus plain log fields.
+type infraHandler struct {
+	slog.Handler
+}
+
+// newInfraHandler wraps next so that all records carry the infra context.
+// Values are resolved once at startup from the environment (or the
+// Kubernetes downward API, which surfaces as env vars), and empty ones are
+// skipped.
+func newInfraHandler(next slog.Handler, config Config) slog.Handler {
+	var attrs []slog.Attr
+	add := func(key, value string) {
+		if value != "" {
+			attrs = append(attrs, slog.String(key, value))
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	add("host", hostname)
+	add("container_id", containerID())
+	add("pod", os.Getenv("POD_NAME"))
+	add("namespace", os.Getenv("POD_NAMESPACE"))
+	add("region", config.region)
+	add("zone", config.zone)
+	add("service_version", config.serviceVersion)
+	add("instance_id", instanceID)
+
+	return &infraHandler{Handler: next.WithAttrs(attrs)}
+}
+
+func (h *infraHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &infraHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *infraHandler) WithGroup(name string) slog.Handler {
+	return &infraHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// containerID returns the ID of the container we are running in, if any.
+// CONTAINER_ID takes precedence, otherwise it is parsed out of the cgroup
+// path (cgroup v1 and docker's cgroup v2 layouts both end in the ID).
+func containerID() string {
+	if id := os.Getenv("CONTAINER_ID"); id != "" {
+		return id
+	}
+
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		path := scanner.Text()[strings.LastIndex(scanner.Text(), ":")+1:]
+		last := path[strings.LastIndex(path, "/")+1:]
+		last = strings.TrimSuffix(strings.TrimPrefix(last, "docker-"), ".scope")
+		if len(last) == 64 {
+			return last
+		}
+	}
+	return ""
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// logLevel is the level records are logged at, unless their route has an
+// override. It starts at LOG_LEVEL and /admin/loglevel changes it.
+var logLevel = new(slog.LevelVar)
+
+// logLevelDefault is LOG_LEVEL, which resetting the level goes back to.
+var logLevelDefault = slog.LevelInfo
+
+// logOverrides holds the per-route level overrides.
+var logOverrides = &levelOverrides{overrides: map[string]*levelOverride{}}
+
+// logOverrideTTL is how long an override lasts when no ttl is given, and
+// logOverrideMaxTTL the longest one may last, so a forgotten debug
+// override can't flood the logs for good.
+const (
+	logOverrideTTL    = 10 * time.Minute
+	logOverrideMaxTTL = 24 * time.Hour
+)
+
+// LevelOverride is a level that records from one route are logged at until
+// it expires.
+type LevelOverride struct {
+	Route   string     `json:"route"`
+	Level   slog.Level `json:"level"`
+	Expires time.Time  `json:"expires"`
+}
+
+type levelOverride struct {
+	LevelOverride
+	timer *time.Timer
+}
+
+// levelOverrides are per-route levels, each removed when it expires.
+type levelOverrides struct {
+	mu        sync.RWMutex
+	overrides map[string]*levelOverride
+}
+
+// Set overrides the level for route for ttl, replacing any override it
+// already has.
+func (o *levelOverrides) Set(route string, level slog.Level, ttl time.Duration) LevelOverride {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if previous, ok := o.overrides[route]; ok {
+		previous.timer.Stop()
+	}
+	override := &levelOverride{LevelOverride: LevelOverride{Route: route, Level: level, Expires: time.Now().Add(ttl)}}
+	override.timer = time.AfterFunc(ttl, func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		// Only if it wasn't replaced in the meantime
+		if o.overrides[route] == override {
+			delete(o.overrides, route)
+			slog.Info("Log level override expired", "route", route, "level", level)
+		}
+	})
+	o.overrides[route] = override
+	return override.LevelOverride
+}
+
+// Remove removes route's override, returning whether there was one.
+func (o *levelOverrides) Remove(route string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	override, ok := o.overrides[route]
+	if ok {
+		override.timer.Stop()
+		delete(o.overrides, route)
+	}
+	return ok
+}
+
+// Clear removes every override.
+func (o *levelOverrides) Clear() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for route, override := range o.overrides {
+		override.timer.Stop()
+		delete(o.overrides, route)
+	}
+}
+
+// Level returns route's overridden level, if it has one.
+func (o *levelOverrides) Level(route string) (slog.Level, bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	override, ok := o.overrides[route]
+	if !ok {
+		return 0, false
+	}
+	return override.Level, true
+}
+
+// List returns the overrides, ordered by route.
+func (o *levelOverrides) List() []LevelOverride {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	list := make([]LevelOverride, 0, len(o.overrides))
+	for _, override := range o.overrides {
+		list = append(list, override.LevelOverride)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Route < list[j].Route })
+	return list
+}
+
+// logRouteKey is the context key for the route a request's records are
+// logged under.
+type logRouteKey struct{}
+
+// logRoute puts the request's mux pattern in its context, so records logged
+// with the request context can be leveled by route.
+func logRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Pattern != "" {
+			r = r.WithContext(context.WithValue(r.Context(), logRouteKey{}, r.Pattern))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// levelHandler decides which records are logged: those at or above their
+// route's override, if their context carries a route with one, or else at
+// or above logLevel. The handler it wraps should let everything through.
+type levelHandler struct {
+	slog.Handler
+}
+
+func (h levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if route, ok := ctx.Value(logRouteKey{}).(string); ok {
+		if min, ok := logOverrides.Level(route); ok {
+			return level >= min
+		}
+	}
+	return level >= logLevel.Level()
+}
+
+func (h levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h levelHandler) WithGroup(name string) slog.Handler {
+	return levelHandler{h.Handler.WithGroup(name)}
+}
+
+// logLevelHandler shows the log level and route overrides on GET. POST
+// sets the level from the level query parameter (debug, info, warn or
+// error), or with route (a mux pattern, e.g. /products) overrides it for
+// that route's records only, for ttl (default 10m). DELETE with route
+// removes that override; without, it removes them all and puts back
+// LOG_LEVEL.
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	route := query.Get("route")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(query.Get("level"))); err != nil {
+			httpError(w, r, errors.New("level must be debug, info, warn or error"), http.StatusBadRequest)
+			return
+		}
+		if route == "" {
+			previous := logLevel.Level()
+			logLevel.Set(level)
+			slog.WarnContext(r.Context(), "Changed log level", "level", level, "previous", previous)
+			break
+		}
+		ttl := logOverrideTTL
+		if v := query.Get("ttl"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 || d > logOverrideMaxTTL {
+				httpError(w, r, errors.New("ttl must be a positive duration of at most 24h"), http.StatusBadRequest)
+				return
+			}
+			ttl = d
+		}
+		override := logOverrides.Set(route, level, ttl)
+		slog.WarnContext(r.Context(), "Overrode log level for route", "route", route, "level", level, "expires", override.Expires)
+	case http.MethodDelete:
+		if route != "" {
+			if !logOverrides.Remove(route) {
+				httpError(w, r, errors.New("route has no log level override"), http.StatusNotFound)
+				return
+			}
+			slog.WarnContext(r.Context(), "Removed log level override", "route", route)
+			break
+		}
+		logOverrides.Clear()
+		logLevel.Set(logLevelDefault)
+		slog.WarnContext(r.Context(), "Reset log level", "level", logLevelDefault)
+	default:
+		httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"level":     logLevel.Level(),
+		"overrides": logOverrides.List(),
+	})
+}
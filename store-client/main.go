@@ -6,26 +6,47 @@ import (
 	"net/http"
 	"time"
 	"os"
+	"path/filepath"
+	"runtime"
 	// "io"
-	"encoding/json"
-	"fmt"
 	"strconv"
 
 	"github.com/grafana/pyroscope-go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
 	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 
-
+	"store-client/pkg/flags"
+
+	"github.com/j6nca/o11y-playground/pkg/cgroup"
+	"github.com/j6nca/o11y-playground/pkg/clientpool"
+	"github.com/j6nca/o11y-playground/pkg/errreport"
+	"github.com/j6nca/o11y-playground/pkg/health"
+	"github.com/j6nca/o11y-playground/pkg/highres"
+	"github.com/j6nca/o11y-playground/pkg/listen"
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+	"github.com/j6nca/o11y-playground/pkg/model"
+	"github.com/j6nca/o11y-playground/pkg/overhead"
+	"github.com/j6nca/o11y-playground/pkg/priority"
+	"github.com/j6nca/o11y-playground/pkg/profiling"
+	"github.com/j6nca/o11y-playground/pkg/recorder"
+	"github.com/j6nca/o11y-playground/pkg/remotewrite"
+	"github.com/j6nca/o11y-playground/pkg/routelimit"
+	"github.com/j6nca/o11y-playground/pkg/routetimeout"
+	"github.com/j6nca/o11y-playground/pkg/servicegraph"
+	"github.com/j6nca/o11y-playground/pkg/spanaudit"
+	"github.com/j6nca/o11y-playground/pkg/telemetry"
+	"github.com/j6nca/o11y-playground/pkg/tracehints"
 )
 
 var (
@@ -60,21 +81,73 @@ var (
 type Config struct {
     serviceName string
     pyroscopeServer string
+    profilingMode string
+    pprofToken string
+    profileTypes string
+    profileMemRate int
+    profileMutexFraction int
+    profileBlockRate int
+    profileUploadInterval time.Duration
     tempoServer string
+    serviceVersion string
+    sentryDSN string
+    errorAggregatorURL string
+    spanLimits sdktrace.SpanLimits
+    spanAudit bool
+    sampleRatio float64
+    samplingComparison bool
+    latencyHighRes bool
+    overheadAccounting bool
+    payloadVerify bool
+    logLevel string
+    remoteWriteURL string
+    remoteWriteInterval time.Duration
+    remoteWriteUsername string
+    remoteWritePassword string
+    remoteWriteLabels string
+    remoteWriteWALDir string
+    remoteWriteWALMaxMB int
+    adminToken string
+    featureFlags string
 		apiServer  string
+    clientH2C bool
+    clientMaxIdlePerHost int
+    clientIdleTimeout time.Duration
+    clientDisableKeepAlives bool
+    dnsCacheTTL time.Duration
+    discovery string
+    discoveryStatic string
+    discoveryRefresh time.Duration
+    consulAddress string
+    productCacheTTL time.Duration
+    productCacheStale time.Duration
+    drainDelay time.Duration
+    drainTimeout time.Duration
+    healthInterval time.Duration
+    recordFile string
+    netChaosMode string
+    netChaosProbability float64
+    routeTimeouts string
+    maxConcurrentRequests int
+    priorityQueueSize int
+    routePriorities string
+    routeConcurrency string
+    listenAddr string
+    adminListenAddr string
+    unixSocketPath string
+    instanceID string
+    region string
+    zone string
 }
 
-// Product represents a product in our system.
-// This is needed to unmarshal the JSON response from the API service.
-type Product struct {
-	ID    int `json:"id"`
-	Name  string `json:"name"`
-	Price int    `json:"price"`
-}
+// Product represents a product in our system, as the API service encodes
+// it.
+type Product = model.Product
 
 func init() {
 	// Register the metrics with Prometheus's default registry.
 	prometheus.MustRegister(requestCount, requestLatency, workLevel)
+	prometheus.MustRegister(cgroup.NewCollector("/sys/fs/cgroup"))
 }
 
 func main() {
@@ -82,97 +155,338 @@ func main() {
 	config := Config{
 		serviceName: os.Getenv("OTEL_SERVICE_NAME"),
 		pyroscopeServer: os.Getenv("PYROSCOPE_SERVER_ADDRESS"),
+		profilingMode: envString("PROFILING_MODE", profiling.Push),
+		pprofToken: os.Getenv("PPROF_TOKEN"),
+		profileTypes: envString("PROFILE_TYPES", "cpu,alloc,inuse"),
+		profileMemRate: envInt("PROFILE_MEM_RATE_BYTES", runtime.MemProfileRate),
+		profileMutexFraction: envInt("PROFILE_MUTEX_FRACTION", 5),
+		profileBlockRate: envInt("PROFILE_BLOCK_RATE_NS", 10000),
+		profileUploadInterval: time.Duration(envInt("PROFILE_UPLOAD_INTERVAL_MS", 15000)) * time.Millisecond,
 		tempoServer: os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"),
+		serviceVersion: os.Getenv("SERVICE_VERSION"),
+		sentryDSN: os.Getenv("SENTRY_DSN"),
+		errorAggregatorURL: os.Getenv("ERROR_AGGREGATOR_URL"),
+		spanLimits: spanLimitsFromEnv(),
+		spanAudit: os.Getenv("SPAN_AUDIT") == "true",
+		sampleRatio: envFloat("TRACE_SAMPLE_RATIO", 1),
+		samplingComparison: os.Getenv("SAMPLING_COMPARISON") == "true",
+		latencyHighRes: os.Getenv("LATENCY_HIGHRES") == "true",
+		overheadAccounting: os.Getenv("INSTRUMENTATION_OVERHEAD") == "true",
+		payloadVerify: os.Getenv("PAYLOAD_VERIFY") == "true",
+		logLevel: envString("LOG_LEVEL", "info"),
+		remoteWriteURL: os.Getenv("REMOTE_WRITE_URL"),
+		remoteWriteInterval: time.Duration(envInt("REMOTE_WRITE_INTERVAL_MS", 15000)) * time.Millisecond,
+		remoteWriteUsername: os.Getenv("REMOTE_WRITE_USERNAME"),
+		remoteWritePassword: os.Getenv("REMOTE_WRITE_PASSWORD"),
+		remoteWriteLabels: os.Getenv("REMOTE_WRITE_LABELS"),
+		remoteWriteWALDir: envString("REMOTE_WRITE_WAL_DIR", filepath.Join(os.TempDir(), "remote-write-wal")),
+		remoteWriteWALMaxMB: envInt("REMOTE_WRITE_WAL_MAX_MB", 64),
+		adminToken: os.Getenv("ADMIN_TOKEN"),
+		featureFlags: os.Getenv("FEATURE_FLAGS"),
 		apiServer: os.Getenv("API_SERVER_ADDRESS"),
+		clientH2C: os.Getenv("HTTP_CLIENT_H2C") == "true",
+		clientMaxIdlePerHost: envInt("HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST", http.DefaultMaxIdleConnsPerHost),
+		clientIdleTimeout: time.Duration(envInt("HTTP_CLIENT_IDLE_CONN_TIMEOUT_MS", 90000)) * time.Millisecond,
+		clientDisableKeepAlives: os.Getenv("HTTP_CLIENT_DISABLE_KEEPALIVES") == "true",
+		dnsCacheTTL: time.Duration(envInt("DNS_CACHE_TTL_MS", 30000)) * time.Millisecond,
+		discovery: os.Getenv("DISCOVERY"),
+		discoveryStatic: os.Getenv("DISCOVERY_STATIC_ENDPOINTS"),
+		discoveryRefresh: time.Duration(envInt("DISCOVERY_REFRESH_MS", 10000)) * time.Millisecond,
+		consulAddress: envString("CONSUL_HTTP_ADDR", "http://consul:8500"),
+		productCacheTTL: time.Duration(envInt("PRODUCT_CACHE_TTL_MS", 0)) * time.Millisecond,
+		productCacheStale: time.Duration(envInt("PRODUCT_CACHE_STALE_MS", 30000)) * time.Millisecond,
+		drainDelay: time.Duration(envInt("DRAIN_DELAY_MS", 2000)) * time.Millisecond,
+		drainTimeout: time.Duration(envInt("DRAIN_TIMEOUT_MS", 5000)) * time.Millisecond,
+		healthInterval: time.Duration(envInt("HEALTH_CHECK_INTERVAL_MS", 15000)) * time.Millisecond,
+		recordFile: os.Getenv("RECORD_TRAFFIC_FILE"),
+		netChaosMode: os.Getenv("CHAOS_NETWORK_MODE"),
+		netChaosProbability: envFloat("CHAOS_NETWORK_PROBABILITY", 1),
+		routeTimeouts: os.Getenv("ROUTE_TIMEOUTS"),
+		maxConcurrentRequests: envInt("MAX_CONCURRENT_REQUESTS", 0),
+		priorityQueueSize: envInt("PRIORITY_QUEUE_SIZE", 100),
+		routePriorities: os.Getenv("ROUTE_PRIORITIES"),
+		routeConcurrency: os.Getenv("ROUTE_CONCURRENCY"),
+		listenAddr: envString("LISTEN_ADDR", ":8081"),
+		adminListenAddr: os.Getenv("ADMIN_LISTEN_ADDR"),
+		unixSocketPath: os.Getenv("UNIX_SOCKET_PATH"),
+		instanceID: os.Getenv("INSTANCE_ID"),
+		region: os.Getenv("REGION"),
+		zone: os.Getenv("ZONE"),
 	}
 
-	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		Level: slog.LevelInfo,
-	})))
+	// Tell this process apart from other replicas in every signal
+	instanceID = newInstanceID(config)
+
+	// Stamp every log record with host/container/pod/region details
+	slog.SetDefault(slog.New(newInfraHandler(levelHandler{slog.NewJSONHandler(telemetry.LogWriter(os.Stdout), &slog.HandlerOptions{
+		// levelHandler decides what is logged, by route
+		Level: slog.LevelDebug,
+	})}, config)))
+	if err := logLevelDefault.UnmarshalText([]byte(config.logLevel)); err != nil {
+		slog.Error("Ignoring invalid LOG_LEVEL:", logfields.Error(err))
+	}
+	logLevel.Set(logLevelDefault)
 
 	// Setup OpenTelemetry for tracing
 	shutdown := setupTracer(config)
 	defer shutdown()
 
-	// Setup Pyroscope for continuous profiling
+	// Setup OpenTelemetry metrics, exposed on /metrics beside our own
+	shutdownMeter := setupMeter(config)
+	defer shutdownMeter()
+
+	// Count the metric series this service exposes
+	go telemetry.CountSeries()
+
+	// Push metrics to a remote write endpoint too, if one is configured
+	if config.remoteWriteURL != "" {
+		labels, err := remotewrite.ParseLabels(config.remoteWriteLabels)
+		if err != nil {
+			slog.Error("Ignoring invalid REMOTE_WRITE_LABELS:", logfields.Error(err))
+			labels = map[string]string{}
+		}
+		// Stand in for the labels a scrape would have added
+		hostname, _ := os.Hostname()
+		for name, value := range map[string]string{"service_name": config.serviceName, "instance": hostname} {
+			if _, ok := labels[name]; !ok {
+				labels[name] = value
+			}
+		}
+		writer, err := remotewrite.New(config.remoteWriteURL, config.remoteWriteUsername, config.remoteWritePassword, labels,
+			config.remoteWriteInterval, config.remoteWriteWALDir, int64(config.remoteWriteWALMaxMB)<<20)
+		if err != nil {
+			slog.Error("Failed to start remote write:", logfields.Error(err))
+		} else {
+			writer.Client.Transport = telemetry.Uploads("metrics", http.DefaultTransport)
+			go writer.Run()
+		}
+	}
+
+	// Setup continuous profiling, pushed to Pyroscope or pulled from pprof
 	setupProfiler(config)
 
+	// Setup error reporting for exception tracking
+	setupErrorReporter(config)
+
+	// Record incoming traffic for replay, if asked to
+	if config.recordFile != "" {
+		if err := recorder.Start(config.recordFile, config.serviceName); err != nil {
+			slog.Error("Failed to start recording traffic:", logfields.Error(err))
+		}
+	}
+
+	// Observe latency in fine buckets too, if asked to
+	if config.latencyHighRes {
+		highres.Enable()
+	}
+
+	// Measure what the instrumentation itself costs, if asked to
+	if config.overheadAccounting {
+		overhead.Enable()
+		slog.SetDefault(slog.New(overhead.LogHandler{Handler: slog.Default().Handler()}))
+	}
+
+	// Admit requests by priority once MAX_CONCURRENT_REQUESTS are running
+	if config.maxConcurrentRequests > 0 {
+		priority.SetLimit(config.maxConcurrentRequests, config.priorityQueueSize)
+	}
+	if parsed, err := priority.Parse(config.routePriorities); err != nil {
+		slog.Error("Ignoring invalid ROUTE_PRIORITIES:", logfields.Error(err))
+	} else {
+		priority.Set(parsed)
+	}
+
+	// Per-route concurrency caps, so one busy endpoint can't starve the rest
+	if parsed, err := routelimit.Parse(config.routeConcurrency); err != nil {
+		slog.Error("Ignoring invalid ROUTE_CONCURRENCY:", logfields.Error(err))
+	} else {
+		routelimit.Set(parsed)
+	}
+
+	// Per-route handler timeouts
+	if parsed, err := routetimeout.Parse(config.routeTimeouts); err != nil {
+		slog.Error("Ignoring invalid ROUTE_TIMEOUTS:", logfields.Error(err))
+	} else {
+		routetimeout.Set(parsed)
+	}
+
 	// Logger setup for Loki
 	slog.Info("Starting Kitchen store app ...")
 
-	// Create an HTTP client that automatically adds tracing headers
-	client := http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+	// Connection pool settings for outbound clients
+	clientpool.Configure(clientpool.Tuning{
+		MaxIdleConnsPerHost: config.clientMaxIdlePerHost,
+		IdleConnTimeout:     config.clientIdleTimeout,
+		DisableKeepAlives:   config.clientDisableKeepAlives,
+	})
+	dnsCaching.Configure(config.dnsCacheTTL)
+
+	// Find store-api's endpoints through service discovery, if configured,
+	// rather than calling its configured address
+	if d, err := newDiscovery(config); err != nil {
+		slog.Error("Ignoring invalid DISCOVERY:", logfields.Error(err))
+	} else if d != nil {
+		serviceDiscovery = newDiscoverer(d, config.discoveryRefresh)
+	}
+
+	// Check what store-api returns is right, not just that it returned
+	payloadVerify = config.payloadVerify
+
+	// Cache products from store-api, serving stale ones while they refresh
+	productsCache.Configure(config.productCacheTTL, config.productCacheStale)
+
+	// Create an HTTP client that automatically adds tracing headers, over
+	// h2c if configured to
+	client := http.Client{Transport: newTransport("store-api", config.clientH2C)}
 
 	// Define HTTP handlers
-	http.Handle("/", otelhttp.NewHandler(
+	http.Handle("/", instrument(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
 			_, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "store-client-handler")
 			defer span.End()
 
-			slog.InfoContext(ctx, "Received request on root path", "path", r.URL.Path)
+			slog.InfoContext(ctx, "Received request on root path", logfields.Path(r.URL.Path))
 
-			requestCount.WithLabelValues(r.URL.Path, r.Method, strconv.Itoa(http.StatusOK)).Inc()
-			requestLatency.WithLabelValues(r.URL.Path).Observe(0) // Simplified latency for this example
+			requestCount.WithLabelValues(routeTarget(r), r.Method, strconv.Itoa(http.StatusOK)).Inc()
+			requestLatency.WithLabelValues(routeTarget(r)).Observe(0) // Simplified latency for this example
 
-			// Format the product data into a user-friendly response.
-			w.Header().Set("Content-Type", "text/html")
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprintf(w, "<html><body><h1>Welcome to the Kitchen store!</h1><p>")
-			fmt.Fprint(w, "<a href='/products'>View Our Products</a></p></body></html>")
+			renderPage(w, r, "home", nil)
 		}),
 		"store-client-handler-span",
 	))
 
-	http.Handle("/products", otelhttp.NewHandler(
+	http.Handle("/products", instrument(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
-			_, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "store-client-handler")
+			ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "store-client-handler")
 			defer span.End()
 
-			slog.InfoContext(ctx, "Received request on root path", "path", r.URL.Path)
+			slog.InfoContext(ctx, "Received request on root path", logfields.Path(r.URL.Path))
 
-			// Make a request to the first Go service, propagating the trace context
-			req, _ := http.NewRequestWithContext(ctx, "GET", config.apiServer, nil)
-			resp, err := client.Do(req)
+			// Make a request to the first Go service, propagating the trace
+			// context and sharing the call with identical concurrent requests
+			products, err := fetchProducts(ctx, &client, config, r.URL.RawQuery)
 			if err != nil {
-				slog.ErrorContext(ctx, "Failed to call store-api service", "error", err)
-				http.Error(w, "Failed to call store-api service", http.StatusInternalServerError)
-				return
-			}
-			defer resp.Body.Close()
-
-			slog.InfoContext(ctx, "Successfully called store-api service", "status_code", resp.StatusCode)
-
-			// Read and forward the response from the first service
-			var products []Product
-			if err := json.NewDecoder(resp.Body).Decode(&products); err != nil {
-				span.RecordError(err)
-				http.Error(w, fmt.Sprintf("Error decoding products JSON: %v", err), http.StatusInternalServerError)
+				httpError(w, r, err, http.StatusInternalServerError)
 				return
 			}
 
 			// Format the product data into a user-friendly response.
-			w.Header().Set("Content-Type", "text/html")
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprintf(w, "<html><body><h1>Our Products</h1><ul>")
-			for _, p := range products {
-				fmt.Fprintf(w, "<li><strong>%d</strong>: %s ($%d)</li>", p.ID, p.Name, p.Price)
+			if !renderPage(w, r, "products", products) {
+				return
 			}
-			fmt.Fprintf(w, "</ul></body></html>")
 
-			requestCount.WithLabelValues(r.URL.Path, r.Method, strconv.Itoa(http.StatusOK)).Inc()
-			requestLatency.WithLabelValues(r.URL.Path).Observe(0) // Simplified latency for this example
+			requestCount.WithLabelValues(routeTarget(r), r.Method, strconv.Itoa(http.StatusOK)).Inc()
+			requestLatency.WithLabelValues(routeTarget(r)).Observe(0) // Simplified latency for this example
 
 		}),
 		"store-client-handler-span",
 	))
 
+	// Product details, either N+1 calls or one batched call by feature flag
+	http.Handle("/products/detailed", instrument(
+		detailedProductsHandler(&client, config),
+		"detailed-products-handler-span",
+	))
+
+	// Feature flags, adjustable at runtime
+	adminToken = config.adminToken
+	flags.Load(config.featureFlags)
+	http.Handle("/admin/flags", instrument(
+		requireAdmin(flags.Handler()),
+		"flags-handler-span",
+	))
+
+	// Break outbound connections at the DNS, TLS or TCP layer
+	http.Handle("/admin/chaos/network", instrument(
+		requireAdmin(http.HandlerFunc(netChaosHandler)),
+		"network-chaos-handler-span",
+	))
+	if config.netChaosMode != "" {
+		if err := netFaults.Start(config.netChaosMode, config.netChaosProbability); err != nil {
+			slog.Error("Failed to start network chaos mode:", logfields.Error(err))
+		}
+	}
+
+	// Series per metric and label value, to find where cardinality comes from
+	http.Handle("/admin/metrics/cardinality", instrument(
+		requireAdmin(http.HandlerFunc(cardinalityHandler)),
+		"cardinality-handler-span",
+	))
+
+	// Expire the DNS cache, or turn it off, to see cold lookups in traces
+	http.Handle("/admin/chaos/dns", instrument(
+		requireAdmin(http.HandlerFunc(dnsChaosHandler)),
+		"dns-chaos-handler-span",
+	))
+
+	// Slow down, fail or empty service discovery's answers
+	http.Handle("/admin/chaos/discovery", instrument(
+		requireAdmin(http.HandlerFunc(discoveryChaosHandler)),
+		"discovery-chaos-handler-span",
+	))
+
+	// Warm up in the background, /readyz fails until this is done
+	go runStartup([]startupStep{
+		{name: "compile-templates", run: compileTemplates},
+		{name: "dial-store-api", run: func(ctx context.Context) error {
+			return dialStoreAPI(ctx, &client, apiBase(config.apiServer))
+		}},
+	})
+
+	// Check on our dependencies in the background
+	health.Register("trace-exporter", checkTraceExporter)
+	health.Register("store-api", func(ctx context.Context) error {
+		return checkStoreAPI(ctx, &client, apiBase(config.apiServer))
+	})
+	health.Start(config.healthInterval, 2*time.Second)
+	http.Handle("/healthz/dependencies", health.Handler())
+
+	// What the service is, where it listens and what it calls
+	http.Handle("/topology", instrument(
+		topologyHandler(newTopology(config)),
+		"topology-handler-span",
+	))
+
 	// Endpoint to get metrics
 	http.Handle("/metrics", promhttp.Handler())
 
-	slog.Info("Application is listening on port 8081...")
-	http.ListenAndServe(":8081", nil)
+	// Application state as JSON on /debug/vars
+	version := publishVars(config)
+
+	// The resolved configuration, secrets redacted, logged once and kept on
+	// /admin/config so what an instance runs with is always answerable
+	resolved := resolvedConfig(config)
+	slog.Info("Resolved configuration", "config_version", version, "config", resolved)
+	http.Handle("/admin/config", instrument(
+		requireAdmin(configHandler(resolved, version)),
+		"config-handler-span",
+	))
+
+	// The trace sampling ratio, changeable without a restart
+	http.Handle("/admin/sampling", instrument(
+		requireAdmin(http.HandlerFunc(samplingHandler)),
+		"sampling-handler-span",
+	))
+
+	// The log level, and per-route overrides that expire on their own
+	http.Handle("/admin/loglevel", instrument(
+		requireAdmin(http.HandlerFunc(logLevelHandler)),
+		"loglevel-handler-span",
+	))
+
+	// Readiness, which fails once the service starts draining
+	http.HandleFunc("/readyz", readyzHandler)
+
+	// The app port, plus an admin port and Unix socket if configured, pprof
+	// asking for PPROF_TOKEN on all of them
+	listeners, err := listen.Open(config.listenAddr, config.adminListenAddr, config.unixSocketPath, profiling.RequireToken(config.pprofToken, httpError)(http.DefaultServeMux))
+	if err != nil {
+		slog.Error("Failed to listen:", logfields.Error(err))
+		return
+	}
+	serve(listeners, config.drainDelay, config.drainTimeout)
 }
 
 func setupTracer(config Config) func() {
@@ -183,53 +497,201 @@ func setupTracer(config Config) func() {
 	conn, err := grpc.DialContext(ctx, config.tempoServer,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
 		grpc.WithBlock(),
+		grpc.WithStatsHandler(telemetry.StatsHandler("traces")),
 	)
 	if err != nil {
-		slog.Error("Failed to create gRPC connection to Tempo:", "error", err)
+		slog.Error("Failed to create gRPC connection to Tempo:", logfields.Error(err))
 		return func() {}
 	}
+	traceConn = conn
 
 	// Create a new OTLP gRPC exporter
 	traceExporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(conn))
 	if err != nil {
-		slog.Error("Failed to create a new OTLP exporter:", "error", err)
+		slog.Error("Failed to create a new OTLP exporter:", logfields.Error(err))
 		return func() {}
 	}
 
 	// Create a new tracer provider with the exporter
-	tp := sdktrace.NewTracerProvider(
+	slog.Info("Applying span limits", "attributes", config.spanLimits.AttributeCountLimit,
+		"attribute_length", config.spanLimits.AttributeValueLengthLimit,
+		"events", config.spanLimits.EventCountLimit, "links", config.spanLimits.LinkCountLimit)
+	options := []sdktrace.TracerProviderOption{
 		sdktrace.WithBatcher(traceExporter),
-		sdktrace.WithResource(resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceName(config.serviceName),
-			attribute.String("application", config.serviceName),
-		)),
-	)
+		sdktrace.WithSpanProcessor(servicegraph.NewProcessor(config.serviceName)),
+		sdktrace.WithSpanProcessor(telemetry.SpanProcessor()),
+		sdktrace.WithRawSpanLimits(config.spanLimits),
+		sdktrace.WithResource(newResource(config)),
+	}
+	// Check spans against the instrumentation conventions, in dev mode
+	if config.spanAudit {
+		slog.Info("Auditing spans against instrumentation conventions")
+		options = append(options, sdktrace.WithSpanProcessor(spanaudit.NewProcessor()))
+	}
+	// Sample, if asked to, and count what sampling loses in comparison mode.
+	// The sampler is always set, so /admin/sampling can change the ratio
+	if config.sampleRatio < 1 || config.samplingComparison {
+		slog.Info("Sampling traces", "ratio", config.sampleRatio, "comparison", config.samplingComparison)
+	}
+	options = append(options, sdktrace.WithSampler(newSampler(config.sampleRatio, config.samplingComparison)))
+	if config.samplingComparison {
+		options = append(options, sdktrace.WithSpanProcessor(samplingProcessor{}))
+	}
+	tp := sdktrace.NewTracerProvider(options...)
 	otel.SetTracerProvider(tp)
-	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}, tracehints.Propagator{}))
 
 	return func() {
 		ctx, cancel := context.WithTimeout(ctx, time.Second)
 		defer cancel()
 		if err := tp.Shutdown(ctx); err != nil {
-			slog.Error("Failed to shutdown tracer provider:", "error", err)
+			slog.Error("Failed to shutdown tracer provider:", logfields.Error(err))
+		}
+	}
+}
+
+// setupMeter registers an OpenTelemetry meter provider whose metrics are
+// exported through the default Prometheus registry. otelhttp picks this up to
+// emit the semconv HTTP metrics (http_server_request_duration_seconds etc.)
+// alongside our hand-rolled go_app_* ones.
+func setupMeter(config Config) func() {
+	exporter, err := otelprom.New()
+	if err != nil {
+		slog.Error("Failed to create Prometheus metrics exporter:", logfields.Error(err))
+		return func() {}
+	}
+
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(exporter),
+		sdkmetric.WithResource(newResource(config)),
+	)
+	otel.SetMeterProvider(mp)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := mp.Shutdown(ctx); err != nil {
+			slog.Error("Failed to shutdown meter provider:", logfields.Error(err))
 		}
 	}
 }
 
+// newResource describes this service for all telemetry signals.
+func newResource(config Config) *resource.Resource {
+	attrs := []attribute.KeyValue{
+		semconv.ServiceName(config.serviceName),
+		semconv.ServiceInstanceID(instanceID),
+		attribute.String("application", config.serviceName),
+	}
+	// The simulated failure domain, for slicing by region and zone
+	if config.region != "" {
+		attrs = append(attrs, semconv.CloudRegion(config.region))
+	}
+	if config.zone != "" {
+		attrs = append(attrs, semconv.CloudAvailabilityZone(config.zone))
+	}
+	return resource.NewWithAttributes(semconv.SchemaURL, attrs...)
+}
+
+// spanLimitsFromEnv reads the span limits using the standard OTel env var
+// names. Unlike the SDK defaults, attribute values are capped at 1024
+// characters so truncation is easy to observe.
+func spanLimitsFromEnv() sdktrace.SpanLimits {
+	return sdktrace.SpanLimits{
+		AttributeCountLimit:         envInt("OTEL_SPAN_ATTRIBUTE_COUNT_LIMIT", sdktrace.DefaultAttributeCountLimit),
+		AttributeValueLengthLimit:   envInt("OTEL_SPAN_ATTRIBUTE_VALUE_LENGTH_LIMIT", 1024),
+		EventCountLimit:             envInt("OTEL_SPAN_EVENT_COUNT_LIMIT", sdktrace.DefaultEventCountLimit),
+		LinkCountLimit:              envInt("OTEL_SPAN_LINK_COUNT_LIMIT", sdktrace.DefaultLinkCountLimit),
+		AttributePerEventCountLimit: envInt("OTEL_EVENT_ATTRIBUTE_COUNT_LIMIT", sdktrace.DefaultAttributePerEventCountLimit),
+		AttributePerLinkCountLimit:  envInt("OTEL_LINK_ATTRIBUTE_COUNT_LIMIT", sdktrace.DefaultAttributePerLinkCountLimit),
+	}
+}
+
+// envInt returns the integer value of an env var, or def if it is unset or
+// not a number.
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// envFloat returns the float value of an env var, or def if it is unset or
+// not a number.
+func envFloat(key string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// envString returns the value of an env var, or def if it is unset.
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
 func setupProfiler(config Config) {
-	slog.Info("Setting up profiler with config", "config", config.pyroscopeServer)
-	_, err := pyroscope.Start(pyroscope.Config{
+	mode, err := profiling.ParseMode(config.profilingMode)
+	if err != nil {
+		slog.Error("Ignoring invalid PROFILING_MODE:", logfields.Error(err))
+		mode = profiling.Push
+	}
+	profiling.SetMode(mode)
+	enabled, err := profiling.ParseTypes(config.profileTypes)
+	if err != nil {
+		slog.Error("Ignoring invalid PROFILE_TYPES:", logfields.Error(err))
+		enabled, _ = profiling.ParseTypes("cpu,alloc,inuse")
+	}
+	// Sample only what is collected; the mutex profile shows contention on
+	// locks like the product cache's
+	types := profiling.Apply(enabled, profiling.Rates{
+		MemBytes:      config.profileMemRate,
+		MutexFraction: config.profileMutexFraction,
+		BlockNanos:    config.profileBlockRate,
+	})
+	if mode == profiling.Pull {
+		// Alloy scrapes /debug/pprof/ instead
+		slog.Info("Serving profiles for scraping", "mode", mode, logfields.Path("/debug/pprof/"), "token_required", config.pprofToken != "")
+		return
+	}
+	if len(types) == 0 {
+		slog.Info("Not profiling, PROFILE_TYPES is empty")
+		return
+	}
+	slog.Info("Setting up profiler with config", "config", config.pyroscopeServer, "profile_types", types)
+	_, err = pyroscope.Start(pyroscope.Config{
 		ApplicationName: config.serviceName,
 		ServerAddress:   config.pyroscopeServer, // Pyroscope address from docker-compose.yml
 		Logger:          pyroscope.StandardLogger,
+		HTTPClient:      telemetry.ProfileClient(),
+		ProfileTypes:    types,
+		UploadRate:      config.profileUploadInterval,
 		// Example tags for profiling data
 		Tags: map[string]string{
-			"environment": "workshop",
-			"service":     config.serviceName,
+			"environment":    "workshop",
+			"service":        config.serviceName,
+			"instance_id":    instanceID,
+			"region":         config.region,
+			"zone":           config.zone,
+			"profiling_mode": mode,
 		},
 	})
 	if err != nil {
-		slog.Error("Failed to start Pyroscope profiler:", "error", err)
+		slog.Error("Failed to start Pyroscope profiler:", logfields.Error(err))
+	}
+}
+
+func setupErrorReporter(config Config) {
+	transport, err := errreport.NewTransport(config.sentryDSN, config.errorAggregatorURL)
+	if err != nil {
+		slog.Error("Failed to setup error reporter:", logfields.Error(err))
+		return
 	}
+	// Report each distinct error at most 10 times a minute
+	errorReporter = errreport.New(config.serviceName, transport, 10, time.Minute)
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// Counter of outbound connections broken by the network chaos mode.
+	networkFaults = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_network_faults_injected_total",
+			Help: "Outbound connections broken by the network chaos mode, by mode.",
+		},
+		[]string{"mode"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(networkFaults)
+}
+
+// Network chaos modes, each failing the way a real network problem would so
+// the error, the span and the httptrace events all look authentic.
+const (
+	// dnsFailure resolves through a resolver that cannot reach any DNS
+	// server, so lookups fail with a *net.DNSError.
+	dnsFailure = "dns"
+	// tlsFailure attempts a TLS handshake with a server that does not speak
+	// TLS, so it fails with a genuine handshake error.
+	tlsFailure = "tls"
+	// connReset aborts the connection once the request is written, so the
+	// response read fails with ECONNRESET and the server sees a RST.
+	connReset = "reset"
+)
+
+// netChaos breaks a fraction of the outbound connections made by the
+// transports it is installed on.
+type netChaos struct {
+	mu          sync.Mutex
+	mode        string
+	probability float64
+	transports  []*http.Transport
+}
+
+var netFaults = &netChaos{}
+
+// Install routes t's dials through the chaos mode.
+func (n *netChaos) Install(t *http.Transport) {
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return n.dial(ctx, dial, network, addr)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.transports = append(n.transports, t)
+}
+
+// Start breaks probability of new outbound connections in the given mode.
+// Idle connections are dropped so the mode applies straight away rather
+// than once the pool turns over.
+func (n *netChaos) Start(mode string, probability float64) error {
+	switch mode {
+	case dnsFailure, tlsFailure, connReset:
+	default:
+		return fmt.Errorf("unknown mode %q, want dns, tls or reset", mode)
+	}
+	if probability <= 0 || probability > 1 {
+		return errors.New("probability must be above 0 and at most 1")
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.mode, n.probability = mode, probability
+	for _, t := range n.transports {
+		t.CloseIdleConnections()
+	}
+	slog.Warn("Started breaking outbound connections", "mode", mode, "probability", probability)
+	return nil
+}
+
+// Stop lets outbound connections through untouched again.
+func (n *netChaos) Stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.mode, n.probability = "", 0
+	slog.Info("Stopped breaking outbound connections")
+}
+
+// current returns the mode to apply to a new connection, or "" to leave it
+// alone.
+func (n *netChaos) current() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.mode == "" || rand.Float64() >= n.probability {
+		return ""
+	}
+	return n.mode
+}
+
+func (n *netChaos) dial(ctx context.Context, dial func(context.Context, string, string) (net.Conn, error), network, addr string) (net.Conn, error) {
+	mode := n.current()
+	if mode == "" {
+		return dial(ctx, network, addr)
+	}
+	networkFaults.WithLabelValues(mode).Inc()
+	trace.SpanFromContext(ctx).AddEvent("chaos-network-fault", trace.WithAttributes(
+		attribute.String("chaos.mode", mode),
+		attribute.String("net.peer.address", addr),
+	))
+
+	switch mode {
+	case dnsFailure:
+		// A resolver with nowhere to send its queries; the lookup still goes
+		// through the real code path, so DNS start and done are traced
+		dialer := &net.Dialer{Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+			},
+		}}
+		return dialer.DialContext(ctx, network, addr)
+
+	case tlsFailure:
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		err = tls.Client(conn, &tls.Config{ServerName: host}).HandshakeContext(ctx)
+		conn.Close()
+		if err == nil {
+			err = errors.New("tls: handshake unexpectedly succeeded")
+		}
+		return nil, err
+
+	default: // connReset
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &resettingConn{Conn: conn}, nil
+	}
+}
+
+// resettingConn lets the request be written, then aborts the connection
+// with a RST instead of reading the response.
+type resettingConn struct {
+	net.Conn
+}
+
+func (c *resettingConn) Read(p []byte) (int, error) {
+	if tcp, ok := c.Conn.(*net.TCPConn); ok {
+		// Zero linger makes Close send a RST rather than a FIN
+		tcp.SetLinger(0)
+	}
+	c.Conn.Close()
+	return 0, &net.OpError{
+		Op:     "read",
+		Net:    c.LocalAddr().Network(),
+		Source: c.LocalAddr(),
+		Addr:   c.RemoteAddr(),
+		Err:    os.NewSyscallError("read", syscall.ECONNRESET),
+	}
+}
+
+// netChaosHandler controls the network chaos mode: POST starts it with the
+// mode (dns, tls or reset) and probability (default 1) query parameters,
+// DELETE stops it.
+func netChaosHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		probability := 1.0
+		if v := r.URL.Query().Get("probability"); v != "" {
+			p, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				httpError(w, r, fmt.Errorf("invalid probability: %w", err), http.StatusBadRequest)
+				return
+			}
+			probability = p
+		}
+		if err := netFaults.Start(r.URL.Query().Get("mode"), probability); err != nil {
+			httpError(w, r, err, http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		netFaults.Stop()
+	default:
+		httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	netFaults.mu.Lock()
+	mode, probability := netFaults.mode, netFaults.probability
+	netFaults.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"mode": mode, "probability": probability})
+}
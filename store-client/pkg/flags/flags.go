@@ -0,0 +1,104 @@
+// Package flags is a tiny runtime feature flag store. Flags are seeded from
+// an env var and can be flipped while the service runs, with the current
+// state exported as a metric so flag changes line up with their effects on
+// dashboards.
+package flags
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Gauge of each flag's state, 1 when enabled.
+	flagEnabled = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "feature_flag_enabled",
+			Help: "Whether a feature flag is enabled (1) or not (0).",
+		},
+		[]string{"flag"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(flagEnabled)
+}
+
+var (
+	mu    sync.RWMutex
+	flags = map[string]bool{}
+)
+
+// Load seeds flags from a comma separated list like "a=true,b=false". A
+// bare name is taken as enabled.
+func Load(spec string) {
+	for _, entry := range strings.Split(spec, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if name == "" {
+			continue
+		}
+		enabled := true
+		if found {
+			enabled, _ = strconv.ParseBool(value)
+		}
+		Set(name, enabled)
+	}
+}
+
+// Enabled reports whether the named flag is on. Unknown flags are off.
+func Enabled(name string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return flags[name]
+}
+
+// Set turns the named flag on or off.
+func Set(name string, enabled bool) {
+	mu.Lock()
+	flags[name] = enabled
+	mu.Unlock()
+
+	value := 0.0
+	if enabled {
+		value = 1
+	}
+	flagEnabled.WithLabelValues(name).Set(value)
+	slog.Info("Feature flag changed", "flag", name, "enabled", enabled)
+}
+
+// Snapshot returns a copy of every flag's current state.
+func Snapshot() map[string]bool {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	snapshot := make(map[string]bool, len(flags))
+	for name, enabled := range flags {
+		snapshot[name] = enabled
+	}
+	return snapshot
+}
+
+// Handler lists flags on GET and sets one on POST/PUT, using the name and
+// enabled query parameters.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost || r.Method == http.MethodPut {
+			name := r.URL.Query().Get("name")
+			enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+			if name == "" || err != nil {
+				http.Error(w, "name and enabled=true|false are required", http.StatusBadRequest)
+				return
+			}
+			Set(name, enabled)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Snapshot())
+	})
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Count product cache lookups, by result.
+	productCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_product_cache_lookups_total",
+			Help: "Total number of product cache lookups, by result: fresh (served as is), stale (served while it refreshes) or miss (fetched before responding).",
+		},
+		[]string{"result"},
+	)
+
+	// Count background refreshes of stale entries, by outcome.
+	productCacheRefreshes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_product_cache_refreshes_total",
+			Help: "Total number of background refreshes of stale product cache entries, by outcome (ok or error).",
+		},
+		[]string{"outcome"},
+	)
+
+	// Histogram of how old the products served from the cache were.
+	productCacheAge = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "go_app_product_cache_served_age_seconds",
+			Help:    "Age of the products served from the cache in seconds, fresh or stale.",
+			Buckets: []float64{.5, 1, 2.5, 5, 10, 15, 30, 60, 120, 300},
+		},
+	)
+
+	// Count entries evicted to make room for new queries, by reason.
+	productCacheEvictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_product_cache_evictions_total",
+			Help: "Total number of product cache entries evicted to make room for a new query, by reason: expired or oldest.",
+		},
+		[]string{"reason"},
+	)
+
+	// Gauge of cached queries.
+	productCacheEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_product_cache_entries",
+			Help: "Number of product queries in the cache.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(productCacheLookups, productCacheRefreshes, productCacheAge, productCacheEvictions, productCacheEntries)
+}
+
+// maxProductCacheEntries bounds the cache. Entries are keyed by query
+// string, which callers choose, so beyond this a new query evicts an older
+// one.
+const maxProductCacheEntries = 1000
+
+// productCache keeps store-api's products with stale-while-revalidate
+// semantics: for ttl an entry is fresh and served as is; for stale after
+// that it is still served, but the first request to see it stale starts a
+// refresh in the background; after that it is fetched again before
+// responding. A ttl of 0 turns the cache off.
+type productCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	stale   time.Duration
+	entries map[string]*productCacheEntry
+}
+
+type productCacheEntry struct {
+	products   []Product
+	fetched    time.Time
+	refreshing bool
+}
+
+var productsCache = &productCache{entries: map[string]*productCacheEntry{}}
+
+// Configure sets how long entries are fresh and then stale, dropping any
+// cached already.
+func (c *productCache) Configure(ttl, stale time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl, c.stale = ttl, stale
+	clear(c.entries)
+	productCacheEntries.Set(0)
+}
+
+// Get returns the products for query, from the cache when it has them and
+// otherwise from load.
+func (c *productCache) Get(ctx context.Context, query string, load func(context.Context) ([]Product, error)) ([]Product, error) {
+	c.mu.Lock()
+	if c.ttl <= 0 {
+		c.mu.Unlock()
+		return load(ctx)
+	}
+	entry, ok := c.entries[query]
+	if ok {
+		age := time.Since(entry.fetched)
+		switch {
+		case age < c.ttl:
+			c.mu.Unlock()
+			c.served(ctx, "fresh", age)
+			return entry.products, nil
+		case age < c.ttl+c.stale:
+			if !entry.refreshing {
+				entry.refreshing = true
+				go c.refresh(ctx, query, load)
+			}
+			c.mu.Unlock()
+			c.served(ctx, "stale", age)
+			return entry.products, nil
+		}
+	}
+	c.mu.Unlock()
+
+	productCacheLookups.WithLabelValues("miss").Inc()
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("product_cache.result", "miss"))
+	fetched, err := load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.store(query, fetched)
+	return fetched, nil
+}
+
+// served records an entry of age being served.
+func (c *productCache) served(ctx context.Context, result string, age time.Duration) {
+	productCacheLookups.WithLabelValues(result).Inc()
+	productCacheAge.Observe(age.Seconds())
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("product_cache.result", result),
+		attribute.Int64("product_cache.age_ms", age.Milliseconds()),
+	)
+}
+
+func (c *productCache) store(query string, fetched []Product) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[query]; !ok && len(c.entries) >= maxProductCacheEntries {
+		c.evict()
+	}
+	c.entries[query] = &productCacheEntry{products: fetched, fetched: time.Now()}
+	productCacheEntries.Set(float64(len(c.entries)))
+}
+
+// evict makes room for a new entry by dropping the ones too old to serve,
+// or the oldest if every one can still be served. The caller must hold mu.
+func (c *productCache) evict() {
+	var oldest string
+	var oldestFetched time.Time
+	expired := 0
+	for query, entry := range c.entries {
+		if time.Since(entry.fetched) >= c.ttl+c.stale {
+			delete(c.entries, query)
+			expired++
+		} else if oldest == "" || entry.fetched.Before(oldestFetched) {
+			oldest, oldestFetched = query, entry.fetched
+		}
+	}
+	if expired > 0 {
+		productCacheEvictions.WithLabelValues("expired").Add(float64(expired))
+		return
+	}
+	delete(c.entries, oldest)
+	productCacheEvictions.WithLabelValues("oldest").Inc()
+}
+
+// refresh fetches query's products again in the background. It gets a trace
+// of its own, linked to the request that found the entry stale, since that
+// request doesn't wait for it. If the refresh fails the stale entry stays,
+// and the next request to see it tries again.
+func (c *productCache) refresh(ctx context.Context, query string, load func(context.Context) ([]Product, error)) {
+	ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(context.WithoutCancel(ctx), "product-cache-refresh",
+		trace.WithNewRoot(),
+		trace.WithLinks(trace.LinkFromContext(ctx)),
+	)
+	defer span.End()
+
+	fetched, err := load(ctx)
+	if err != nil {
+		productCacheRefreshes.WithLabelValues("error").Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.WarnContext(ctx, "Failed to refresh cached products, serving stale ones", logfields.PeerService("store-api"), logfields.Error(err))
+		c.mu.Lock()
+		if entry, ok := c.entries[query]; ok {
+			entry.refreshing = false
+		}
+		c.mu.Unlock()
+		return
+	}
+	productCacheRefreshes.WithLabelValues("ok").Inc()
+	c.store(query, fetched)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Count product fetches, by whether the store-api call behind them was
+	// shared with other concurrent fetches.
+	productFetches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_product_fetches_total",
+			Help: "Total number of product fetches, by whether their store-api call was shared between callers.",
+		},
+		[]string{"shared"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(productFetches)
+}
+
+// productGroup deduplicates concurrent product fetches. During a loadgen
+// spike many requests ask store-api for the same thing at once; only one of
+// them makes the call and the rest wait for its answer.
+var productGroup singleflight.Group
+
+// fetchProducts gets the products for query, from the product cache if it
+// is on and otherwise from store-api, and verifies them.
+func fetchProducts(ctx context.Context, client *http.Client, config Config, query string) ([]Product, error) {
+	products, err := productsCache.Get(ctx, query, func(ctx context.Context) ([]Product, error) {
+		return loadProducts(ctx, client, config, query)
+	})
+	if err != nil {
+		return nil, err
+	}
+	verifyProducts(ctx, "products", products, nil)
+	return products, nil
+}
+
+// loadProducts gets the products for query from store-api, joining an
+// in-flight call for the same query if there is one. The shared call is not
+// cancelled with the request that started it, so one impatient client can't
+// fail everyone waiting on it.
+func loadProducts(ctx context.Context, client *http.Client, config Config, query string) ([]Product, error) {
+	url := config.apiServer
+	if query != "" {
+		url += "?" + query
+	}
+
+	v, err, shared := productGroup.Do(query, func() (any, error) {
+		req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Caller", config.serviceName)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to call store-api service: %w", err)
+		}
+		defer resp.Body.Close()
+
+		slog.InfoContext(ctx, "Successfully called store-api service", logfields.PeerService("store-api"), logfields.StatusCode(resp.StatusCode))
+
+		return decodeProducts(ctx, resp)
+	})
+
+	productFetches.WithLabelValues(strconv.FormatBool(shared)).Inc()
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("singleflight.shared", shared))
+	if err != nil {
+		return nil, err
+	}
+	return v.([]Product), nil
+}
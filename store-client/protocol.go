@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+
+	"github.com/j6nca/o11y-playground/pkg/clientpool"
+)
+
+// newServer returns a server for handler that speaks HTTP/1.1 and, for clients
+// that know to ask for it, unencrypted HTTP/2 (h2c). Serving both lets the
+// same load be replayed over either protocol and compared.
+func newServer(handler http.Handler) *http.Server {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Server{Handler: handler, Protocols: &protocols}
+}
+
+// newTransport returns a traced transport that talks h2c when h2c is set,
+// and plain HTTP/1.1 otherwise, with the configured pool settings and pool
+// statistics labelled client. Connection setup (DNS, connect, TLS) gets
+// its own child spans, hostnames resolve through the DNS cache, dials go
+// through the network chaos mode, and requests go to the endpoints service
+// discovery finds for client when it is on.
+func newTransport(client string, h2c bool) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if h2c {
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+	clientpool.Apply(transport)
+	dnsCaching.Install(transport)
+	netFaults.Install(transport)
+	return otelhttp.NewTransport(discoveryTransport{service: client, next: clientpool.Track(client, transport)}, otelhttp.WithClientTrace(func(ctx context.Context) *httptrace.ClientTrace {
+		return otelhttptrace.NewClientTrace(ctx)
+	}))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+var (
+	// Count traces started here, by root span and whether they were
+	// sampled.
+	samplingTraces = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_sampling_traces_total",
+			Help: "Total number of traces (or parts of traces) rooted in this service in sampling comparison mode, by root span name and whether they were sampled.",
+		},
+		[]string{"route", "sampled"},
+	)
+
+	// Count every span, by whether it was sampled.
+	samplingSpans = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_sampling_spans_total",
+			Help: "Total number of spans ended in sampling comparison mode, by whether they were sampled.",
+		},
+		[]string{"sampled"},
+	)
+
+	// Gauge of the head sampling ratio.
+	samplingRatio = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "go_app_sampling_ratio",
+			Help: "Ratio of the traces started here that are sampled.",
+		},
+	)
+
+	// Count changes to the sampling ratio.
+	samplingRatioChanges = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "go_app_sampling_ratio_changes_total",
+			Help: "Total number of times the sampling ratio was changed at runtime.",
+		},
+	)
+
+	// Count error spans sampling threw away.
+	samplingErrorsLost = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "go_app_sampling_error_spans_lost_total",
+			Help: "Total number of spans with an error status that were not sampled, in sampling comparison mode.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(samplingTraces, samplingSpans, samplingErrorsLost, samplingRatio, samplingRatioChanges)
+}
+
+// newSampler returns a head sampler keeping ratio of the traces that start
+// here, and following the caller's decision for the rest. The ratio can be
+// changed while running, through sampleRatio. In comparison mode the
+// traces it would drop are recorded anyway, so the counting processor sees
+// them; only sampled spans are exported either way.
+func newSampler(ratio float64, comparison bool) sdktrace.Sampler {
+	sampleRatio.initial = ratio
+	sampleRatio.Set(ratio)
+	sampler := sdktrace.ParentBased(sampleRatio)
+	if comparison {
+		return comparisonSampler{sampler}
+	}
+	return sampler
+}
+
+// sampleRatio is the root sampler, whose ratio /admin/sampling changes.
+var sampleRatio = &dynamicRatioSampler{}
+
+// dynamicRatioSampler samples a ratio of traces by trace ID, like
+// TraceIDRatioBased, but with a ratio that can be swapped without
+// rebuilding the tracer provider. Each decision reads the current sampler
+// atomically, so a change applies from the next trace.
+type dynamicRatioSampler struct {
+	current atomic.Pointer[ratioSampler]
+	initial float64
+}
+
+type ratioSampler struct {
+	ratio   float64
+	sampler sdktrace.Sampler
+}
+
+// Set changes the ratio, returning the previous one.
+func (s *dynamicRatioSampler) Set(ratio float64) float64 {
+	previous := s.current.Swap(&ratioSampler{ratio: ratio, sampler: sdktrace.TraceIDRatioBased(ratio)})
+	samplingRatio.Set(ratio)
+	if previous == nil {
+		return ratio
+	}
+	return previous.ratio
+}
+
+// Ratio returns the current ratio.
+func (s *dynamicRatioSampler) Ratio() float64 {
+	if current := s.current.Load(); current != nil {
+		return current.ratio
+	}
+	return 1
+}
+
+func (s *dynamicRatioSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	current := s.current.Load()
+	if current == nil {
+		return sdktrace.AlwaysSample().ShouldSample(p)
+	}
+	return current.sampler.ShouldSample(p)
+}
+
+func (s *dynamicRatioSampler) Description() string {
+	if current := s.current.Load(); current != nil {
+		return "Dynamic{" + current.sampler.Description() + "}"
+	}
+	return "Dynamic{AlwaysOnSampler}"
+}
+
+// comparisonSampler records what its sampler would drop, without sampling
+// it.
+type comparisonSampler struct {
+	sdktrace.Sampler
+}
+
+func (s comparisonSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	result := s.Sampler.ShouldSample(p)
+	if result.Decision == sdktrace.Drop {
+		result.Decision = sdktrace.RecordOnly
+	}
+	return result
+}
+
+func (s comparisonSampler) Description() string {
+	return "Comparison{" + s.Sampler.Description() + "}"
+}
+
+// samplingProcessor counts every span against the ones sampled, making what
+// head sampling loses measurable: the sampled share of each route's traces,
+// and the errors that never reach Tempo. Routes are the names of the spans
+// that start each trace here, which instrument keeps low-cardinality.
+type samplingProcessor struct{}
+
+func (samplingProcessor) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+
+func (samplingProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	sampled := s.SpanContext().IsSampled()
+	label := strconv.FormatBool(sampled)
+	samplingSpans.WithLabelValues(label).Inc()
+	if !sampled && s.Status().Code == codes.Error {
+		samplingErrorsLost.Inc()
+	}
+	if parent := s.Parent(); !parent.IsValid() || parent.IsRemote() {
+		samplingTraces.WithLabelValues(s.Name(), label).Inc()
+	}
+}
+
+func (samplingProcessor) Shutdown(context.Context) error   { return nil }
+func (samplingProcessor) ForceFlush(context.Context) error { return nil }
+
+// samplingHandler shows the sampling ratio on GET. POST changes it from the
+// ratio query parameter (0 to 1), from the next trace on, and DELETE puts
+// back the ratio the service started with. Only traces that start here are
+// affected; the rest follow their caller's decision.
+func samplingHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		ratio := sampleRatio.initial
+		if r.Method == http.MethodPost {
+			var err error
+			ratio, err = strconv.ParseFloat(r.URL.Query().Get("ratio"), 64)
+			if err != nil || ratio < 0 || ratio > 1 {
+				httpError(w, r, errors.New("ratio must be between 0 and 1"), http.StatusBadRequest)
+				return
+			}
+		}
+		previous := sampleRatio.Set(ratio)
+		samplingRatioChanges.Inc()
+		slog.WarnContext(r.Context(), "Changed trace sample ratio", "ratio", ratio, "previous", previous)
+	default:
+		httpError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"ratio":   sampleRatio.Ratio(),
+		"initial": sampleRatio.initial,
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Count product payloads decoded, by schema version.
+	schemaDecoded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_payload_schema_decoded_total",
+			Help: "Total number of store-api product payloads decoded, by the schema version they were decoded as.",
+		},
+		[]string{"version"},
+	)
+
+	// Count payloads that couldn't be decoded as the version they declared.
+	schemaFallbacks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_payload_schema_fallbacks_total",
+			Help: "Total number of store-api product payloads not decoded as the schema version they declared, by reason: undeclared, unknown_version or mismatch.",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(schemaDecoded, schemaFallbacks)
+}
+
+// The versions of store-api's product JSON schema this client can decode:
+// v1, a bare array of products, and v2, an envelope holding products whose
+// prices carry their currency.
+const (
+	productSchemaV1 = 1
+	productSchemaV2 = 2
+)
+
+// schemaVersionHeader is where store-api says which product schema version
+// a response is in.
+const schemaVersionHeader = "X-Schema-Version"
+
+// productsV2 is the v2 products payload.
+type productsV2 struct {
+	SchemaVersion int `json:"schema_version"`
+	Products      []struct {
+		ID    int    `json:"id"`
+		Name  string `json:"name"`
+		Price struct {
+			Amount   int    `json:"amount"`
+			Currency string `json:"currency"`
+		} `json:"price"`
+	} `json:"products"`
+}
+
+// decodeProducts decodes the products in resp, in the schema version its
+// header declares. When there is no version declared, one this client
+// doesn't know, or the body doesn't decode as the declared one, it falls
+// back to the version the body looks like, and counts the fallback: during a
+// rollout that is the sign clients and servers disagree. A response that
+// isn't a success is an error, without being decoded.
+func decodeProducts(ctx context.Context, resp *http.Response) ([]Product, error) {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// An error body is no schema version at all, so not a fallback
+		return nil, fmt.Errorf("store-api returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading products: %w", err)
+	}
+
+	sniffed := productSchemaV1
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+		sniffed = productSchemaV2
+	}
+
+	header := resp.Header.Get(schemaVersionHeader)
+	declared, err := strconv.Atoi(header)
+	reason := ""
+	switch {
+	case header == "":
+		reason = "undeclared"
+	case err != nil || (declared != productSchemaV1 && declared != productSchemaV2):
+		reason = "unknown_version"
+	}
+
+	version := declared
+	if reason != "" {
+		version = sniffed
+	}
+	products, err := decodeProductsVersion(body, version)
+	if err != nil && reason == "" && version != sniffed {
+		reason, version = "mismatch", sniffed
+		products, err = decodeProductsVersion(body, version)
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Int("payload.schema_version", version))
+	if reason != "" {
+		schemaFallbacks.WithLabelValues(reason).Inc()
+		span.SetAttributes(attribute.String("payload.schema_fallback", reason))
+		slog.WarnContext(ctx, "Decoded products as a schema version they didn't declare", logfields.PeerService("store-api"),
+			"declared", header, "decoded", version, "reason", reason)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding products JSON: %w", err)
+	}
+	schemaDecoded.WithLabelValues(strconv.Itoa(version)).Inc()
+	return products, nil
+}
+
+// decodeProductsVersion decodes body as the given product schema version.
+// v2 prices lose their currency, as Product has nowhere to keep it.
+func decodeProductsVersion(body []byte, version int) ([]Product, error) {
+	if version == productSchemaV1 {
+		var products []Product
+		if err := json.Unmarshal(body, &products); err != nil {
+			return nil, err
+		}
+		return products, nil
+	}
+
+	var payload productsV2
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	if payload.SchemaVersion != productSchemaV2 {
+		return nil, fmt.Errorf("payload has schema version %d, not %d", payload.SchemaVersion, productSchemaV2)
+	}
+	products := make([]Product, len(payload.Products))
+	for i, p := range payload.Products {
+		products[i] = Product{ID: p.ID, Name: p.Name, Price: p.Price.Amount}
+	}
+	return products, nil
+}
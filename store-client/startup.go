@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Gauge of how long the startup phase took.
+	startupDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "startup_duration_seconds",
+			Help: "Time the startup phase took in seconds.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(startupDuration)
+}
+
+// started is set once the startup phase has finished, and until then
+// /readyz reports the service as starting.
+var started atomic.Bool
+
+// startupStep is one piece of warmup work done before the service is ready.
+type startupStep struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// runStartup runs steps in order under a startup root span, then marks the
+// service ready. A failed step is recorded and logged but does not hold up
+// readiness: warmup only makes the first requests faster, they work without
+// it.
+func runStartup(steps []startupStep) {
+	tracer := otel.Tracer("go.opentelemetry.io/http")
+	ctx, span := tracer.Start(context.Background(), "startup")
+	defer span.End()
+	start := time.Now()
+
+	for _, step := range steps {
+		stepCtx, stepSpan := tracer.Start(ctx, "startup-"+step.name)
+		stepStart := time.Now()
+		err := step.run(stepCtx)
+		if err != nil {
+			stepSpan.RecordError(err)
+			stepSpan.SetStatus(codes.Error, err.Error())
+			slog.WarnContext(stepCtx, "Startup step failed", "step", step.name, logfields.Error(err))
+		} else {
+			slog.InfoContext(stepCtx, "Startup step completed", "step", step.name, logfields.Duration(time.Since(stepStart)))
+		}
+		stepSpan.End()
+	}
+
+	duration := time.Since(start)
+	span.SetAttributes(attribute.Int("startup.steps", len(steps)))
+	startupDuration.Set(duration.Seconds())
+	started.Store(true)
+	slog.InfoContext(ctx, "Startup complete, ready for traffic", logfields.Duration(duration))
+}
+
+// dialStoreAPI opens a connection to store-api ahead of the first real
+// request. Any response will do, it is the pooled connection we are after.
+func dialStoreAPI(ctx context.Context, client *http.Client, base string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, base+"/readyz", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to dial store-api: %w", err)
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+// pageTemplates holds the HTML for every page the store renders.
+const pageTemplates = `
+{{define "home"}}<html><body><h1>Welcome to the Kitchen store!</h1><p><a href='/products'>View Our Products</a></p></body></html>{{end}}
+{{define "products"}}<html><body><h1>Our Products</h1><ul>{{range .}}<li><strong>{{.ID}}</strong>: {{.Name}} (${{.Price}})</li>{{end}}</ul></body></html>{{end}}
+{{define "detailed"}}<html><body><h1>Our Products, in Detail</h1><ul>{{range .}}<li><strong>{{.Name}}</strong> (${{.Price}}, {{.Stock}} in stock): {{.Description}}</li>{{end}}</ul></body></html>{{end}}
+`
+
+// templates parses pageTemplates the first time it is called. Startup calls
+// it early so no request pays for the parse.
+var templates = sync.OnceValues(func() (*template.Template, error) {
+	return template.New("pages").Parse(pageTemplates)
+})
+
+// compileTemplates is the startup step that parses the page templates.
+func compileTemplates(ctx context.Context) error {
+	_, err := templates()
+	return err
+}
+
+// renderPage writes the named page for data as the response, reporting
+// whether it could.
+func renderPage(w http.ResponseWriter, r *http.Request, name string, data any) bool {
+	t, err := templates()
+	if err != nil {
+		httpError(w, r, fmt.Errorf("Failed to parse templates: %w", err), http.StatusInternalServerError)
+		return false
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusOK)
+	if err := t.ExecuteTemplate(w, name, data); err != nil {
+		// Some of the page may be out already, so all that's left is to log it
+		slog.ErrorContext(r.Context(), "Failed to render page", "page", name, logfields.Error(err))
+	}
+	return true
+}
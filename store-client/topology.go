@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// Topology is what the service says about itself on /topology: who it is,
+// where it listens, what it calls and which of its routes are safe to send
+// load to. o11yctl topology collects it from every service into one file.
+type Topology struct {
+	Name         string               `json:"name"`
+	Version      string               `json:"version,omitempty"`
+	Listen       []TopologyListener   `json:"listen"`
+	Dependencies []TopologyDependency `json:"dependencies"`
+	// Entrypoints are GET paths, with any query they need, that load can
+	// be sent to
+	Entrypoints []string `json:"entrypoints"`
+}
+
+// TopologyListener is an address the service listens on.
+type TopologyListener struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+}
+
+// TopologyDependency is a service this one calls, named by its host, which
+// in docker compose is the service name.
+type TopologyDependency struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// dependency describes the service at address.
+func dependency(address string) TopologyDependency {
+	name := address
+	if u, err := url.Parse(address); err == nil && u.Hostname() != "" {
+		name = u.Hostname()
+	}
+	return TopologyDependency{Name: name, Address: address}
+}
+
+// newTopology describes the service as config sets it up.
+func newTopology(config Config) Topology {
+	t := Topology{
+		Name:    config.serviceName,
+		Version: config.serviceVersion,
+		Listen: []TopologyListener{
+			{Name: "app", Addr: config.listenAddr},
+		},
+		Dependencies: []TopologyDependency{dependency(apiBase(config.apiServer))},
+		Entrypoints:  []string{"/", "/products", "/products/detailed"},
+	}
+	if config.adminListenAddr != "" {
+		t.Listen = append(t.Listen, TopologyListener{Name: "admin", Addr: config.adminListenAddr})
+	}
+	if config.unixSocketPath != "" {
+		t.Listen = append(t.Listen, TopologyListener{Name: "unix", Addr: config.unixSocketPath})
+	}
+	return t
+}
+
+// topologyHandler serves the service's topology.
+func topologyHandler(topology Topology) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(topology)
+	}
+}
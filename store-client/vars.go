@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"hash/crc32"
+	"runtime"
+
+	"store-client/pkg/flags"
+)
+
+// publishVars exposes application state on /debug/vars (registered by
+// importing expvar) for quick JSON introspection, without having to know
+// which metric to look for. It returns the config version.
+func publishVars(config Config) string {
+	expvar.NewString("service_version").Set(config.serviceVersion)
+	// Not a setting: it differs between instances with the same config
+	expvar.NewString("instance_id").Set(instanceID)
+
+	// The settings that change behaviour, and a short hash of them so two
+	// instances can be checked for the same config at a glance
+	settings := map[string]any{
+		"api_server":                config.apiServer,
+		"client_h2c":                config.clientH2C,
+		"span_audit":                config.spanAudit,
+		"profiling_mode":            config.profilingMode,
+		"profile_types":             config.profileTypes,
+		"profile_mem_rate_bytes":    config.profileMemRate,
+		"profile_mutex_fraction":    config.profileMutexFraction,
+		"profile_block_rate_ns":     config.profileBlockRate,
+		"trace_sample_ratio":        config.sampleRatio,
+		"sampling_comparison":       config.samplingComparison,
+		"latency_highres":           config.latencyHighRes,
+		"instrumentation_overhead":  config.overheadAccounting,
+		"payload_verify":            config.payloadVerify,
+		"log_level":                 config.logLevel,
+		"remote_write_enabled":      config.remoteWriteURL != "",
+		"remote_write_interval_ms":  config.remoteWriteInterval.Milliseconds(),
+		"remote_write_labels":       config.remoteWriteLabels,
+		"remote_write_wal_max_mb":   config.remoteWriteWALMaxMB,
+		"client_max_idle_per_host":  config.clientMaxIdlePerHost,
+		"client_idle_timeout_ms":    config.clientIdleTimeout.Milliseconds(),
+		"client_disable_keepalives": config.clientDisableKeepAlives,
+		"product_cache_ttl_ms":      config.productCacheTTL.Milliseconds(),
+		"product_cache_stale_ms":    config.productCacheStale.Milliseconds(),
+		"discovery":                 config.discovery,
+		"discovery_refresh_ms":      config.discoveryRefresh.Milliseconds(),
+	}
+	expvar.Publish("config", expvar.Func(func() any { return settings }))
+	version := configVersion(settings)
+	expvar.NewString("config_version").Set(version)
+
+	expvar.Publish("feature_flags", expvar.Func(func() any {
+		return flags.Snapshot()
+	}))
+	expvar.Publish("goroutines", expvar.Func(func() any {
+		return runtime.NumGoroutine()
+	}))
+	return version
+}
+
+// configVersion hashes settings into a short, stable identifier.
+func configVersion(settings map[string]any) string {
+	// Map keys are sorted when marshaled, so equal settings hash the same
+	raw, _ := json.Marshal(settings)
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE(raw))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Count payloads verified, by source and result.
+	dataQualityChecks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_data_quality_checks_total",
+			Help: "Total number of store-api payloads checked against their invariants, by source and result (ok or violated).",
+		},
+		[]string{"source", "result"},
+	)
+
+	// Count broken invariants, by source and rule.
+	dataQualityViolations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_data_quality_violations_total",
+			Help: "Total number of items in store-api payloads that broke an invariant, by source and rule.",
+		},
+		[]string{"source", "rule"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(dataQualityChecks, dataQualityViolations)
+}
+
+// payloadVerify turns on checking what store-api returns against the
+// invariants product data must hold. Latency and error metrics say nothing
+// about whether a 200's body is right; these checks do.
+var payloadVerify bool
+
+// dataQualityLogInterval is how often each rule may log a violation, as
+// with the span audit.
+const dataQualityLogInterval = time.Minute
+
+// violation is an item that broke a rule.
+type violation struct {
+	rule   string
+	id     int
+	detail string
+}
+
+// verifyProducts checks products from source against the product
+// invariants: positive, unique IDs, names, and prices and stock that aren't
+// negative. stock holds the stock levels when source has them. Violations
+// are counted, logged and recorded on a verify-payload span marked as an
+// error, but the payload is served as it is.
+func verifyProducts(ctx context.Context, source string, products []Product, stock []int) {
+	if !payloadVerify {
+		return
+	}
+	_, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "verify-payload")
+	defer span.End()
+	span.SetAttributes(attribute.String("data_quality.source", source), attribute.Int("data_quality.items", len(products)))
+
+	var violations []violation
+	seen := make(map[int]bool, len(products))
+	for i, p := range products {
+		switch {
+		case p.ID <= 0:
+			violations = append(violations, violation{"non-positive-id", p.ID, fmt.Sprintf("id %d", p.ID)})
+		case seen[p.ID]:
+			violations = append(violations, violation{"duplicate-id", p.ID, fmt.Sprintf("id %d appears more than once", p.ID)})
+		}
+		seen[p.ID] = true
+		if strings.TrimSpace(p.Name) == "" {
+			violations = append(violations, violation{"missing-name", p.ID, "empty name"})
+		}
+		if p.Price < 0 {
+			violations = append(violations, violation{"negative-price", p.ID, fmt.Sprintf("price %d", p.Price)})
+		}
+		if i < len(stock) && stock[i] < 0 {
+			violations = append(violations, violation{"negative-stock", p.ID, fmt.Sprintf("stock %d", stock[i])})
+		}
+	}
+
+	if len(violations) == 0 {
+		dataQualityChecks.WithLabelValues(source, "ok").Inc()
+		return
+	}
+	dataQualityChecks.WithLabelValues(source, "violated").Inc()
+	for _, v := range violations {
+		dataQualityViolations.WithLabelValues(source, v.rule).Inc()
+		span.AddEvent("data_quality.violation", trace.WithAttributes(
+			attribute.String("data_quality.rule", v.rule),
+			attribute.Int("product.id", v.id),
+			attribute.String("data_quality.detail", v.detail),
+		))
+		dataQualityLog.report(ctx, source, v)
+	}
+	span.SetAttributes(attribute.Int("data_quality.violations", len(violations)))
+	span.SetStatus(codes.Error, fmt.Sprintf("%d data quality violations", len(violations)))
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("data_quality.violated", true))
+}
+
+// dataQualityLogger logs an example of each rule's violations at most once
+// per dataQualityLogInterval, and how many were skipped since the last.
+type dataQualityLogger struct {
+	mu      sync.Mutex
+	lastLog map[string]time.Time
+	skipped map[string]int
+}
+
+var dataQualityLog = &dataQualityLogger{lastLog: map[string]time.Time{}, skipped: map[string]int{}}
+
+func (l *dataQualityLogger) report(ctx context.Context, source string, v violation) {
+	l.mu.Lock()
+	if time.Since(l.lastLog[v.rule]) < dataQualityLogInterval {
+		l.skipped[v.rule]++
+		l.mu.Unlock()
+		return
+	}
+	skipped := l.skipped[v.rule]
+	l.lastLog[v.rule], l.skipped[v.rule] = time.Now(), 0
+	l.mu.Unlock()
+
+	slog.WarnContext(ctx, "Payload breaks data quality invariant", "source", source, "rule", v.rule,
+		logfields.ProductID(v.id), "detail", v.detail, "skipped", skipped)
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/j6nca/o11y-playground/pkg/logfields"
+)
+
+var (
+	// Create a new counter vector for total requests.
+	requestCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "go_app_http_requests_total",
+			Help: "Total number of HTTP requests.",
+		},
+		[]string{"path", "method", "status_code"},
+	)
+
+	// Create a new histogram for request latencies.
+	requestLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "go_app_http_request_duration_seconds",
+			Help:    "HTTP request latency in seconds.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"path"},
+	)
+
+	// Count webhook events received, by type and outcome.
+	events = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "webhook_receiver_events_total",
+			Help: "Total number of webhook deliveries received, by event type and outcome (accepted, duplicate, invalid_signature or failed).",
+		},
+		[]string{"event_type", "outcome"},
+	)
+
+	// Histogram of how long after the event happened it arrived here.
+	eventDelay = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "webhook_receiver_event_delay_seconds",
+			Help:    "Time between a webhook event being created and a delivery of it arriving in seconds, by event type.",
+			Buckets: []float64{.05, .1, .5, 1, 2.5, 5, 10, 30, 60, 300},
+		},
+		[]string{"event_type"},
+	)
+
+	// Gauge describing the active behaviour.
+	errorRateGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "webhook_receiver_profile_error_rate",
+			Help: "Fraction of deliveries the active profile fails.",
+		},
+	)
+)
+
+type Config struct {
+	serviceName string
+	tempoServer string
+	secret      string
+	tolerance   time.Duration
+	profile     Profile
+}
+
+// Profile describes how the simulated third party behaves.
+type Profile struct {
+	LatencyMS int     `json:"latency_ms"`
+	JitterMS  int     `json:"jitter_ms"`
+	ErrorRate float64 `json:"error_rate"`
+	// StatusCode is what failed deliveries get, a 5xx for the sender to
+	// retry or a 4xx for it to give up on
+	StatusCode int `json:"status_code"`
+}
+
+var (
+	mu     sync.RWMutex
+	active Profile
+)
+
+// seen holds the IDs of events already accepted, so retried deliveries of
+// them are acknowledged without being processed twice.
+var seen = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: map[string]bool{}}
+
+// maxSeen bounds seen; past it the oldest IDs are forgotten wholesale.
+const maxSeen = 10000
+
+func init() {
+	// Register the metrics with Prometheus's default registry.
+	prometheus.MustRegister(requestCount, requestLatency, events, eventDelay, errorRateGauge)
+}
+
+func main() {
+
+	config := Config{
+		serviceName: os.Getenv("OTEL_SERVICE_NAME"),
+		tempoServer: os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"),
+		secret:      os.Getenv("WEBHOOK_SECRET"),
+		tolerance:   time.Duration(envInt("WEBHOOK_TOLERANCE_S", 300)) * time.Second,
+		profile: Profile{
+			LatencyMS:  envInt("RECEIVER_LATENCY_MS", 20),
+			JitterMS:   envInt("RECEIVER_JITTER_MS", 20),
+			ErrorRate:  envFloat("RECEIVER_ERROR_RATE", 0.05),
+			StatusCode: envInt("RECEIVER_STATUS_CODE", http.StatusServiceUnavailable),
+		},
+	}
+
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	})))
+
+	// Setup OpenTelemetry for tracing
+	shutdown := setupTracer(config)
+	defer shutdown()
+
+	setProfile(config.profile)
+	slog.Info("Starting webhook receiver ...")
+
+	// Receive a signed webhook delivery
+	http.Handle("/webhooks", otelhttp.NewHandler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			ctx, span := otel.Tracer("go.opentelemetry.io/http").Start(ctx, "webhook-handler")
+			defer span.End()
+			start := time.Now()
+
+			respond := func(status int, body any) {
+				requestCount.WithLabelValues(r.URL.Path, r.Method, strconv.Itoa(status)).Inc()
+				requestLatency.WithLabelValues(r.URL.Path).Observe(time.Since(start).Seconds())
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(status)
+				json.NewEncoder(w).Encode(body)
+			}
+
+			if r.Method != http.MethodPost {
+				respond(http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+				return
+			}
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				respond(http.StatusBadRequest, map[string]string{"error": "failed to read body"})
+				return
+			}
+
+			id, eventType := r.Header.Get("Webhook-Id"), r.Header.Get("Webhook-Event")
+			span.SetAttributes(
+				attribute.String("webhook.event_id", id),
+				attribute.String("webhook.event_type", eventType),
+			)
+
+			if err := verify(config.secret, r.Header.Get("Webhook-Signature"), body, time.Now(), config.tolerance); err != nil {
+				events.WithLabelValues(eventType, "invalid_signature").Inc()
+				span.SetStatus(codes.Error, err.Error())
+				slog.WarnContext(ctx, "Rejected webhook", "event_id", id, logfields.Error(err))
+				respond(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+				return
+			}
+
+			var event struct {
+				CreatedAt time.Time `json:"created_at"`
+			}
+			if err := json.Unmarshal(body, &event); err == nil && !event.CreatedAt.IsZero() {
+				eventDelay.WithLabelValues(eventType).Observe(time.Since(event.CreatedAt).Seconds())
+			}
+
+			seen.Lock()
+			duplicate := seen.ids[id]
+			seen.Unlock()
+			if duplicate {
+				events.WithLabelValues(eventType, "duplicate").Inc()
+				span.SetAttributes(attribute.Bool("webhook.duplicate", true))
+				respond(http.StatusOK, map[string]string{"id": id, "status": "duplicate"})
+				return
+			}
+
+			profile := currentProfile()
+			delay := time.Duration(profile.LatencyMS) * time.Millisecond
+			if profile.JitterMS > 0 {
+				delay += time.Duration(rand.Intn(profile.JitterMS)) * time.Millisecond
+			}
+			time.Sleep(delay)
+
+			if rand.Float64() < profile.ErrorRate {
+				events.WithLabelValues(eventType, "failed").Inc()
+				span.SetStatus(codes.Error, "simulated failure")
+				slog.WarnContext(ctx, "Failed webhook", "event_id", id, logfields.StatusCode(profile.StatusCode))
+				respond(profile.StatusCode, map[string]string{"error": "simulated failure"})
+				return
+			}
+
+			seen.Lock()
+			if len(seen.ids) >= maxSeen {
+				seen.ids = map[string]bool{}
+			}
+			seen.ids[id] = true
+			seen.Unlock()
+			events.WithLabelValues(eventType, "accepted").Inc()
+			slog.InfoContext(ctx, "Accepted webhook", "event_id", id, "event_type", eventType, logfields.Duration(time.Since(start)))
+			respond(http.StatusOK, map[string]string{"id": id, "status": "accepted"})
+		}),
+		"webhook-handler-span",
+	))
+
+	// Inspect or change the active profile by setting any of latency_ms,
+	// jitter_ms, error_rate and status_code.
+	http.Handle("/admin/profile", otelhttp.NewHandler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPut || r.Method == http.MethodPost {
+				q := r.URL.Query()
+				profile := currentProfile()
+				if v, err := strconv.Atoi(q.Get("latency_ms")); err == nil {
+					profile.LatencyMS = v
+				}
+				if v, err := strconv.Atoi(q.Get("jitter_ms")); err == nil {
+					profile.JitterMS = v
+				}
+				if v, err := strconv.ParseFloat(q.Get("error_rate"), 64); err == nil {
+					profile.ErrorRate = v
+				}
+				if v, err := strconv.Atoi(q.Get("status_code")); err == nil {
+					profile.StatusCode = v
+				}
+				setProfile(profile)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(currentProfile())
+		}),
+		"admin-profile-handler-span",
+	))
+
+	// What the service is, where it listens and what it calls, for
+	// o11yctl topology
+	http.Handle("/topology", otelhttp.NewHandler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{
+				"name":         config.serviceName,
+				"version":      os.Getenv("SERVICE_VERSION"),
+				"listen":       []map[string]string{{"name": "app", "addr": ":8086"}},
+				"dependencies": []map[string]string{},
+				"entrypoints":  []string{},
+			})
+		}),
+		"topology-handler-span",
+	))
+
+	// Endpoint to get metrics
+	http.Handle("/metrics", promhttp.Handler())
+
+	slog.Info("Application is listening on port 8086...")
+	// Accept h2c as well as HTTP/1.1, so callers can pick either
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Addr: ":8086", Protocols: &protocols}
+	server.ListenAndServe()
+}
+
+// verify checks a Webhook-Signature header, "t=<unix seconds>,v1=<hex
+// HMAC-SHA256 of "<t>.<body>">", against body, and that it was signed
+// within tolerance of now so old deliveries can't be replayed.
+func verify(secret, header string, body []byte, now time.Time, tolerance time.Duration) error {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig = v
+		}
+	}
+	if ts == "" || sig == "" {
+		return errors.New("missing or malformed signature")
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("malformed signature timestamp")
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return errors.New("signature timestamp outside tolerance")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	want := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+func currentProfile() Profile {
+	mu.RLock()
+	defer mu.RUnlock()
+	return active
+}
+
+func setProfile(p Profile) {
+	mu.Lock()
+	active = p
+	mu.Unlock()
+
+	errorRateGauge.Set(p.ErrorRate)
+	slog.Info("Active profile changed", "latency_ms", p.LatencyMS, "jitter_ms", p.JitterMS, "error_rate", p.ErrorRate, logfields.StatusCode(p.StatusCode))
+}
+
+func setupTracer(config Config) func() {
+	ctx := context.Background()
+	slog.Info("Setting up traces with config", "config", config.tempoServer)
+	// Tempo gRPC endpoint from docker-compose.yml
+	conn, err := grpc.DialContext(ctx, config.tempoServer,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+	)
+	if err != nil {
+		slog.Error("Failed to create gRPC connection to Tempo:", logfields.Error(err))
+		return func() {}
+	}
+
+	// Create a new OTLP gRPC exporter
+	traceExporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(conn))
+	if err != nil {
+		slog.Error("Failed to create a new OTLP exporter:", logfields.Error(err))
+		return func() {}
+	}
+
+	// Create a new tracer provider with the exporter
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(traceExporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(config.serviceName),
+			attribute.String("application", config.serviceName),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return func() {
+		ctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			slog.Error("Failed to shutdown tracer provider:", logfields.Error(err))
+		}
+	}
+}
+
+// envInt returns the integer value of an env var, or def if it is unset or
+// not a number.
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// envFloat returns the float value of an env var, or def if it is unset or
+// not a number.
+func envFloat(key string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}